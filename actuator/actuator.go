@@ -0,0 +1,289 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package actuator turns alerts into actions: it receives the webhooks of
+Prometheus Alertmanager and runs NUT instant commands or sets GPIO outputs
+for the alerts that match, e.g. to switch off a smart plug or a UPS outlet
+when a temperature alert fires and on again when it resolves:
+
+	actions:
+	  - alert: RackTooHot
+	    labels:
+	      rack: r12
+	    firing:
+	      nut: {ups: "admin:ENC[...]@pdu1@nas", command: outlet.2.load.off}
+	    resolved:
+	      nut: {ups: "admin:ENC[...]@pdu1@nas", command: outlet.2.load.on}
+	  - alert: WaterLeak
+	    firing:
+	      gpio: {chip: gpiochip0, line: 17, value: 1}
+
+Alertmanager repeats firing alerts, so the commands should do no harm when
+run again.
+
+The same commands power cycle the recovery targets, hosts that hang, on
+request, see Target.
+*/
+package actuator
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/gpio"
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+var timeOut = 10 * time.Second
+
+// An Action runs the Firing command when an alert of the name Alert and with
+// all of Labels fires, and the Resolved one when it resolves. Either may be
+// nil.
+type Action struct {
+	Alert    string            `yaml:"alert" toml:"alert"`
+	Labels   map[string]string `yaml:"labels" toml:"labels"`
+	Firing   *Command          `yaml:"firing" toml:"firing"`
+	Resolved *Command          `yaml:"resolved" toml:"resolved"`
+}
+
+// A Command is a NUT instant command or a GPIO output to set.
+type Command struct {
+	NUT  *NUTCommand  `yaml:"nut" toml:"nut"`
+	GPIO *GPIOCommand `yaml:"gpio" toml:"gpio"`
+}
+
+// A NUTCommand is run by upsd with INSTCMD, which needs a user allowed to
+// in upsd.users. UPS is [USER:PASSWORD@]UPS@HOST[:PORT], Value the optional
+// argument of the command.
+type NUTCommand struct {
+	UPS     string `yaml:"ups" toml:"ups"`
+	Command string `yaml:"command" toml:"command"`
+	Value   string `yaml:"value" toml:"value"`
+}
+
+// A GPIOCommand drives a GPIO line to Value, 1 for active. The line is kept
+// requested, so that it holds the value.
+type GPIOCommand struct {
+	Chip      string `yaml:"chip" toml:"chip"`
+	Line      int    `yaml:"line" toml:"line"`
+	Value     int    `yaml:"value" toml:"value"`
+	ActiveLow bool   `yaml:"active_low" toml:"active_low"`
+}
+
+// Check checks the actions of a configuration file.
+func Check(actions []Action) error {
+	for i, a := range actions {
+		if a.Alert == "" {
+			return fmt.Errorf("action %d has no alert", i+1)
+		}
+		if a.Firing == nil && a.Resolved == nil {
+			return fmt.Errorf("action %d has neither firing nor resolved", i+1)
+		}
+		for _, c := range []*Command{a.Firing, a.Resolved} {
+			if c == nil {
+				continue
+			}
+			if (c.NUT == nil) == (c.GPIO == nil) {
+				return fmt.Errorf("action %d needs either nut or gpio", i+1)
+			}
+			if c.NUT != nil && (c.NUT.Command == "" || strings.Count(c.NUT.UPS, "@") < 1) {
+				return fmt.Errorf("action %d needs a command and ups: [USER:PASSWORD@]UPS@HOST", i+1)
+			}
+			if c.GPIO != nil && (c.GPIO.Value < 0 || c.GPIO.Value > 1) {
+				return fmt.Errorf("action %d, gpio value must be 0 or 1", i+1)
+			}
+		}
+	}
+	return nil
+}
+
+// An Actuator is the http.Handler of the Alertmanager webhooks.
+type Actuator struct {
+	mutex      sync.Mutex
+	actions    []Action
+	targets    []Target
+	lines      map[string]*gpio.Line // by chip/line
+	recoveries map[[3]string]uint64  // by target, action and result
+}
+
+// New returns an Actuator of actions, which should have been checked.
+func New(actions []Action) *Actuator {
+	return &Actuator{actions: actions, lines: make(map[string]*gpio.Line),
+		recoveries: make(map[[3]string]uint64)}
+}
+
+// SetActions replaces the actions, e.g. when the configuration file is
+// reloaded. GPIO lines stay requested.
+func (a *Actuator) SetActions(actions []Action) {
+	a.mutex.Lock()
+	a.actions = actions
+	a.mutex.Unlock()
+}
+
+// webhook is the part of the Alertmanager webhook payload that is used.
+type webhook struct {
+	Alerts []struct {
+		Status string            `json:"status"`
+		Labels map[string]string `json:"labels"`
+	} `json:"alerts"`
+}
+
+// ServeHTTP runs the commands of the alerts of a webhook. If any fails it
+// answers with an error, so that Alertmanager retries.
+func (a *Actuator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Alertmanager webhooks are POSTed.", http.StatusMethodNotAllowed)
+		return
+	}
+	var hook webhook
+	if err := json.NewDecoder(r.Body).Decode(&hook); err != nil {
+		http.Error(w, "Bad webhook: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	failed := 0
+	for _, alert := range hook.Alerts {
+		for _, action := range a.actions {
+			if !action.matches(alert.Labels) {
+				continue
+			}
+			c := action.Firing
+			if alert.Status == "resolved" {
+				c = action.Resolved
+			}
+			if c == nil {
+				continue
+			}
+			slog.Info("Running command of alert", "alert", action.Alert,
+				"labels", sensor.LabelString(action.Labels), "status", alert.Status, "command", c.String())
+			if err := a.run(c); err != nil {
+				sensor.Incident()
+				slog.Error("Could not run command", "command", c.String(), "err", err)
+				failed++
+			}
+		}
+	}
+	if failed > 0 {
+		http.Error(w, fmt.Sprintf("%d commands failed.", failed), http.StatusInternalServerError)
+	}
+}
+
+func (a Action) matches(labels map[string]string) bool {
+	if labels["alertname"] != a.Alert {
+		return false
+	}
+	for name, value := range a.Labels {
+		if labels[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// String describes c without the password.
+func (c *Command) String() string {
+	if c.NUT != nil {
+		ups := c.NUT.UPS
+		if i := strings.Index(ups, "@"); strings.Count(ups, "@") > 1 {
+			ups = ups[i+1:]
+		}
+		return "nut " + c.NUT.Command + " on " + ups
+	}
+	return fmt.Sprintf("gpio %s/%d = %d", c.GPIO.Chip, c.GPIO.Line, c.GPIO.Value)
+}
+
+func (a *Actuator) run(c *Command) error {
+	if c.NUT != nil {
+		return c.NUT.run()
+	}
+	g := c.GPIO
+	key := fmt.Sprintf("%s/%d", g.Chip, g.Line)
+	line, ok := a.lines[key]
+	if !ok {
+		flags := gpio.Output
+		if g.ActiveLow {
+			flags |= gpio.ActiveLow
+		}
+		var err error
+		if line, err = gpio.Request(g.Chip, g.Line, flags, 0); err != nil {
+			return err
+		}
+		a.lines[key] = line
+	}
+	return line.SetValue(g.Value)
+}
+
+// run logs in to upsd, if there are credentials, and sends INSTCMD.
+func (n *NUTCommand) run() error {
+	parts := strings.Split(n.UPS, "@")
+	var user, password string
+	if len(parts) == 3 {
+		credentials := strings.SplitN(parts[0], ":", 2)
+		if len(credentials) != 2 {
+			return errors.New("expected USER:PASSWORD@UPS@HOST")
+		}
+		user, password, parts = credentials[0], credentials[1], parts[1:]
+	}
+	ups, host := parts[0], parts[1]
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "3493")
+	}
+
+	conn, err := sensor.DialTimeout("tcp", host, timeOut)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeOut))
+	reader := bufio.NewReader(conn)
+	cmd := "INSTCMD " + quote(ups) + " " + quote(n.Command)
+	if n.Value != "" {
+		cmd += " " + quote(n.Value)
+	}
+	lines := []string{cmd}
+	if user != "" {
+		lines = []string{"USERNAME " + quote(user), "PASSWORD " + quote(password), cmd}
+	}
+	for _, line := range lines {
+		fmt.Fprintf(conn, "%s\n", line)
+		res, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		// OK, or OK TRACKING <id> if upsd tracks commands.
+		if res = strings.TrimSpace(res); !strings.HasPrefix(res, "OK") {
+			return errors.New(strings.Fields(line)[0] + " returned " + res)
+		}
+	}
+	fmt.Fprint(conn, "LOGOUT\n")
+	return nil
+}
+
+// quote quotes an argument of the upsd protocol.
+func quote(arg string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+}
@@ -0,0 +1,227 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package actuator
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var defaultCycleWait = 10 * time.Second
+
+// A Target is a host, e.g. a Pi that reads sensors, that can be recovered
+// when it hangs: woken with a Wake-on-LAN packet, or power cycled by running
+// Off, waiting Wait (10s by default) and running On, e.g. to switch the
+// outlet of a PDU or a relay.
+//
+//	recovery:
+//	  - name: pi-garage
+//	    wake: {mac: "b8:27:eb:12:34:56", broadcast: "192.168.1.255"}
+//	  - name: pi-attic
+//	    off: {nut: {ups: "admin:ENC[...]@pdu1@nas", command: outlet.3.load.off}}
+//	    on: {nut: {ups: "admin:ENC[...]@pdu1@nas", command: outlet.3.load.on}}
+//	    wait: 30s
+type Target struct {
+	Name string        `yaml:"name" toml:"name"`
+	Wake *WakeOnLAN    `yaml:"wake" toml:"wake"`
+	Off  *Command      `yaml:"off" toml:"off"`
+	On   *Command      `yaml:"on" toml:"on"`
+	Wait time.Duration `yaml:"wait" toml:"wait"`
+}
+
+// WakeOnLAN sends a magic packet for MAC to the UDP port 9 of Broadcast,
+// 255.255.255.255 by default.
+type WakeOnLAN struct {
+	MAC       string `yaml:"mac" toml:"mac"`
+	Broadcast string `yaml:"broadcast" toml:"broadcast"`
+}
+
+// The actions of a target.
+const (
+	actionWake  = "wake"
+	actionCycle = "cycle"
+)
+
+var recoveriesDesc = prometheus.NewDesc("sensor_exporter_recoveries_total",
+	"Recoveries of hosts requested at /admin/recover, by target, action and result.",
+	[]string{"target", "action", "result"}, nil)
+
+// CheckTargets checks the recovery targets of a configuration file.
+func CheckTargets(targets []Target) error {
+	names := make(map[string]bool)
+	for i, t := range targets {
+		if t.Name == "" {
+			return fmt.Errorf("recovery target %d has no name", i+1)
+		}
+		if names[t.Name] {
+			return fmt.Errorf("recovery target %s is given twice", t.Name)
+		}
+		names[t.Name] = true
+		if t.Wake == nil && t.Off == nil {
+			return fmt.Errorf("recovery target %s needs wake or off and on", t.Name)
+		}
+		if (t.Off == nil) != (t.On == nil) {
+			return fmt.Errorf("recovery target %s needs both off and on", t.Name)
+		}
+		if t.Wake != nil {
+			if _, err := net.ParseMAC(t.Wake.MAC); err != nil {
+				return fmt.Errorf("recovery target %s: %w", t.Name, err)
+			}
+		}
+		if t.Off != nil {
+			// Checked as the commands of an action.
+			if err := Check([]Action{{Alert: t.Name, Firing: t.Off, Resolved: t.On}}); err != nil {
+				return fmt.Errorf("recovery target %s: %w", t.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// SetTargets replaces the recovery targets, which should have been checked.
+func (a *Actuator) SetTargets(targets []Target) {
+	a.mutex.Lock()
+	a.targets = targets
+	a.mutex.Unlock()
+}
+
+// RecoverHandler recovers targets: a POST with target, the name of a target,
+// and action, wake or cycle, wakes or power cycles it, e.g.
+// target=pi-garage&action=wake. It answers once the commands ran, after the
+// wait of a power cycle. Any request lists the targets and their actions.
+// Anyone who can reach it can power cycle the targets, so it should only be
+// served with authentication.
+func (a *Actuator) RecoverHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			if status, err := a.recover(r.FormValue("target"), r.FormValue("action")); err != nil {
+				http.Error(w, err.Error(), status)
+				return
+			}
+		}
+		a.mutex.Lock()
+		defer a.mutex.Unlock()
+		for _, t := range a.targets {
+			fmt.Fprint(w, t.Name)
+			if t.Wake != nil {
+				fmt.Fprint(w, " "+actionWake)
+			}
+			if t.Off != nil {
+				fmt.Fprint(w, " "+actionCycle)
+			}
+			fmt.Fprintln(w)
+		}
+	})
+}
+
+// recover runs action on the target of that name and counts it. It returns
+// the HTTP status of an error.
+func (a *Actuator) recover(name, action string) (int, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	var target *Target
+	for i := range a.targets {
+		if a.targets[i].Name == name {
+			target = &a.targets[i]
+		}
+	}
+	if target == nil {
+		return http.StatusNotFound, errors.New("No recovery target " + name)
+	}
+	var err error
+	switch {
+	case action == actionWake && target.Wake != nil:
+		err = target.Wake.send()
+	case action == actionCycle && target.Off != nil:
+		err = a.cycle(target)
+	default:
+		return http.StatusBadRequest, fmt.Errorf("Recovery target %s cannot %s", name, action)
+	}
+	result := "ok"
+	if err != nil {
+		result = "failed"
+		sensor.Incident()
+		slog.Error("Could not recover target", "target", name, "action", action, "err", err)
+	} else {
+		slog.Info("Recovered target", "target", name, "action", action)
+	}
+	a.recoveries[[3]string{name, action, result}]++
+	return http.StatusInternalServerError, err
+}
+
+// cycle switches the power of t off and on again.
+func (a *Actuator) cycle(t *Target) error {
+	if err := a.run(t.Off); err != nil {
+		return err
+	}
+	wait := t.Wait
+	if wait == 0 {
+		wait = defaultCycleWait
+	}
+	time.Sleep(wait)
+	return a.run(t.On)
+}
+
+// send broadcasts the magic packet, 6 bytes 0xff then the MAC 16 times.
+func (w *WakeOnLAN) send() error {
+	mac, err := net.ParseMAC(w.MAC)
+	if err != nil {
+		return err
+	}
+	packet := append(bytes.Repeat([]byte{0xff}, 6), bytes.Repeat(mac, 16)...)
+	broadcast := w.Broadcast
+	if broadcast == "" {
+		broadcast = "255.255.255.255"
+	}
+	conn, err := net.Dial("udp", net.JoinHostPort(broadcast, "9"))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(packet)
+	return err
+}
+
+// Describe describes nothing, the recoveries depend on the requests; the
+// Actuator is an unchecked collector.
+func (a *Actuator) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect sends the count of recoveries, for the registry of the exporter.
+func (a *Actuator) Collect(ch chan<- prometheus.Metric) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	keys := make([][3]string, 0, len(a.recoveries))
+	for key := range a.recoveries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0]+keys[i][1]+keys[i][2] < keys[j][0]+keys[j][1]+keys[j][2]
+	})
+	for _, key := range keys {
+		ch <- prometheus.MustNewConstMetric(recoveriesDesc, prometheus.CounterValue, float64(a.recoveries[key]), key[0], key[1], key[2])
+	}
+}
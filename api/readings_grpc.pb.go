@@ -0,0 +1,224 @@
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// The gRPC API of sensor_exporter, enabled with -grpc.port. Regenerate the Go
+// code with:
+//
+//   protoc --go_out=. --go_opt=paths=source_relative \
+//       --go-grpc_out=. --go-grpc_opt=paths=source_relative api/readings.proto
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.6.2
+// - protoc             v5.28.3
+// source: api/readings.proto
+
+package api
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Readings_ListSensors_FullMethodName   = "/sensor_exporter.v1.Readings/ListSensors"
+	Readings_GetReadings_FullMethodName   = "/sensor_exporter.v1.Readings/GetReadings"
+	Readings_WatchReadings_FullMethodName = "/sensor_exporter.v1.Readings/WatchReadings"
+)
+
+// ReadingsClient is the client API for Readings service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Readings gives programmatic access to the readings of the exporter.
+type ReadingsClient interface {
+	// ListSensors lists the configured sensors and the available collectors.
+	ListSensors(ctx context.Context, in *ListSensorsRequest, opts ...grpc.CallOption) (*ListSensorsResponse, error)
+	// GetReadings returns the readings of the last scrape of every sensor.
+	GetReadings(ctx context.Context, in *GetReadingsRequest, opts ...grpc.CallOption) (*GetReadingsResponse, error)
+	// WatchReadings streams readings as the sensors are scraped.
+	WatchReadings(ctx context.Context, in *WatchReadingsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Reading], error)
+}
+
+type readingsClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewReadingsClient(cc grpc.ClientConnInterface) ReadingsClient {
+	return &readingsClient{cc}
+}
+
+func (c *readingsClient) ListSensors(ctx context.Context, in *ListSensorsRequest, opts ...grpc.CallOption) (*ListSensorsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListSensorsResponse)
+	err := c.cc.Invoke(ctx, Readings_ListSensors_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *readingsClient) GetReadings(ctx context.Context, in *GetReadingsRequest, opts ...grpc.CallOption) (*GetReadingsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetReadingsResponse)
+	err := c.cc.Invoke(ctx, Readings_GetReadings_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *readingsClient) WatchReadings(ctx context.Context, in *WatchReadingsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Reading], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Readings_ServiceDesc.Streams[0], Readings_WatchReadings_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WatchReadingsRequest, Reading]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Readings_WatchReadingsClient = grpc.ServerStreamingClient[Reading]
+
+// ReadingsServer is the server API for Readings service.
+// All implementations must embed UnimplementedReadingsServer
+// for forward compatibility.
+//
+// Readings gives programmatic access to the readings of the exporter.
+type ReadingsServer interface {
+	// ListSensors lists the configured sensors and the available collectors.
+	ListSensors(context.Context, *ListSensorsRequest) (*ListSensorsResponse, error)
+	// GetReadings returns the readings of the last scrape of every sensor.
+	GetReadings(context.Context, *GetReadingsRequest) (*GetReadingsResponse, error)
+	// WatchReadings streams readings as the sensors are scraped.
+	WatchReadings(*WatchReadingsRequest, grpc.ServerStreamingServer[Reading]) error
+	mustEmbedUnimplementedReadingsServer()
+}
+
+// UnimplementedReadingsServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedReadingsServer struct{}
+
+func (UnimplementedReadingsServer) ListSensors(context.Context, *ListSensorsRequest) (*ListSensorsResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method ListSensors not implemented")
+}
+func (UnimplementedReadingsServer) GetReadings(context.Context, *GetReadingsRequest) (*GetReadingsResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method GetReadings not implemented")
+}
+func (UnimplementedReadingsServer) WatchReadings(*WatchReadingsRequest, grpc.ServerStreamingServer[Reading]) error {
+	return status.Error(codes.Unimplemented, "method WatchReadings not implemented")
+}
+func (UnimplementedReadingsServer) mustEmbedUnimplementedReadingsServer() {}
+func (UnimplementedReadingsServer) testEmbeddedByValue()                  {}
+
+// UnsafeReadingsServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ReadingsServer will
+// result in compilation errors.
+type UnsafeReadingsServer interface {
+	mustEmbedUnimplementedReadingsServer()
+}
+
+func RegisterReadingsServer(s grpc.ServiceRegistrar, srv ReadingsServer) {
+	// If the following call panics, it indicates UnimplementedReadingsServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Readings_ServiceDesc, srv)
+}
+
+func _Readings_ListSensors_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListSensorsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ReadingsServer).ListSensors(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Readings_ListSensors_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ReadingsServer).ListSensors(ctx, req.(*ListSensorsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Readings_GetReadings_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetReadingsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ReadingsServer).GetReadings(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Readings_GetReadings_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ReadingsServer).GetReadings(ctx, req.(*GetReadingsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Readings_WatchReadings_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchReadingsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ReadingsServer).WatchReadings(m, &grpc.GenericServerStream[WatchReadingsRequest, Reading]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Readings_WatchReadingsServer = grpc.ServerStreamingServer[Reading]
+
+// Readings_ServiceDesc is the grpc.ServiceDesc for Readings service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Readings_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "sensor_exporter.v1.Readings",
+	HandlerType: (*ReadingsServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListSensors",
+			Handler:    _Readings_ListSensors_Handler,
+		},
+		{
+			MethodName: "GetReadings",
+			Handler:    _Readings_GetReadings_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchReadings",
+			Handler:       _Readings_WatchReadings_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "api/readings.proto",
+}
@@ -0,0 +1,390 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package binarysensor reads on/off sensors, like leak detectors and door
+contacts, from different backends behind one interface, so that collectors
+can expose them as one metric family whatever hardware is used. A source is
+given as a spec:
+
+	gpio:gpiochip0/17        a GPIO line, active high
+	shelly:192.168.1.20      a Shelly device, over its HTTP API
+	deconz:host:80/KEY/5     sensor 5 of a deCONZ (Phoscon) Zigbee gateway
+	file:/run/leak/kitchen   a file holding 0/1, true/false, on/off...
+
+A leading ! inverts the state, e.g. !gpio:gpiochip0/17 for an active low
+line.
+
+Shelly Flood and Door/Window devices run on batteries and sleep between
+events, so they only answer while awake. For them the last state read is
+kept and reported until maxAge passes.
+
+Shelly and deCONZ sources also tell when the device last reported, its
+battery level and its signal strength, see Report.
+*/
+package binarysensor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/gpio"
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+// A Kind tells a source which state to read from devices that report more
+// than one.
+type Kind int
+
+const (
+	Water Kind = iota // water detected
+	Open              // door or window open
+)
+
+// A Source is one binary sensor.
+type Source interface {
+	// State returns true when the sensor is active (wet, open...).
+	State() (bool, error)
+	String() string
+}
+
+// A reporter is a source of a wireless, usually battery powered, device.
+type reporter interface {
+	lastReport() sensor.DeviceReport
+}
+
+// Report returns what the device behind src last told about itself. It
+// returns false for wired sources. The report time is zero until the device
+// was first heard of.
+func Report(src Source) (sensor.DeviceReport, bool) {
+	for {
+		switch s := src.(type) {
+		case inverted:
+			src = s.Source
+		case *Tracker:
+			src = s.Source
+		case reporter:
+			return s.lastReport(), true
+		default:
+			return sensor.DeviceReport{}, false
+		}
+	}
+}
+
+// Close releases what src holds, like the line of a GPIO source, and stops
+// polling it if it is a Tracker.
+func Close(src Source) error {
+	for {
+		switch s := src.(type) {
+		case inverted:
+			src = s.Source
+		case *Tracker:
+			s.stopOnce.Do(func() { close(s.stop) })
+			src = s.Source
+		case io.Closer:
+			return s.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+var httpClient = &http.Client{Timeout: 5 * time.Second, Transport: transport()}
+
+// transport is the default transport, dialing with sensor.Dial.
+func transport() http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = sensor.Dial
+	return t
+}
+
+// maxAge is how long the last state of a sleeping device is trusted.
+var maxAge = 12 * time.Hour
+
+// Parse creates the source described by spec.
+func Parse(spec string, kind Kind) (Source, error) {
+	invert := strings.HasPrefix(spec, "!")
+	parts := strings.SplitN(strings.TrimPrefix(spec, "!"), ":", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("binary sensor must be backend:address, got " + spec)
+	}
+	var src Source
+	var err error
+	switch parts[0] {
+	case "gpio":
+		src, err = newGPIO(parts[1])
+	case "shelly":
+		src = &shelly{host: parts[1], kind: kind}
+	case "deconz":
+		src, err = newDeconz(parts[1], kind)
+	case "file":
+		src = file(parts[1])
+	default:
+		err = errors.New("unknown binary sensor backend " + parts[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+	if invert {
+		src = inverted{src}
+	}
+	return src, nil
+}
+
+type inverted struct{ Source }
+
+func (i inverted) State() (bool, error) {
+	s, err := i.Source.State()
+	return !s, err
+}
+
+func (i inverted) String() string { return "!" + i.Source.String() }
+
+type gpioSource struct{ *gpio.Line }
+
+func newGPIO(addr string) (Source, error) {
+	parts := strings.SplitN(addr, "/", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("gpio binary sensor must be gpio:chip/line")
+	}
+	line, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	// Debounced, as many of these are mechanical switches or floats.
+	l, err := gpio.Request(parts[0], line, gpio.Input, 10*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	return gpioSource{l}, nil
+}
+
+func (g gpioSource) State() (bool, error) {
+	v, err := g.Value()
+	return v == 1, err
+}
+
+func (g gpioSource) String() string {
+	return fmt.Sprintf("gpio:%s/%d", g.Chip, g.Offset)
+}
+
+type file string
+
+func (f file) State() (bool, error) {
+	dat, err := ioutil.ReadFile(string(f))
+	if err != nil {
+		return false, err
+	}
+	return parseBool(strings.TrimSpace(string(dat)))
+}
+
+func (f file) String() string { return "file:" + string(f) }
+
+func parseBool(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "1", "true", "on", "yes", "open", "wet":
+		return true, nil
+	case "0", "false", "off", "no", "closed", "dry":
+		return false, nil
+	}
+	return false, errors.New("not a binary state: " + s)
+}
+
+// shelly reads Gen2+ devices through RPC and falls back to the Gen1 status
+// endpoint.
+type shelly struct {
+	host string
+	kind Kind
+
+	mutex  sync.Mutex
+	last   bool
+	report sensor.DeviceReport
+}
+
+func (s *shelly) State() (bool, error) {
+	r := sensor.NewDeviceReport(time.Now(), sensor.TransportWiFi)
+	state, err := s.read(&r)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err == nil {
+		s.last, s.report = state, r
+		return state, nil
+	}
+	if !s.report.Time.IsZero() && time.Since(s.report.Time) < maxAge {
+		return s.last, nil
+	}
+	return false, err
+}
+
+// read reads the state and fills in the battery level and signal strength.
+func (s *shelly) read(r *sensor.DeviceReport) (bool, error) {
+	var rpc struct {
+		Alarm *bool `json:"alarm"` // Flood.GetStatus
+		State *bool `json:"state"` // Input.GetStatus of door sensors
+	}
+	method := "Flood.GetStatus"
+	if s.kind == Open {
+		method = "Input.GetStatus"
+	}
+	if err := getJSON("http://"+s.host+"/rpc/"+method+"?id=0", &rpc); err == nil {
+		var power struct {
+			Battery struct {
+				Percent *float64 `json:"percent"`
+			} `json:"battery"`
+		}
+		if getJSON("http://"+s.host+"/rpc/DevicePower.GetStatus?id=0", &power) == nil &&
+			power.Battery.Percent != nil {
+			r.Battery = *power.Battery.Percent
+		}
+		var wifi struct {
+			RSSI *float64 `json:"rssi"`
+		}
+		if getJSON("http://"+s.host+"/rpc/Wifi.GetStatus", &wifi) == nil && wifi.RSSI != nil {
+			r.RSSI = *wifi.RSSI
+		}
+		if rpc.Alarm != nil {
+			return *rpc.Alarm, nil
+		}
+		if rpc.State != nil {
+			return *rpc.State, nil
+		}
+	}
+	var gen1 struct {
+		Flood  *bool `json:"flood"`
+		Sensor *struct {
+			State string `json:"state"`
+		} `json:"sensor"`
+		Bat *struct {
+			Value float64 `json:"value"`
+		} `json:"bat"`
+		WifiSta *struct {
+			RSSI float64 `json:"rssi"`
+		} `json:"wifi_sta"`
+	}
+	if err := getJSON("http://"+s.host+"/status", &gen1); err != nil {
+		return false, err
+	}
+	if gen1.Bat != nil {
+		r.Battery = gen1.Bat.Value
+	}
+	if gen1.WifiSta != nil {
+		r.RSSI = gen1.WifiSta.RSSI
+	}
+	switch {
+	case s.kind == Water && gen1.Flood != nil:
+		return *gen1.Flood, nil
+	case s.kind == Open && gen1.Sensor != nil:
+		return parseBool(gen1.Sensor.State)
+	}
+	return false, errors.New("shelly device does not report the requested state")
+}
+
+func (s *shelly) lastReport() sensor.DeviceReport {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.report
+}
+
+func (s *shelly) String() string { return "shelly:" + s.host }
+
+type deconz struct {
+	url   string
+	field string
+	spec  string
+
+	mutex  sync.Mutex
+	report sensor.DeviceReport
+}
+
+func newDeconz(addr string, kind Kind) (Source, error) {
+	parts := strings.Split(addr, "/")
+	if len(parts) != 3 {
+		return nil, errors.New("deconz binary sensor must be deconz:host/apikey/id")
+	}
+	field := "water"
+	if kind == Open {
+		field = "open"
+	}
+	// The API key is left out of labels and logs.
+	return &deconz{
+		url:    fmt.Sprintf("http://%s/api/%s/sensors/%s", parts[0], parts[1], parts[2]),
+		field:  field,
+		spec:   "deconz:" + parts[0] + "/" + parts[2],
+		report: sensor.NewDeviceReport(time.Time{}, sensor.TransportZigbee),
+	}, nil
+}
+
+func (d *deconz) State() (bool, error) {
+	var dev struct {
+		State  map[string]interface{} `json:"state"`
+		Config struct {
+			Reachable *bool    `json:"reachable"`
+			Battery   *float64 `json:"battery"`
+		} `json:"config"`
+	}
+	if err := getJSON(d.url, &dev); err != nil {
+		return false, err
+	}
+	d.mutex.Lock()
+	// The gateway knows when the device last reported, in UTC. It does not
+	// tell the link quality of sensors.
+	if s, ok := dev.State["lastupdated"].(string); ok {
+		if t, err := time.Parse("2006-01-02T15:04:05", s); err == nil {
+			d.report.Time = t
+		}
+	}
+	if dev.Config.Battery != nil {
+		d.report.Battery = *dev.Config.Battery
+	}
+	d.mutex.Unlock()
+	if dev.Config.Reachable != nil && !*dev.Config.Reachable {
+		return false, errors.New("zigbee device unreachable")
+	}
+	v, ok := dev.State[d.field].(bool)
+	if !ok {
+		return false, errors.New("sensor has no " + d.field + " state")
+	}
+	return v, nil
+}
+
+func (d *deconz) lastReport() sensor.DeviceReport {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.report
+}
+
+func (d *deconz) String() string { return d.spec }
+
+func getJSON(url string, v interface{}) error {
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("http status " + resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,105 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package binarysensor
+
+import (
+	"sync"
+	"time"
+)
+
+// A Tracker polls a source in the background and accumulates how long it
+// has been active, which scrapes alone are too coarse for.
+type Tracker struct {
+	Source
+
+	mutex       sync.Mutex
+	known       bool
+	active      bool
+	since       time.Time // of the current state
+	last        time.Time // of the last successful poll
+	activeTotal time.Duration
+	activations uint64
+	err         error
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// Stats is a snapshot of a tracker.
+type Stats struct {
+	Active      bool
+	Current     time.Duration // how long the current active period lasts, 0 if inactive
+	ActiveTotal time.Duration
+	Activations uint64
+}
+
+// Track starts polling src every interval, until the tracker is given to
+// Close.
+func Track(src Source, interval time.Duration) *Tracker {
+	t := &Tracker{Source: src, stop: make(chan struct{})}
+	t.poll()
+	go func() {
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-t.stop:
+				return
+			case <-tick.C:
+				t.poll()
+			}
+		}
+	}()
+	return t
+}
+
+func (t *Tracker) poll() {
+	active, err := t.State()
+	now := time.Now()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.err = err
+	if err != nil {
+		// Time the source could not be read is not counted.
+		return
+	}
+	if t.known && t.active {
+		t.activeTotal += now.Sub(t.last)
+	}
+	if !t.known || active != t.active {
+		if t.known && active {
+			t.activations++
+		}
+		t.since = now
+	}
+	t.known, t.active, t.last = true, active, now
+}
+
+// Stats returns the accumulated state, or the error of the last poll.
+func (t *Tracker) Stats() (Stats, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.err != nil {
+		return Stats{}, t.err
+	}
+	st := Stats{Active: t.active, ActiveTotal: t.activeTotal, Activations: t.activations}
+	if t.active {
+		st.Current = t.last.Sub(t.since)
+	}
+	return st, nil
+}
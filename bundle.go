@@ -0,0 +1,210 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"runtime/pprof"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/fmoessbauer/sensor_exporter/exporter"
+	"github.com/fmoessbauer/sensor_exporter/logging"
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+	"github.com/prometheus/common/expfmt"
+	"gopkg.in/yaml.v3"
+)
+
+// recentLog keeps the last lines logged, for the debug bundle.
+var recentLog = logging.NewRecent(1000)
+
+var started = time.Now()
+
+// Secrets left out of the debug bundle besides those of options, see
+// exporter.SanitizeOptions: the values of keys of the configuration file
+// named like secrets.
+var (
+	secretKey  = regexp.MustCompile(`(?i)(password|passwd|passphrase|secret|token|community|api_?key)`)
+	logOptions = regexp.MustCompile(`(options=)("(?:[^"\\]|\\.)*"|\S*)`)
+)
+
+// debugBundleHandler serves a gzipped tarball to attach to bug reports: the
+// version, the command line and configuration without secrets, the health,
+// traces and metrics of the sensors, the last lines logged, the last
+// exchanges of the sensors with their devices, and the goroutines.
+func debugBundleHandler(e *exporter.Exporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		var files []bundleFile
+		add := func(name string, write func(b *bytes.Buffer)) {
+			var b bytes.Buffer
+			write(&b)
+			files = append(files, bundleFile{name, b.Bytes()})
+		}
+		add("version.txt", writeVersion)
+		if *configFile != "" {
+			add("config.yml", writeConfig)
+		}
+		add("health.json", func(b *bytes.Buffer) { e.WriteHealth(b) })
+		add("scrapes.txt", func(b *bytes.Buffer) { e.WriteTraces(b) })
+		add("metrics.txt", func(b *bytes.Buffer) { writeMetrics(b, e) })
+		add("log.txt", func(b *bytes.Buffer) {
+			for _, line := range recentLog.Lines() {
+				b.WriteString(sanitizeLine(line))
+			}
+		})
+		add("exchanges.txt", writeExchanges)
+		add("goroutines.txt", func(b *bytes.Buffer) { pprof.Lookup("goroutine").WriteTo(b, 1) })
+
+		name := "sensor_exporter-debug-" + now.Format("20060102-150405")
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.tar.gz"`)
+		if err := writeBundle(w, name, now, files); err != nil {
+			slog.Warn("Could not write the debug bundle", "err", err)
+		}
+	})
+}
+
+type bundleFile struct {
+	name string
+	data []byte
+}
+
+// writeBundle writes files as a gzipped tarball, in the directory dir.
+func writeBundle(w io.Writer, dir string, t time.Time, files []bundleFile) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, f := range files {
+		h := &tar.Header{Name: dir + "/" + f.name, Mode: 0644, Size: int64(len(f.data)), ModTime: t.Truncate(time.Second)}
+		if err := tw.WriteHeader(h); err != nil {
+			return err
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func writeVersion(b *bytes.Buffer) {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		fmt.Fprintf(b, "version: %s\n", info.Main.Version)
+		for _, s := range info.Settings {
+			if strings.HasPrefix(s.Key, "vcs.") || s.Key == "-tags" || s.Key == "CGO_ENABLED" {
+				fmt.Fprintf(b, "%s: %s\n", s.Key, s.Value)
+			}
+		}
+	}
+	fmt.Fprintf(b, "go: %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(b, "started: %s\n", started.Format(time.RFC3339))
+	args := make([]string, len(os.Args))
+	for i, arg := range os.Args {
+		args[i] = exporter.SanitizeOptions(arg)
+	}
+	fmt.Fprintf(b, "command line: %q\n", args)
+}
+
+// writeConfig writes the configuration file, as YAML, without secrets.
+func writeConfig(b *bytes.Buffer) {
+	content, err := os.ReadFile(*configFile)
+	if err != nil {
+		fmt.Fprintf(b, "# could not read %s: %s\n", *configFile, err)
+		return
+	}
+	var config any
+	if strings.HasSuffix(*configFile, ".toml") {
+		err = toml.Unmarshal(content, &config)
+	} else {
+		err = yaml.Unmarshal(content, &config)
+	}
+	if err != nil {
+		fmt.Fprintf(b, "# could not parse %s: %s\n", *configFile, err)
+		return
+	}
+	fmt.Fprintf(b, "# %s, without secrets\n", *configFile)
+	enc := yaml.NewEncoder(b)
+	enc.SetIndent(2)
+	enc.Encode(sanitizeValue("", config))
+}
+
+// sanitizeValue replaces the secrets in v, a value of the key key.
+func sanitizeValue(key string, v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, x := range v {
+			v[k] = sanitizeValue(k, x)
+		}
+	case []map[string]any:
+		for _, x := range v {
+			sanitizeValue(key, x)
+		}
+	case []any:
+		for i, x := range v {
+			v[i] = sanitizeValue(key, x)
+		}
+	case string:
+		if secretKey.MatchString(key) {
+			return "REDACTED"
+		}
+		return exporter.SanitizeOptions(v)
+	}
+	return v
+}
+
+// sanitizeLine replaces the secrets in the options and URLs of a line logged.
+func sanitizeLine(line string) string {
+	line = exporter.SanitizeURLs(line)
+	return logOptions.ReplaceAllStringFunc(line, func(m string) string {
+		value := strings.TrimPrefix(m, "options=")
+		if unquoted, ok := strings.CutPrefix(value, `"`); ok {
+			return `options="` + exporter.SanitizeOptions(unquoted)
+		}
+		return "options=" + exporter.SanitizeOptions(value)
+	})
+}
+
+func writeMetrics(b *bytes.Buffer, e *exporter.Exporter) {
+	families, err := e.Gatherer().Gather()
+	if err != nil {
+		fmt.Fprintf(b, "# error gathering metrics: %s\n", err)
+	}
+	for _, mf := range families {
+		expfmt.MetricFamilyToText(b, mf)
+	}
+}
+
+func writeExchanges(b *bytes.Buffer) {
+	for _, x := range sensor.Exchanges() {
+		fmt.Fprintf(b, "%s %s %s\n", x.Time.Format(time.RFC3339Nano), x.Collector, x.Device)
+		fmt.Fprintf(b, "> %q\n< %q\n\n", x.Sent, x.Received)
+	}
+}
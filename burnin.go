@@ -0,0 +1,179 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/exporter"
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+// series are the values a burn-in saw of one series.
+type series struct {
+	seen     int
+	min, max float64
+}
+
+// burnIn scrapes one sensor over and over, one scrape at a time, for a while
+// and prints how reliable it was: the share of successful scrapes, their
+// latency and the range of every value, then exits, with 1 if any scrape
+// failed. It is for qualifying new or flaky hardware before relying on it.
+// An interrupt ends it early, with the report so far.
+func burnIn(args []string) {
+	fs := flag.NewFlagSet("burnin", flag.ExitOnError)
+	duration := fs.Duration("duration", time.Hour, "how long to scrape the sensor")
+	pause := fs.Duration("interval", 100*time.Millisecond, "least time between the starts of two scrapes, so that failing ones do not hammer the device")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags] burnin [burnin flags] sensor [burnin flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	// The flags may follow the sensor too.
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		def := fs.Arg(0)
+		fs.Parse(fs.Args()[1:])
+		args = append([]string{def}, fs.Args()...)
+	} else {
+		args = nil
+	}
+	_, sensors := configuredSensors(args)
+	if len(sensors) != 1 {
+		fatal("Burn-in takes one sensor", "sensors", len(sensors))
+	}
+	c := sensors[0]
+	interval := ""
+	if c.Interval != 0 {
+		interval = c.Interval.String()
+	}
+	name := c.Type + sensor.LabelString(c.Labels) + "," + interval + "," + exporter.SanitizeOptions(c.Options)
+
+	key, err := exporter.LoadSecretKey(*keyFile)
+	if err != nil {
+		fatal("Could not read key", "err", err)
+	}
+	e := exporter.New(exporter.Config{SecretKey: key, ScrapeTimeout: *scrapeTimeout})
+	e.Register(collectors...)
+	p, err := e.Probe(c)
+	if err != nil {
+		fatal("Could not create sensor", "sensor", name, "err", err)
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, syscall.SIGINT, syscall.SIGTERM)
+	end := time.After(*duration)
+	fmt.Printf("# Burn-in of %s for %s, Ctrl-C to stop early\n", name, *duration)
+
+	start := time.Now()
+	var latencies []time.Duration
+	errs := make(map[string]int)
+	values := make(map[string]*series)
+	failed, run, longestRun := 0, 0, 0
+	next := time.NewTimer(0)
+loop:
+	for {
+		select {
+		case <-end:
+			break loop
+		case <-interrupt:
+			break loop
+		case <-next.C:
+		}
+		at := time.Now()
+		next.Reset(*pause)
+		samples, err := p.Scrape()
+		latencies = append(latencies, time.Since(at))
+		if err != nil {
+			failed++
+			run++
+			longestRun = max(longestRun, run)
+			errs[err.Error()]++
+			if err != exporter.ErrIncident {
+				continue
+			}
+		} else {
+			run = 0
+		}
+		for _, s := range samples {
+			id := s.Name + sensor.LabelString(s.Labels)
+			v := values[id]
+			if v == nil {
+				v = &series{min: math.Inf(1), max: math.Inf(-1)}
+				values[id] = v
+			}
+			v.seen++
+			v.min, v.max = min(v.min, s.Value), max(v.max, s.Value)
+		}
+	}
+	signal.Stop(interrupt)
+	p.Close()
+
+	scrapes := len(latencies)
+	fmt.Printf("# Ran for %s\n", time.Since(start).Round(time.Second))
+	if scrapes == 0 {
+		fmt.Println("# No scrapes")
+		os.Exit(1)
+	}
+	fmt.Printf("Scrapes: %d, %d OK (%.2f%%), %d failed, at most %d in a row\n",
+		scrapes, scrapes-failed, 100*float64(scrapes-failed)/float64(scrapes), failed, longestRun)
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	fmt.Printf("Latency: p50 %s, p90 %s, p99 %s, max %s\n", percentile(latencies, 50),
+		percentile(latencies, 90), percentile(latencies, 99), latencies[scrapes-1])
+
+	if len(errs) > 0 {
+		fmt.Println("Errors:")
+		messages := make([]string, 0, len(errs))
+		for m := range errs {
+			messages = append(messages, m)
+		}
+		sort.Slice(messages, func(i, j int) bool { return errs[messages[i]] > errs[messages[j]] })
+		for _, m := range messages {
+			fmt.Printf("  %6d  %s\n", errs[m], m)
+		}
+	}
+
+	ids := make([]string, 0, len(values))
+	for id := range values {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "Values:\tseen\tmin\tmax\t")
+	for _, id := range ids {
+		v := values[id]
+		fmt.Fprintf(w, "  %s\t%d\t%g\t%g\t\n", id, v.seen, v.min, v.max)
+	}
+	w.Flush()
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// percentile returns the pth percentile of sorted, by the nearest rank.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	i := (len(sorted)*p + 99) / 100
+	return sorted[max(i, 1)-1]
+}
@@ -0,0 +1,278 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package chaos injects faults into what collectors read from their devices,
+to test realistically how the exporter and the collectors retry, back off
+and recover: dropped connections, slow reads and corrupt frames. It is only
+linked into builds with the chaos tag, for tests, never into releases:
+
+	go build -tags chaos
+
+Faults apply to the connections of sensor.Dial and to the serial ports of
+the serial package, of the devices whose address or path matches the glob
+pattern Device, all if empty. They are set and cleared at run time through
+Handler, which the exporter serves at /admin/chaos with
+-web.enable-admin-api:
+
+	curl -d 'device=127.0.0.1:3493&drop=0.2&delay=2s&corrupt=0.05&for=10m' localhost:9091/admin/chaos
+	curl -d 'device=127.0.0.1:3493&clear=1' localhost:9091/admin/chaos
+*/
+package chaos
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A Fault is what goes wrong with the devices matching Device: a dial, a
+// read or an open fails with probability Drop, and a dropped connection is
+// closed; every read waits Delay first; and a read flips a byte of what it
+// got with probability Corrupt. It lasts until Until, or until cleared if
+// zero.
+type Fault struct {
+	Device  string
+	Drop    float64
+	Delay   time.Duration
+	Corrupt float64
+	Until   time.Time
+
+	// Injected counts the faults injected, by kind.
+	Injected map[string]int
+}
+
+// ErrDropped is the error of a dropped dial, open or read.
+var ErrDropped = errors.New("chaos: connection dropped")
+
+var (
+	faults = make(map[string]*Fault) // by Device
+	mutex  sync.Mutex
+)
+
+// Set sets the fault of f.Device, replacing the one it had.
+func Set(f Fault) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	f.Injected = make(map[string]int)
+	faults[f.Device] = &f
+	if f.Until.IsZero() {
+		slog.Warn("Injecting faults", "device", f.Device, "drop", f.Drop, "delay", f.Delay, "corrupt", f.Corrupt)
+	} else {
+		slog.Warn("Injecting faults", "device", f.Device, "drop", f.Drop, "delay", f.Delay, "corrupt", f.Corrupt, "until", f.Until)
+	}
+}
+
+// Clear clears the fault of device.
+func Clear(device string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	delete(faults, device)
+	slog.Info("No longer injecting faults", "device", device)
+}
+
+// Faults returns the faults set, by device.
+func Faults() []Fault {
+	mutex.Lock()
+	defer mutex.Unlock()
+	expire()
+	out := make([]Fault, 0, len(faults))
+	for _, f := range faults {
+		g := *f
+		g.Injected = make(map[string]int, len(f.Injected))
+		for k, v := range f.Injected {
+			g.Injected[k] = v
+		}
+		out = append(out, g)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Device < out[j].Device })
+	return out
+}
+
+// expire removes the faults that are over. It is called with the mutex held.
+func expire() {
+	now := time.Now()
+	for device, f := range faults {
+		if !f.Until.IsZero() && now.After(f.Until) {
+			delete(faults, device)
+			slog.Info("No longer injecting faults", "device", device)
+		}
+	}
+}
+
+// inject tells which of the faults of device to inject now, drop or corrupt,
+// and how long to delay, counting them. Opening a connection or port can only
+// be dropped.
+func inject(device string, reading bool) (drop, corrupt bool, delay time.Duration) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	expire()
+	for _, f := range faults {
+		if ok, _ := path.Match(f.Device, device); f.Device != "" && !ok {
+			continue
+		}
+		if rand.Float64() < f.Drop {
+			drop = true
+			f.Injected["drop"]++
+		}
+		if !reading {
+			continue
+		}
+		if rand.Float64() < f.Corrupt {
+			corrupt = true
+			f.Injected["corrupt"]++
+		}
+		if f.Delay > 0 {
+			delay = max(delay, f.Delay)
+			f.Injected["delay"]++
+		}
+	}
+	return drop, corrupt, delay
+}
+
+// Injector is the sensor.Injector of the faults set.
+var Injector injector
+
+type injector struct{}
+
+func (injector) Conn(address string, conn net.Conn) (net.Conn, error) {
+	if drop, _, _ := inject(address, false); drop {
+		return nil, ErrDropped
+	}
+	return &faultyConn{Conn: conn, device: address}, nil
+}
+
+func (injector) Port(device string, port io.ReadWriteCloser) (io.ReadWriteCloser, error) {
+	if drop, _, _ := inject(device, false); drop {
+		return nil, ErrDropped
+	}
+	return &faultyPort{ReadWriteCloser: port, device: device}, nil
+}
+
+// read reads from r with the faults of device.
+func read(device string, r io.ReadCloser, b []byte) (int, error) {
+	drop, corrupt, delay := inject(device, true)
+	time.Sleep(delay)
+	if drop {
+		r.Close()
+		return 0, ErrDropped
+	}
+	n, err := r.Read(b)
+	if corrupt && n > 0 {
+		b[rand.IntN(n)] ^= byte(1 << rand.IntN(8))
+	}
+	return n, err
+}
+
+// faultyConn is a network connection with faults.
+type faultyConn struct {
+	net.Conn
+	device string
+}
+
+func (c *faultyConn) Read(b []byte) (int, error) {
+	return read(c.device, c.Conn, b)
+}
+
+// faultyPort is a serial port with faults.
+type faultyPort struct {
+	io.ReadWriteCloser
+	device string
+}
+
+func (p *faultyPort) Read(b []byte) (int, error) {
+	return read(p.device, p.ReadWriteCloser, b)
+}
+
+// Handler sets faults: a POST with device, a glob pattern of the devices,
+// and drop, a probability, delay, a duration, corrupt, a probability, and
+// for, how long, any of them, sets the fault of device; with clear=1 it clears
+// it. Any request lists the faults, with the faults injected so far.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if r.Method == http.MethodPost {
+			if err := set(r); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		for _, f := range Faults() {
+			fmt.Fprintf(w, "%q drop=%g delay=%s corrupt=%g", f.Device, f.Drop, f.Delay, f.Corrupt)
+			if !f.Until.IsZero() {
+				fmt.Fprintf(w, " until %s", f.Until.Format(time.RFC3339))
+			}
+			fmt.Fprintf(w, ", injected %d drops, %d delays, %d corruptions\n",
+				f.Injected["drop"], f.Injected["delay"], f.Injected["corrupt"])
+		}
+	})
+}
+
+// set sets or clears the fault of a POST to Handler.
+func set(r *http.Request) error {
+	device := r.FormValue("device")
+	if _, err := path.Match(device, ""); err != nil {
+		return errors.New("Bad device pattern: " + err.Error())
+	}
+	if r.FormValue("clear") != "" {
+		Clear(device)
+		return nil
+	}
+	f := Fault{Device: device}
+	var err error
+	if f.Drop, err = probability(r.FormValue("drop")); err != nil {
+		return errors.New("Bad drop: " + err.Error())
+	}
+	if f.Corrupt, err = probability(r.FormValue("corrupt")); err != nil {
+		return errors.New("Bad corrupt: " + err.Error())
+	}
+	if v := r.FormValue("delay"); v != "" {
+		if f.Delay, err = time.ParseDuration(v); err != nil {
+			return errors.New("Bad delay: " + err.Error())
+		}
+	}
+	if v := r.FormValue("for"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return errors.New("Bad duration for: " + err.Error())
+		}
+		f.Until = time.Now().Add(d)
+	}
+	Set(f)
+	return nil
+}
+
+// probability parses a probability, 0 if empty.
+func probability(v string) (float64, error) {
+	if v == "" {
+		return 0, nil
+	}
+	p, err := strconv.ParseFloat(v, 64)
+	if err == nil && (p < 0 || p > 1) {
+		err = errors.New("not between 0 and 1")
+	}
+	return p, err
+}
@@ -0,0 +1,116 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/fmoessbauer/sensor_exporter/exporter"
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+// checkSensors creates the sensors of args and of -config, scrapes each once
+// and prints their samples, or why they failed, then exits, with 1 if any
+// sensor failed. Nothing is served.
+func checkSensors(args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags] check [sensors]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	_, sensors := configuredSensors(fs.Args())
+	key, err := exporter.LoadSecretKey(*keyFile)
+	if err != nil {
+		fatal("Could not read key", "err", err)
+	}
+	e := exporter.New(exporter.Config{SecretKey: key, ScrapeTimeout: *scrapeTimeout})
+	e.Register(collectors...)
+
+	failed := 0
+	for _, c := range sensors {
+		// As it would be given on the command line.
+		interval := ""
+		if c.Interval != 0 {
+			interval = c.Interval.String()
+		}
+		name := c.Type + sensor.LabelString(c.Labels) + "," + interval + "," + exporter.SanitizeOptions(c.Options)
+		samples, err := e.Check(c)
+		if err != nil {
+			failed++
+			fmt.Printf("# %s: FAILED: %s\n", name, err)
+		} else {
+			fmt.Printf("# %s: OK\n", name)
+		}
+		for _, s := range samples {
+			fmt.Printf("%s%s %g\n", s.Name, sensor.LabelString(s.Labels), s.Value)
+		}
+	}
+	if failed > 0 {
+		fmt.Printf("# %d of %d sensors failed\n", failed, len(sensors))
+		os.Exit(1)
+	}
+}
+
+// checkConfig loads -config as it would be on the host given with -host, by
+// default this one, and prints the sensors it resolves to, with its includes
+// and variables applied, then exits, with 1 if the configuration is bad.
+// Nothing is scraped.
+func checkConfig(args []string) {
+	fs := flag.NewFlagSet("check-config", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s -config file [flags] check-config [-host name]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	host, _ := os.Hostname()
+	fs.StringVar(&host, "host", host, "Check the configuration as on the host of this name.")
+	fs.Parse(args)
+	if *configFile == "" || fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	config, err := exporter.LoadConfigFor(*configFile, host)
+	if err != nil {
+		fmt.Printf("# %s: FAILED: %s\n", *configFile, err)
+		os.Exit(1)
+	}
+	e := exporter.New(exporter.Config{})
+	e.Register(collectors...)
+	known := e.Collectors()
+	failed := 0
+	for _, c := range config.Sensors {
+		interval := ""
+		if c.Interval != 0 {
+			interval = c.Interval.String()
+		}
+		fmt.Println(c.Type + sensor.LabelString(c.Labels) + "," + interval + "," + exporter.SanitizeOptions(c.Options))
+		if _, ok := known[c.Type]; !ok {
+			failed++
+			fmt.Printf("# %s: FAILED: sensor not found\n", c.Type)
+		}
+	}
+	fmt.Printf("# %s on %s: %d sensors, %d actions, %d recovery targets, %d helpers\n",
+		*configFile, host, len(config.Sensors), len(config.Actions), len(config.Recovery), len(config.Helpers))
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,111 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+//go:build !minimal || consul
+
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/consul"
+	"github.com/fmoessbauer/sensor_exporter/exporter"
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+var (
+	consulAddress       = flag.String("consul.address", "http://127.0.0.1:8500", "URL of the Consul agent; its ACL token is read from $CONSUL_HTTP_TOKEN")
+	consulRegister      = flag.Bool("consul.register", false, "register /metrics with the Consul agent as a service, with a health check of /healthz")
+	consulService       = flag.String("consul.service", "sensor_exporter", "name of the registered service")
+	consulTags          = flag.String("consul.tags", "", "comma separated tags of the registered service")
+	consulCheckURL      = flag.String("consul.check-url", "", "URL the agent checks the health at, http://127.0.0.1:PORT/healthz by default")
+	consulCheckInterval = flag.Duration("consul.check-interval", 15*time.Second, "how often the agent checks the health")
+	consulPrefix        = flag.String("consul.kv-prefix", "", "read sensors from the keys below this prefix of the Consul KV store, one per key, and follow their changes")
+	consulLeaseKey      = flag.String("ha.lease-consul", "", "key of the Consul KV store locked by the exporter that scrapes the leader_only sensors, instead of -ha.lease-file")
+)
+
+func init() {
+	advertisers = append(advertisers, registerConsul)
+	sensorStores = append(sensorStores, watchConsul)
+	leases = append(leases, consulLease)
+	sensor.RegisterFeature(remoteConfig, "sensors from Consul, etcd or Kubernetes")
+}
+
+// registerConsul registers the metrics endpoint on port with the Consul
+// agent, if -consul.register is set, and returns the function that
+// deregisters it.
+func registerConsul(port string) func() {
+	if !*consulRegister {
+		return nil
+	}
+	if port == "" {
+		fatal("Registering with -consul.register needs a port, -p")
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		fatal("Could not register a port that is not a number", "port", port)
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		fatal("Could not get the host name to register", "err", err)
+	}
+	check := *consulCheckURL
+	if check == "" {
+		check = "http://127.0.0.1:" + port + "/healthz"
+	}
+	s := consul.Service{ID: *consulService + "-" + host + "-" + port, Name: *consulService, Port: p,
+		Meta:  map[string]string{"metrics_path": "/metrics"},
+		Check: &consul.Check{HTTP: check, Interval: consulCheckInterval.String()}}
+	if *consulTags != "" {
+		s.Tags = strings.Split(*consulTags, ",")
+	}
+	c := consul.New(*consulAddress, os.Getenv("CONSUL_HTTP_TOKEN"))
+	if err := c.Register(s); err != nil {
+		fatal("Could not register with Consul", "address", *consulAddress, "err", err)
+	}
+	slog.Info("Registered with Consul", "service", s.Name, "id", s.ID, "port", p)
+	return func() {
+		if err := c.Deregister(s.ID); err != nil {
+			slog.Warn("Could not deregister from Consul", "id", s.ID, "err", err)
+		}
+	}
+}
+
+// watchConsul applies the sensors below -consul.kv-prefix, if given, until
+// ctx is done.
+func watchConsul(ctx context.Context, apply func(sensors []exporter.SensorConfig)) {
+	if *consulPrefix == "" {
+		return
+	}
+	requireFeature(remoteConfig, "-consul.kv-prefix")
+	c := consul.New(*consulAddress, os.Getenv("CONSUL_HTTP_TOKEN"))
+	c.Watch(ctx, *consulPrefix, storeSensors("consul", *consulPrefix, apply))
+}
+
+// consulLease returns the lease of -ha.lease-consul, if given.
+func consulLease() exporter.Lease {
+	if *consulLeaseKey == "" {
+		return nil
+	}
+	return consul.New(*consulAddress, os.Getenv("CONSUL_HTTP_TOKEN")).Lease(*consulLeaseKey)
+}
@@ -0,0 +1,216 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package consul registers a service with the local Consul agent and watches a
+prefix of the Consul KV store, through the HTTP API:
+
+	c := consul.New("http://127.0.0.1:8500", os.Getenv("CONSUL_HTTP_TOKEN"))
+	err := c.Register(consul.Service{ID: "sensor_exporter-pi4-9091",
+		Name: "sensor_exporter", Port: 9091,
+		Check: &consul.Check{HTTP: "http://127.0.0.1:9091/healthz", Interval: "15s"}})
+	...
+	go c.Watch(ctx, "sensor_exporter/pi4/", func(values map[string][]byte) { ... })
+	...
+	c.Deregister("sensor_exporter-pi4-9091")
+
+Watch waits for changes with blocking queries, so that they are seen within
+a round trip of being made.
+*/
+package consul
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+// A Client talks to a Consul agent.
+type Client struct {
+	address string
+	token   string
+	client  *http.Client
+}
+
+// A Service is registered with the agent, see the agent service API. The
+// address is the agent's if empty.
+type Service struct {
+	ID      string            `json:"ID"`
+	Name    string            `json:"Name"`
+	Tags    []string          `json:"Tags,omitempty"`
+	Address string            `json:"Address,omitempty"`
+	Port    int               `json:"Port"`
+	Meta    map[string]string `json:"Meta,omitempty"`
+	Check   *Check            `json:"Check,omitempty"`
+}
+
+// A Check is the HTTP health check of a Service, passing with any 2xx
+// status.
+type Check struct {
+	HTTP          string `json:"HTTP"`
+	Interval      string `json:"Interval"`
+	Timeout       string `json:"Timeout,omitempty"`
+	TLSSkipVerify bool   `json:"TLSSkipVerify,omitempty"`
+	// DeregisterCriticalServiceAfter removes the service once it has
+	// failed its check this long, e.g. of an exporter that was killed.
+	DeregisterCriticalServiceAfter string `json:"DeregisterCriticalServiceAfter,omitempty"`
+}
+
+// requestTimeout is the deadline of requests other than blocking queries.
+var requestTimeout = 10 * time.Second
+
+// wait is how long a blocking query waits for a change.
+var wait = 5 * time.Minute
+
+// retry is how long Watch waits after an error.
+var retry = 10 * time.Second
+
+// New returns a client of the agent at address, like
+// http://127.0.0.1:8500, with an ACL token if not empty.
+func New(address, token string) *Client {
+	// Blocking queries get their deadline from wait, other requests from
+	// requestTimeout.
+	return &Client{address: strings.TrimSuffix(address, "/"), token: token, client: &http.Client{}}
+}
+
+// Register registers s, or updates it if registered.
+func (c *Client) Register(s Service) error {
+	body, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	_, _, err = c.do(http.MethodPut, "/v1/agent/service/register", body)
+	return err
+}
+
+// Deregister removes the service with the id.
+func (c *Client) Deregister(id string) error {
+	_, _, err := c.do(http.MethodPut, "/v1/agent/service/deregister/"+url.PathEscape(id), nil)
+	return err
+}
+
+// do makes a request within requestTimeout and returns the body of its
+// response and its status.
+func (c *Client) do(method, path string, body []byte) ([]byte, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	resp, err := c.request(ctx, method, path, body)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, resp.StatusCode, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(data))
+	}
+	return data, resp.StatusCode, nil
+}
+
+// request sends a request with the token.
+func (c *Client) request(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.address+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+	return c.client.Do(req)
+}
+
+// Watch calls f with the keys below prefix and their values, now and on
+// every change, until ctx is done. Errors are logged and the prefix read
+// again after a while; f is not called for them.
+func (c *Client) Watch(ctx context.Context, prefix string, f func(values map[string][]byte)) {
+	var index uint64
+	for ctx.Err() == nil {
+		values, next, err := c.list(ctx, prefix, index)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			sensor.Incident()
+			slog.Error("Could not read Consul KV", "prefix", prefix, "err", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(retry):
+			}
+			continue
+		}
+		if index == 0 || next != index {
+			f(values)
+		}
+		// The index may also go back, e.g. when the KV store was
+		// restored; the next query waits from there. It is never 0, which
+		// would not block.
+		index = next
+		if index == 0 {
+			index = 1
+		}
+	}
+}
+
+// list reads the keys below prefix with a blocking query, which returns
+// when the index of the prefix is past index or after wait. It returns the
+// values and the new index.
+func (c *Client) list(ctx context.Context, prefix string, index uint64) (map[string][]byte, uint64, error) {
+	ctx, cancel := context.WithTimeout(ctx, wait+requestTimeout)
+	defer cancel()
+	path := "/v1/kv/" + strings.TrimPrefix(prefix, "/") + "?recurse=true"
+	if index > 0 {
+		path += "&index=" + strconv.FormatUint(index, 10) + "&wait=" + wait.String()
+	}
+	resp, err := c.request(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	next, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	values := map[string][]byte{}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		// No keys below the prefix.
+		return values, next, nil
+	case resp.StatusCode/100 != 2:
+		data, _ := io.ReadAll(resp.Body)
+		return nil, 0, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(data))
+	}
+	var pairs []struct {
+		Key   string
+		Value []byte // base64 in the JSON, null for folders
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&pairs); err != nil {
+		return nil, 0, err
+	}
+	for _, p := range pairs {
+		values[p.Key] = p.Value
+	}
+	return values, next, nil
+}
@@ -0,0 +1,83 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// A Lease is a lock on a key of the KV store held by a session of the agent,
+// see exporter.Lease. The session ends, and the key is released, when it is
+// not renewed within its TTL, by default doubled by Consul, or when the node
+// of the agent fails.
+type Lease struct {
+	c       *Client
+	key     string
+	mutex   sync.Mutex
+	session string
+}
+
+// Lease returns the lease of the key.
+func (c *Client) Lease(key string) *Lease {
+	return &Lease{c: c, key: key}
+}
+
+// Acquire renews the session of the lease, or creates it with a TTL of d, at
+// least the 10s Consul allows, and then locks the key with it, writing id.
+// It tells whether the session holds the lock.
+func (l *Lease) Acquire(id string, d time.Duration) (bool, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.session != "" {
+		_, status, err := l.c.do(http.MethodPut, "/v1/session/renew/"+url.PathEscape(l.session), nil)
+		if status == http.StatusNotFound {
+			// Expired, maybe while the agent was unreachable.
+			l.session = ""
+		} else if err != nil {
+			return false, err
+		}
+	}
+	if l.session == "" {
+		ttl := max(d, 10*time.Second)
+		body, _ := json.Marshal(map[string]string{"Name": "sensor_exporter " + id,
+			"TTL": fmt.Sprintf("%ds", int(ttl.Seconds())), "Behavior": "release", "LockDelay": "0s"})
+		data, _, err := l.c.do(http.MethodPut, "/v1/session/create", body)
+		if err != nil {
+			return false, err
+		}
+		var session struct{ ID string }
+		if err := json.Unmarshal(data, &session); err != nil {
+			return false, err
+		}
+		l.session = session.ID
+	}
+	data, _, err := l.c.do(http.MethodPut, "/v1/kv/"+l.key+"?acquire="+url.QueryEscape(l.session), []byte(id))
+	if err != nil {
+		return false, err
+	}
+	var held bool
+	if err := json.Unmarshal(data, &held); err != nil {
+		return false, err
+	}
+	return held, nil
+}
@@ -0,0 +1,267 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/fmoessbauer/sensor_exporter/exporter"
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+// grafanaUnits are the Grafana units of the OpenMetrics units of the
+// collectors.
+var grafanaUnits = map[string]string{
+	"amperes":                     "amp",
+	"celsius":                     "celsius",
+	"dba":                         "suffix: dBA",
+	"dbm":                         "dBm",
+	"degrees":                     "degree",
+	"grams":                       "massg",
+	"grams_per_cubic_meter":       "congm3",
+	"hertz":                       "hertz",
+	"km":                          "lengthkm",
+	"meters_per_second":           "velocityms",
+	"micrograms_per_cubic_meter":  "conμgm3",
+	"microsiemens_per_centimeter": "suffix: µS/cm",
+	"milligrams_per_liter":        "suffix: mg/L",
+	"millimeters":                 "lengthmm",
+	"ohms":                        "ohm",
+	"pascals":                     "pressurepa",
+	"percent":                     "percent",
+	"ppb":                         "ppb",
+	"ppm":                         "ppm",
+	"psu":                         "suffix: PSU",
+	"rpm":                         "rpm",
+	"seconds":                     "s",
+	"va":                          "voltamp",
+	"volts":                       "volt",
+	"watthours":                   "watth",
+	"watts":                       "watt",
+}
+
+// genDashboard prints a Grafana dashboard of the sensors of args and of
+// -config: a row per sensor with a panel per metric of its collector.
+func genDashboard(args []string) {
+	fs := flag.NewFlagSet("gen-dashboard", flag.ExitOnError)
+	title := fs.String("title", "Sensors", "title of the dashboard")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags] gen-dashboard [options] [sensors]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	e, sensors := configuredSensors(fs.Args())
+
+	d := dashboard{Title: *title, SchemaVersion: 39, Editable: true,
+		Time: timeRange{From: "now-24h", To: "now"}, Refresh: "1m",
+		Templating: templating{List: []variable{
+			{Name: "datasource", Label: "Data source", Type: "datasource", Query: "prometheus"},
+			{Name: "instance", Label: "Instance", Type: "query", Datasource: datasourceRef,
+				Query: "label_values(sensor_exporter_collector_up, instance)", Refresh: 1, Multi: true, IncludeAll: true},
+		}}}
+	entries := e.Collectors()
+	y := 0
+	for _, c := range sensors {
+		d.addRow(rowTitle(c), y)
+		y++
+		selector := panelSelector(c)
+		for i, m := range metricsOf(entries[c.Type]) {
+			d.addPanel(m, selector, i%2*12, y+i/2*8)
+		}
+		y += (len(metricsOf(entries[c.Type])) + 1) / 2 * 8
+	}
+	d.addRow("sensor_exporter", y)
+	for i, m := range []metric{
+		{name: "sensor_exporter_collector_up", help: "Whether the last scrape of a sensor succeeded and returned samples."},
+		{name: "sensor_exporter_scrape_duration_seconds", help: "Duration of the last scrape of a sensor.", unit: "seconds"},
+	} {
+		d.addPanel(m, `instance=~"$instance"`, i*12, y+1)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(d); err != nil {
+		fatal("Could not write the dashboard", "err", err)
+	}
+}
+
+// A metric of a collector entry, as its TYPE, HELP and UNIT lines tell.
+type metric struct {
+	name, typ, help, unit string
+}
+
+// metricsOf returns the metrics of entry, sorted by name. Info metrics,
+// which have no value worth a graph, are left out.
+func metricsOf(entry sensor.CollectorEntry) []metric {
+	byName := make(map[string]*metric)
+	get := func(line, prefix string) (*metric, string) {
+		fields := strings.SplitN(strings.TrimPrefix(line, prefix), " ", 2)
+		m, ok := byName[fields[0]]
+		if !ok {
+			m = &metric{name: fields[0]}
+			byName[fields[0]] = m
+		}
+		if len(fields) < 2 {
+			return m, ""
+		}
+		return m, fields[1]
+	}
+	for _, line := range entry.Type {
+		m, typ := get(line, "# TYPE ")
+		m.typ = typ
+	}
+	for _, line := range entry.Help {
+		m, help := get(line, "# HELP ")
+		m.help = help
+	}
+	for _, line := range entry.Unit {
+		m, unit := get(line, "# UNIT ")
+		m.unit = unit
+	}
+	var metrics []metric
+	for _, m := range byName {
+		if m.typ != "" && !strings.HasSuffix(m.name, "_info") {
+			metrics = append(metrics, *m)
+		}
+	}
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].name < metrics[j].name })
+	return metrics
+}
+
+// rowTitle names a sensor by its type, options and labels.
+func rowTitle(c exporter.SensorConfig) string {
+	title := c.Type
+	if c.Options != "" {
+		title += " " + exporter.SanitizeOptions(c.Options)
+	}
+	if c.Tenant != "" {
+		title += " (" + c.Tenant + ")"
+	}
+	return title + sensor.LabelString(c.Labels)
+}
+
+// panelSelector selects the samples of c: by instance and by its static
+// labels and tenant, if any. Sensors of the same type without labels share
+// their panels.
+func panelSelector(c exporter.SensorConfig) string {
+	matchers := []string{`instance=~"$instance"`}
+	labels := sensor.Labels(c.Labels)
+	if c.Tenant != "" {
+		labels = labels.With("tenant", c.Tenant)
+	}
+	for _, name := range labels.Names() {
+		matchers = append(matchers, name+`="`+sensor.EscapeLabelValue(labels[name])+`"`)
+	}
+	return strings.Join(matchers, ",")
+}
+
+var datasourceRef = map[string]string{"type": "prometheus", "uid": "${datasource}"}
+
+type dashboard struct {
+	Title         string     `json:"title"`
+	SchemaVersion int        `json:"schemaVersion"`
+	Editable      bool       `json:"editable"`
+	Time          timeRange  `json:"time"`
+	Refresh       string     `json:"refresh"`
+	Templating    templating `json:"templating"`
+	Panels        []panel    `json:"panels"`
+}
+
+type timeRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type templating struct {
+	List []variable `json:"list"`
+}
+
+type variable struct {
+	Name       string            `json:"name"`
+	Label      string            `json:"label"`
+	Type       string            `json:"type"`
+	Datasource map[string]string `json:"datasource,omitempty"`
+	Query      string            `json:"query"`
+	Refresh    int               `json:"refresh,omitempty"`
+	Multi      bool              `json:"multi,omitempty"`
+	IncludeAll bool              `json:"includeAll,omitempty"`
+}
+
+type panel struct {
+	ID          int               `json:"id"`
+	Type        string            `json:"type"`
+	Title       string            `json:"title"`
+	Description string            `json:"description,omitempty"`
+	GridPos     gridPos           `json:"gridPos"`
+	Datasource  map[string]string `json:"datasource,omitempty"`
+	Targets     []target          `json:"targets,omitempty"`
+	FieldConfig *fieldConfig      `json:"fieldConfig,omitempty"`
+}
+
+type gridPos struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+type target struct {
+	RefID string `json:"refId"`
+	Expr  string `json:"expr"`
+}
+
+type fieldConfig struct {
+	Defaults struct {
+		Unit string `json:"unit,omitempty"`
+	} `json:"defaults"`
+	Overrides []interface{} `json:"overrides"`
+}
+
+func (d *dashboard) addRow(title string, y int) {
+	d.Panels = append(d.Panels, panel{ID: len(d.Panels) + 1, Type: "row", Title: title,
+		GridPos: gridPos{Y: y, W: 24, H: 1}})
+}
+
+// addPanel adds a time series panel of m at x, y. Counters are graphed as
+// their rate.
+func (d *dashboard) addPanel(m metric, selector string, x, y int) {
+	expr := m.name + "{" + selector + "}"
+	title := m.name
+	if m.typ == "counter" {
+		expr = "rate(" + expr + "[$__rate_interval])"
+		title += " rate"
+	}
+	fc := &fieldConfig{Overrides: []interface{}{}}
+	unit := m.unit
+	if unit == "" { // The name may still end with the unit.
+		for u := range grafanaUnits {
+			if strings.HasSuffix(m.name, "_"+u) || strings.HasSuffix(m.name, "_"+u+"_total") {
+				unit = u
+			}
+		}
+	}
+	fc.Defaults.Unit = grafanaUnits[unit]
+	d.Panels = append(d.Panels, panel{ID: len(d.Panels) + 1, Type: "timeseries", Title: title,
+		Description: m.help, GridPos: gridPos{X: x, Y: y, W: 12, H: 8}, Datasource: datasourceRef,
+		Targets: []target{{RefID: "A", Expr: expr}}, FieldConfig: fc})
+}
@@ -0,0 +1,76 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+//go:build !minimal || dnssd
+
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/fmoessbauer/sensor_exporter/dnssd"
+)
+
+var (
+	dnssdAdvertise = flag.Bool("dnssd.advertise", false, "advertise /metrics with mDNS as a _prometheus-http._tcp service, for discovery on the local network")
+	dnssdInstance  = flag.String("dnssd.instance", "", "instance name of the advertised service, sensor_exporter on the host name by default")
+)
+
+func init() {
+	advertisers = append(advertisers, advertise)
+}
+
+// advertise advertises the metrics endpoint on port, if -dnssd.advertise is
+// set, and returns the function that withdraws it.
+func advertise(port string) func() {
+	if !*dnssdAdvertise {
+		return nil
+	}
+	if port == "" {
+		fatal("Advertising with -dnssd.advertise needs a port, -p")
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		fatal("Could not advertise a port that is not a number", "port", port)
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		fatal("Could not get the host name to advertise", "err", err)
+	}
+	// Of a fully qualified name, the first label is the name in .local.
+	host, _, _ = strings.Cut(host, ".")
+	instance := *dnssdInstance
+	if instance == "" {
+		instance = "sensor_exporter on " + host
+	}
+	s := dnssd.Service{Instance: instance, Type: "_prometheus-http._tcp", Host: host, Port: p,
+		Text: []string{"path=/metrics"}}
+	a, err := dnssd.Advertise(s)
+	if err != nil {
+		fatal("Could not advertise with mDNS", "err", err)
+	}
+	slog.Info("Advertising with mDNS", "instance", instance, "type", s.Type, "port", p)
+	return func() {
+		if err := a.Close(); err != nil {
+			slog.Warn("Could not withdraw mDNS advertisement", "err", err)
+		}
+	}
+}
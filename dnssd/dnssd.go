@@ -0,0 +1,301 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package dnssd advertises a service with multicast DNS service discovery
+(mDNS, RFC 6762, and DNS-SD, RFC 6763), as Avahi or Bonjour do, so that
+clients browsing for its type on the local network find it:
+
+	a, err := dnssd.Advertise(dnssd.Service{Instance: "sensor_exporter on pi4",
+		Type: "_prometheus-http._tcp", Host: "pi4", Port: 9091,
+		Text: []string{"path=/metrics"}})
+	...
+	a.Close()
+
+It answers the PTR queries of the service type and of
+_services._dns-sd._udp.local, and those for the SRV and TXT records of the
+instance and the A records of the host, with its IPv4 addresses, on the
+multicast interface of the system. The service is announced when
+advertised and withdrawn, with TTL 0, when closed. There is no probing for
+name conflicts, so instance names must be unique.
+*/
+package dnssd
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+)
+
+// A Service is what is advertised.
+type Service struct {
+	Instance string   // name of the instance, dots are replaced by dashes
+	Type     string   // service type, like _prometheus-http._tcp
+	Host     string   // host name, in .local
+	Port     int      // TCP port
+	Text     []string // TXT record, key=value pairs
+}
+
+// An Advertiser answers the queries of a service until it is closed.
+type Advertiser struct {
+	s    Service
+	conn *net.UDPConn
+
+	typ, instance, host, services dnsmessage.Name
+
+	mutex  sync.Mutex
+	closed bool
+}
+
+var group = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// TTLs of the host related records, A and SRV, and of the others, as RFC
+// 6762 recommends them.
+const (
+	hostTTL  = 120
+	otherTTL = 4500
+)
+
+// Advertise starts advertising s.
+func Advertise(s Service) (*Advertiser, error) {
+	if s.Instance == "" || s.Type == "" || s.Host == "" || s.Port == 0 {
+		return nil, errors.New("dnssd needs an instance, type, host and port")
+	}
+	instance := strings.ReplaceAll(s.Instance, ".", "-")
+	a := &Advertiser{s: s}
+	var err error
+	if a.typ, err = dnsmessage.NewName(s.Type + ".local."); err != nil {
+		return nil, err
+	}
+	if a.instance, err = dnsmessage.NewName(instance + "." + s.Type + ".local."); err != nil {
+		return nil, err
+	}
+	if a.host, err = dnsmessage.NewName(s.Host + ".local."); err != nil {
+		return nil, err
+	}
+	a.services = dnsmessage.MustNewName("_services._dns-sd._udp.local.")
+	if a.conn, err = net.ListenMulticastUDP("udp4", nil, group); err != nil {
+		return nil, err
+	}
+	// For browsers on this host too, which Go leaves out by default.
+	if err := ipv4.NewPacketConn(a.conn).SetMulticastLoopback(true); err != nil {
+		slog.Warn("Could not loop back mDNS answers to this host", "err", err)
+	}
+	go a.serve()
+	// Announced twice, a second apart, see RFC 6762 section 8.3.
+	go func() {
+		for i := 0; i < 2 && !a.isClosed(false); i++ {
+			if err := a.announce(otherTTL, hostTTL); err != nil {
+				slog.Warn("Could not announce service", "instance", s.Instance, "err", err)
+			}
+			time.Sleep(time.Second)
+		}
+	}()
+	return a, nil
+}
+
+// Close withdraws the service and stops answering.
+func (a *Advertiser) Close() error {
+	if a.isClosed(true) {
+		return nil
+	}
+	err := a.announce(0, 0)
+	if cerr := a.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// isClosed tells whether a was closed, and closes it if close is set.
+func (a *Advertiser) isClosed(close bool) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	closed := a.closed
+	a.closed = a.closed || close
+	return closed
+}
+
+// announce sends all records of the service, with TTL 0 to withdraw it.
+func (a *Advertiser) announce(ttl, addrTTL uint32) error {
+	msg, err := a.response(0, nil, true, true, true, ttl, addrTTL)
+	if err != nil {
+		return err
+	}
+	_, err = a.conn.WriteToUDP(msg, group)
+	return err
+}
+
+// serve answers queries until the connection is closed.
+func (a *Advertiser) serve() {
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := a.conn.ReadFromUDP(buf)
+		if err != nil {
+			if !a.isClosed(false) {
+				slog.Warn("Could not read mDNS query", "err", err)
+			}
+			return
+		}
+		if err := a.answer(buf[:n], from); err != nil {
+			slog.Debug("Could not answer mDNS query", "from", from, "err", err)
+		}
+	}
+}
+
+// answer answers query, if it asks for the service: by multicast, or to
+// from for legacy resolvers that do not query from port 5353.
+func (a *Advertiser) answer(query []byte, from *net.UDPAddr) error {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil || h.Response {
+		return err
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return err
+	}
+	var ptr, srv, addr bool
+	var asked []dnsmessage.Question
+	for _, q := range questions {
+		all := q.Type == dnsmessage.TypeALL
+		name := q.Name.String()
+		switch {
+		case strings.EqualFold(name, a.typ.String()) && (all || q.Type == dnsmessage.TypePTR):
+			ptr = true
+		case strings.EqualFold(name, a.services.String()) && (all || q.Type == dnsmessage.TypePTR):
+			ptr = true
+		case strings.EqualFold(name, a.instance.String()) && (all || q.Type == dnsmessage.TypeSRV || q.Type == dnsmessage.TypeTXT):
+			srv = true
+		case strings.EqualFold(name, a.host.String()) && (all || q.Type == dnsmessage.TypeA):
+			addr = true
+		default:
+			continue
+		}
+		asked = append(asked, dnsmessage.Question{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET})
+	}
+	if asked == nil {
+		return nil
+	}
+	legacy := from.Port != group.Port
+	id := uint16(0)
+	ttl, addrTTL := uint32(otherTTL), uint32(hostTTL)
+	if !legacy {
+		asked = nil
+	} else {
+		// RFC 6762 section 6.7.
+		id, ttl, addrTTL = h.ID, 10, 10
+	}
+	msg, err := a.response(id, asked, ptr, srv || ptr, addr || srv || ptr, ttl, addrTTL)
+	if err != nil {
+		return err
+	}
+	to := group
+	if legacy {
+		to = from
+	}
+	_, err = a.conn.WriteToUDP(msg, to)
+	return err
+}
+
+// response builds a response with the PTR, SRV and TXT, and A records of the
+// service, as far as asked for. asked are repeated for legacy resolvers.
+func (a *Advertiser) response(id uint16, asked []dnsmessage.Question, ptr, srv, addr bool, ttl, addrTTL uint32) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, Response: true, Authoritative: true})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	for _, q := range asked {
+		if err := b.Question(q); err != nil {
+			return nil, err
+		}
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	// Records only this host has get the cache flush bit, but not for
+	// legacy resolvers.
+	unique := dnsmessage.ClassINET | 1<<15
+	if asked != nil {
+		unique = dnsmessage.ClassINET
+	}
+	if ptr {
+		h := dnsmessage.ResourceHeader{Name: a.typ, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: ttl}
+		if err := b.PTRResource(h, dnsmessage.PTRResource{PTR: a.instance}); err != nil {
+			return nil, err
+		}
+		h.Name = a.services
+		if err := b.PTRResource(h, dnsmessage.PTRResource{PTR: a.typ}); err != nil {
+			return nil, err
+		}
+	}
+	if srv {
+		h := dnsmessage.ResourceHeader{Name: a.instance, Type: dnsmessage.TypeSRV, Class: unique, TTL: addrTTL}
+		if err := b.SRVResource(h, dnsmessage.SRVResource{Port: uint16(a.s.Port), Target: a.host}); err != nil {
+			return nil, err
+		}
+		txt := a.s.Text
+		if len(txt) == 0 {
+			txt = []string{""}
+		}
+		h = dnsmessage.ResourceHeader{Name: a.instance, Type: dnsmessage.TypeTXT, Class: unique, TTL: ttl}
+		if err := b.TXTResource(h, dnsmessage.TXTResource{TXT: txt}); err != nil {
+			return nil, err
+		}
+	}
+	if addr {
+		for _, ip := range addresses() {
+			h := dnsmessage.ResourceHeader{Name: a.host, Type: dnsmessage.TypeA, Class: unique, TTL: addrTTL}
+			if err := b.AResource(h, dnsmessage.AResource{A: ip}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return b.Finish()
+}
+
+// addresses returns the IPv4 addresses of the interfaces that are up, but
+// not of loopback ones.
+func addresses() (out [][4]byte) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	for _, i := range interfaces {
+		if i.Flags&net.FlagUp == 0 || i.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := i.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if n, ok := addr.(*net.IPNet); ok {
+				if ip := n.IP.To4(); ip != nil {
+					out = append(out, [4]byte(ip))
+				}
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,71 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package exporter
+
+import "time"
+
+// cached tells whether s keeps serving the samples of its last successful
+// scrape after a failed one at t, as they are younger than its Cache, and
+// drops them once they are older. Without Cache it does nothing. The caller
+// holds s.Mutex.
+func (s *Scraper) cached(t time.Time) bool {
+	if s.Cache <= 0 {
+		return false
+	}
+	if len(s.Samples) > 0 && t.Sub(s.Time) <= s.Cache {
+		s.stale = true
+		return true
+	}
+	s.Samples, s.stale = nil, false
+	return false
+}
+
+// unserved returns the time of the samples of the sensors selected by only
+// in CacheMode once that were not served yet. Taken before gathering, a
+// scrape that ends meanwhile is served again at the next request rather
+// than not at all.
+func (e *Exporter) unserved(only filter) map[*Scraper]time.Time {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	var times map[*Scraper]time.Time
+	for _, s := range e.scrapers {
+		if s.CacheMode != "once" || !only.match(s) {
+			continue
+		}
+		s.Mutex.RLock()
+		if s.served.Before(s.Time) {
+			if times == nil {
+				times = make(map[*Scraper]time.Time)
+			}
+			times[s] = s.Time
+		}
+		s.Mutex.RUnlock()
+	}
+	return times
+}
+
+// markServed marks the samples of times as served, once they are written.
+func markServed(times map[*Scraper]time.Time) {
+	for s, t := range times {
+		s.Mutex.Lock()
+		if s.served.Before(t) {
+			s.served = t
+		}
+		s.Mutex.Unlock()
+	}
+}
@@ -0,0 +1,108 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package exporter
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+// ErrIncident is the error of a check whose sensor logged an error, e.g. for
+// one of several devices, even if it returned samples.
+var ErrIncident = errors.New("the sensor logged errors")
+
+// Check creates the sensor of c, scrapes it once and closes it again, to try
+// a configuration without serving it. The samples are returned as they would
+// be served, but also while the sensor warms up, muted or not, with the error
+// of creating or scraping the sensor, ErrNoSamples if it returned none or
+// ErrIncident. The sensor is not added.
+func (e *Exporter) Check(c SensorConfig) ([]sensor.Sample, error) {
+	p, err := e.Probe(c)
+	if err != nil {
+		return nil, err
+	}
+	defer p.Close()
+	return p.Scrape()
+}
+
+// A Probe is a sensor created to be scraped on request, outside of the
+// scrapes of the exporter, e.g. to check it or to put a device through its
+// paces. It is never scraped concurrently; close it when done.
+type Probe struct {
+	scraper *Scraper
+	e       *Exporter
+}
+
+// Probe creates the sensor of c, without adding it or scraping it.
+func (e *Exporter) Probe(c SensorConfig) (*Probe, error) {
+	collector, c, err := e.create(c)
+	if err != nil {
+		return nil, err
+	}
+	scraper, _, err := e.newScraper(c.Type, collector, c)
+	if err != nil {
+		if closer, ok := collector.(io.Closer); ok {
+			closer.Close()
+		}
+		return nil, err
+	}
+	return &Probe{scraper: scraper, e: e}, nil
+}
+
+// Scrape scrapes the sensor once and returns its samples like Check.
+func (p *Probe) Scrape() ([]sensor.Sample, error) {
+	samples, _, err := p.scrape()
+	return samples, err
+}
+
+// ScrapeTrace is Scrape, also returning the stages of the scrape, whether or
+// not the exporter traces its scrapes, nil if it timed out.
+func (p *Probe) ScrapeTrace() ([]sensor.Sample, *sensor.Trace, error) {
+	p.scraper.traced = true
+	return p.scrape()
+}
+
+func (p *Probe) scrape() ([]sensor.Sample, *sensor.Trace, error) {
+	incidents := sensor.GetIncident()
+	samples, trace, err := p.e.scrape(p.scraper)
+	switch {
+	case err != nil:
+		return nil, trace, errors.New("Could not scrape: " + err.Error())
+	case len(samples) == 0:
+		return nil, trace, sensor.ErrNoSamples
+	}
+	samples = p.scraper.pipeline(samples)
+	if sensor.GetIncident() != incidents {
+		return samples, trace, ErrIncident
+	}
+	return samples, trace, nil
+}
+
+// Close stops the sensor and closes it if its collector is an io.Closer,
+// logging why it could not.
+func (p *Probe) Close() {
+	close(p.scraper.stop)
+	if closer, ok := p.scraper.Collector.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			slog.Warn("Could not close sensor", "collector", p.scraper.Type, "err", err)
+		}
+	}
+}
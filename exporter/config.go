@@ -0,0 +1,473 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package exporter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/fmoessbauer/sensor_exporter/actuator"
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+	"github.com/fmoessbauer/sensor_exporter/supervisor"
+	"github.com/fmoessbauer/sensor_exporter/tlsconfig"
+	"gopkg.in/yaml.v3"
+)
+
+// SensorConfig is a sensor as given on the command line, sensor_name,
+// interval,opts, or in a configuration file, with extra labels for all its
+// samples.
+type SensorConfig struct {
+	Type     string            `yaml:"type" toml:"type"`
+	Interval time.Duration     `yaml:"interval" toml:"interval"`
+	Options  string            `yaml:"options" toml:"options"`
+	Labels   map[string]string `yaml:"labels" toml:"labels"`
+	// TLS is passed to the sensor as its tls.* options.
+	TLS *tlsconfig.Config `yaml:"tls" toml:"tls"`
+	// Tenant puts the sensor in a tenant, see Scraper.Tenant.
+	Tenant string `yaml:"tenant" toml:"tenant"`
+	// Timeout is the deadline of a scrape of the sensor, by default its
+	// interval but at least Config.ScrapeTimeout.
+	Timeout time.Duration `yaml:"timeout" toml:"timeout"`
+	// LeaderOnly sensors are scraped by the leader of exporters sharing a
+	// lease only, see Config.Lease.
+	LeaderOnly bool `yaml:"leader_only" toml:"leader_only"`
+	// Mute are the windows the sensor is muted in, see Scraper.Mute.
+	Mute []MuteWindow `yaml:"mute" toml:"mute"`
+	// Schedule are the times of day of other intervals, see
+	// Scraper.Schedule.
+	Schedule []IntervalWindow `yaml:"schedule" toml:"schedule"`
+	// WarmUp and WarmUpScrapes override those of the collector entry, see
+	// Scraper.WarmUp.
+	WarmUp        time.Duration `yaml:"warmup" toml:"warmup"`
+	WarmUpScrapes int           `yaml:"warmup_scrapes" toml:"warmup_scrapes"`
+	// Filters reject implausible values, see OutlierFilter.
+	Filters []OutlierFilter `yaml:"filters" toml:"filters"`
+	// Relabel renames and drops the metrics of the sensor before they are
+	// served, see Scraper.Relabel.
+	Relabel *sensor.Relabel `yaml:"relabel" toml:"relabel"`
+	// Cache is how long the last samples are served after failed scrapes,
+	// see Scraper.Cache.
+	Cache time.Duration `yaml:"cache" toml:"cache"`
+	// CacheMode is repeat or once, see Scraper.CacheMode.
+	CacheMode string `yaml:"cache_mode" toml:"cache_mode"`
+	// Mappings map the readings that are strings to values before those of
+	// the collector entry, see sensor.Mapping.
+	Mappings []sensor.Mapping `yaml:"mappings" toml:"mappings"`
+	// Redact hides location-revealing metrics from those served, see
+	// Scraper.Redact.
+	Redact []sensor.Redaction `yaml:"redact" toml:"redact"`
+}
+
+// ParseSensor parses a sensor as given on the command line,
+// sensor_name,interval,opts. Static labels may follow the name,
+// sensor_name{site="dc1",rack="r12"},interval,opts.
+func ParseSensor(arg string) (SensorConfig, error) {
+	var labels sensor.Labels
+	if i := strings.IndexAny(arg, "{,"); i >= 0 && arg[i] == '{' {
+		l, rest, err := sensor.ParseLabels(arg[i:])
+		if err != nil {
+			return SensorConfig{}, errors.New("Could not parse labels: " + err.Error())
+		}
+		if rest != "" && rest[0] != ',' {
+			return SensorConfig{}, errors.New("Expected a comma after the labels, got: " + rest)
+		}
+		arg, labels = arg[:i]+rest, l
+	}
+	conf := strings.SplitN(arg, ",", 3)
+	c := SensorConfig{Type: conf[0], Labels: labels}
+	if len(conf) == 3 {
+		c.Options = conf[2]
+	}
+	if len(conf) >= 2 {
+		interval, err := time.ParseDuration(conf[1])
+		if err != nil {
+			slog.Warn("Could not understand scrape interval, using default", "interval", conf[1])
+		}
+		c.Interval = interval
+	}
+	return c, nil
+}
+
+func (c SensorConfig) key() string {
+	return fmt.Sprintf("%s,%s,%s%s,%s,%s,%t,%v,%v,%s,%d,%v,%s,%s,%s,%v,%v", c.Type, c.Interval, c.options(), sensor.LabelString(c.Labels), c.Tenant, c.Timeout, c.LeaderOnly, c.Mute, c.Schedule, c.WarmUp, c.WarmUpScrapes, c.Filters, c.Relabel.String(), c.Cache, c.CacheMode, c.Mappings, c.Redact)
+}
+
+// options returns the options of the sensor, with those of the TLS block.
+func (c SensorConfig) options() string {
+	if c.TLS == nil {
+		return c.Options
+	}
+	if c.Options == "" {
+		return c.TLS.Options()
+	}
+	return c.Options + "," + c.TLS.Options()
+}
+
+// A FileConfig is the content of a configuration file. In YAML:
+//
+//	sensors:
+//	  - type: upsc
+//	    interval: 30s
+//	    options: UPS@HOST
+//	    labels:
+//	      site: basement
+//	    tls:
+//	      ca_file: /etc/ssl/nut-ca.pem
+//
+// or in TOML, if the file name ends with .toml:
+//
+//	[[sensors]]
+//	type = "upsc"
+//	interval = "30s"
+//	options = "UPS@HOST"
+//	labels = { site = "basement" }
+//	tls = { ca_file = "/etc/ssl/nut-ca.pem" }
+//
+// The tls block is for sensors that take the options of package tlsconfig.
+//
+// A fleet of similar sites can share a base file: a file includes others,
+// and ${NAME} anywhere in a file is replaced, as text, by its variable NAME,
+// or the host name for ${host}; $$ is a $. The variables of a file are
+// those of its vars, those of the files including it taking precedence, and
+// then those of its hosts entry of the host it is loaded on:
+//
+//	include: [base.yml]
+//	vars:
+//	  site: garden
+//	  ups: ups@nas
+//	hosts:
+//	  pi-shed:
+//	    ups: ups@shed
+type FileConfig struct {
+	// Include are more files, glob patterns relative to the directory of
+	// this one, whose sensors, actions, recovery targets and helpers come
+	// before those of this one.
+	Include []string `yaml:"include" toml:"include"`
+	// Vars are the variables of this file and of those it includes.
+	Vars map[string]string `yaml:"vars" toml:"vars"`
+	// Hosts override Vars on the host of that name.
+	Hosts map[string]map[string]string `yaml:"hosts" toml:"hosts"`
+
+	Sensors []SensorConfig `yaml:"sensors" toml:"sensors"`
+	// Actions are run on Alertmanager webhooks, see the actuator package.
+	Actions []actuator.Action `yaml:"actions" toml:"actions"`
+	// Recovery are the hosts that can be woken or power cycled on request,
+	// see actuator.Target.
+	Recovery []actuator.Target `yaml:"recovery" toml:"recovery"`
+	// Helpers are processes run next to the exporter, see the supervisor
+	// package.
+	Helpers []supervisor.Helper `yaml:"helpers" toml:"helpers"`
+}
+
+// LoadConfig reads a configuration file and those it includes, for this
+// host. Unknown keys are an error, to catch typos.
+func LoadConfig(path string) (*FileConfig, error) {
+	host, _ := os.Hostname()
+	return LoadConfigFor(path, host)
+}
+
+// LoadConfigFor is LoadConfig on the host named host, e.g. to check the
+// configuration of another host of a fleet.
+func LoadConfigFor(path, host string) (*FileConfig, error) {
+	l := configLoader{host: host}
+	c, err := l.load(path, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	for i, s := range c.Sensors {
+		if s.Type == "" {
+			return nil, fmt.Errorf("sensor %d has no type", i+1)
+		}
+		if err := s.check(); err != nil {
+			return nil, fmt.Errorf("sensor %d, %w", i+1, err)
+		}
+	}
+	if err := actuator.Check(c.Actions); err != nil {
+		return nil, err
+	}
+	if err := actuator.CheckTargets(c.Recovery); err != nil {
+		return nil, err
+	}
+	if err := supervisor.Check(c.Helpers); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// A configLoader loads a configuration file and those it includes.
+type configLoader struct {
+	host    string
+	loading []string // the files being loaded, to catch include cycles
+}
+
+// load loads the file path with the variables vars and hostVars of the files
+// including it, which take precedence over its vars and hosts entry.
+func (l *configLoader) load(path string, vars, hostVars map[string]string) (*FileConfig, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if slices.Contains(l.loading, abs) {
+		return nil, errors.New("include cycle at " + path)
+	}
+	l.loading = append(l.loading, abs)
+	defer func() { l.loading = l.loading[:len(l.loading)-1] }()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	isTOML := strings.ToLower(filepath.Ext(path)) == ".toml"
+	// The variables are read first, with the references blanked, which
+	// may not parse where they stand, e.g. in a YAML flow mapping.
+	var head configHead
+	if err := decodeConfig(placeholder.ReplaceAll(data, []byte("x")), isTOML, &head, false); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	vars = merge(head.Vars, vars)
+	hostVars = merge(head.Hosts[l.host], hostVars)
+	text, err := expand(data, merge(merge(map[string]string{"host": l.host}, vars), hostVars))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	c := &FileConfig{}
+	if err := decodeConfig(text, isTOML, c, true); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	all := &FileConfig{Include: c.Include, Vars: vars, Hosts: c.Hosts}
+	for _, pattern := range c.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: bad include %s: %w", path, pattern, err)
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("%s: include %s matches no file", path, pattern)
+		}
+		for _, file := range files {
+			included, err := l.load(file, vars, hostVars)
+			if err != nil {
+				return nil, err
+			}
+			all.add(included)
+		}
+	}
+	all.add(c)
+	return all, nil
+}
+
+// add appends the sensors, actions, recovery targets and helpers of o.
+func (c *FileConfig) add(o *FileConfig) {
+	c.Sensors = append(c.Sensors, o.Sensors...)
+	c.Actions = append(c.Actions, o.Actions...)
+	c.Recovery = append(c.Recovery, o.Recovery...)
+	c.Helpers = append(c.Helpers, o.Helpers...)
+}
+
+// configHead is the part of a FileConfig read before its variables are
+// expanded.
+type configHead struct {
+	Include []string                     `yaml:"include" toml:"include"`
+	Vars    map[string]string            `yaml:"vars" toml:"vars"`
+	Hosts   map[string]map[string]string `yaml:"hosts" toml:"hosts"`
+}
+
+// decodeConfig decodes a configuration file in TOML or YAML into c, if strict
+// rejecting unknown keys.
+func decodeConfig(data []byte, isTOML bool, c interface{}, strict bool) error {
+	if isTOML {
+		md, err := toml.Decode(string(data), c)
+		if err != nil {
+			return err
+		}
+		if undecoded := md.Undecoded(); strict && len(undecoded) > 0 {
+			return errors.New("unknown key " + undecoded[0].String())
+		}
+		return nil
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(strict)
+	if err := dec.Decode(c); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// placeholder matches $$ and the variable references ${NAME}.
+var placeholder = regexp.MustCompile(`\$\$|\$\{[^}]*\}`)
+
+// expand replaces the variable references of data by their values in vars.
+func expand(data []byte, vars map[string]string) ([]byte, error) {
+	var err error
+	out := placeholder.ReplaceAllFunc(data, func(ref []byte) []byte {
+		if string(ref) == "$$" {
+			return []byte("$")
+		}
+		name := string(ref[2 : len(ref)-1])
+		value, ok := vars[name]
+		if !ok && err == nil {
+			err = errors.New("undefined variable " + string(ref))
+		}
+		return []byte(value)
+	})
+	return out, err
+}
+
+// merge returns a copy of vars with those of over, which take precedence.
+func merge(vars, over map[string]string) map[string]string {
+	out := make(map[string]string, len(vars)+len(over))
+	for name, value := range vars {
+		out[name] = value
+	}
+	for name, value := range over {
+		out[name] = value
+	}
+	return out
+}
+
+// ParseSensorKeys reads the sensors of a key-value store, one per key, in the
+// YAML (or JSON) of an entry of sensors in the configuration file:
+//
+//	type: upsc
+//	interval: 30s
+//	options: UPS@HOST
+//
+// Keys with empty values, like the folders of Consul, are skipped. The
+// sensors are in the order of their keys.
+func ParseSensorKeys(values map[string][]byte) ([]SensorConfig, error) {
+	keys := make([]string, 0, len(values))
+	for k, v := range values {
+		if len(bytes.TrimSpace(v)) > 0 {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	sensors := make([]SensorConfig, 0, len(keys))
+	for _, k := range keys {
+		var s SensorConfig
+		dec := yaml.NewDecoder(bytes.NewReader(values[k]))
+		dec.KnownFields(true)
+		if err := dec.Decode(&s); err != nil {
+			return nil, fmt.Errorf("key %s: %w", k, err)
+		}
+		if s.Type == "" {
+			return nil, fmt.Errorf("key %s has no type", k)
+		}
+		if err := s.check(); err != nil {
+			return nil, fmt.Errorf("key %s, %w", k, err)
+		}
+		sensors = append(sensors, s)
+	}
+	return sensors, nil
+}
+
+// check checks the mute windows, schedule, filters, relabeling, mappings and
+// redactions of c.
+func (c SensorConfig) check() error {
+	for _, w := range c.Mute {
+		if err := w.check(); err != nil {
+			return fmt.Errorf("bad mute window: %w", err)
+		}
+	}
+	for _, w := range c.Schedule {
+		if err := w.check(); err != nil {
+			return fmt.Errorf("bad schedule: %w", err)
+		}
+	}
+	for _, f := range c.Filters {
+		if err := f.check(); err != nil {
+			return fmt.Errorf("bad filter: %w", err)
+		}
+	}
+	if c.Relabel != nil {
+		if err := c.Relabel.Compile(); err != nil {
+			return fmt.Errorf("bad relabel: %w", err)
+		}
+	}
+	for i := range c.Mappings {
+		if err := c.Mappings[i].Compile(); err != nil {
+			return err
+		}
+	}
+	for i := range c.Redact {
+		if err := c.Redact[i].Compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply makes the sensors of earlier calls of Apply those of sensors: the
+// ones no longer listed are removed and new ones are added, while unchanged
+// ones keep running. Sensors added otherwise are left alone. A sensor that
+// cannot be added does not keep the others from being applied; the errors
+// are returned together. Of a sharded exporter only the sensors of its
+// shard are applied.
+func (e *Exporter) Apply(sensors []SensorConfig) error {
+	e.applyMutex.Lock()
+	defer e.applyMutex.Unlock()
+	if e.shard.Count > 1 {
+		var owned []SensorConfig
+		for _, c := range sensors {
+			if e.shard.owns(c) {
+				owned = append(owned, c)
+			}
+		}
+		slog.Info("Shard scrapes some of the sensors", "shard", e.shard.String(), "sensors", len(owned), "of", len(sensors))
+		sensors = owned
+	}
+	wanted := make(map[string]bool, len(sensors))
+	for _, c := range sensors {
+		wanted[c.key()] = true
+	}
+	for key, s := range e.applied {
+		if !wanted[key] {
+			e.Remove(s)
+			delete(e.applied, key)
+		}
+	}
+	var errs []error
+	for _, c := range sensors {
+		key := c.key()
+		if _, exists := e.applied[key]; exists {
+			continue
+		}
+		s, err := e.AddSensor(c)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s,%s,%s: %w", c.Type, c.Interval, SanitizeOptions(c.options()), err))
+			continue
+		}
+		e.applied[key] = s
+	}
+	return errors.Join(errs...)
+}
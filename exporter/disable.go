@@ -0,0 +1,136 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package exporter
+
+import (
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var defaultDisableWindow = 20
+var defaultDisableFor = time.Hour
+
+var (
+	disabledDesc = prometheus.NewDesc("sensor_exporter_disabled",
+		"Whether a sensor is disabled, not scraped, as too many of its scrapes failed.", selfLabels, nil)
+	failureRatioDesc = prometheus.NewDesc("sensor_exporter_failure_ratio",
+		"Fraction of the last scrapes of a sensor that failed, in the window that disables it.", selfLabels, nil)
+)
+
+// A failureWindow is the outcome of the last scrapes of a sensor.
+type failureWindow struct {
+	failed   []bool // ring of the outcomes
+	next     int    // index of the next outcome in failed
+	n        int    // outcomes in failed
+	failures int    // failed outcomes in failed
+}
+
+// add adds an outcome, dropping the oldest one if the window is full.
+func (w *failureWindow) add(size int, failed bool) {
+	if len(w.failed) != size {
+		*w = failureWindow{failed: make([]bool, size)}
+	}
+	if w.n == size {
+		if w.failed[w.next] {
+			w.failures--
+		}
+	} else {
+		w.n++
+	}
+	w.failed[w.next] = failed
+	if failed {
+		w.failures++
+	}
+	w.next = (w.next + 1) % size
+}
+
+// ratio is the fraction of failed outcomes, 0 without any.
+func (w *failureWindow) ratio() float64 {
+	if w.n == 0 {
+		return 0
+	}
+	return float64(w.failures) / float64(w.n)
+}
+
+// judge counts the scrape of s started at t towards its failure window, and
+// disables s for e.disableFor if too many scrapes of a full window failed.
+// Without Config.DisableRatio it does nothing.
+func (e *Exporter) judge(s *Scraper, t time.Time) {
+	if e.disableRatio <= 0 {
+		return
+	}
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	if !s.last.Equal(t) {
+		return // not recorded, e.g. skipped
+	}
+	s.failures.add(e.disableWindow, !s.Up)
+	if s.failures.n < e.disableWindow || s.failures.ratio() < e.disableRatio {
+		return
+	}
+	sensor.Incident()
+	s.disabledUntil = t.Add(e.disableFor)
+	slog.Warn("Disabling sensor, too many scrapes failed", "collector", s.Type, "id", s.ID,
+		"failure_ratio", s.failures.ratio(), "scrapes", s.failures.n, "last_error", s.LastError, "until", s.disabledUntil)
+	// It starts over when tried again, and has nothing to serve meanwhile.
+	s.failures = failureWindow{}
+	s.Samples = nil
+}
+
+// disabled tells whether s is disabled at t, logging when it is tried again.
+func (s *Scraper) disabled(t time.Time) bool {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	if s.disabledUntil.IsZero() {
+		return false
+	}
+	if t.Before(s.disabledUntil) {
+		return true
+	}
+	s.disabledUntil = time.Time{}
+	slog.Info("Scraping disabled sensor again", "collector", s.Type, "id", s.ID)
+	return false
+}
+
+// collectDisabled sends whether the sensors selected by only are disabled,
+// and their failure ratios, if sensors are disabled at all. The caller holds
+// e.mutex.
+func (e *Exporter) collectDisabled(ch chan<- prometheus.Metric, only filter) {
+	if e.disableRatio <= 0 {
+		return
+	}
+	now := time.Now()
+	for _, s := range e.scrapers {
+		if !only.match(s) {
+			continue
+		}
+		s.Mutex.RLock()
+		disabled, ratio := 0.0, s.failures.ratio()
+		if now.Before(s.disabledUntil) {
+			disabled = 1
+		}
+		s.Mutex.RUnlock()
+		id := strconv.Itoa(s.ID)
+		ch <- prometheus.MustNewConstMetric(disabledDesc, prometheus.GaugeValue, disabled, s.Type, id)
+		ch <- prometheus.MustNewConstMetric(failureRatioDesc, prometheus.GaugeValue, ratio, s.Type, id)
+	}
+}
@@ -0,0 +1,138 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package exporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// metricDoc documents a metric family served by Handler.
+type metricDoc struct {
+	Name       string     `json:"name"`
+	Help       string     `json:"help,omitempty"`
+	Type       string     `json:"type"`
+	Unit       string     `json:"unit,omitempty"`
+	Collectors []string   `json:"collectors,omitempty"`
+	Series     int        `json:"series"`
+	LabelSets  [][]string `json:"label_sets"`
+}
+
+// MetricsDocsHandler documents the metric families served by Handler now,
+// from the registry: their HELP, TYPE and UNIT, the collectors that declare
+// or write them, "exporter" for the sensor_exporter_ self-metrics, and the sets of label names
+// their series have. It serves JSON, or a Markdown table with
+// format=markdown, so that what a deployment exports can be audited.
+func (e *Exporter) MetricsDocsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		docs := e.metricsDocs()
+		if r.FormValue("format") == "markdown" {
+			w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+			writeMetricsDocs(w, docs)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(docs)
+	})
+}
+
+// metricsDocs documents the families gathered from the registry, by name.
+func (e *Exporter) metricsDocs() []metricDoc {
+	families, err := e.registry.Gather()
+	if err != nil {
+		slog.Warn("Error gathering metrics", "err", err)
+	}
+	// The collectors of the families the sensors write without declaring
+	// them, like the variables of upsc.
+	writers := make(map[string]map[string]bool)
+	for _, s := range e.Scrapers() {
+		s.Mutex.RLock()
+		for _, sample := range s.Samples {
+			if writers[sample.Name] == nil {
+				writers[sample.Name] = make(map[string]bool)
+			}
+			writers[sample.Name][s.Type] = true
+		}
+		s.Mutex.RUnlock()
+	}
+
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	docs := make([]metricDoc, 0, len(families))
+	for _, mf := range families {
+		name := mf.GetName()
+		doc := metricDoc{Name: name, Help: mf.GetHelp(), Unit: e.metadata.unit[name],
+			Type: strings.ToLower(mf.GetType().String()), Series: len(mf.GetMetric())}
+		collectors := make(map[string]bool)
+		for c := range e.metadata.collectors[name] {
+			collectors[c] = true
+		}
+		for c := range writers[name] {
+			collectors[c] = true
+		}
+		if len(collectors) == 0 && strings.HasPrefix(name, "sensor_exporter_") {
+			collectors["exporter"] = true
+		}
+		for c := range collectors {
+			doc.Collectors = append(doc.Collectors, c)
+		}
+		sort.Strings(doc.Collectors)
+		sets := make(map[string][]string)
+		for _, m := range mf.GetMetric() {
+			var names []string
+			for _, l := range m.GetLabel() {
+				names = append(names, l.GetName())
+			}
+			sort.Strings(names)
+			sets[strings.Join(names, ",")] = names
+		}
+		keys := make([]string, 0, len(sets))
+		for k := range sets {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		doc.LabelSets = make([][]string, 0, len(keys))
+		for _, k := range keys {
+			doc.LabelSets = append(doc.LabelSets, append([]string{}, sets[k]...))
+		}
+		docs = append(docs, doc)
+	}
+	return docs
+}
+
+// writeMetricsDocs writes docs as a Markdown table.
+func writeMetricsDocs(w io.Writer, docs []metricDoc) {
+	cell := strings.NewReplacer("|", `\|`, "\n", " ")
+	fmt.Fprintln(w, "| Metric | Type | Unit | Collectors | Labels | Series | Help |")
+	fmt.Fprintln(w, "|---|---|---|---|---|---|---|")
+	for _, d := range docs {
+		sets := make([]string, len(d.LabelSets))
+		for i, names := range d.LabelSets {
+			sets[i] = "{" + strings.Join(names, ", ") + "}"
+		}
+		fmt.Fprintf(w, "| `%s` | %s | %s | %s | %s | %d | %s |\n", d.Name, d.Type, d.Unit,
+			strings.Join(d.Collectors, ", "), strings.Join(sets, " "), d.Series, cell.Replace(d.Help))
+	}
+}
@@ -0,0 +1,985 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package exporter is the core of sensor_exporter as a library, for programs
+that want to embed a set of sensors, their own ones included, and serve them
+to Prometheus:
+
+	e := exporter.New(exporter.Config{})
+	e.Register(sensor_hddtemp.Collector, sensor.CollectorEntry{
+		Name: "mysensor",
+		New:  newMySensor,
+		Type: []string{"# TYPE my_metric gauge"},
+		Help: []string{"# HELP my_metric What it measures."}})
+	if _, err := e.Add("mysensor,10s,some-opts"); err != nil {
+		log.Fatal(err)
+	}
+	e.Start()
+	http.Handle("/metrics", e.Handler())
+
+Collector instances made by the program can be added directly with
+AddCollector.
+*/
+package exporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/output"
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/proto"
+)
+
+// A Scraper scrapes one collector at its interval and keeps its last value.
+type Scraper struct {
+	ID        int
+	Collector sensor.Collector
+	Interval  time.Duration
+	Type      string
+	Samples   []sensor.Sample
+	Time      time.Time // of the last scrape
+	Mutex     *sync.RWMutex
+	// Duration is how long the last scrape took. Status tells whether it
+	// succeeded, how many scrapes failed or returned no samples and why.
+	Duration time.Duration
+	sensor.Status
+	// Labels are added to the samples, unless the collector sets them.
+	Labels sensor.Labels
+	// Tenant, if set, is the tenant label of all samples, whatever the
+	// collector and Labels set, and selects the sensor at TenantHandler.
+	Tenant string
+	// Timeout is the deadline of a scrape, see SensorConfig.Timeout.
+	Timeout time.Duration
+	// LeaderOnly sensors are only scraped while the exporter leads, see
+	// Config.Lease.
+	LeaderOnly bool
+	// Mute are the windows the sensor is not scraped in, and its samples
+	// are not served; see also MuteUntil.
+	Mute []MuteWindow
+	// Schedule are the times of day the sensor is scraped at another
+	// interval than Interval.
+	Schedule []IntervalWindow
+	// The samples of the first WarmUpScrapes scrapes and of those within
+	// WarmUp of the first one are discarded, when the sensor is added and
+	// after a failed scrape, see sensor.CollectorEntry.
+	WarmUp        time.Duration
+	WarmUpScrapes int
+	// Filters reject the implausible values of its metrics.
+	Filters []OutlierFilter
+	// Relabel renames and drops the metrics of the samples last, after the
+	// filters, which go by the names of the collector.
+	Relabel *sensor.Relabel
+	// Cache, if set, is how long the samples of the last successful scrape
+	// are still served after scrapes that failed or returned no samples,
+	// instead of none, so that alerts on absent metrics do not fire for a
+	// blip. Without it the samples are dropped after a scrape without
+	// samples, and kept after a failed scrape.
+	Cache time.Duration
+	// Redact hides what the samples reveal of where the sensor is when
+	// they are served, on the Handler and by the gRPC API; the outputs, the
+	// CSV files and the samples kept get them as they are.
+	Redact []sensor.Redaction
+	// CacheMode once, with Cache, serves the samples of a scrape on the
+	// Handler once, with the time of the scrape, and leaves them out until
+	// the next scrape; Prometheus honoring the timestamps then marks the
+	// series stale on its own instead of storing the same values again.
+	// Samples not served within Cache are dropped. The default, repeat,
+	// serves them at every request.
+	CacheMode string
+
+	// The stages of the last and the slowest scrape, if tracing.
+	LastTrace, SlowestTrace *sensor.Trace
+
+	stop    chan struct{}
+	last    time.Time     // start of the last scrape, failed or not
+	running chan struct{} // closed when the running scrape ends, if any
+	pending chan struct{} // closed when a timed out collector returns, if any
+	calling sync.Mutex    // held while the collector is called, see RawHandler
+	traced  bool          // trace every scrape, see Probe.ScrapeTrace
+
+	listening bool // a sensor.Streamer is started, see stream
+	restarts  int  // of a sensor.Streamer
+
+	mutedUntil time.Time // see MuteUntil
+
+	stale  bool      // serving the samples of an earlier scrape, see Cache
+	served time.Time // of the scrape last served, see CacheMode
+
+	failures      failureWindow // of the last scrapes, see judge
+	disabledUntil time.Time     // see judge
+
+	warm        bool      // done warming up
+	warmStart   time.Time // of the first scrape of the warm-up
+	warmScrapes int       // successful scrapes since the warm-up started
+
+	histories map[string]*history // of the filtered series, see filter
+	rejected  map[string]uint64   // samples rejected by Filters, by metric
+
+	mappings []sensor.Mapping // of the sensor, then of the collector entry
+
+	ranges      map[string]sensor.Range // declared by the collector entry
+	implausible map[string]uint64       // samples out of range, by metric
+
+	states  map[string]string       // declared by the collector entry
+	current map[string]string       // state of each series, see track
+	changes map[string]*stateChange // by series, from and to
+}
+
+// Config configures an Exporter.
+type Config struct {
+	// DefaultInterval is used for collectors that do not suggest one.
+	DefaultInterval time.Duration
+	// Sinks receive the readings of every scrape besides the Handler. The
+	// metrics of those that are prometheus.Collectors, like outputs with a
+	// WAL, are served too.
+	Sinks []output.Sink
+	// Trace records the stages of every scrape for TraceHandler.
+	Trace bool
+	// OnDemand scrapes the sensors when the Handler is requested instead of
+	// at their intervals, which then are the least time between two scrapes
+	// of a sensor. A sensor that takes longer than ScrapeTimeout (10s by
+	// default) is served with its previous samples. ScrapeTimeout is also
+	// the least deadline of a scrape, see SensorConfig.Timeout.
+	OnDemand      bool
+	ScrapeTimeout time.Duration
+	// SecretKey decrypts the ENC[...] values in sensor options, see
+	// Encrypt.
+	SecretKey []byte
+	// Shard limits the sensors of Apply to a part of them.
+	Shard Shard
+	// Lease, if set, makes the exporter scrape the LeaderOnly sensors only
+	// while it holds the lease for LeaseID, renewed for LeaseDuration (15s
+	// by default). The standby serves their last samples.
+	Lease         Lease
+	LeaseID       string
+	LeaseDuration time.Duration
+	// MaxGoroutines, if set, is the number of goroutines of the program
+	// beyond which scrapes are skipped, so that hung collectors do not pile
+	// up more of them.
+	MaxGoroutines int
+	// DisableRatio, if set, disables a sensor for DisableFor (1h by
+	// default) when at least this fraction of its last DisableWindow (20 by
+	// default) scrapes failed, so that a broken sensor does not take up its
+	// scrape slot and fill the log forever. It is tried again after that.
+	DisableRatio  float64
+	DisableWindow int
+	DisableFor    time.Duration
+}
+
+// An Exporter scrapes a set of collectors and serves their values. It is a
+// prometheus.Collector of the last values, so it can also be registered to a
+// registry of the program.
+type Exporter struct {
+	defaultInterval time.Duration
+	sinks           []output.Sink
+	trace           bool
+	onDemand        bool
+	scrapeTimeout   time.Duration
+	secretKey       []byte
+	shard           Shard
+	lease           Lease
+	leaseID         string
+	leaseDuration   time.Duration
+	leader          atomic.Bool
+	leaseChecked    atomic.Bool
+	maxGoroutines   int
+	skipped         atomic.Uint64 // scrapes, see overloaded
+	disableRatio    float64
+	disableWindow   int
+	disableFor      time.Duration
+	readings        *grpcServer
+	registry        *prometheus.Registry
+	stopGRPC        func() // of the server of ServeGRPCTLS, if serving
+	scraping        sync.WaitGroup
+
+	mutex      sync.RWMutex
+	collectors map[string]sensor.CollectorEntry
+	scrapers   []*Scraper
+	nextID     int
+	metadata   *metadata
+	started    bool
+
+	applyMutex sync.Mutex
+	applied    map[string]*Scraper // by SensorConfig.key
+}
+
+var defaultInterval = time.Duration(4800) * time.Millisecond
+var defaultScrapeTimeout = 10 * time.Second
+var scrapeGrace = time.Second
+var defaultLeaseDuration = 15 * time.Second
+
+// New returns an Exporter without collectors, see Register.
+func New(c Config) *Exporter {
+	e := &Exporter{
+		defaultInterval: c.DefaultInterval,
+		sinks:           c.Sinks,
+		trace:           c.Trace,
+		onDemand:        c.OnDemand,
+		scrapeTimeout:   c.ScrapeTimeout,
+		secretKey:       c.SecretKey,
+		shard:           c.Shard,
+		lease:           c.Lease,
+		leaseID:         c.LeaseID,
+		leaseDuration:   c.LeaseDuration,
+		maxGoroutines:   c.MaxGoroutines,
+		disableRatio:    c.DisableRatio,
+		disableWindow:   c.DisableWindow,
+		disableFor:      c.DisableFor,
+		collectors:      make(map[string]sensor.CollectorEntry),
+		metadata:        newMetadata(),
+		applied:         make(map[string]*Scraper),
+	}
+	if e.defaultInterval == 0 {
+		e.defaultInterval = defaultInterval
+	}
+	if e.scrapeTimeout == 0 {
+		e.scrapeTimeout = defaultScrapeTimeout
+	}
+	if e.leaseDuration == 0 {
+		e.leaseDuration = defaultLeaseDuration
+	}
+	if e.disableWindow <= 0 {
+		e.disableWindow = defaultDisableWindow
+	}
+	if e.disableFor == 0 {
+		e.disableFor = defaultDisableFor
+	}
+	if e.lease != nil {
+		e.campaign()
+	}
+	e.readings = newGRPCServer(e)
+	e.metadata.add("exporter", selfUnits)
+	e.metadata.add("exporter", runtimeUnits)
+	e.registry = prometheus.NewRegistry()
+	e.registry.MustRegister(e)
+	for _, sink := range e.sinks {
+		if c, ok := sink.(prometheus.Collector); ok {
+			e.registry.MustRegister(c)
+		}
+	}
+	return e
+}
+
+// Register makes collectors available to Add under their names. A collector
+// replaces an earlier one of the same name.
+func (e *Exporter) Register(entries ...sensor.CollectorEntry) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for _, entry := range entries {
+		e.collectors[entry.Name] = entry
+	}
+}
+
+// Collectors returns the collectors available to Add.
+func (e *Exporter) Collectors() map[string]sensor.CollectorEntry {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	c := make(map[string]sensor.CollectorEntry, len(e.collectors))
+	for name, entry := range e.collectors {
+		c[name] = entry
+	}
+	return c
+}
+
+// CollectorNames returns the names of the collectors available to Add,
+// sorted.
+func (e *Exporter) CollectorNames() []string {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	names := make([]string, 0, len(e.collectors))
+	for name := range e.collectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Scrapers returns the sensors added so far.
+func (e *Exporter) Scrapers() []*Scraper {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return append([]*Scraper(nil), e.scrapers...)
+}
+
+// Add creates a sensor from a string like sensor_name,interval,opts, as
+// given on the command line, and performs its first scrape. See
+// ParseSensor.
+func (e *Exporter) Add(arg string) (*Scraper, error) {
+	c, err := ParseSensor(arg)
+	if err != nil {
+		return nil, err
+	}
+	return e.AddSensor(c)
+}
+
+// Interval returns the scrape interval of c: its own, or else the suggested
+// one of its collector, or else the default.
+func (e *Exporter) Interval(c SensorConfig) time.Duration {
+	if c.Interval != 0 {
+		return c.Interval
+	}
+	e.mutex.RLock()
+	entry := e.collectors[c.Type]
+	e.mutex.RUnlock()
+	if entry.DefaultInterval != 0 {
+		return entry.DefaultInterval
+	}
+	return e.defaultInterval
+}
+
+// AddSensor creates a sensor and performs its first scrape.
+func (e *Exporter) AddSensor(c SensorConfig) (*Scraper, error) {
+	e.mutex.RLock()
+	single := e.collectors[c.Type].Single
+	for _, s := range e.scrapers {
+		if single && s.Type == c.Type {
+			e.mutex.RUnlock()
+			return nil, errors.New("Only one " + c.Type + " sensor may be set.")
+		}
+	}
+	e.mutex.RUnlock()
+	collector, c, err := e.create(c)
+	if err != nil {
+		return nil, err
+	}
+	return e.addCollector(c.Type, collector, c)
+}
+
+// create creates the sensor of c and returns it with c, whose interval is
+// set to the suggested one of the collector if it had none.
+func (e *Exporter) create(c SensorConfig) (sensor.Collector, SensorConfig, error) {
+	e.mutex.RLock()
+	entry, exists := e.collectors[c.Type]
+	e.mutex.RUnlock()
+	if !exists {
+		return nil, c, errors.New("Sensor " + c.Type + " not found")
+	}
+	if entry.Feature != "" && !sensor.FeatureEnabled(entry.Feature) {
+		return nil, c, errors.New("Sensor " + c.Type + " is experimental, enable it with -enable-feature=" + entry.Feature)
+	}
+	for name := range c.Labels {
+		if !sensor.ValidLabelName(name) {
+			return nil, c, errors.New("Bad label name: " + name)
+		}
+	}
+	interval := c.Interval
+	if interval == 0 { // Try to assign scraper's suggested interval
+		interval = entry.DefaultInterval
+	}
+
+	// Logged before decryption, to keep the secrets out of the log.
+	slog.Info("Adding scraper", "collector", c.Type, "labels", sensor.LabelString(c.Labels), "interval", interval, "options", SanitizeOptions(c.options()))
+
+	opts, err := Decrypt(e.secretKey, c.options())
+	if err != nil {
+		return nil, c, errors.New("Could not decrypt options: " + err.Error())
+	}
+	collector, err := entry.New(opts)
+	if err != nil {
+		return nil, c, errors.New("Could not init sensor: " + err.Error())
+	}
+	c.Interval = interval
+	return collector, c, nil
+}
+
+// AddCollector adds a collector created by the caller under the sensor name
+// name and performs its first scrape. The TYPE and HELP texts of the
+// registered collector of the same name, if any, are served with it. A zero
+// interval means the suggested one of that collector or the default.
+func (e *Exporter) AddCollector(name string, collector sensor.Collector, interval time.Duration) (*Scraper, error) {
+	return e.addCollector(name, collector, SensorConfig{Interval: interval})
+}
+
+// addCollector adds collector with the interval, timeout, labels and tenant
+// of c.
+func (e *Exporter) addCollector(name string, collector sensor.Collector, c SensorConfig) (*Scraper, error) {
+	scraper, entry, err := e.newScraper(name, collector, c)
+	if err != nil {
+		return nil, err
+	}
+	start := scraper.Time
+	if c.LeaderOnly && !e.isLeader() {
+		// The standby leaves the device alone, even to check it.
+		slog.Info("Not scraping sensor before leading", "collector", name)
+	} else if scraper.Muted(start) {
+		slog.Info("Not scraping sensor while it is muted", "collector", name)
+	} else {
+		samples, trace, err := e.scrape(scraper)
+		if err != nil {
+			close(scraper.stop)
+			return nil, errors.New("Could not perform first scrape: " + err.Error())
+		}
+		if !scraper.warmingUp(start) {
+			scraper.Samples = scraper.pipeline(samples)
+		}
+		scraper.record(start, time.Since(start), len(samples), nil)
+		scraper.addTrace(trace)
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.metadata.add(name, scraper.Relabel.Lines(entry.Type))
+	e.metadata.add(name, scraper.Relabel.Lines(entry.Help))
+	e.metadata.add(name, scraper.Relabel.Lines(entry.Unit))
+	e.metadata.add(name, qualityMetadata(scraper.Samples))
+	if len(entry.States) > 0 {
+		e.metadata.add(name, scraper.Relabel.Lines(stateChangesMetadata))
+	}
+	scraper.ID = e.nextID
+	e.nextID++
+	e.scrapers = append(e.scrapers, scraper)
+	if e.started && !e.onDemand {
+		e.startSensor(scraper)
+	}
+	return scraper, nil
+}
+
+// newScraper makes the scraper of collector with the settings of c and of
+// the registered collector name, without scraping it, and starts collector
+// if it is a sensor.Streamer; closing the stop channel of the scraper stops
+// it.
+func (e *Exporter) newScraper(name string, collector sensor.Collector, c SensorConfig) (*Scraper, sensor.CollectorEntry, error) {
+	interval := c.Interval
+	e.mutex.RLock()
+	entry, exists := e.collectors[name]
+	e.mutex.RUnlock()
+	if interval == 0 && exists {
+		interval = entry.DefaultInterval
+	}
+	if interval == 0 { // Assign our interval if all else failed
+		interval = e.defaultInterval
+	}
+
+	if c.Relabel != nil {
+		if err := c.Relabel.Compile(); err != nil {
+			return nil, entry, errors.New("Bad relabel: " + err.Error())
+		}
+	}
+
+	switch c.CacheMode {
+	case "", "repeat":
+	case "once":
+		if c.Cache <= 0 {
+			return nil, entry, errors.New("Cache mode once needs a cache duration")
+		}
+	default:
+		return nil, entry, errors.New("Bad cache mode " + c.CacheMode + ", expected repeat or once")
+	}
+
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = max(interval, e.scrapeTimeout)
+	}
+
+	scraper := &Scraper{Collector: collector, Interval: interval, Type: name,
+		Time: time.Now(), Mutex: &sync.RWMutex{}, Labels: c.Labels, Tenant: c.Tenant,
+		Timeout: timeout, LeaderOnly: c.LeaderOnly, Mute: c.Mute, Schedule: c.Schedule,
+		WarmUp: c.WarmUp, WarmUpScrapes: c.WarmUpScrapes, Relabel: c.Relabel, Cache: c.Cache,
+		CacheMode: c.CacheMode, Redact: append([]sensor.Redaction(nil), c.Redact...), stop: make(chan struct{})}
+	for i := range scraper.Redact {
+		if err := scraper.Redact[i].Compile(); err != nil {
+			return nil, entry, errors.New("Bad redaction: " + err.Error())
+		}
+	}
+	scraper.setFilters(c.Filters)
+	if err := scraper.setMappings(c.Mappings, entry.Mappings); err != nil {
+		return nil, entry, err
+	}
+	scraper.setRanges(entry.Ranges)
+	scraper.setStates(entry.States)
+	if c.WarmUp == 0 && c.WarmUpScrapes == 0 {
+		scraper.WarmUp, scraper.WarmUpScrapes = entry.WarmUp, entry.WarmUpScrapes
+	}
+	if st, ok := collector.(sensor.Streamer); ok {
+		e.stream(scraper, st)
+	}
+	return scraper, entry, nil
+}
+
+// pipeline labels, maps, bounds, filters, tracks and relabels the samples of
+// a scrape of s, and adds their quality, in the order they are served. The
+// labels come first, as the history of the filters is kept by series.
+func (s *Scraper) pipeline(samples []sensor.Sample) []sensor.Sample {
+	return addQuality(s.Relabel.Apply(s.track(s.filter(s.bound(s.mapText(s.label(samples)))))))
+}
+
+// Remove stops scraping s and removes it. Its collector is closed if it is
+// an io.Closer.
+func (e *Exporter) Remove(s *Scraper) {
+	e.mutex.Lock()
+	found := false
+	for i, v := range e.scrapers {
+		if v == s {
+			e.scrapers = append(e.scrapers[:i:i], e.scrapers[i+1:]...)
+			found = true
+			break
+		}
+	}
+	e.mutex.Unlock()
+	if !found {
+		return
+	}
+	slog.Info("Removing scraper", "collector", s.Type, "id", s.ID)
+	close(s.stop)
+	if c, ok := s.Collector.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			slog.Warn("Could not close sensor", "collector", s.Type, "id", s.ID, "err", err)
+		}
+	}
+}
+
+// label adds the labels of s to samples.
+func (s *Scraper) label(samples []sensor.Sample) []sensor.Sample {
+	if len(s.Labels) == 0 && s.Tenant == "" {
+		return samples
+	}
+	for i := range samples {
+		labels := make(sensor.Labels, len(s.Labels)+len(samples[i].Labels)+1)
+		for name, value := range s.Labels {
+			labels[name] = value
+		}
+		for name, value := range samples[i].Labels {
+			labels[name] = value
+		}
+		if s.Tenant != "" {
+			labels["tenant"] = s.Tenant
+		}
+		samples[i].Labels = labels
+	}
+	return samples
+}
+
+// Start starts scraping the sensors added so far and those added later, unless
+// they are scraped on demand.
+func (e *Exporter) Start() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.started {
+		return
+	}
+	e.started = true
+	if e.onDemand {
+		return
+	}
+	for _, s := range e.scrapers {
+		e.startSensor(s)
+	}
+}
+
+// startSensor scrapes s in its own goroutine at its own interval, or that of
+// its schedule.
+func (e *Exporter) startSensor(s *Scraper) {
+	e.scraping.Add(1)
+	go func() {
+		defer e.scraping.Done()
+		now := time.Now()
+		at := now.Add(s.next(now))
+		timer := time.NewTimer(time.Until(at))
+		defer timer.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-timer.C:
+				e.scrapeSensor(s)
+			}
+			// Like a ticker, keep the pace whatever the scrapes take, but
+			// skip the scrapes missed by a slow one.
+			at = at.Add(s.next(at))
+			if now := time.Now(); at.Before(now) {
+				at = now
+			}
+			timer.Reset(time.Until(at))
+		}
+	}()
+}
+
+// scrapeSensor scrapes s once, keeps its samples and publishes them.
+func (e *Exporter) scrapeSensor(s *Scraper) {
+	if s.LeaderOnly && !e.isLeader() || e.overloaded(s) {
+		return
+	}
+	start := time.Now()
+	if s.Muted(start) {
+		// Drop the samples from before, so they are not served when the
+		// sensor is unmuted until it is scraped again.
+		s.Mutex.Lock()
+		s.Samples = nil
+		s.Mutex.Unlock()
+		return
+	}
+	if s.disabled(start) {
+		return
+	}
+	defer e.judge(s, start)
+	samples, trace, err := e.scrape(s)
+	end := time.Since(start)
+	if err != nil {
+		s.Mutex.Lock()
+		s.record(start, end, 0, err)
+		s.coolDown()
+		s.cached(start)
+		s.addTrace(trace)
+		s.Mutex.Unlock()
+		slog.Error("Could not scrape", "collector", s.Type, "id", s.ID, "err", err)
+		return
+	}
+	s.Mutex.Lock()
+	if len(samples) == 0 {
+		s.coolDown()
+		if s.cached(start) {
+			s.record(start, end, 0, nil)
+			s.addTrace(trace)
+			s.Mutex.Unlock()
+			return
+		}
+	} else if s.warmingUp(start) {
+		s.record(start, end, len(samples), nil)
+		s.addTrace(trace)
+		s.Mutex.Unlock()
+		return
+	}
+	// A rejected value is left out, not counted as a failure.
+	s.record(start, end, len(samples), nil)
+	samples = s.pipeline(samples)
+	s.Samples = samples
+	s.Time = start
+	s.stale = false
+	s.Mutex.Unlock()
+	e.describeQuality(s.Type, samples)
+	e.publish(s, start, samples)
+	trace.Mark("publish")
+	s.Mutex.Lock()
+	s.addTrace(trace)
+	s.Mutex.Unlock()
+	// If it took too long for the scrape to finish, report it.
+	if interval := s.intervalAt(start); end > interval && !e.onDemand {
+		sensor.Incident()
+		slog.Warn("Scrape took longer than the scrape interval", "collector", s.Type, "id", s.ID, "duration", end, "interval", interval)
+	}
+}
+
+// scrape scrapes the collector of s, tracing its stages if enabled, and gives
+// up after s.Timeout. A collector that does not return in time is left
+// running, and s is not scraped again until it returns, so that a collector
+// is never called concurrently and a hung one does not pile up goroutines.
+func (e *Exporter) scrape(s *Scraper) ([]sensor.Sample, *sensor.Trace, error) {
+	s.Mutex.Lock()
+	pending := s.pending
+	s.Mutex.Unlock()
+	if pending != nil {
+		select {
+		case <-pending:
+		default:
+			return nil, nil, errors.New("its timed out scrape has not returned yet")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+	defer cancel()
+	type result struct {
+		samples []sensor.Sample
+		trace   *sensor.Trace
+		err     error
+	}
+	done := make(chan result, 1)
+	returned := make(chan struct{})
+	go func() {
+		defer close(returned)
+		s.calling.Lock()
+		samples, trace, err := e.call(ctx, s.Collector, e.trace || s.traced)
+		s.calling.Unlock()
+		done <- result{samples, trace, err}
+	}()
+	// A ContextCollector gets some time to return what it has at the
+	// deadline, e.g. that its device is down.
+	timer := time.NewTimer(s.Timeout + scrapeGrace)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.samples, r.trace, r.err
+	case <-timer.C:
+		s.Mutex.Lock()
+		s.pending = returned
+		s.Mutex.Unlock()
+		sensor.Incident()
+		return nil, nil, fmt.Errorf("timed out after %s", s.Timeout)
+	}
+}
+
+// call calls the scrape method of c, with ctx if it is a ContextCollector,
+// and traces its stages if trace is set.
+func (e *Exporter) call(ctx context.Context, c sensor.Collector, trace bool) ([]sensor.Sample, *sensor.Trace, error) {
+	var t *sensor.Trace
+	if trace {
+		t = sensor.NewTrace()
+	}
+	if cc, ok := c.(sensor.ContextCollector); ok {
+		samples, err := cc.ScrapeContext(ctx, t)
+		return samples, t, err
+	}
+	if tc, ok := c.(sensor.TracedCollector); ok && t != nil {
+		samples, err := tc.ScrapeTrace(t)
+		return samples, t, err
+	}
+	samples, err := c.Scrape()
+	t.Mark("scrape")
+	return samples, t, err
+}
+
+// record notes the outcome of a scrape for the self-metrics. A scrape that
+// returns no samples counts as failed, as the sensor has nothing to show. The
+// caller holds s.Mutex unless s is not shared yet.
+func (s *Scraper) record(start time.Time, d time.Duration, samples int, err error) {
+	s.last = start
+	s.Duration = d
+	s.Record(start, samples, err)
+}
+
+// addTrace keeps t as the last trace and, if no earlier scrape took longer,
+// the slowest. The caller holds s.Mutex unless s is not shared yet.
+func (s *Scraper) addTrace(t *sensor.Trace) {
+	if t == nil {
+		return
+	}
+	s.LastTrace = t
+	if s.SlowestTrace == nil || t.Total() > s.SlowestTrace.Total() {
+		s.SlowestTrace = t
+	}
+}
+
+// publish sends the readings of a scrape to the outputs besides the handler
+// and to gRPC watchers.
+func (e *Exporter) publish(s *Scraper, t time.Time, samples []sensor.Sample) {
+	for _, sink := range e.sinks {
+		if err := sink.Write(t, s.Type, samples); err != nil {
+			sensor.Incident()
+			slog.Error("Could not write readings", "collector", s.Type, "id", s.ID, "err", err)
+		}
+	}
+	if e.readings.watching() {
+		e.readings.notify(s, t, samples)
+	}
+}
+
+// Handler serves the values of all sensors in the Prometheus text format, or
+// OpenMetrics, with UNIT lines, if the scraper asks for it. The samples of a
+// metric family are grouped under a single HELP and TYPE header, even if
+// several sensors write them, and families without samples are left out.
+// Duplicate samples are logged and left out.
+//
+// The collector parameter, given once or more or as comma separated list,
+// limits the values to those of the named sensors, e.g. /metrics?collector=upsc.
+// In OnDemand mode the sensors served are scraped first.
+func (e *Exporter) Handler() http.Handler {
+	return http.HandlerFunc(e.metricsHandler)
+}
+
+// MustRegister registers c to the registry of Handler, for metrics of the
+// program besides those of the sensors.
+func (e *Exporter) MustRegister(c prometheus.Collector) {
+	e.registry.MustRegister(c)
+}
+
+// Gatherer gathers what Handler serves, e.g. to push it.
+func (e *Exporter) Gatherer() prometheus.Gatherer {
+	return e.registry
+}
+
+func (e *Exporter) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	e.serveMetrics(w, r, collectorFilter(r))
+}
+
+// serveMetrics serves the values of the sensors selected by only.
+func (e *Exporter) serveMetrics(w http.ResponseWriter, r *http.Request, only filter) {
+	var gatherer prometheus.Gatherer = e.registry
+	if !only.all() {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(view{e, only})
+		gatherer = registry
+	}
+	if e.onDemand {
+		e.refresh(only, e.timeout(r))
+	}
+	unserved := e.unserved(only)
+
+	// On errors, Gather still returns the families it could collect.
+	families, err := gatherer.Gather()
+	if err != nil {
+		slog.Warn("Error gathering metrics", "err", err)
+	}
+	e.mutex.RLock()
+	for _, mf := range families {
+		if unit, ok := e.metadata.unit[mf.GetName()]; ok {
+			mf.Unit = proto.String(unit)
+		}
+	}
+	e.mutex.RUnlock()
+
+	format := expfmt.NegotiateIncludingOpenMetrics(r.Header)
+	w.Header().Set("Content-Type", string(format))
+	enc := expfmt.NewEncoder(w, format, expfmt.WithUnit())
+	for _, mf := range families {
+		if err := enc.Encode(mf); err != nil {
+			slog.Warn("Could not write metrics", "err", err)
+			return
+		}
+	}
+	if closer, ok := enc.(expfmt.Closer); ok {
+		closer.Close()
+	}
+	markServed(unserved)
+}
+
+// Describe describes nothing, as the metrics depend on the sensors; the
+// Exporter is an unchecked collector.
+func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect sends the samples of the last scrape of every sensor, typed and
+// described by the entries of their collectors, and the self-metrics.
+func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	e.collect(ch, filter{})
+}
+
+// collect sends the samples of the sensors selected by only.
+func (e *Exporter) collect(ch chan<- prometheus.Metric, only filter) {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	now := time.Now()
+	for _, s := range e.scrapers {
+		if !only.match(s) || s.Muted(now) {
+			continue
+		}
+		s.Mutex.RLock()
+		samples, t, once := s.Samples, s.Time, s.CacheMode == "once"
+		if once && !s.served.Before(t) {
+			samples = nil
+		}
+		s.Mutex.RUnlock()
+		for _, sample := range sensor.Redact(s.Redact, samples) {
+			m, err := e.constMetric(sample)
+			if err == nil && once {
+				m = prometheus.NewMetricWithTimestamp(t, m)
+			}
+			ch <- m
+		}
+	}
+	e.collectSelf(ch, only)
+	e.collectDisabled(ch, only)
+	e.collectLeader(ch)
+	e.collectRuntime(ch)
+}
+
+// constMetric is sample as a metric, typed and described by the entry of its
+// collector, or an invalid metric with the error. The caller holds e.mutex.
+func (e *Exporter) constMetric(sample sensor.Sample) (prometheus.Metric, error) {
+	help, typ := e.metadata.get(sample.Name)
+	names := sample.Labels.Names()
+	values := make([]string, len(names))
+	for i, name := range names {
+		values[i] = sample.Labels[name]
+	}
+	desc := prometheus.NewDesc(sample.Name, help, names, nil)
+	m, err := prometheus.NewConstMetric(desc, typ, sample.Value, values...)
+	if err != nil {
+		return prometheus.NewInvalidMetric(desc, err), err
+	}
+	return m, nil
+}
+
+// TraceHandler serves the stages of the last and the slowest scrape of
+// every sensor, as plain text, if Config.Trace is set.
+func (e *Exporter) TraceHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if !e.trace {
+			http.Error(w, "Tracing is disabled.", http.StatusNotFound)
+			return
+		}
+		e.WriteTraces(w)
+	})
+}
+
+// WriteTraces writes the last and the slowest scrape of every sensor as
+// TraceHandler serves them, without stages unless Config.Trace is set.
+func (e *Exporter) WriteTraces(w io.Writer) {
+	for _, s := range e.Scrapers() {
+		s.Mutex.RLock()
+		fmt.Fprintf(w, "%s (%d) every %s\n", s.Type, s.ID, s.Interval)
+		fmt.Fprintf(w, "\tlast:    %s\n", s.LastTrace)
+		fmt.Fprintf(w, "\tslowest: %s\n", s.SlowestTrace)
+		s.Mutex.RUnlock()
+	}
+}
+
+// Shutdown stops scraping and the gRPC server, waits for the scrapes in
+// flight until ctx is done and closes the collectors that are io.Closers and
+// the sinks. Collectors still scraping when ctx is done are not closed.
+func (e *Exporter) Shutdown(ctx context.Context) error {
+	e.mutex.Lock()
+	scrapers, stopGRPC := e.scrapers, e.stopGRPC
+	e.scrapers = nil
+	e.mutex.Unlock()
+	if stopGRPC != nil {
+		stopGRPC()
+	}
+	for _, s := range scrapers {
+		close(s.stop)
+	}
+	done := make(chan struct{})
+	go func() {
+		e.scraping.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+		for _, s := range scrapers {
+			if c, ok := s.Collector.(io.Closer); ok {
+				if cerr := c.Close(); cerr != nil {
+					slog.Warn("Could not close sensor", "collector", s.Type, "id", s.ID, "err", cerr)
+				}
+			}
+		}
+	case <-ctx.Done():
+		err = errors.New("scrapes still running: " + ctx.Err().Error())
+	}
+	return errors.Join(err, e.Close())
+}
+
+// Close closes the sinks.
+func (e *Exporter) Close() error {
+	var err error
+	for _, sink := range e.sinks {
+		if cerr := sink.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
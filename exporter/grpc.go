@@ -0,0 +1,200 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+//go:build !minimal || grpc
+
+package exporter
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/api"
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcServer implements the Readings service of api/readings.proto.
+type grpcServer struct {
+	api.UnimplementedReadingsServer
+	e *Exporter
+
+	mutex    sync.Mutex
+	watchers map[*watcher]bool
+}
+
+type watcher struct {
+	filter *api.Filter
+	ch     chan *api.Reading
+}
+
+func newGRPCServer(e *Exporter) *grpcServer {
+	return &grpcServer{e: e, watchers: make(map[*watcher]bool)}
+}
+
+// Readings are dropped for watchers that fall this far behind.
+var watchBuffer = 1024
+
+// ServeGRPC serves the Readings service of api/readings.proto on addr, in
+// the background.
+func (e *Exporter) ServeGRPC(addr string) error {
+	return e.ServeGRPCTLS(addr, nil)
+}
+
+// ServeGRPCTLS is ServeGRPC over TLS with conf, which may require client
+// certificates. A nil conf serves in plaintext.
+func (e *Exporter) ServeGRPCTLS(addr string, conf *tls.Config) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	var opts []grpc.ServerOption
+	if conf != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(conf)))
+	}
+	s := grpc.NewServer(opts...)
+	api.RegisterReadingsServer(s, e.readings)
+	e.mutex.Lock()
+	// Not GracefulStop, which would wait for the watchers forever.
+	e.stopGRPC = s.Stop
+	e.mutex.Unlock()
+	go func() {
+		if err := s.Serve(l); err != nil {
+			slog.Error("gRPC server failed", "err", err)
+			os.Exit(1)
+		}
+	}()
+	return nil
+}
+
+func (g *grpcServer) ListSensors(ctx context.Context, req *api.ListSensorsRequest) (*api.ListSensorsResponse, error) {
+	resp := &api.ListSensorsResponse{}
+	for _, s := range g.e.Scrapers() {
+		resp.Sensors = append(resp.Sensors, &api.Sensor{
+			Id: uint32(s.ID), Type: s.Type, Interval: durationpb.New(s.Interval)})
+	}
+	collectors := g.e.Collectors()
+	for _, name := range g.e.CollectorNames() {
+		c := collectors[name]
+		resp.Collectors = append(resp.Collectors, &api.Collector{Type: name,
+			DefaultInterval: durationpb.New(c.DefaultInterval), Description: c.Description})
+	}
+	return resp, nil
+}
+
+func (g *grpcServer) GetReadings(ctx context.Context, req *api.GetReadingsRequest) (*api.GetReadingsResponse, error) {
+	resp := &api.GetReadingsResponse{}
+	for _, s := range g.e.Scrapers() {
+		if !matchSensor(req.GetFilter(), s.Type) {
+			continue
+		}
+		s.Mutex.RLock()
+		samples, t := s.Samples, s.Time
+		s.Mutex.RUnlock()
+		resp.Readings = append(resp.Readings, readings(req.GetFilter(), s, t, samples)...)
+	}
+	return resp, nil
+}
+
+func (g *grpcServer) WatchReadings(req *api.WatchReadingsRequest, stream api.Readings_WatchReadingsServer) error {
+	w := &watcher{filter: req.GetFilter(), ch: make(chan *api.Reading, watchBuffer)}
+	g.mutex.Lock()
+	g.watchers[w] = true
+	g.mutex.Unlock()
+	defer func() {
+		g.mutex.Lock()
+		delete(g.watchers, w)
+		g.mutex.Unlock()
+	}()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case r := <-w.ch:
+			if err := stream.Send(r); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// watching tells whether anyone watches readings, so that they are only
+// converted when needed.
+func (g *grpcServer) watching() bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return len(g.watchers) > 0
+}
+
+// notify sends the readings of a scrape to the watchers.
+func (g *grpcServer) notify(s *Scraper, t time.Time, samples []sensor.Sample) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+watchers:
+	for w := range g.watchers {
+		if !matchSensor(w.filter, s.Type) {
+			continue
+		}
+		for _, r := range readings(w.filter, s, t, samples) {
+			select {
+			case w.ch <- r:
+			default:
+				sensor.Incident()
+				slog.Warn("gRPC watcher is too slow, dropping readings", "collector", s.Type, "id", s.ID)
+				continue watchers
+			}
+		}
+	}
+}
+
+func matchSensor(f *api.Filter, sensorType string) bool {
+	return len(f.GetSensorTypes()) == 0 || contains(f.GetSensorTypes(), sensorType)
+}
+
+func readings(f *api.Filter, s *Scraper, t time.Time, samples []sensor.Sample) []*api.Reading {
+	var out []*api.Reading
+	ts := timestamppb.New(t)
+	for _, sample := range sensor.Redact(s.Redact, samples) {
+		if len(f.GetMetrics()) > 0 && !contains(f.GetMetrics(), sample.Name) {
+			continue
+		}
+		r := &api.Reading{SensorId: uint32(s.ID), SensorType: s.Type, Time: ts,
+			Metric: sample.Name, Value: sample.Value}
+		if len(sample.Labels) > 0 {
+			r.Labels = sample.Labels
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,141 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package exporter
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A Lease elects the leader of exporters that watch the same devices, so
+// that only one of them scrapes the sensors that must not be polled twice,
+// see SensorConfig.LeaderOnly. Acquire takes or renews the lease for id,
+// for d, and tells whether id holds it.
+type Lease interface {
+	Acquire(id string, d time.Duration) (bool, error)
+}
+
+// A FileLease is a lease in a file all exporters can write, e.g. on NFS. It
+// holds the ID of the leader and when its lease expires, so the clocks of
+// the hosts should be in sync. When two exporters take an expired lease at
+// the same time the last write wins, but both may lead until the next
+// renewal.
+type FileLease string
+
+type leaseFile struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+func (l FileLease) Acquire(id string, d time.Duration) (bool, error) {
+	var cur leaseFile
+	data, err := ioutil.ReadFile(string(l))
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	// A lease file that cannot be parsed is free.
+	if err == nil && json.Unmarshal(data, &cur) == nil &&
+		cur.Holder != id && time.Now().Before(cur.Expires) {
+		return false, nil
+	}
+
+	data, _ = json.Marshal(leaseFile{Holder: id, Expires: time.Now().Add(d)})
+	f, err := ioutil.TempFile(filepath.Dir(string(l)), ".lease-")
+	if err != nil {
+		return false, err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), string(l))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return false, err
+	}
+
+	// Another exporter may have written the lease since it was read.
+	if data, err = ioutil.ReadFile(string(l)); err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(data, &cur); err != nil {
+		return false, err
+	}
+	return cur.Holder == id, nil
+}
+
+var haLeaderDesc = prometheus.NewDesc("sensor_exporter_ha_leader",
+	"Whether this exporter holds the lease and scrapes the leader only sensors.", nil, nil)
+
+// campaign acquires the lease now and then renews it, or tries to take it,
+// every third of its duration. Failing to reach the lease costs the
+// leadership, so that two exporters never keep polling a device for long.
+func (e *Exporter) campaign() {
+	e.acquire()
+	go func() {
+		ticker := time.NewTicker(e.leaseDuration / 3)
+		defer ticker.Stop()
+		for range ticker.C {
+			e.acquire()
+		}
+	}()
+}
+
+func (e *Exporter) acquire() {
+	leader, err := e.lease.Acquire(e.leaseID, e.leaseDuration)
+	if err != nil {
+		sensor.Incident()
+		slog.Error("Could not acquire the lease", "err", err)
+		leader = false
+	}
+	first := !e.leaseChecked.Swap(true)
+	if was := e.leader.Swap(leader); was != leader || first {
+		if leader {
+			slog.Info("Leading, scraping all sensors", "id", e.leaseID)
+		} else {
+			slog.Info("On standby, serving the last samples of the leader only sensors", "id", e.leaseID)
+		}
+	}
+}
+
+// isLeader tells whether the exporter scrapes the leader only sensors: if it
+// holds the lease, or has none.
+func (e *Exporter) isLeader() bool {
+	return e.lease == nil || e.leader.Load()
+}
+
+// collectLeader sends whether the exporter leads, if it has a lease.
+func (e *Exporter) collectLeader(ch chan<- prometheus.Metric) {
+	if e.lease == nil {
+		return
+	}
+	leader := 0.0
+	if e.leader.Load() {
+		leader = 1
+	}
+	ch <- prometheus.MustNewConstMetric(haLeaderDesc, prometheus.GaugeValue, leader)
+}
@@ -0,0 +1,119 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package exporter
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+)
+
+// sensorHealth is the status of a sensor at HealthHandler.
+type sensorHealth struct {
+	Collector           string     `json:"collector"`
+	ID                  int        `json:"id"`
+	Up                  bool       `json:"up"`
+	Muted               bool       `json:"muted,omitempty"`
+	Standby             bool       `json:"standby,omitempty"`
+	DisabledUntil       *time.Time `json:"disabled_until,omitempty"`
+	LastSuccess         *time.Time `json:"last_success,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastErrorTime       *time.Time `json:"last_error_time,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	Failures            int        `json:"failures"`
+}
+
+type health struct {
+	Ready   bool           `json:"ready"`
+	Sensors []sensorHealth `json:"sensors"`
+}
+
+// health returns the status of the sensors and whether the exporter is
+// ready: it started and every sensor was scraped successfully at least once,
+// unless it is muted, a leader only sensor on standby or scraped on demand.
+func (e *Exporter) health() health {
+	e.mutex.RLock()
+	h := health{Ready: e.started, Sensors: []sensorHealth{}}
+	e.mutex.RUnlock()
+	now := time.Now()
+	for _, s := range e.Scrapers() {
+		sh := sensorHealth{Collector: s.Type, ID: s.ID, Muted: s.Muted(now),
+			Standby: s.LeaderOnly && !e.isLeader()}
+		s.Mutex.RLock()
+		status, disabledUntil := s.Status, s.disabledUntil
+		s.Mutex.RUnlock()
+		if now.Before(disabledUntil) {
+			sh.DisabledUntil = &disabledUntil
+		}
+		sh.Up, sh.LastError = status.Up, status.LastError
+		sh.ConsecutiveFailures, sh.Failures = status.ConsecutiveErrors, status.Errors
+		if !status.LastUp.IsZero() {
+			sh.LastSuccess = &status.LastUp
+		}
+		if !status.LastErrorTime.IsZero() {
+			sh.LastErrorTime = &status.LastErrorTime
+		}
+		if sh.LastSuccess == nil && !sh.Muted && !sh.Standby && !e.onDemand {
+			h.Ready = false
+		}
+		h.Sensors = append(h.Sensors, sh)
+	}
+	return h
+}
+
+// HealthHandler serves the status of every sensor as JSON, e.g. for uptime
+// checks:
+//
+//	{"ready":true,"sensors":[{"collector":"upsc","id":0,"up":false,
+//	  "last_success":"2026-10-16T09:10:00Z","last_error":"returned no samples",
+//	  "last_error_time":"2026-10-16T09:10:30Z","consecutive_failures":1,"failures":4}]}
+//
+// It answers 200 as long as the exporter runs, as restarting it does not
+// bring back a sensor.
+func (e *Exporter) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e.serveHealth(w, e.health(), http.StatusOK)
+	})
+}
+
+// ReadyHandler serves the status of every sensor like HealthHandler, but
+// answers 503 until the exporter is ready, see health.
+func (e *Exporter) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := e.health()
+		code := http.StatusOK
+		if !h.Ready {
+			code = http.StatusServiceUnavailable
+		}
+		e.serveHealth(w, h, code)
+	})
+}
+
+// WriteHealth writes the status of every sensor as HealthHandler serves it.
+func (e *Exporter) WriteHealth(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(e.health())
+}
+
+func (e *Exporter) serveHealth(w http.ResponseWriter, h health, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(h)
+}
@@ -0,0 +1,51 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package exporter
+
+import (
+	"log/slog"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+// setMappings sets the mappings of s, those of its configuration before
+// those of its collector entry, compiled.
+func (s *Scraper) setMappings(configured, declared []sensor.Mapping) error {
+	s.mappings = append(append([]sensor.Mapping(nil), configured...), declared...)
+	for i := range s.mappings {
+		if err := s.mappings[i].Compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mapText sets the values of the samples whose reading is a string by the
+// mappings of s, and leaves out those that none matches. The caller holds
+// s.Mutex unless s is not shared yet.
+func (s *Scraper) mapText(samples []sensor.Sample) []sensor.Sample {
+	kept := samples[:0]
+	for _, sample := range samples {
+		if !sensor.MapText(s.mappings, &sample) {
+			slog.Debug("No mapping of a reading", "collector", s.Type, "metric", sample.Name, "text", sample.Text)
+			continue
+		}
+		kept = append(kept, sample)
+	}
+	return kept
+}
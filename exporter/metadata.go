@@ -0,0 +1,98 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package exporter
+
+import (
+	"log/slog"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metadata holds the HELP, TYPE and UNIT of the metric families of the
+// collectors in use, one of each per family even if several collectors write
+// the same family, and the collectors that declare them.
+type metadata struct {
+	help       map[string]string
+	typ        map[string]prometheus.ValueType
+	unit       map[string]string
+	collectors map[string]map[string]bool
+}
+
+func newMetadata() *metadata {
+	return &metadata{help: make(map[string]string),
+		typ: make(map[string]prometheus.ValueType), unit: make(map[string]string),
+		collectors: make(map[string]map[string]bool)}
+}
+
+// add adds the TYPE, HELP and UNIT lines of a collector. The first one seen for a
+// family is kept; a different TYPE for it is logged, as the collectors
+// disagree on what the family is.
+func (m *metadata) add(collector string, lines []string) {
+	for _, line := range lines {
+		fields := strings.SplitN(line, " ", 4)
+		if len(fields) < 4 || fields[0] != "#" {
+			continue
+		}
+		family := fields[2]
+		if m.collectors[family] == nil {
+			m.collectors[family] = make(map[string]bool)
+		}
+		m.collectors[family][collector] = true
+		switch fields[1] {
+		case "HELP":
+			if _, ok := m.help[family]; !ok {
+				m.help[family] = fields[3]
+			}
+		case "TYPE":
+			typ := valueType(fields[3])
+			if old, ok := m.typ[family]; !ok {
+				m.typ[family] = typ
+			} else if old != typ {
+				slog.Warn("Sensor declares a type but another type is used", "collector", collector, "line", line)
+			}
+		case "UNIT":
+			// OpenMetrics wants the unit as suffix of the name, before _total.
+			if !strings.HasSuffix(strings.TrimSuffix(family, "_total"), "_"+fields[3]) {
+				slog.Warn("Sensor declares a unit but the name does not end with it", "collector", collector, "line", line)
+			} else if _, ok := m.unit[family]; !ok {
+				m.unit[family] = fields[3]
+			}
+		}
+	}
+}
+
+func valueType(t string) prometheus.ValueType {
+	switch t {
+	case "counter":
+		return prometheus.CounterValue
+	case "gauge":
+		return prometheus.GaugeValue
+	default:
+		return prometheus.UntypedValue
+	}
+}
+
+// get returns the HELP and TYPE of a family. Unknown families are untyped.
+func (m *metadata) get(family string) (string, prometheus.ValueType) {
+	typ, ok := m.typ[family]
+	if !ok {
+		typ = prometheus.UntypedValue
+	}
+	return m.help[family], typ
+}
@@ -0,0 +1,181 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package exporter
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A MuteWindow is a time a sensor is not scraped, e.g. for a planned UPS
+// test or battery replacement: from From until Until, or for For from At
+// every day, "03:00", or every week, "Sun 03:00", in local time.
+type MuteWindow struct {
+	From  time.Time     `yaml:"from" toml:"from"`
+	Until time.Time     `yaml:"until" toml:"until"`
+	At    string        `yaml:"at" toml:"at"`
+	For   time.Duration `yaml:"for" toml:"for"`
+}
+
+var weekdays = map[string]time.Weekday{"sun": time.Sunday, "mon": time.Monday,
+	"tue": time.Tuesday, "wed": time.Wednesday, "thu": time.Thursday,
+	"fri": time.Friday, "sat": time.Saturday}
+
+// parseAt parses At, returning a weekday of -1 for every day.
+func (w MuteWindow) parseAt() (day time.Weekday, hour, minute int, err error) {
+	fields := strings.Fields(w.At)
+	day = -1
+	if len(fields) == 2 {
+		d, ok := weekdays[strings.ToLower(fields[0])[:min(3, len(fields[0]))]]
+		if !ok {
+			return 0, 0, 0, errors.New("unknown weekday " + fields[0])
+		}
+		day, fields = d, fields[1:]
+	}
+	if len(fields) != 1 {
+		return 0, 0, 0, errors.New("expected at: [WEEKDAY] HH:MM, got " + w.At)
+	}
+	t, err := time.Parse("15:04", fields[0])
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return day, t.Hour(), t.Minute(), nil
+}
+
+func (w MuteWindow) check() error {
+	if w.At != "" {
+		if _, _, _, err := w.parseAt(); err != nil {
+			return err
+		}
+		if w.For <= 0 {
+			return errors.New("at needs a duration, for")
+		}
+		return nil
+	}
+	if w.From.IsZero() || !w.Until.After(w.From) {
+		return errors.New("needs from and a later until, or at and for")
+	}
+	return nil
+}
+
+// active tells whether t is in w.
+func (w MuteWindow) active(t time.Time) bool {
+	if w.At == "" {
+		return !t.Before(w.From) && t.Before(w.Until)
+	}
+	day, hour, minute, err := w.parseAt()
+	if err != nil {
+		return false
+	}
+	// The last start of the window before t.
+	start := time.Date(t.Year(), t.Month(), t.Day(), hour, minute, 0, 0, t.Location())
+	if start.After(t) {
+		start = start.AddDate(0, 0, -1)
+	}
+	if day >= 0 {
+		start = start.AddDate(0, 0, -((int(start.Weekday()) - int(day) + 7) % 7))
+	}
+	return t.Before(start.Add(w.For))
+}
+
+// Muted tells whether s is muted at t, by its windows or Mute.
+func (s *Scraper) Muted(t time.Time) bool {
+	s.Mutex.RLock()
+	until := s.mutedUntil
+	s.Mutex.RUnlock()
+	if t.Before(until) {
+		return true
+	}
+	for _, w := range s.Mute {
+		if w.active(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// MuteUntil mutes s until the given time, besides its windows, or unmutes it
+// if that has passed.
+func (s *Scraper) MuteUntil(until time.Time) {
+	s.Mutex.Lock()
+	s.mutedUntil = until
+	s.Mutex.Unlock()
+}
+
+// MuteHandler mutes sensors for a while: a POST with id, the ID of a
+// scraper, or collector, the name of a sensor for all of its scrapers, and
+// for, a duration, mutes them, e.g. id=3&for=2h. for=0 unmutes them. Any
+// request lists the sensors, with when they are muted until.
+func (e *Exporter) MuteHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if r.Method == http.MethodPost {
+			if err := e.mute(r); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		now := time.Now()
+		for _, s := range e.Scrapers() {
+			s.Mutex.RLock()
+			until := s.mutedUntil
+			s.Mutex.RUnlock()
+			fmt.Fprintf(w, "%s (%d)", s.Type, s.ID)
+			switch {
+			case now.Before(until):
+				fmt.Fprintf(w, " muted until %s", until.Format(time.RFC3339))
+			case s.Muted(now):
+				fmt.Fprintf(w, " muted by its windows")
+			}
+			fmt.Fprintln(w)
+		}
+	})
+}
+
+// mute mutes the sensors of a POST to MuteHandler.
+func (e *Exporter) mute(r *http.Request) error {
+	duration, err := time.ParseDuration(r.FormValue("for"))
+	if err != nil {
+		return errors.New("Bad duration for: " + err.Error())
+	}
+	id, collector := r.FormValue("id"), r.FormValue("collector")
+	if (id == "") == (collector == "") {
+		return errors.New("Give either id or collector.")
+	}
+	found := false
+	for _, s := range e.Scrapers() {
+		if s.Type == collector || (id != "" && id == strconv.Itoa(s.ID)) {
+			s.MuteUntil(time.Now().Add(duration))
+			if duration > 0 {
+				slog.Info("Muting sensor", "collector", s.Type, "id", s.ID, "for", duration)
+			} else {
+				slog.Info("Unmuting sensor", "collector", s.Type, "id", s.ID)
+			}
+			found = true
+		}
+	}
+	if !found {
+		return errors.New("No such sensor.")
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+//go:build minimal && !grpc
+
+package exporter
+
+import (
+	"crypto/tls"
+	"errors"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+// grpcServer stands in for the Readings service in builds without gRPC.
+type grpcServer struct{}
+
+func newGRPCServer(e *Exporter) *grpcServer {
+	return &grpcServer{}
+}
+
+// ServeGRPC fails, sensor_exporter was built without gRPC.
+func (e *Exporter) ServeGRPC(addr string) error {
+	return errors.New("built without gRPC, add the grpc build tag")
+}
+
+// ServeGRPCTLS fails, sensor_exporter was built without gRPC.
+func (e *Exporter) ServeGRPCTLS(addr string, conf *tls.Config) error {
+	return e.ServeGRPC(addr)
+}
+
+func (g *grpcServer) watching() bool {
+	return false
+}
+
+func (g *grpcServer) notify(s *Scraper, t time.Time, samples []sensor.Sample) {}
@@ -0,0 +1,144 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package exporter
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A filter selects the sensors served by a request. Its zero value selects
+// all of them.
+type filter struct {
+	collectors map[string]bool // by name, all if nil
+	tenant     *string         // all if nil
+}
+
+// match tells whether s is selected.
+func (f filter) match(s *Scraper) bool {
+	if f.collectors != nil && !f.collectors[s.Type] {
+		return false
+	}
+	return f.tenant == nil || *f.tenant == s.Tenant
+}
+
+// all tells whether f selects all sensors.
+func (f filter) all() bool {
+	return f.collectors == nil && f.tenant == nil
+}
+
+// collectorFilter returns the filter of the collector parameters of r, which
+// selects all sensors if there are none.
+func collectorFilter(r *http.Request) filter {
+	values := r.URL.Query()["collector"]
+	if len(values) == 0 {
+		return filter{}
+	}
+	only := make(map[string]bool)
+	for _, v := range values {
+		for _, name := range strings.Split(v, ",") {
+			only[strings.TrimSpace(name)] = true
+		}
+	}
+	return filter{collectors: only}
+}
+
+// view is a prometheus.Collector of the sensors selected by a filter.
+type view struct {
+	e    *Exporter
+	only filter
+}
+
+func (v view) Describe(ch chan<- *prometheus.Desc) {}
+
+func (v view) Collect(ch chan<- prometheus.Metric) {
+	v.e.collect(ch, v.only)
+}
+
+// timeout returns how long to wait for the sensors: ScrapeTimeout, or less if
+// Prometheus gives up earlier.
+func (e *Exporter) timeout(r *http.Request) time.Duration {
+	timeout := e.scrapeTimeout
+	if h := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); h != "" {
+		if seconds, err := strconv.ParseFloat(h, 64); err == nil && seconds > 0 {
+			// Leave some time to render the samples.
+			if t := time.Duration(seconds * 0.9 * float64(time.Second)); t < timeout {
+				timeout = t
+			}
+		}
+	}
+	return timeout
+}
+
+// refresh scrapes the sensors selected by only concurrently and waits for
+// them up to timeout.
+func (e *Exporter) refresh(only filter, timeout time.Duration) {
+	var wg sync.WaitGroup
+	for _, s := range e.Scrapers() {
+		if !only.match(s) {
+			continue
+		}
+		wg.Add(1)
+		go func(s *Scraper) {
+			defer wg.Done()
+			e.refreshSensor(s, timeout)
+		}(s)
+	}
+	wg.Wait()
+}
+
+// refreshSensor scrapes s unless its last scrape is more recent than its
+// interval. A scrape already running, for a concurrent request, is waited
+// for instead of starting another one. If the scrape does not end in time it
+// is left running and updates s when it ends.
+func (e *Exporter) refreshSensor(s *Scraper, timeout time.Duration) {
+	s.Mutex.Lock()
+	done := s.running
+	if done == nil {
+		if time.Since(s.last) < s.intervalAt(time.Now()) {
+			s.Mutex.Unlock()
+			return
+		}
+		done = make(chan struct{})
+		s.running = done
+		go func() {
+			e.scrapeSensor(s)
+			s.Mutex.Lock()
+			s.running = nil
+			s.Mutex.Unlock()
+			close(done)
+		}()
+	}
+	s.Mutex.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		sensor.Incident()
+		slog.Warn("Sensor did not finish its scrape in time, serving its previous samples", "collector", s.Type, "id", s.ID, "timeout", timeout)
+	}
+}
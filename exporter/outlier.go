@@ -0,0 +1,167 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package exporter
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+// An OutlierFilter rejects implausible values of a metric of a sensor, like
+// the 85 °C a DS18B20 reads after a power glitch or the garbage of a DHT22
+// on a long wire: those outside Min and Max, and those more than Sigma
+// standard deviations from the mean of the last Window accepted values of
+// their series. Deviations up to Tolerance are never rejected, for series
+// that hardly vary. Until a series has three values, only Min and Max are
+// checked.
+type OutlierFilter struct {
+	// Metric is the name of the filtered metric, all of the sensor if
+	// empty.
+	Metric    string   `yaml:"metric" toml:"metric"`
+	Min       *float64 `yaml:"min" toml:"min"`
+	Max       *float64 `yaml:"max" toml:"max"`
+	Sigma     float64  `yaml:"sigma" toml:"sigma"`
+	Window    int      `yaml:"window" toml:"window"` // 10 by default
+	Tolerance float64  `yaml:"tolerance" toml:"tolerance"`
+}
+
+// String is used in SensorConfig.key, which must not print the addresses of
+// Min and Max.
+func (f OutlierFilter) String() string {
+	bound := func(b *float64) string {
+		if b == nil {
+			return "-"
+		}
+		return fmt.Sprint(*b)
+	}
+	return fmt.Sprintf("{%s %s %s %g %d %g}", f.Metric, bound(f.Min), bound(f.Max), f.Sigma, f.Window, f.Tolerance)
+}
+
+func (f OutlierFilter) check() error {
+	if f.Min == nil && f.Max == nil && f.Sigma == 0 {
+		return errors.New("needs min, max or sigma")
+	}
+	if f.Min != nil && f.Max != nil && *f.Min > *f.Max {
+		return errors.New("min is above max")
+	}
+	if f.Sigma < 0 || f.Window < 0 || f.Tolerance < 0 {
+		return errors.New("sigma, window and tolerance cannot be negative")
+	}
+	return nil
+}
+
+func (f OutlierFilter) window() int {
+	if f.Window == 0 {
+		return 10
+	}
+	return f.Window
+}
+
+// history are the last accepted values of a series and how many values were
+// rejected in a row since.
+type history struct {
+	values   []float64
+	rejected int
+}
+
+// plausible tells whether v is plausible after h, and updates h. If Window
+// values in a row deviate too far, the series is taken to have changed for
+// real, e.g. a heater was switched on: the last of them is accepted and
+// starts its history over.
+func (f OutlierFilter) plausible(h *history, v float64) bool {
+	if math.IsNaN(v) || f.Min != nil && v < *f.Min || f.Max != nil && v > *f.Max {
+		return false
+	}
+	if f.Sigma > 0 && len(h.values) >= 3 {
+		var mean, squares float64
+		for _, x := range h.values {
+			mean += x
+		}
+		mean /= float64(len(h.values))
+		for _, x := range h.values {
+			squares += (x - mean) * (x - mean)
+		}
+		deviation := math.Abs(v - mean)
+		if deviation > f.Tolerance && deviation > f.Sigma*math.Sqrt(squares/float64(len(h.values))) {
+			if h.rejected++; h.rejected < f.window() {
+				return false
+			}
+			h.values = h.values[:0]
+		}
+	}
+	h.rejected = 0
+	if h.values = append(h.values, v); len(h.values) > f.window() {
+		h.values = h.values[1:]
+	}
+	return true
+}
+
+// filter leaves out the samples rejected by the filters of s and counts
+// them. Samples of metrics without a filter are kept. The caller holds
+// s.Mutex unless s is not shared yet.
+func (s *Scraper) filter(samples []sensor.Sample) []sensor.Sample {
+	if len(s.Filters) == 0 {
+		return samples
+	}
+	kept := samples[:0]
+	for _, sample := range samples {
+		f, ok := s.filterOf(sample.Name)
+		if !ok {
+			kept = append(kept, sample)
+			continue
+		}
+		key := sample.Name + sensor.LabelString(sample.Labels)
+		h := s.histories[key]
+		if h == nil {
+			h = &history{}
+			s.histories[key] = h
+		}
+		if !f.plausible(h, sample.Value) {
+			s.rejected[sample.Name]++
+			continue
+		}
+		kept = append(kept, sample)
+	}
+	return kept
+}
+
+// setFilters sets the filters of s, counting no rejected samples of the
+// metrics they name yet, and none of the others until one is rejected.
+func (s *Scraper) setFilters(filters []OutlierFilter) {
+	s.Filters = filters
+	s.histories = make(map[string]*history)
+	s.rejected = make(map[string]uint64)
+	for _, f := range filters {
+		if f.Metric != "" {
+			s.rejected[f.Metric] = 0
+		}
+	}
+}
+
+// filterOf returns the first filter of s for the metric name.
+func (s *Scraper) filterOf(name string) (OutlierFilter, bool) {
+	for _, f := range s.Filters {
+		if f.Metric == "" || f.Metric == name {
+			return f, true
+		}
+	}
+	return OutlierFilter{}, false
+}
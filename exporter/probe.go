@@ -0,0 +1,117 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package exporter
+
+import (
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// invalidName matches what a collector name may have but a metric name not.
+var invalidName = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// ProbeHandler creates a sensor of the collector of the module parameter
+// with the target parameter as its options, scrapes it once and serves its
+// samples and, the way blackbox_exporter does, probe_success,
+// probe_duration_seconds and probe_MODULE_duration_seconds, the stages of
+// the scrape by phase, so that the dashboards and alerts of probers work
+// unchanged. Only the collectors of modules may be probed; the deadline
+// is that of the scrape by Prometheus, at most the scrape timeout.
+func (e *Exporter) ProbeHandler(modules []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		module, target := r.FormValue("module"), r.FormValue("target")
+		if target == "" {
+			http.Error(w, "Target parameter is missing", http.StatusBadRequest)
+			return
+		}
+		if !slices.Contains(modules, module) {
+			http.Error(w, "Unknown module "+module, http.StatusBadRequest)
+			return
+		}
+
+		success := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_success",
+			Help: "Displays whether or not the probe was a success",
+		})
+		duration := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_duration_seconds",
+			Help: "Returns how long the probe took to complete in seconds",
+		})
+		phases := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "probe_" + invalidName.ReplaceAllString(module, "_") + "_duration_seconds",
+			Help: "Duration of the probe by phase, the stages of the scrape",
+		}, []string{"phase"})
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(success, duration, phases)
+
+		start := time.Now()
+		samples, err := e.probe(SensorConfig{Type: module, Options: target, Timeout: e.timeout(r)}, phases)
+		duration.Set(time.Since(start).Seconds())
+		if err != nil {
+			slog.Debug("Probe failed", "module", module, "target", target, "err", err)
+		} else {
+			success.Set(1)
+		}
+		if len(samples) > 0 {
+			registry.MustRegister(probeSamples{e, samples})
+		}
+		promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	})
+}
+
+// probe creates the sensor of c, scrapes it once and sets phases to the
+// durations of the stages of the scrape.
+func (e *Exporter) probe(c SensorConfig, phases *prometheus.GaugeVec) ([]sensor.Sample, error) {
+	p, err := e.Probe(c)
+	if err != nil {
+		return nil, err
+	}
+	defer p.Close()
+	samples, trace, err := p.ScrapeTrace()
+	if trace != nil {
+		for _, stage := range trace.Stages {
+			phases.WithLabelValues(stage.Name).Add(stage.Duration.Seconds())
+		}
+	}
+	return samples, err
+}
+
+// probeSamples collects the samples of a probe, typed and described like
+// those of the sensors.
+type probeSamples struct {
+	e       *Exporter
+	samples []sensor.Sample
+}
+
+func (p probeSamples) Describe(ch chan<- *prometheus.Desc) {}
+
+func (p probeSamples) Collect(ch chan<- prometheus.Metric) {
+	p.e.mutex.RLock()
+	defer p.e.mutex.RUnlock()
+	for _, sample := range p.samples {
+		m, _ := p.e.constMetric(sample)
+		ch <- m
+	}
+}
@@ -0,0 +1,57 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package exporter
+
+import "github.com/fmoessbauer/sensor_exporter/sensor"
+
+// qualityMetadata returns the TYPE and HELP lines of the quality companions
+// of samples, see sensor.Quality.
+func qualityMetadata(samples []sensor.Sample) []string {
+	var out []string
+	for _, s := range samples {
+		if s.Quality == sensor.Good {
+			continue
+		}
+		family := s.Name + sensor.QualitySuffix
+		out = append(out, "# TYPE "+family+" gauge",
+			"# HELP "+family+" Quality of the readings of "+s.Name+" that are questionable: 1 degraded, 2 estimated.")
+	}
+	return out
+}
+
+// describeQuality adds the metadata of the quality companions of the samples
+// of a scrape of collector, the first time they come.
+func (e *Exporter) describeQuality(collector string, samples []sensor.Sample) {
+	if lines := qualityMetadata(samples); len(lines) > 0 {
+		e.mutex.Lock()
+		e.metadata.add(collector, lines)
+		e.mutex.Unlock()
+	}
+}
+
+// addQuality adds the quality companions of the samples whose Quality is not
+// Good.
+func addQuality(samples []sensor.Sample) []sensor.Sample {
+	for _, s := range samples {
+		if s.Quality != sensor.Good {
+			samples = append(samples, sensor.Sample{Name: s.Name + sensor.QualitySuffix,
+				Labels: s.Labels, Value: float64(s.Quality)})
+		}
+	}
+	return samples
+}
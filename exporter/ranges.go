@@ -0,0 +1,60 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package exporter
+
+import (
+	"math"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+// setRanges sets the plausible ranges of the metrics of s, counting no
+// implausible samples yet.
+func (s *Scraper) setRanges(ranges map[string]sensor.Range) {
+	s.ranges = ranges
+	s.implausible = make(map[string]uint64, len(ranges))
+	for name := range ranges {
+		s.implausible[name] = 0
+	}
+}
+
+// bound leaves out the samples outside the ranges declared by the collector
+// of s and counts them, and clamps those just outside, see sensor.Range. The
+// caller holds s.Mutex unless s is not shared yet.
+func (s *Scraper) bound(samples []sensor.Sample) []sensor.Sample {
+	if len(s.ranges) == 0 {
+		return samples
+	}
+	kept := samples[:0]
+	for _, sample := range samples {
+		r, ok := s.ranges[sample.Name]
+		// NaN, of sensors without a reading, is left alone.
+		switch {
+		case !ok || math.IsNaN(sample.Value) || sample.Value >= r.Min && sample.Value <= r.Max:
+		case sample.Value < r.Min && sample.Value >= r.Min-r.Clamp:
+			sample.Value = r.Min
+		case sample.Value > r.Max && sample.Value <= r.Max+r.Clamp:
+			sample.Value = r.Max
+		default:
+			s.implausible[sample.Name]++
+			continue
+		}
+		kept = append(kept, sample)
+	}
+	return kept
+}
@@ -0,0 +1,123 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package exporter
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+// RawHandler scrapes the sensor with the ID of the sensor parameter once and
+// serves what its collector sent to the device and got back, unparsed, as
+// plain text: text as it is, binary, like Modbus frames, as a hex dump. It
+// is for capturing what a device actually sends, e.g. for a bug report. Only
+// collectors that record their exchanges have any, see sensor.Exchange;
+// those of other sensors of the collector scraped meanwhile are included.
+// The samples of the scrape are not served. Sensors the exporter does not
+// scrape now, on a standby of a lease, muted or disabled, are not scraped
+// either, the request fails with 409 Conflict.
+func (e *Exporter) RawHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.FormValue("sensor"))
+		if err != nil {
+			http.Error(w, "Give the ID of a sensor as sensor.", http.StatusBadRequest)
+			return
+		}
+		var s *Scraper
+		for _, scraper := range e.Scrapers() {
+			if scraper.ID == id {
+				s = scraper
+			}
+		}
+		if s == nil {
+			http.Error(w, "No such sensor.", http.StatusNotFound)
+			return
+		}
+		start := time.Now()
+		s.Mutex.RLock()
+		disabled := start.Before(s.disabledUntil)
+		s.Mutex.RUnlock()
+		switch {
+		case s.LeaderOnly && !e.isLeader():
+			http.Error(w, "The sensor is scraped by the leader only.", http.StatusConflict)
+			return
+		case s.Muted(start):
+			http.Error(w, "The sensor is muted.", http.StatusConflict)
+			return
+		case disabled:
+			http.Error(w, "The sensor is disabled.", http.StatusConflict)
+			return
+		}
+		stop := sensor.Capture(s.Type)
+		samples, _, err := e.scrape(s)
+		exchanges := stop()
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "# %s (%d) scraped at %s in %s: ", s.Type, s.ID, start.Format(time.RFC3339), time.Since(start))
+		if err != nil {
+			fmt.Fprintf(w, "error %s\n", err)
+		} else {
+			fmt.Fprintf(w, "%d samples\n", len(samples))
+		}
+		if len(exchanges) == 0 {
+			fmt.Fprintln(w, "# No exchanges recorded, the collector records none or did not reach its device.")
+		}
+		for _, x := range exchanges {
+			fmt.Fprintf(w, "\n# %s %s\n", x.Time.Format(time.RFC3339Nano), x.Device)
+			writeRaw(w, "> ", x.Sent)
+			writeRaw(w, "< ", x.Received)
+		}
+	})
+}
+
+// writeRaw writes b with prefix before every line, as text if it is
+// printable, else as a hex dump.
+func writeRaw(w io.Writer, prefix string, b []byte) {
+	text := string(b)
+	if !printable(text) {
+		text = hex.Dump(b)
+	}
+	for _, line := range strings.SplitAfter(text, "\n") {
+		if line != "" {
+			fmt.Fprint(w, prefix, strings.TrimSuffix(line, "\n"), "\n")
+		}
+	}
+}
+
+// printable tells whether s is UTF-8 text of printable characters and line
+// breaks and tabs.
+func printable(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if !unicode.IsPrint(r) && r != '\n' && r != '\r' && r != '\t' {
+			return false
+		}
+	}
+	return true
+}
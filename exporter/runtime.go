@@ -0,0 +1,91 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package exporter
+
+import (
+	"log/slog"
+	"math"
+	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The self-metrics of the resources of the exporter, for small targets where
+// it runs next to critical services.
+var (
+	goroutinesDesc = prometheus.NewDesc("sensor_exporter_goroutines",
+		"Goroutines of the exporter.", nil, nil)
+	goroutinesLimitDesc = prometheus.NewDesc("sensor_exporter_goroutines_limit",
+		"Goroutines beyond which scrapes are skipped.", nil, nil)
+	skippedScrapesDesc = prometheus.NewDesc("sensor_exporter_skipped_scrapes_total",
+		"Scrapes skipped as the exporter had more goroutines than its limit.", nil, nil)
+	memoryDesc = prometheus.NewDesc("sensor_exporter_memory_bytes",
+		"Memory of the exporter that counts against its limit, mapped by the Go runtime and not released.", nil, nil)
+	memoryLimitDesc = prometheus.NewDesc("sensor_exporter_memory_limit_bytes",
+		"Soft memory limit of the Go runtime, beyond which it collects garbage more often.", nil, nil)
+)
+
+// runtimeUnits are the UNIT lines of the resources.
+var runtimeUnits = []string{
+	"# UNIT sensor_exporter_memory_bytes bytes",
+	"# UNIT sensor_exporter_memory_limit_bytes bytes",
+}
+
+// Metrics of the runtime the memory limit applies to.
+var memorySamples = []metrics.Sample{
+	{Name: "/memory/classes/total:bytes"},
+	{Name: "/memory/classes/heap/released:bytes"},
+}
+
+// overloaded tells whether the exporter has more goroutines than its limit,
+// e.g. as collectors hang, and counts the scrape of s as skipped if so.
+func (e *Exporter) overloaded(s *Scraper) bool {
+	if e.maxGoroutines == 0 {
+		return false
+	}
+	n := runtime.NumGoroutine()
+	if n <= e.maxGoroutines {
+		return false
+	}
+	e.skipped.Add(1)
+	sensor.Incident()
+	slog.Warn("Skipping scrape, the exporter has too many goroutines", "collector", s.Type, "id", s.ID, "goroutines", n, "limit", e.maxGoroutines)
+	return true
+}
+
+// collectRuntime sends the goroutines and memory of the exporter and their
+// limits.
+func (e *Exporter) collectRuntime(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(goroutinesDesc, prometheus.GaugeValue, float64(runtime.NumGoroutine()))
+	if e.maxGoroutines > 0 {
+		ch <- prometheus.MustNewConstMetric(goroutinesLimitDesc, prometheus.GaugeValue, float64(e.maxGoroutines))
+		ch <- prometheus.MustNewConstMetric(skippedScrapesDesc, prometheus.CounterValue, float64(e.skipped.Load()))
+	}
+	samples := make([]metrics.Sample, len(memorySamples))
+	copy(samples, memorySamples)
+	metrics.Read(samples)
+	memory := samples[0].Value.Uint64() - samples[1].Value.Uint64()
+	ch <- prometheus.MustNewConstMetric(memoryDesc, prometheus.GaugeValue, float64(memory))
+	// A negative limit reads it without changing it.
+	if limit := debug.SetMemoryLimit(-1); limit != math.MaxInt64 {
+		ch <- prometheus.MustNewConstMetric(memoryLimitDesc, prometheus.GaugeValue, float64(limit))
+	}
+}
@@ -0,0 +1,103 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package exporter
+
+import (
+	"errors"
+	"time"
+)
+
+// An IntervalWindow is a time of day a sensor is scraped at another
+// interval, e.g. a solar inverter every 10s from 06:00 until 21:00 and at
+// its own interval at night. From and Until are local times like "06:00";
+// a window with Until before From lasts over midnight.
+type IntervalWindow struct {
+	From     string        `yaml:"from" toml:"from"`
+	Until    string        `yaml:"until" toml:"until"`
+	Interval time.Duration `yaml:"interval" toml:"interval"`
+}
+
+// bounds returns From and Until as times since midnight.
+func (w IntervalWindow) bounds() (from, until time.Duration, err error) {
+	f, err := time.Parse("15:04", w.From)
+	if err != nil {
+		return 0, 0, errors.New("bad from: " + err.Error())
+	}
+	u, err := time.Parse("15:04", w.Until)
+	if err != nil {
+		return 0, 0, errors.New("bad until: " + err.Error())
+	}
+	return f.Sub(f.Truncate(24 * time.Hour)), u.Sub(u.Truncate(24 * time.Hour)), nil
+}
+
+func (w IntervalWindow) check() error {
+	from, until, err := w.bounds()
+	if err != nil {
+		return err
+	}
+	if from == until {
+		return errors.New("from and until are the same")
+	}
+	if w.Interval <= 0 {
+		return errors.New("needs an interval")
+	}
+	return nil
+}
+
+// sinceMidnight returns the time of day of t.
+func sinceMidnight(t time.Time) time.Duration {
+	return t.Sub(time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location()))
+}
+
+// intervalAt returns the interval of s at t: that of the first window of
+// its Schedule t is in, else Interval.
+func (s *Scraper) intervalAt(t time.Time) time.Duration {
+	now := sinceMidnight(t)
+	for _, w := range s.Schedule {
+		from, until, err := w.bounds()
+		if err != nil {
+			continue
+		}
+		if from < until && now >= from && now < until ||
+			from > until && (now >= from || now < until) {
+			return w.Interval
+		}
+	}
+	return s.Interval
+}
+
+// next returns how long after t to scrape s next: after its interval at t,
+// or earlier when a window of its Schedule starts or ends, so that the new
+// interval applies at once.
+func (s *Scraper) next(t time.Time) time.Duration {
+	d := s.intervalAt(t)
+	now := sinceMidnight(t)
+	for _, w := range s.Schedule {
+		from, until, err := w.bounds()
+		if err != nil {
+			continue
+		}
+		for _, b := range []time.Duration{from, until} {
+			wait := (b - now + 24*time.Hour) % (24 * time.Hour)
+			if wait > 0 && wait < d {
+				d = wait
+			}
+		}
+	}
+	return d
+}
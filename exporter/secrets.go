@@ -0,0 +1,152 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package exporter
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// SecretKeyEnv is the environment variable that may hold the key of the
+// encrypted values of a configuration file, instead of a key file.
+const SecretKeyEnv = "SENSOR_EXPORTER_CONFIG_KEY"
+
+// An encrypted value is ENC[base64 of nonce and AES-256-GCM ciphertext]. It
+// may be part of a longer value, e.g. the password in USER:ENC[...]@UPS@HOST.
+var encryptedRe = regexp.MustCompile(`ENC\[([A-Za-z0-9+/=]*)\]`)
+
+// Secrets left out of what is logged of options: the values of options
+// named like secrets, the passwords of URLs and the USER:PASSWORD@ of upsc.
+var (
+	secretOption = regexp.MustCompile(`(?i)^([a-z_.]*(?:password|passwd|passphrase|secret|token|community|api_?key)[a-z_]*=).*`)
+	urlPassword  = regexp.MustCompile(`(://[^:/@]+:)[^@/]+@`)
+	upscPassword = regexp.MustCompile(`(^|\|)([^@=:/|]+:)[^@|]+@`)
+)
+
+// SanitizeOptions replaces the secrets in comma separated options with
+// REDACTED, for logs and reports.
+func SanitizeOptions(s string) string {
+	fields := strings.Split(s, ",")
+	for i, f := range fields {
+		f = secretOption.ReplaceAllString(f, "${1}REDACTED")
+		f = urlPassword.ReplaceAllString(f, "${1}REDACTED@")
+		fields[i] = upscPassword.ReplaceAllString(f, "${1}${2}REDACTED@")
+	}
+	return strings.Join(fields, ",")
+}
+
+// SanitizeURLs replaces the passwords of the URLs in s with REDACTED.
+func SanitizeURLs(s string) string {
+	return urlPassword.ReplaceAllString(s, "${1}REDACTED@")
+}
+
+// LoadSecretKey reads the key of encrypted values, 32 bytes in base64, from
+// file or, if file is empty, from SecretKeyEnv. Without either it returns a
+// nil key.
+func LoadSecretKey(file string) ([]byte, error) {
+	encoded := os.Getenv(SecretKeyEnv)
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(data)
+	}
+	if encoded = strings.TrimSpace(encoded); encoded == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("key is not base64: " + err.Error())
+	}
+	if len(key) != 32 {
+		return nil, errors.New("key must be 32 bytes")
+	}
+	return key, nil
+}
+
+// GenerateSecretKey returns a new random key in base64, for a key file.
+func GenerateSecretKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// Encrypt encrypts value with key for a configuration file.
+func Encrypt(key []byte, value string) (string, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(value), nil)
+	return "ENC[" + base64.StdEncoding.EncodeToString(sealed) + "]", nil
+}
+
+// Decrypt replaces the encrypted values in s by their plaintext.
+func Decrypt(key []byte, s string) (string, error) {
+	var err error
+	out := encryptedRe.ReplaceAllStringFunc(s, func(m string) string {
+		if err != nil {
+			return m
+		}
+		var plain string
+		plain, err = decryptOne(key, encryptedRe.FindStringSubmatch(m)[1])
+		return plain
+	})
+	return out, err
+}
+
+func decryptOne(key []byte, encoded string) (string, error) {
+	if key == nil {
+		return "", errors.New("encrypted value but no key, see -config.key-file")
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("malformed encrypted value")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("could not decrypt value, wrong key?")
+	}
+	return string(plain), nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,143 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package exporter
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The self-metrics tell how the sensors fare, so that a sensor that stops
+// returning data can be alerted on. They are labeled with the sensor name
+// and the ID of its scraper, as a sensor may be added more than once. The
+// incidents of the whole program are the log sensor's.
+var (
+	selfLabels = []string{"collector", "id"}
+
+	scrapeDurationDesc = prometheus.NewDesc("sensor_exporter_scrape_duration_seconds",
+		"Duration of the last scrape of a sensor.", selfLabels, nil)
+	scrapeErrorsDesc = prometheus.NewDesc("sensor_exporter_scrape_errors_total",
+		"Scrapes of a sensor that failed or returned no samples.", selfLabels, nil)
+	lastScrapeDesc = prometheus.NewDesc("sensor_exporter_last_scrape_timestamp_seconds",
+		"Time of the last successful scrape of a sensor.", selfLabels, nil)
+	collectorUpDesc = prometheus.NewDesc("sensor_exporter_collector_up",
+		"Whether the last scrape of a sensor succeeded and returned samples.", selfLabels, nil)
+	mutedDesc = prometheus.NewDesc("sensor_exporter_muted",
+		"Whether a sensor is muted, neither scraped nor served.", selfLabels, nil)
+	warmingUpDesc = prometheus.NewDesc("sensor_exporter_warming_up",
+		"Whether the samples of a sensor are discarded while it warms up.", selfLabels, nil)
+	staleDesc = prometheus.NewDesc("sensor_exporter_stale",
+		"Whether the samples served of a sensor with a cache are those of an earlier scrape, as the last ones failed.", selfLabels, nil)
+	rejectedDesc = prometheus.NewDesc("sensor_exporter_rejected_samples_total",
+		"Samples of a sensor rejected as implausible by its filters.", append(selfLabels, "metric"), nil)
+	implausibleDesc = prometheus.NewDesc("sensor_exporter_implausible_samples_total",
+		"Samples of a sensor left out as outside the range its collector declares.", append(selfLabels, "metric"), nil)
+	streamListeningDesc = prometheus.NewDesc("sensor_exporter_stream_listening",
+		"Whether a streaming sensor listens to its device.", selfLabels, nil)
+	streamRestartsDesc = prometheus.NewDesc("sensor_exporter_stream_restarts_total",
+		"Times a streaming sensor was restarted after it stopped listening.", selfLabels, nil)
+	streamAgeDesc = prometheus.NewDesc("sensor_exporter_stream_age_seconds",
+		"Time since a streaming sensor last received data from its device.", selfLabels, nil)
+	droppedDesc = prometheus.NewDesc("sensor_exporter_dropped_samples_total",
+		"Samples a sensor dropped as its buffer was full.", selfLabels, nil)
+)
+
+// selfUnits are the UNIT lines of the self-metrics.
+var selfUnits = []string{
+	"# UNIT sensor_exporter_scrape_duration_seconds seconds",
+	"# UNIT sensor_exporter_last_scrape_timestamp_seconds seconds",
+	"# UNIT sensor_exporter_stream_age_seconds seconds",
+}
+
+// collectSelf sends the self-metrics of the sensors selected by only. Muted
+// sensors have no collector_up, so that they do not alert. The caller holds
+// e.mutex.
+func (e *Exporter) collectSelf(ch chan<- prometheus.Metric, only filter) {
+	now := time.Now()
+	for _, s := range e.scrapers {
+		if !only.match(s) {
+			continue
+		}
+		id := strconv.Itoa(s.ID)
+		s.Mutex.RLock()
+		duration, errs, up, last := s.Duration, s.Errors, s.Up, s.LastUp
+		stale := 0.0
+		if s.stale {
+			stale = 1
+		}
+		warmingUp := 0.0
+		if !s.warm && (s.WarmUp > 0 || s.WarmUpScrapes > 0) {
+			warmingUp = 1
+		}
+		for metric, n := range s.rejected {
+			ch <- prometheus.MustNewConstMetric(rejectedDesc, prometheus.CounterValue, float64(n), s.Type, id, metric)
+		}
+		for metric, n := range s.implausible {
+			ch <- prometheus.MustNewConstMetric(implausibleDesc, prometheus.CounterValue, float64(n), s.Type, id, metric)
+		}
+		s.Mutex.RUnlock()
+		upValue := 0.0
+		if up {
+			upValue = 1
+		}
+		ch <- prometheus.MustNewConstMetric(scrapeDurationDesc, prometheus.GaugeValue, duration.Seconds(), s.Type, id)
+		ch <- prometheus.MustNewConstMetric(scrapeErrorsDesc, prometheus.CounterValue, float64(errs), s.Type, id)
+		if !last.IsZero() {
+			ch <- prometheus.MustNewConstMetric(lastScrapeDesc, prometheus.GaugeValue, float64(last.UnixNano())/1e9, s.Type, id)
+		}
+		muted := 0.0
+		if s.Muted(now) {
+			muted = 1
+		} else {
+			ch <- prometheus.MustNewConstMetric(collectorUpDesc, prometheus.GaugeValue, upValue, s.Type, id)
+		}
+		ch <- prometheus.MustNewConstMetric(mutedDesc, prometheus.GaugeValue, muted, s.Type, id)
+		ch <- prometheus.MustNewConstMetric(warmingUpDesc, prometheus.GaugeValue, warmingUp, s.Type, id)
+		if s.Cache > 0 {
+			ch <- prometheus.MustNewConstMetric(staleDesc, prometheus.GaugeValue, stale, s.Type, id)
+		}
+		if st, ok := s.Collector.(sensor.Streamer); ok {
+			collectStream(ch, s, st, now)
+		}
+		if d, ok := s.Collector.(sensor.Dropper); ok {
+			ch <- prometheus.MustNewConstMetric(droppedDesc, prometheus.CounterValue, float64(d.Dropped()), s.Type, id)
+		}
+	}
+}
+
+// collectStream sends the self-metrics of a streaming sensor: whether it
+// listens, how often it was restarted and, once it received data, how long
+// ago that was, which grows while the device is silent though the stream
+// still listens. The caller holds e.mutex.
+func collectStream(ch chan<- prometheus.Metric, s *Scraper, st sensor.Streamer, now time.Time) {
+	id := strconv.Itoa(s.ID)
+	s.Mutex.RLock()
+	listening, restarts := 0.0, s.restarts
+	if s.listening {
+		listening = 1
+	}
+	s.Mutex.RUnlock()
+	ch <- prometheus.MustNewConstMetric(streamListeningDesc, prometheus.GaugeValue, listening, s.Type, id)
+	ch <- prometheus.MustNewConstMetric(streamRestartsDesc, prometheus.CounterValue, float64(restarts), s.Type, id)
+	if received := st.Received(); !received.IsZero() {
+		ch <- prometheus.MustNewConstMetric(streamAgeDesc, prometheus.GaugeValue, now.Sub(received).Seconds(), s.Type, id)
+	}
+}
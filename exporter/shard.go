@@ -0,0 +1,76 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package exporter
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A Shard is the part of the sensors of Apply an exporter scrapes, so that
+// several exporters can share a long list of targets, e.g. the UPSes and
+// PDUs of a fleet, without partitioning it by hand. Sensors are assigned by
+// a consistent hash of their type and options: going from n to n+1 shards
+// moves only about 1/(n+1) of them. The zero Shard scrapes all sensors.
+type Shard struct {
+	Index int // from 1 to Count
+	Count int
+}
+
+// ParseShard parses a shard like 2/4, the second of four.
+func ParseShard(s string) (Shard, error) {
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return Shard{}, errors.New("expected INDEX/COUNT, got: " + s)
+	}
+	index, err1 := strconv.Atoi(parts[0])
+	count, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil || count < 1 || index < 1 || index > count {
+		return Shard{}, errors.New("expected INDEX/COUNT with 1 <= INDEX <= COUNT, got: " + s)
+	}
+	return Shard{Index: index, Count: count}, nil
+}
+
+func (s Shard) String() string {
+	return fmt.Sprintf("%d/%d", s.Index, s.Count)
+}
+
+// owns tells whether c belongs to the shard.
+func (s Shard) owns(c SensorConfig) bool {
+	if s.Count <= 1 {
+		return true
+	}
+	sum := sha256.Sum256([]byte(c.Type + "," + c.options()))
+	return jumpHash(binary.BigEndian.Uint64(sum[:8]), s.Count) == s.Index-1
+}
+
+// jumpHash is the jump consistent hash of Lamping and Veach, which maps key
+// to one of buckets.
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
@@ -0,0 +1,102 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package exporter
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+// stateChangesMetadata are the TYPE and HELP lines of the state changes, for
+// the collectors that declare states.
+var stateChangesMetadata = []string{"# TYPE state_changes_total counter",
+	"# HELP state_changes_total Changes of the state a metric enumerates, from one state to another, since the sensor was added."}
+
+// A stateChange is the count of the changes of a series from one state to
+// another.
+type stateChange struct {
+	labels sensor.Labels
+	count  float64
+}
+
+// setStates sets the metrics of s that enumerate a state, see
+// sensor.CollectorEntry.
+func (s *Scraper) setStates(states map[string]string) {
+	s.states = states
+	s.current = make(map[string]string)
+	s.changes = make(map[string]*stateChange)
+}
+
+// track notes the states of samples, counts the changes since the last scrape
+// and returns samples with the counts. A series missing from a scrape keeps
+// its state, so a sensor that misses a reading does not count as a change.
+// The caller holds s.Mutex unless s is not shared yet.
+func (s *Scraper) track(samples []sensor.Sample) []sensor.Sample {
+	if len(s.states) == 0 {
+		return samples
+	}
+	for _, sample := range samples {
+		label, ok := s.states[sample.Name]
+		if !ok {
+			continue
+		}
+		labels, state := sample.Labels, strconv.FormatFloat(sample.Value, 'g', -1, 64)
+		if label != "" {
+			// Of the states named by a label, the current one is set.
+			if sample.Value == 0 {
+				continue
+			}
+			labels, state = without(sample.Labels, label), sample.Labels[label]
+		}
+		key := sample.Name + sensor.LabelString(labels)
+		from, seen := s.current[key]
+		s.current[key] = state
+		if !seen || from == state {
+			continue
+		}
+		labels = labels.With("metric", sample.Name, "from", from, "to", state)
+		change := sensor.LabelString(labels)
+		if s.changes[change] == nil {
+			s.changes[change] = &stateChange{labels: labels}
+		}
+		s.changes[change].count++
+	}
+	keys := make([]string, 0, len(s.changes))
+	for key := range s.changes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		c := s.changes[key]
+		samples = append(samples, sensor.Sample{Name: "state_changes_total", Labels: c.labels, Value: c.count})
+	}
+	return samples
+}
+
+// without returns a copy of labels without name.
+func without(labels sensor.Labels, name string) sensor.Labels {
+	c := make(sensor.Labels, len(labels))
+	for n, v := range labels {
+		if n != name {
+			c[n] = v
+		}
+	}
+	return c
+}
@@ -0,0 +1,82 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package exporter
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+// A Streamer is restarted streamRestart after it stopped listening, twice
+// that after each further try up to maxStreamRestart, and at once again
+// after it listened for maxStreamRestart.
+var (
+	streamRestart    = time.Second
+	maxStreamRestart = time.Minute
+)
+
+// stream runs the streamer st of s in a goroutine of its own until s.stop
+// is closed, then stops it.
+func (e *Exporter) stream(s *Scraper, st sensor.Streamer) {
+	e.scraping.Add(2)
+	go func() {
+		defer e.scraping.Done()
+		<-s.stop
+		st.Stop()
+	}()
+	go func() {
+		defer e.scraping.Done()
+		wait := streamRestart
+		for {
+			s.Mutex.Lock()
+			s.listening = true
+			s.Mutex.Unlock()
+			start := time.Now()
+			err := st.Start()
+			s.Mutex.Lock()
+			s.listening = false
+			s.Mutex.Unlock()
+			select {
+			case <-s.stop:
+				return
+			default:
+			}
+
+			if err == nil {
+				err = errors.New("stopped listening")
+			}
+			if time.Since(start) >= maxStreamRestart {
+				wait = streamRestart
+			}
+			sensor.Incident()
+			slog.Error("Streaming sensor failed, restarting", "collector", s.Type, "err", err, "in", wait)
+			select {
+			case <-s.stop:
+				return
+			case <-time.After(wait):
+			}
+			wait = min(2*wait, maxStreamRestart)
+			s.Mutex.Lock()
+			s.restarts++
+			s.Mutex.Unlock()
+		}
+	}()
+}
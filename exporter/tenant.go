@@ -0,0 +1,51 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package exporter
+
+import (
+	"net/http"
+	"path"
+)
+
+// TenantHandler serves the values of the sensors of one tenant, named by the
+// last element of the path, like Handler, e.g. /metrics/tenant-a. Tenants
+// without sensors are not found. The samples of tenant sensors all have the
+// tenant label, so Handler can still serve all tenants to the owner of the
+// exporter.
+func (e *Exporter) TenantHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant := path.Base(r.URL.Path)
+		if tenant == "" || !e.hasTenant(tenant) {
+			http.NotFound(w, r)
+			return
+		}
+		only := collectorFilter(r)
+		only.tenant = &tenant
+		e.serveMetrics(w, r, only)
+	})
+}
+
+// hasTenant tells whether a sensor belongs to tenant.
+func (e *Exporter) hasTenant(tenant string) bool {
+	for _, s := range e.Scrapers() {
+		if s.Tenant == tenant {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,47 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package exporter
+
+import (
+	"time"
+)
+
+// warmingUp counts a successful scrape at t towards the warm-up of s and
+// tells whether its samples are still to be discarded: until WarmUpScrapes
+// scrapes were discarded and WarmUp has passed since the first one. The
+// caller holds s.Mutex unless s is not shared yet.
+func (s *Scraper) warmingUp(t time.Time) bool {
+	if s.warm || s.WarmUp <= 0 && s.WarmUpScrapes <= 0 {
+		return false
+	}
+	if s.warmScrapes == 0 {
+		s.warmStart = t
+	}
+	s.warmScrapes++
+	if s.warmScrapes > s.WarmUpScrapes && t.Sub(s.warmStart) >= s.WarmUp {
+		s.warm = true
+		return false
+	}
+	return true
+}
+
+// coolDown starts the warm-up of s again, as a failed scrape may mean that
+// the sensor was reconnected or powered up again. The caller holds s.Mutex.
+func (s *Scraper) coolDown() {
+	s.warm, s.warmScrapes = false, 0
+}
@@ -0,0 +1,252 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/exporter"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+)
+
+// genScrapeConfig prints the Prometheus scrape configuration of the sensors
+// of args and of -config, or alerting rules for them. The sensors are not
+// created.
+func genScrapeConfig(args []string) {
+	fs := flag.NewFlagSet("gen-scrape-config", flag.ExitOnError)
+	target := fs.String("target", "", "address Prometheus scrapes, the host name and -p by default")
+	scheme := fs.String("scheme", "http", "scheme of the target, https with TLS in -web.config.file")
+	rules := fs.Bool("rules", false, "print alerting rules for the sensors instead")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags] gen-scrape-config [options] [sensors]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	e, sensors := configuredSensors(fs.Args())
+
+	var out interface{}
+	if *rules {
+		out = alertRules(sensors)
+	} else {
+		if *target == "" {
+			host, err := os.Hostname()
+			if err != nil {
+				fatal("Could not get the host name, give -target", "err", err)
+			}
+			*target = net.JoinHostPort(host, *port)
+		}
+		out = scrapeConfigs(e, sensors, *target, *scheme)
+	}
+	enc := yaml.NewEncoder(os.Stdout)
+	enc.SetIndent(2)
+	if err := enc.Encode(out); err != nil {
+		fatal("Could not write the configuration", "err", err)
+	}
+}
+
+// configuredSensors returns the sensors of args and of -config, and an
+// exporter with the collectors registered, without creating the sensors.
+func configuredSensors(args []string) (*exporter.Exporter, []exporter.SensorConfig) {
+	e := exporter.New(exporter.Config{})
+	e.Register(collectors...)
+	var sensors []exporter.SensorConfig
+	for _, v := range args {
+		c, err := exporter.ParseSensor(v)
+		if err != nil {
+			fatal("Could not parse sensor", "sensor", v, "err", err)
+		}
+		sensors = append(sensors, c)
+	}
+	if *configFile != "" {
+		config, err := exporter.LoadConfig(*configFile)
+		if err != nil {
+			fatal("Could not read configuration", "file", *configFile, "err", err)
+		}
+		sensors = append(sensors, config.Sensors...)
+	}
+	known := e.Collectors()
+	for _, c := range sensors {
+		if _, ok := known[c.Type]; !ok {
+			fatal("Sensor not found", "collector", c.Type)
+		}
+	}
+	if len(sensors) == 0 {
+		fatal("No sensors given, on the command line or with -config")
+	}
+	return e, sensors
+}
+
+type scrapeConfig struct {
+	JobName        string              `yaml:"job_name"`
+	ScrapeInterval string              `yaml:"scrape_interval"`
+	ScrapeTimeout  string              `yaml:"scrape_timeout"`
+	MetricsPath    string              `yaml:"metrics_path"`
+	Scheme         string              `yaml:"scheme,omitempty"`
+	Params         map[string][]string `yaml:"params"`
+	StaticConfigs  []staticConfig      `yaml:"static_configs"`
+}
+
+type staticConfig struct {
+	Targets []string `yaml:"targets"`
+}
+
+// scrapeConfigs makes a job for every tenant and interval, which scrapes the
+// sensors of that interval with the collector parameter. Sensors of the same
+// type share the collector parameter, so they are scraped at the shortest
+// interval of their type.
+func scrapeConfigs(e *exporter.Exporter, sensors []exporter.SensorConfig, target, scheme string) map[string][]scrapeConfig {
+	type key struct{ tenant, typ string }
+	intervals := make(map[key]time.Duration)
+	for _, c := range sensors {
+		k := key{c.Tenant, c.Type}
+		if i, ok := intervals[k]; !ok || e.Interval(c) < i {
+			intervals[k] = e.Interval(c)
+		}
+	}
+	type job struct {
+		tenant   string
+		interval time.Duration
+	}
+	jobs := make(map[job][]string)
+	for k, interval := range intervals {
+		// Prometheus scrapes at most every second.
+		seconds := time.Duration(math.Ceil(interval.Seconds())) * time.Second
+		j := job{k.tenant, seconds}
+		jobs[j] = append(jobs[j], k.typ)
+	}
+	var sorted []job
+	for j := range jobs {
+		sorted = append(sorted, j)
+	}
+	sort.Slice(sorted, func(a, b int) bool {
+		if sorted[a].tenant != sorted[b].tenant {
+			return sorted[a].tenant < sorted[b].tenant
+		}
+		return sorted[a].interval < sorted[b].interval
+	})
+
+	var configs []scrapeConfig
+	for _, j := range sorted {
+		types := jobs[j]
+		sort.Strings(types)
+		interval := model.Duration(j.interval).String()
+		name, path := "sensor_exporter_"+interval, "/metrics"
+		if j.tenant != "" {
+			name, path = "sensor_exporter_"+j.tenant+"_"+interval, "/metrics/"+j.tenant
+		}
+		if scheme == "http" {
+			scheme = ""
+		}
+		// The timeout may not exceed the interval.
+		timeout := min(j.interval, *scrapeTimeout)
+		configs = append(configs, scrapeConfig{
+			JobName:        name,
+			ScrapeInterval: interval,
+			ScrapeTimeout:  model.Duration(timeout).String(),
+			MetricsPath:    path,
+			Scheme:         scheme,
+			Params:         map[string][]string{"collector": types},
+			StaticConfigs:  []staticConfig{{Targets: []string{target}}},
+		})
+	}
+	return map[string][]scrapeConfig{"scrape_configs": configs}
+}
+
+type ruleGroup struct {
+	Name  string `yaml:"name"`
+	Rules []rule `yaml:"rules"`
+}
+
+type rule struct {
+	Alert       string            `yaml:"alert"`
+	Expr        string            `yaml:"expr"`
+	For         string            `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels"`
+	Annotations map[string]string `yaml:"annotations"`
+}
+
+// upsRules alert on the upsc metrics, which apcupsd exports too.
+var upsRules = []rule{
+	{Alert: "UPSOnBattery", Expr: "upsc_ups_online == 0", For: "1m", Labels: map[string]string{"severity": "warning"},
+		Annotations: map[string]string{"summary": "UPS {{ $labels.ups }} runs on battery"}},
+	{Alert: "UPSLowBattery", Expr: "upsc_battery_charge <= upsc_battery_charge_low", Labels: map[string]string{"severity": "critical"},
+		Annotations: map[string]string{"summary": "UPS {{ $labels.ups }} battery is low: {{ $value }}%"}},
+}
+
+// sensorRules are the alerting rules of the sensors that have some, by
+// sensor type. Sensors without any still get the SensorDown rule.
+var sensorRules = map[string][]rule{
+	"upsc":    upsRules,
+	"apcupsd": upsRules,
+	"snmp_ups": {
+		{Alert: "UPSOnBattery", Expr: "snmp_ups_on_battery == 1", For: "1m", Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{"summary": "UPS {{ $labels.target }} runs on battery"}},
+		{Alert: "UPSLowBattery", Expr: "snmp_ups_battery_runtime_seconds < 300", Labels: map[string]string{"severity": "critical"},
+			Annotations: map[string]string{"summary": "UPS {{ $labels.target }} has {{ $value }}s of battery left"}},
+		{Alert: "UPSDown", Expr: "snmp_ups_up == 0", For: "5m", Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{"summary": "UPS {{ $labels.target }} does not answer SNMP"}},
+	},
+	"upsd": {
+		{Alert: "UpsdDown", Expr: "upsd_up == 0", For: "5m", Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{"summary": "upsd on {{ $labels.host }} does not answer"}},
+	},
+	"cputemp": {
+		{Alert: "CPUTemperatureHigh", Expr: "cpu_temperature_headroom_celsius < 10", For: "5m", Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{"summary": "CPU package {{ $labels.package }} is {{ $value }}°C from TjMax"}},
+	},
+	"smart": {
+		{Alert: "DiskTemperatureHigh", Expr: "smart_temperature_celsius > 55", For: "10m", Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{"summary": "Disk {{ $labels.device }} is at {{ $value }}°C"}},
+		{Alert: "DiskUnhealthy", Expr: "smart_healthy == 0", Labels: map[string]string{"severity": "critical"},
+			Annotations: map[string]string{"summary": "Disk {{ $labels.device }} fails its SMART self-assessment"}},
+	},
+	"hddtemp": {
+		{Alert: "DiskTemperatureHigh", Expr: "hdd_temperature_celsius > 55", For: "10m", Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{"summary": "Disk {{ $labels.disk }} is at {{ $value }}°C"}},
+	},
+	"ipmi": {
+		{Alert: "IPMISensorOutOfRange", Expr: "ipmi_sensor_ok == 0", For: "5m", Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{"summary": "BMC {{ $labels.target }} reports {{ $labels.sensor }} beyond its thresholds"}},
+	},
+}
+
+// alertRules returns the rule file of the alerting rules of sensors.
+func alertRules(sensors []exporter.SensorConfig) map[string][]ruleGroup {
+	group := ruleGroup{Name: "sensor_exporter", Rules: []rule{
+		{Alert: "SensorDown", Expr: "sensor_exporter_collector_up == 0", For: "5m", Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{"summary": "Sensor {{ $labels.collector }} on {{ $labels.instance }} returns no readings"}},
+	}}
+	seen := make(map[string]bool)
+	for _, c := range sensors {
+		for _, r := range sensorRules[c.Type] {
+			if !seen[r.Expr] {
+				seen[r.Expr] = true
+				group.Rules = append(group.Rules, r)
+			}
+		}
+	}
+	return map[string][]ruleGroup{"groups": {group}}
+}
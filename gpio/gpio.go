@@ -0,0 +1,191 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package gpio requests GPIO lines through the Linux GPIO character device
+(/dev/gpiochipN, uAPI v2, kernel 5.10 or newer). It is a helper for sensors
+that count pulses, read switches or bit-bang simple protocols.
+*/
+package gpio
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Flags of a line request, from linux/gpio.h.
+type Flags uint64
+
+const (
+	ActiveLow   Flags = 1 << 1
+	Input       Flags = 1 << 2
+	Output      Flags = 1 << 3
+	EdgeRising  Flags = 1 << 4
+	EdgeFalling Flags = 1 << 5
+	PullUp      Flags = 1 << 8
+	PullDown    Flags = 1 << 9
+)
+
+const (
+	getLineIoctl   = 0xC250B407
+	getValuesIoctl = 0xC010B40E
+	setValuesIoctl = 0xC010B40F
+	attrDebounce   = 3
+	eventSize      = 48
+)
+
+type lineAttribute struct {
+	id    uint32
+	_     uint32
+	value uint64
+	mask  uint64
+}
+
+type lineConfig struct {
+	flags    uint64
+	numAttrs uint32
+	_        [5]uint32
+	attrs    [10]lineAttribute
+}
+
+type lineRequest struct {
+	offsets         [64]uint32
+	consumer        [32]byte
+	config          lineConfig
+	numLines        uint32
+	eventBufferSize uint32
+	_               [5]uint32
+	fd              int32
+}
+
+type lineValues struct {
+	bits uint64
+	mask uint64
+}
+
+// A Line is one requested GPIO line.
+type Line struct {
+	Chip   string
+	Offset int
+
+	f *os.File
+}
+
+// An Event is an edge seen on a line.
+type Event struct {
+	Time   time.Duration // kernel monotonic timestamp
+	Rising bool
+}
+
+// ChipPath turns gpiochip0 or 0 into /dev/gpiochip0.
+func ChipPath(chip string) string {
+	if strings.HasPrefix(chip, "/") {
+		return chip
+	}
+	if !strings.HasPrefix(chip, "gpiochip") {
+		chip = "gpiochip" + chip
+	}
+	return "/dev/" + chip
+}
+
+// Request requests a line of chip with the given flags. A non-zero debounce
+// period is applied by the kernel to input lines.
+func Request(chip string, offset int, flags Flags, debounce time.Duration) (*Line, error) {
+	cf, err := os.OpenFile(ChipPath(chip), os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer cf.Close()
+
+	var req lineRequest
+	req.offsets[0] = uint32(offset)
+	copy(req.consumer[:], "sensor_exporter")
+	req.config.flags = uint64(flags)
+	if debounce > 0 {
+		req.config.numAttrs = 1
+		req.config.attrs[0] = lineAttribute{id: attrDebounce,
+			value: uint64(debounce / time.Microsecond), mask: 1}
+	}
+	req.numLines = 1
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, cf.Fd(), getLineIoctl, uintptr(unsafe.Pointer(&req)))
+	if errno != 0 {
+		return nil, errors.New("could not request gpio line: " + errno.Error())
+	}
+	// Non-blocking, so that the runtime poller waits for edges and Close
+	// wakes a WaitEdge up.
+	if err := syscall.SetNonblock(int(req.fd), true); err != nil {
+		syscall.Close(int(req.fd))
+		return nil, err
+	}
+	return &Line{Chip: chip, Offset: offset, f: os.NewFile(uintptr(req.fd), "gpio-line")}, nil
+}
+
+// ioctl calls the ioctl req of the line with arg. Not through Fd, which
+// would make the line blocking again.
+func (l *Line) ioctl(req uintptr, arg unsafe.Pointer) error {
+	c, err := l.f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	if err := c.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg))
+	}); err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Value reads the line, 1 for active.
+func (l *Line) Value() (int, error) {
+	v := lineValues{mask: 1}
+	if err := l.ioctl(getValuesIoctl, unsafe.Pointer(&v)); err != nil {
+		return 0, err
+	}
+	return int(v.bits & 1), nil
+}
+
+// SetValue drives an output line, 1 for active.
+func (l *Line) SetValue(value int) error {
+	v := lineValues{bits: uint64(value & 1), mask: 1}
+	return l.ioctl(setValuesIoctl, unsafe.Pointer(&v))
+}
+
+// WaitEdge blocks until the next edge on a line requested with edge flags,
+// or until the line is closed.
+func (l *Line) WaitEdge() (Event, error) {
+	buf := make([]byte, eventSize)
+	if _, err := l.f.Read(buf); err != nil {
+		return Event{}, err
+	}
+	ts := binary.LittleEndian.Uint64(buf[0:8])
+	id := binary.LittleEndian.Uint32(buf[8:12])
+	return Event{Time: time.Duration(ts), Rising: id == 1}, nil
+}
+
+// Close releases the line.
+func (l *Line) Close() error {
+	return l.f.Close()
+}
@@ -0,0 +1,202 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package hwmon reads the Linux hardware monitoring interface exposed under
+/sys/class/hwmon. It is not a sensor itself, but a helper for sensors that
+need to find chips and read their channels.
+
+The sysfs interface is documented at
+https://www.kernel.org/doc/Documentation/hwmon/sysfs-interface
+*/
+package hwmon
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Root is the directory where hwmon devices are looked up.
+var Root = "/sys/class/hwmon"
+
+// A Chip is a single hwmon device, e.g. coretemp.0 or nct6775.
+type Chip struct {
+	Path string
+	Name string
+}
+
+// A Channel is one input of a chip, e.g. temp2 or fan1.
+type Channel struct {
+	Chip  Chip
+	Kind  string // temp, fan, in, humidity, power, curr
+	Index int
+	Label string
+}
+
+var inputRe = regexp.MustCompile(`^([a-z]+)([0-9]+)_input$`)
+
+// Chips returns all hwmon chips found under Root, sorted by path.
+func Chips() ([]Chip, error) {
+	dirs, err := filepath.Glob(filepath.Join(Root, "hwmon*"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(dirs)
+	var chips []Chip
+	for _, dir := range dirs {
+		name, err := readString(filepath.Join(dir, "name"))
+		if err != nil {
+			// Older kernels keep the attributes under device/
+			name, err = readString(filepath.Join(dir, "device", "name"))
+			if err != nil {
+				continue
+			}
+			dir = filepath.Join(dir, "device")
+		}
+		chips = append(chips, Chip{Path: dir, Name: name})
+	}
+	return chips, nil
+}
+
+// ChipsByName returns the chips whose name is one of names.
+func ChipsByName(names ...string) ([]Chip, error) {
+	chips, err := Chips()
+	if err != nil {
+		return nil, err
+	}
+	var out []Chip
+	for _, c := range chips {
+		for _, n := range names {
+			if c.Name == n {
+				out = append(out, c)
+				break
+			}
+		}
+	}
+	return out, nil
+}
+
+// Channels returns the channels of the chip of the given kind, sorted by
+// index. If kind is empty all channels are returned. Channels without a
+// label file get a label of the form kindN.
+func (c Chip) Channels(kind string) ([]Channel, error) {
+	files, err := filepath.Glob(filepath.Join(c.Path, "*_input"))
+	if err != nil {
+		return nil, err
+	}
+	var chans []Channel
+	for _, f := range files {
+		m := inputRe.FindStringSubmatch(filepath.Base(f))
+		if m == nil || (kind != "" && m[1] != kind) {
+			continue
+		}
+		idx, _ := strconv.Atoi(m[2])
+		ch := Channel{Chip: c, Kind: m[1], Index: idx}
+		ch.Label, err = readString(ch.file("label"))
+		if err != nil {
+			ch.Label = m[1] + m[2]
+		}
+		chans = append(chans, ch)
+	}
+	sort.Slice(chans, func(i, j int) bool {
+		if chans[i].Kind != chans[j].Kind {
+			return chans[i].Kind < chans[j].Kind
+		}
+		return chans[i].Index < chans[j].Index
+	})
+	return chans, nil
+}
+
+// Find looks up a channel by a "chip/channel" spec, where chip is the chip
+// name and channel is either the sysfs name (temp1, fan2) or the label of
+// the channel. The first match wins if several chips share a name.
+func Find(spec string) (Channel, error) {
+	parts := strings.SplitN(spec, "/", 2)
+	if len(parts) != 2 {
+		return Channel{}, errors.New("hwmon channel spec must be chip/channel: " + spec)
+	}
+	chips, err := ChipsByName(parts[0])
+	if err != nil {
+		return Channel{}, err
+	}
+	for _, c := range chips {
+		chans, err := c.Channels("")
+		if err != nil {
+			return Channel{}, err
+		}
+		for _, ch := range chans {
+			if ch.Name() == parts[1] || ch.Label == parts[1] {
+				return ch, nil
+			}
+		}
+	}
+	return Channel{}, errors.New("hwmon channel not found: " + spec)
+}
+
+// Name returns the sysfs name of the channel, e.g. temp1.
+func (ch Channel) Name() string {
+	return ch.Kind + strconv.Itoa(ch.Index)
+}
+
+func (ch Channel) file(item string) string {
+	return filepath.Join(ch.Chip.Path, ch.Name()+"_"+item)
+}
+
+// Has reports whether the channel exposes the given item (input, crit, ...).
+func (ch Channel) Has(item string) bool {
+	_, err := readString(ch.file(item))
+	return err == nil
+}
+
+// ReadRaw reads an item of the channel as it is stored in sysfs.
+func (ch Channel) ReadRaw(item string) (float64, error) {
+	s, err := readString(ch.file(item))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// Read reads an item of the channel and converts it to the base unit of its
+// kind: millidegrees, millivolts, milliamperes and milli-percent are divided
+// by 1000, microwatts by 1000000. Fan speeds are returned as is (RPM).
+func (ch Channel) Read(item string) (float64, error) {
+	v, err := ch.ReadRaw(item)
+	if err != nil {
+		return 0, err
+	}
+	switch ch.Kind {
+	case "temp", "in", "curr", "humidity":
+		v = v / 1000
+	case "power", "energy":
+		v = v / 1000000
+	}
+	return v, nil
+}
+
+func readString(file string) (string, error) {
+	dat, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(dat)), nil
+}
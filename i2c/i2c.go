@@ -0,0 +1,146 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package i2c talks to devices on an I2C bus through the Linux i2c-dev
+interface (/dev/i2c-N). It is a helper for sensors, not a sensor itself.
+The i2c-dev kernel module must be loaded.
+*/
+package i2c
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// The i2c-dev ioctl that selects the slave address, from linux/i2c-dev.h.
+const i2cSlave = 0x0703
+
+// A Device is one slave on a bus. Its methods may be called concurrently.
+type Device struct {
+	Bus     int
+	Address int
+
+	f     *os.File
+	mutex sync.Mutex
+}
+
+// Open opens the device at address on /dev/i2c-bus.
+func Open(bus, address int) (*Device, error) {
+	f, err := os.OpenFile(fmt.Sprintf("/dev/i2c-%d", bus), os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), i2cSlave, uintptr(address))
+	if errno != 0 {
+		f.Close()
+		return nil, fmt.Errorf("could not select i2c address 0x%02x: %s", address, errno)
+	}
+	return &Device{Bus: bus, Address: address, f: f}, nil
+}
+
+// ParseAddress parses an address like 0x76 or 118.
+func ParseAddress(s string) (int, error) {
+	base := 10
+	if strings.HasPrefix(s, "0x") {
+		s, base = s[2:], 16
+	}
+	a, err := strconv.ParseUint(s, base, 7)
+	return int(a), err
+}
+
+// Close closes the device.
+func (d *Device) Close() error {
+	return d.f.Close()
+}
+
+// Write sends b to the device.
+func (d *Device) Write(b []byte) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	_, err := d.f.Write(b)
+	return err
+}
+
+// Read fills b from the device.
+func (d *Device) Read(b []byte) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	_, err := d.f.Read(b)
+	return err
+}
+
+// i2cMsg and i2cRdwrData mirror struct i2c_msg and struct
+// i2c_rdwr_ioctl_data of linux/i2c-dev.h.
+type i2cMsg struct {
+	addr  uint16
+	flags uint16
+	len   uint16
+	_     uint16
+	buf   uintptr
+}
+
+type i2cRdwrData struct {
+	msgs  uintptr
+	nmsgs uint32
+	_     uint32
+}
+
+const (
+	i2cRdwr = 0x0707
+	i2cMRd  = 0x0001
+)
+
+// ReadReg writes the register address and then reads len(b) bytes from it,
+// in one combined transaction with a repeated start, as most chips expect.
+func (d *Device) ReadReg(reg byte, b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	w := []byte{reg}
+	msgs := []i2cMsg{
+		{addr: uint16(d.Address), len: 1, buf: uintptr(unsafe.Pointer(&w[0]))},
+		{addr: uint16(d.Address), flags: i2cMRd, len: uint16(len(b)), buf: uintptr(unsafe.Pointer(&b[0]))},
+	}
+	data := i2cRdwrData{msgs: uintptr(unsafe.Pointer(&msgs[0])), nmsgs: 2}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, d.f.Fd(), i2cRdwr, uintptr(unsafe.Pointer(&data)))
+	runtime.KeepAlive(w)
+	runtime.KeepAlive(b)
+	runtime.KeepAlive(msgs)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// WriteReg writes a single byte register.
+func (d *Device) WriteReg(reg, value byte) error {
+	return d.Write([]byte{reg, value})
+}
+
+// String returns bus and address, for logs and labels.
+func (d *Device) String() string {
+	return fmt.Sprintf("i2c-%d/0x%02x", d.Bus, d.Address)
+}
@@ -0,0 +1,117 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+//go:build !minimal || output_push
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/output"
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+	"github.com/fmoessbauer/sensor_exporter/sensor_apcupsd"
+	"github.com/fmoessbauer/sensor_exporter/sensor_upsc"
+)
+
+func init() {
+	importLogs = importUPSLogs
+}
+
+// importUPSLogs reads the logs of upslog or apcupsd of args and writes their
+// readings, with the times they were logged at, to the remote write receiver
+// of -push.url, under the names and labels of the upsc and apcupsd sensors,
+// so that the history of a UPS carries over to the exporter.
+func importUPSLogs(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	from := fs.String("from", "upslog", "program that wrote the logs, upslog or apcupsd")
+	format := fs.String("upslog.format", sensor_upsc.DefaultUpslogFormat, "format of the upslog lines, as given to upslog -f")
+	ups := fs.String("ups", "", "UPS of the readings, UPS@HOST for upslog unless the format has %UPSHOST%, the UPSNAME for apcupsd")
+	host := fs.String("host", "", "host label of the readings of apcupsd")
+	dryRun := fs.Bool("dry-run", false, "print the samples with their timestamps instead of writing them")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags] import [options] FILE...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var samples []output.TimedSample
+	add := func(t time.Time, readings []sensor.Sample) {
+		for _, s := range readings {
+			samples = append(samples, output.TimedSample{Sample: s, Time: t})
+		}
+	}
+	for _, name := range fs.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			fatal("Could not open log", "err", err)
+		}
+		before := len(samples)
+		var skipped int
+		switch *from {
+		case "upslog":
+			var labels sensor.Labels
+			if *ups != "" {
+				upsName, host, found := strings.Cut(*ups, "@")
+				labels = sensor.Labels{"ups": upsName}
+				if found {
+					labels["host"] = strings.Split(host, ":")[0]
+				}
+			} else if !strings.Contains(strings.ToUpper(*format), "%UPSHOST%") {
+				fatal("Importing upslog needs -ups or %UPSHOST% in -upslog.format")
+			}
+			skipped, err = sensor_upsc.ReadUpslog(f, *format, labels, time.Now(), add)
+		case "apcupsd":
+			skipped, err = sensor_apcupsd.ReadLog(f, *ups, *host, time.Now(), add)
+		default:
+			fatal("Import -from must be upslog or apcupsd", "from", *from)
+		}
+		f.Close()
+		if err != nil {
+			fatal("Could not read log", "file", name, "err", err)
+		}
+		slog.Info("Read log", "file", name, "samples", len(samples)-before, "skipped_lines", skipped)
+	}
+
+	if *dryRun {
+		for _, s := range samples {
+			fmt.Printf("%s%s %g %d\n", s.Name, sensor.LabelString(s.Labels), s.Value, s.Time.UnixMilli())
+		}
+		return
+	}
+	if *pushURL == "" {
+		fatal("Importing needs -push.url, the remote write receiver")
+	}
+	c := pushConfig()
+	p, err := output.NewPusher(c)
+	if err != nil {
+		fatal("Could not create push output", "err", err)
+	}
+	if err := p.Backfill(samples); err != nil {
+		fatal("Could not write samples", "url", c.URL, "err", err)
+	}
+	slog.Info("Imported", "url", c.URL, "samples", len(samples))
+}
@@ -0,0 +1,147 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+//go:build !minimal || kubernetes
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/fmoessbauer/sensor_exporter/exporter"
+	"github.com/fmoessbauer/sensor_exporter/kubernetes"
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+var (
+	kubeConfigMap = flag.String("kubernetes.configmap", "", "read sensors from the keys of this ConfigMap and of NAME-NODE, one per key, and follow their changes, when running in a Kubernetes pod")
+	kubeSensors   = flag.Bool("kubernetes.sensors", false, "read sensors from the Sensor objects (sensor-exporter.io/v1alpha1) for the node, and follow their changes, when running in a Kubernetes pod")
+	kubeLease     = flag.String("ha.lease-kubernetes", "", "name of the Lease object of the namespace held by the exporter that scrapes the leader_only sensors, instead of -ha.lease-file, when running in a Kubernetes pod")
+	kubeNode      = flag.String("kubernetes.node", os.Getenv("NODE_NAME"), "name of the node the exporter runs on, e.g. given by the downward API as $NODE_NAME")
+)
+
+func init() {
+	sensorStores = append(sensorStores, watchConfigMap, watchSensors)
+	leases = append(leases, kubernetesLease)
+	sensor.RegisterFeature(remoteConfig, "sensors from Consul, etcd or Kubernetes")
+}
+
+// kubeClient returns a client of the API server of the cluster the exporter
+// runs in.
+func kubeClient() *kubernetes.Client {
+	c, err := kubernetes.InCluster()
+	if err != nil {
+		fatal("Could not connect to the Kubernetes API", "err", err)
+	}
+	return c
+}
+
+// kubernetesLease returns the lease of -ha.lease-kubernetes, if given.
+func kubernetesLease() exporter.Lease {
+	if *kubeLease == "" {
+		return nil
+	}
+	return kubeClient().Lease(*kubeLease)
+}
+
+// watchConfigMap applies the sensors of -kubernetes.configmap, if given,
+// until ctx is done. Each key of the ConfigMap, and of the one of the node,
+// is a sensor.
+func watchConfigMap(ctx context.Context, apply func(sensors []exporter.SensorConfig)) {
+	if *kubeConfigMap == "" {
+		return
+	}
+	requireFeature(remoteConfig, "-kubernetes.configmap")
+	names := []string{*kubeConfigMap}
+	if *kubeNode != "" {
+		names = append(names, *kubeConfigMap+"-"+*kubeNode)
+	}
+	c := kubeClient()
+	read := storeSensors("kubernetes", "configmap/"+*kubeConfigMap, apply)
+	// A watch per ConfigMap, of it alone, so that only these need to be
+	// readable and changes of others are not even seen.
+	var mutex sync.Mutex
+	data := make([]map[string]string, len(names))
+	listed := make([]bool, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.WatchSelected(ctx, "/api/v1/namespaces/"+c.Namespace+"/configmaps", "metadata.name="+name, func(objects map[string]json.RawMessage) {
+				var cm struct {
+					Data map[string]string `json:"data"`
+				}
+				json.Unmarshal(objects[name], &cm)
+				mutex.Lock()
+				defer mutex.Unlock()
+				data[i], listed[i] = cm.Data, true
+				if slices.Contains(listed, false) {
+					// Not to drop the sensors of the others meanwhile.
+					return
+				}
+				values := map[string][]byte{}
+				for i, name := range names {
+					for k, v := range data[i] {
+						values[name+"/"+k] = []byte(v)
+					}
+				}
+				read(values)
+			})
+		}()
+	}
+	wg.Wait()
+}
+
+// watchSensors applies the Sensor objects of the namespace for the node, if
+// -kubernetes.sensors is set, until ctx is done. Their spec is a sensor of
+// the configuration file, and the nodes it is for, all if none.
+func watchSensors(ctx context.Context, apply func(sensors []exporter.SensorConfig)) {
+	if !*kubeSensors {
+		return
+	}
+	requireFeature(remoteConfig, "-kubernetes.sensors")
+	c := kubeClient()
+	path := "/apis/sensor-exporter.io/v1alpha1/namespaces/" + c.Namespace + "/sensors"
+	read := storeSensors("kubernetes", "sensors", apply)
+	c.Watch(ctx, path, func(objects map[string]json.RawMessage) {
+		values := map[string][]byte{}
+		for name, o := range objects {
+			var s struct {
+				Spec map[string]any `json:"spec"`
+			}
+			json.Unmarshal(o, &s)
+			nodes, _ := s.Spec["nodes"].([]any)
+			delete(s.Spec, "nodes")
+			if len(nodes) > 0 && !slices.Contains(nodes, any(*kubeNode)) {
+				continue
+			}
+			// JSON is YAML to ParseSensorKeys.
+			spec, err := json.Marshal(s.Spec)
+			if err != nil {
+				continue
+			}
+			values["sensor/"+name] = spec
+		}
+		read(values)
+	})
+}
@@ -0,0 +1,289 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package kubernetes follows objects of the Kubernetes API from inside a pod,
+with the service account of the pod:
+
+	c, err := kubernetes.InCluster()
+	...
+	go c.Watch(ctx, "/api/v1/namespaces/"+c.Namespace+"/configmaps",
+		func(objects map[string]json.RawMessage) { ... })
+
+Watch lists the objects and then watches them, listing them again when the
+watch falls too far behind, as the informers of client-go do. WatchSelected
+follows only those of a field selector, like metadata.name=sensors.
+*/
+package kubernetes
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+// serviceAccount is where Kubernetes mounts the credentials of the service
+// account of a pod.
+const serviceAccount = "/var/run/secrets/kubernetes.io/serviceaccount/"
+
+// A Client talks to the API server.
+type Client struct {
+	// Namespace is that of the pod.
+	Namespace string
+	host      string
+	client    *http.Client
+}
+
+// requestTimeout is the deadline of requests other than watches.
+var requestTimeout = 30 * time.Second
+
+// watchTimeout is how long the API server keeps a watch open.
+var watchTimeout = 5 * time.Minute
+
+// retry is how long Watch waits after an error.
+var retry = 10 * time.Second
+
+// errExpired is returned by watch when the resource version it watches from
+// is too old, after which the objects are listed again.
+var errExpired = errors.New("resource version expired")
+
+// InCluster returns a client of the API server of the cluster the pod runs
+// in.
+func InCluster() (*Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes pod, $KUBERNETES_SERVICE_HOST is not set")
+	}
+	ca, err := os.ReadFile(serviceAccount + "ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificates in " + serviceAccount + "ca.crt")
+	}
+	namespace, err := os.ReadFile(serviceAccount + "namespace")
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &Client{Namespace: strings.TrimSpace(string(namespace)),
+		host:   "https://" + net.JoinHostPort(host, port),
+		client: &http.Client{Transport: transport}}, nil
+}
+
+// Watch calls f with the objects of the collection at path, like
+// /api/v1/namespaces/default/configmaps, by name, now and on every change,
+// until ctx is done. Errors are logged and the objects listed again after a
+// while; f is not called for them.
+func (c *Client) Watch(ctx context.Context, path string, f func(objects map[string]json.RawMessage)) {
+	c.WatchSelected(ctx, path, "", f)
+}
+
+// WatchSelected is Watch of the objects matching a field selector only, like
+// metadata.name=sensors, which needs the right to list and watch just those.
+func (c *Client) WatchSelected(ctx context.Context, path, selector string, f func(objects map[string]json.RawMessage)) {
+	query := ""
+	if selector != "" {
+		query = "fieldSelector=" + url.QueryEscape(selector)
+	}
+	for ctx.Err() == nil {
+		err := c.listWatch(ctx, path, query, f)
+		if err == nil || ctx.Err() != nil {
+			continue
+		}
+		sensor.Incident()
+		slog.Error("Could not watch Kubernetes objects", "path", path, "err", err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(retry):
+		}
+	}
+}
+
+// meta is the metadata of an object or list.
+type meta struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+}
+
+// listWatch lists the objects at path, with the query if any, and watches
+// them until an error, or until the watch expired, when it returns nil.
+func (c *Client) listWatch(ctx context.Context, path, query string, f func(objects map[string]json.RawMessage)) error {
+	var list struct {
+		meta
+		Items []json.RawMessage `json:"items"`
+	}
+	listPath := path
+	if query != "" {
+		listPath += "?" + query
+	}
+	if err := c.get(ctx, listPath, &list); err != nil {
+		return err
+	}
+	objects := make(map[string]json.RawMessage, len(list.Items))
+	for _, o := range list.Items {
+		var m meta
+		if err := json.Unmarshal(o, &m); err != nil {
+			return err
+		}
+		objects[m.Metadata.Name] = o
+	}
+	f(objects)
+	version := list.Metadata.ResourceVersion
+	for ctx.Err() == nil {
+		var err error
+		if version, err = c.watch(ctx, path, query, version, objects, f); err == errExpired {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// watch applies the events of a watch of path from version to objects,
+// calling f after each change, until the API server ends the watch. It
+// returns the resource version to watch from next.
+func (c *Client) watch(ctx context.Context, path, query, version string, objects map[string]json.RawMessage, f func(objects map[string]json.RawMessage)) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, watchTimeout+requestTimeout)
+	defer cancel()
+	if query != "" {
+		query = "&" + query
+	}
+	resp, err := c.request(ctx, fmt.Sprintf("%s?watch=true&allowWatchBookmarks=true&timeoutSeconds=%d&resourceVersion=%s%s",
+		path, int(watchTimeout.Seconds()), url.QueryEscape(version), query))
+	if err != nil {
+		return version, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return version, errExpired
+	}
+	if resp.StatusCode/100 != 2 {
+		return version, status(resp)
+	}
+	// A watch streams a JSON object per event.
+	dec := json.NewDecoder(bufio.NewReader(resp.Body))
+	for {
+		var event struct {
+			Type   string          `json:"type"`
+			Object json.RawMessage `json:"object"`
+		}
+		if err := dec.Decode(&event); err == io.EOF {
+			return version, nil
+		} else if err != nil {
+			return version, err
+		}
+		if event.Type == "ERROR" {
+			var s struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			}
+			json.Unmarshal(event.Object, &s)
+			if s.Code == http.StatusGone {
+				return version, errExpired
+			}
+			return version, errors.New(s.Message)
+		}
+		var m meta
+		if err := json.Unmarshal(event.Object, &m); err != nil {
+			return version, err
+		}
+		version = m.Metadata.ResourceVersion
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			objects[m.Metadata.Name] = event.Object
+		case "DELETED":
+			delete(objects, m.Metadata.Name)
+		default:
+			// BOOKMARK, which only moves the version on.
+			continue
+		}
+		f(objects)
+	}
+}
+
+// get decodes the JSON at path into v, within requestTimeout.
+func (c *Client) get(ctx context.Context, path string, v any) error {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	resp, err := c.request(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return status(resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// request gets path with the token of the service account.
+func (c *Client) request(ctx context.Context, path string) (*http.Response, error) {
+	return c.send(ctx, http.MethodGet, path, nil)
+}
+
+// send sends a request, with a JSON body if not nil, with the token of the
+// service account, read anew for every request as Kubernetes rotates it.
+func (c *Client) send(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	token, err := os.ReadFile(serviceAccount + "token")
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.host+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+string(bytes.TrimSpace(token)))
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return c.client.Do(req)
+}
+
+// status is the error of a response with a status other than 2xx, with the
+// message of the Status object of the API server, if any.
+func status(resp *http.Response) error {
+	data, _ := io.ReadAll(resp.Body)
+	var s struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(data, &s) == nil && s.Message != "" {
+		return fmt.Errorf("%s: %s", resp.Status, s.Message)
+	}
+	return errors.New(resp.Status)
+}
@@ -0,0 +1,119 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// A Lease is a Lease object of the coordination.k8s.io API in the namespace
+// of the pod, see exporter.Lease, like those client-go elects leaders with.
+// Its holder renews it before it expires; a changed object is not
+// overwritten, so that of two exporters taking an expired lease only one
+// gets it.
+type Lease struct {
+	c    *Client
+	name string
+}
+
+// Lease returns the Lease object of the name.
+func (c *Client) Lease(name string) *Lease {
+	return &Lease{c: c, name: name}
+}
+
+// microTime is the layout of the times of a Lease.
+const microTime = "2006-01-02T15:04:05.000000Z07:00"
+
+type leaseObject struct {
+	APIVersion string         `json:"apiVersion"`
+	Kind       string         `json:"kind"`
+	Metadata   map[string]any `json:"metadata"`
+	Spec       struct {
+		HolderIdentity       string `json:"holderIdentity,omitempty"`
+		LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+		AcquireTime          string `json:"acquireTime,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+		LeaseTransitions     int    `json:"leaseTransitions,omitempty"`
+	} `json:"spec"`
+}
+
+// Acquire creates the lease for id, renews it if id holds it, or takes it
+// over if it expired, for d. It tells whether id holds the lease.
+func (l *Lease) Acquire(id string, d time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	path := "/apis/coordination.k8s.io/v1/namespaces/" + l.c.Namespace + "/leases"
+	var o leaseObject
+	resp, err := l.c.request(ctx, path+"/"+l.name)
+	if err != nil {
+		return false, err
+	}
+	method := http.MethodPut
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		o = leaseObject{APIVersion: "coordination.k8s.io/v1", Kind: "Lease",
+			Metadata: map[string]any{"name": l.name}}
+		method = http.MethodPost
+	case resp.StatusCode/100 != 2:
+		err = status(resp)
+	default:
+		err = json.NewDecoder(resp.Body).Decode(&o)
+		path += "/" + l.name
+	}
+	resp.Body.Close()
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	if o.Spec.HolderIdentity != id {
+		renewed, err := time.Parse(microTime, o.Spec.RenewTime)
+		expires := renewed.Add(time.Duration(o.Spec.LeaseDurationSeconds) * time.Second)
+		if o.Spec.HolderIdentity != "" && err == nil && now.Before(expires) {
+			return false, nil
+		}
+		if method == http.MethodPut {
+			o.Spec.LeaseTransitions++
+		}
+		o.Spec.HolderIdentity = id
+		o.Spec.AcquireTime = now.UTC().Format(microTime)
+	}
+	o.Spec.LeaseDurationSeconds = int((d + time.Second - 1) / time.Second)
+	o.Spec.RenewTime = now.UTC().Format(microTime)
+	body, err := json.Marshal(o)
+	if err != nil {
+		return false, err
+	}
+	// The resourceVersion of the object read makes the API server refuse
+	// the update if another exporter changed it meanwhile.
+	resp, err = l.c.send(ctx, method, path, body)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusConflict {
+		return false, nil
+	}
+	if resp.StatusCode/100 != 2 {
+		return false, status(resp)
+	}
+	return true, nil
+}
@@ -0,0 +1,245 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package logging sets up the structured logger of sensor_exporter, with
+log/slog: its level, its format, text or JSON, and the deduplication of
+repeated warnings and errors.
+
+A sensor whose device or server is gone fails the same way at every scrape,
+e.g. a UPS host that is down. So that it does not fill the journal, a warning
+or error that is the same as one logged less than an interval before, in
+message and attributes, is left out. When it comes up again after the
+interval it is logged with the number of repetitions left out meanwhile, in
+the attribute repeated.
+
+The last lines logged are kept by a Recent, fed through Tee, for the debug
+bundle of the exporter.
+
+The packages of sensor_exporter log with the default logger of slog, which
+main sets up:
+
+	h, err := logging.NewHandler(os.Stderr, "json", slog.LevelInfo)
+	...
+	slog.SetDefault(slog.New(logging.Deduplicate(h, 10*time.Minute)))
+*/
+package logging
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NewHandler returns a handler that writes the records of level and above to
+// w in format, text (logfmt) or json.
+func NewHandler(w io.Writer, format string, level slog.Leveler) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch format {
+	case "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	}
+	return nil, errors.New("unknown log format " + format + ", expected text or json")
+}
+
+// ParseLevel parses a level, debug, info, warn or error.
+func ParseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(s))
+	return level, err
+}
+
+// maxRepeats is the number of records remembered, beyond which those older
+// than the interval are forgotten.
+const maxRepeats = 1000
+
+// repeat is a record that was logged.
+type repeat struct {
+	logged  time.Time
+	skipped int // repetitions left out since
+}
+
+// dedup is the state shared by a handler and those derived from it.
+type dedup struct {
+	mutex    sync.Mutex
+	interval time.Duration
+	seen     map[string]*repeat
+}
+
+type dedupHandler struct {
+	next   slog.Handler
+	state  *dedup
+	prefix string // attributes and groups of WithAttrs and WithGroup
+}
+
+// Deduplicate returns a handler that passes the records to next, but leaves
+// out warnings and errors logged less than interval before, see the package
+// documentation. An interval of 0 leaves out none.
+func Deduplicate(next slog.Handler, interval time.Duration) slog.Handler {
+	if interval <= 0 {
+		return next
+	}
+	return &dedupHandler{next: next, state: &dedup{interval: interval, seen: make(map[string]*repeat)}}
+}
+
+func (h *dedupHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *dedupHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < slog.LevelWarn {
+		return h.next.Handle(ctx, r)
+	}
+	var key strings.Builder
+	key.WriteString(r.Level.String())
+	key.WriteString(h.prefix)
+	key.WriteString(r.Message)
+	r.Attrs(func(a slog.Attr) bool {
+		key.WriteString(" " + a.String())
+		return true
+	})
+	skipped, ok := h.state.check(key.String(), r.Time)
+	if !ok {
+		return nil
+	}
+	if skipped > 0 {
+		r = r.Clone()
+		r.AddAttrs(slog.Int("repeated", skipped))
+	}
+	return h.next.Handle(ctx, r)
+}
+
+// check tells whether the record of key at t is to be logged, and how many
+// repetitions were left out before.
+func (d *dedup) check(key string, t time.Time) (int, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	r := d.seen[key]
+	if r != nil && t.Sub(r.logged) < d.interval {
+		r.skipped++
+		return 0, false
+	}
+	if r == nil && len(d.seen) >= maxRepeats {
+		for k, old := range d.seen {
+			if t.Sub(old.logged) >= d.interval {
+				delete(d.seen, k)
+			}
+		}
+	}
+	skipped := 0
+	if r != nil {
+		skipped = r.skipped
+	}
+	d.seen[key] = &repeat{logged: t}
+	return skipped, true
+}
+
+func (h *dedupHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	prefix := h.prefix
+	for _, a := range attrs {
+		prefix += a.String() + " "
+	}
+	return &dedupHandler{next: h.next.WithAttrs(attrs), state: h.state, prefix: prefix}
+}
+
+func (h *dedupHandler) WithGroup(name string) slog.Handler {
+	return &dedupHandler{next: h.next.WithGroup(name), state: h.state, prefix: h.prefix + name + "."}
+}
+
+// Recent keeps the last lines written to it, e.g. by a handler of
+// NewHandler, for the debug bundle. Each Write is taken as a line.
+type Recent struct {
+	mutex sync.Mutex
+	lines []string
+	next  int // index of the oldest line once full
+	size  int
+}
+
+// NewRecent returns a Recent keeping size lines.
+func NewRecent(size int) *Recent {
+	return &Recent{size: size}
+}
+
+func (r *Recent) Write(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.lines) < r.size {
+		r.lines = append(r.lines, string(p))
+	} else {
+		r.lines[r.next] = string(p)
+		r.next = (r.next + 1) % r.size
+	}
+	return len(p), nil
+}
+
+// Lines returns the lines kept, oldest first.
+func (r *Recent) Lines() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append(append([]string(nil), r.lines[r.next:]...), r.lines[:r.next]...)
+}
+
+type teeHandler []slog.Handler
+
+// Tee returns a handler that passes the records to all of handlers that are
+// enabled for their level.
+func Tee(handlers ...slog.Handler) slog.Handler {
+	return teeHandler(handlers)
+}
+
+func (h teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, next := range h {
+		if next.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var err error
+	for _, next := range h {
+		if next.Enabled(ctx, r.Level) {
+			if e := next.Handle(ctx, r.Clone()); e != nil && err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+func (h teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make(teeHandler, len(h))
+	for i, next := range h {
+		out[i] = next.WithAttrs(attrs)
+	}
+	return out
+}
+
+func (h teeHandler) WithGroup(name string) slog.Handler {
+	out := make(teeHandler, len(h))
+	for i, next := range h {
+		out[i] = next.WithGroup(name)
+	}
+	return out
+}
@@ -18,163 +18,576 @@
 package main
 
 import (
-	"errors"
+	"bufio"
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"sort"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/fmoessbauer/sensor_exporter/actuator"
+	"github.com/fmoessbauer/sensor_exporter/exporter"
+	"github.com/fmoessbauer/sensor_exporter/logging"
+	"github.com/fmoessbauer/sensor_exporter/output"
 	"github.com/fmoessbauer/sensor_exporter/sensor"
-	_ "github.com/fmoessbauer/sensor_exporter/sensor_coretemp"
-	_ "github.com/fmoessbauer/sensor_exporter/sensor_example"
-	_ "github.com/fmoessbauer/sensor_exporter/sensor_hddtemp"
-	_ "github.com/fmoessbauer/sensor_exporter/sensor_log"
-	_ "github.com/fmoessbauer/sensor_exporter/sensor_upsc"
+	"github.com/fmoessbauer/sensor_exporter/supervisor"
 )
 
-type Scraper struct {
-	Collector sensor.Collector
-	Interval  time.Duration
-	Type      string
-	Value     string
-	Mutex     *sync.RWMutex
+// collectors are the sensors this binary is built with. Each is added by its
+// collector_*.go file, which the minimal build tag leaves out unless the
+// sensor's own tag is given too.
+var collectors []sensor.CollectorEntry
+
+// outputs create the sinks enabled by flags besides CSV, if they are built
+// in, see output_*.go. They return nil if not enabled.
+var outputs []func() output.Sink
+
+// pushers start pushing what /metrics serves, if built in and enabled by
+// flags, see output_push.go.
+var pushers []func(e *exporter.Exporter)
+
+// advertisers announce the metrics endpoint on the network, if built in and
+// enabled by flags, see dnssd.go. They return a function that withdraws it,
+// or nil.
+var advertisers []func(port string) func()
+
+// sensorStores watch key-value stores for sensors, if built in and enabled by
+// flags, see consul.go and etcd.go. They call apply with the sensors of the
+// store now and on every change, until ctx is done.
+var sensorStores []func(ctx context.Context, apply func(sensors []exporter.SensorConfig))
+
+// leases return the lease of their -ha.lease-* flag, if built in and given,
+// else nil, see consul.go and kubernetes.go.
+var leases []func() exporter.Lease
+
+// chaosHandler sets the faults injected into the connections to devices, in
+// test builds with the chaos tag, see chaos.go.
+var chaosHandler http.Handler
+
+// importLogs is the import subcommand, if built in, see import.go.
+var importLogs func(args []string)
+
+// serve serves the default mux with server on addr until it is shut down;
+// web.go replaces it with one that does TLS and basic auth, and takes the
+// socket of systemd socket activation, if built in.
+var serve = func(server *http.Server, addr string) error {
+	server.Addr = addr
+	return server.ListenAndServe()
 }
 
-var scrapers []*Scraper
-var supportTexts = make(map[string]bool)
+// grpcTLS returns the TLS settings of the gRPC API, nil for plaintext; web.go
+// replaces it with the TLS settings of the web config file.
+var grpcTLS = func() (*tls.Config, error) {
+	return nil, nil
+}
 
-var (
-	defaultInterval = time.Duration(4800) * time.Millisecond
-)
+// webAuth tells whether the HTTP server asks for basic auth or client
+// certificates; web.go replaces it with one that reads the web config file.
+var webAuth = func() bool {
+	return false
+}
 
 var (
-	port        = flag.String("p", "9091", "port to listen on")
+	port        = flag.String("p", "9091", "port to listen on, none if empty, e.g. to only push")
 	listSensors = flag.Bool("list-sensors", false, "list available sensors")
+	features    = flag.String("enable-feature", "", "comma separated experimental features to enable, see -list-features")
+	listFeature = flag.Bool("list-features", false, "list the experimental features")
+	configFile  = flag.String("config", "", "YAML or TOML (.toml) file with more sensors, reloaded on SIGHUP")
+	keyFile     = flag.String("config.key-file", "", "key of the ENC[...] values in sensor options, else $"+exporter.SecretKeyEnv)
+	encrypt     = flag.Bool("config.encrypt", false, "print the values read from stdin, one per line, encrypted for sensor options, and exit")
+	genKey      = flag.Bool("config.generate-key", false, "print a new key for -config.key-file and exit")
+	shard       = flag.String("shard", "", "scrape only this part of the sensors of -config, INDEX/COUNT like 2/4, to spread them over COUNT exporters")
+	csvDir      = flag.String("csv.dir", "", "also append readings to CSV files in this directory")
+	csvMaxSize  = flag.Int64("csv.max-size", 10<<20, "start a new CSV file after this many bytes")
+	csvMaxAge   = flag.Duration("csv.max-age", 24*time.Hour, "start a new CSV file after this long")
+
+	onDemand      = flag.Bool("scrape.on-demand", false, "scrape the sensors when /metrics is requested, at most once per their interval")
+	scrapeTimeout = flag.Duration("scrape.timeout", 10*time.Second, "least deadline of a scrape; with -scrape.on-demand, serve the previous samples of sensors slower than this")
+	disableRatio  = flag.Float64("scrape.disable-ratio", 0, "disable a sensor for -scrape.disable-for when at least this fraction of its last -scrape.disable-window scrapes failed, e.g. 0.9, 0 to never")
+	disableWindow = flag.Int("scrape.disable-window", 20, "number of the last scrapes of a sensor -scrape.disable-ratio goes by")
+	disableFor    = flag.Duration("scrape.disable-for", time.Hour, "how long a sensor is disabled before it is tried again")
+	fallbackDelay = flag.Duration("net.fallback-delay", 300*time.Millisecond, "how long network sensors wait for a connection to a host before also trying its addresses of the other IP family, negative to try them one after the other")
+
+	debugTrace = flag.Bool("debug.trace", false, "time the stages of every scrape and serve the last and slowest at /debug/scrapes")
+	adminAPI   = flag.Bool("web.enable-admin-api", false, "serve /admin/mute, to mute sensors for a while, /admin/debug-bundle, a tarball for bug reports, /admin/recover, to wake or power cycle the recovery targets of -config, and /api/v1/raw, the raw exchange of a scrape with a device")
+
+	grpcPort = flag.String("grpc.port", "", "port to serve the gRPC readings API on, disabled if empty")
+
+	probeModules = flag.String("probe.modules", "", "comma separated sensors that may be probed at /probe?module=SENSOR&target=OPTIONS like with blackbox_exporter, none if empty")
+
+	leaseFile     = flag.String("ha.lease-file", "", "file shared with a standby exporter; only the holder of its lease scrapes the leader_only sensors")
+	leaseID       = flag.String("ha.id", "", "name of this exporter in the lease, the host name by default")
+	leaseDuration = flag.Duration("ha.lease-duration", 15*time.Second, "how long the lease lasts without renewal")
+
+	memoryLimit   = flag.Int64("runtime.memory-limit", 0, "soft limit of the memory of the exporter in bytes, past which it collects garbage harder, 0 for $GOMEMLIMIT or none")
+	gcPercent     = flag.Int("runtime.gc-percent", 0, "heap growth in percent that triggers garbage collection, 0 for $GOGC or 100, -1 to collect only at -runtime.memory-limit")
+	maxGoroutines = flag.Int("runtime.max-goroutines", 0, "skip scrapes while the exporter has more goroutines, e.g. of hung sensors, 0 for no limit")
+
+	shutdownTimeout = flag.Duration("shutdown.timeout", 15*time.Second, "how long to wait for the requests and scrapes in flight on SIGTERM or SIGINT")
+
+	logLevel  = flag.String("log.level", "info", "least level of the messages logged: debug, info, warn or error")
+	logFormat = flag.String("log.format", "text", "format of the log: text (logfmt) or json")
+	logRepeat = flag.Duration("log.repeat-interval", 10*time.Minute, "log a warning or error repeated within this time only once, 0 to log every one")
+
+	clockWait = flag.Bool("clock.wait-for-sync", false, "hold the readings pushed with remote write or sent to an IoT hub until the kernel reports the clock synchronized, e.g. by NTP, then time them by the monotonic clock, for devices without a real time clock")
 )
 
 func main() {
 	flag.Parse()
+	setUpLogging()
+	setUpRuntime()
+	sensor.FallbackDelay = *fallbackDelay
+	enableFeatures()
 
 	if *listSensors {
-		for k, v := range sensor.AvailableCollectors {
+		e := exporter.New(exporter.Config{})
+		e.Register(collectors...)
+		for k, v := range e.Collectors() {
 			fmt.Printf("SENSOR %s\nDefault scrape interval: %s\n", k, v.DefaultInterval)
+			if v.Feature != "" {
+				fmt.Printf("Experimental, enable with -enable-feature=%s\n", v.Feature)
+			}
 			fmt.Printf("%s\n\n", v.Description)
 		}
 		return
 	}
-	for k, _ := range sensor.AvailableCollectors {
-		log.Printf("Found sensor type %s\n", k)
+	if *listFeature {
+		help := sensor.Features()
+		names := make([]string, 0, len(help))
+		for k := range help {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			fmt.Printf("%s\t%s\n", k, help[k])
+		}
+		return
+	}
+
+	if flag.Arg(0) == "gen-scrape-config" {
+		genScrapeConfig(flag.Args()[1:])
+		return
+	}
+	if flag.Arg(0) == "gen-dashboard" {
+		genDashboard(flag.Args()[1:])
+		return
+	}
+	if flag.Arg(0) == "check" {
+		checkSensors(flag.Args()[1:])
+		return
+	}
+	if flag.Arg(0) == "check-config" {
+		checkConfig(flag.Args()[1:])
+		return
+	}
+	if flag.Arg(0) == "migrate" {
+		migrate(flag.Args()[1:])
+		return
+	}
+	if flag.Arg(0) == "burnin" {
+		burnIn(flag.Args()[1:])
+		return
+	}
+	if flag.Arg(0) == "import" && importLogs != nil {
+		importLogs(flag.Args()[1:])
+		return
+	}
+
+	if *genKey {
+		key, err := exporter.GenerateSecretKey()
+		if err != nil {
+			fatal("Could not generate key", "err", err)
+		}
+		fmt.Println(key)
+		return
+	}
+	key, err := exporter.LoadSecretKey(*keyFile)
+	if err != nil {
+		fatal("Could not read key", "err", err)
+	}
+	if *encrypt {
+		encryptValues(key)
+		return
+	}
+
+	var part exporter.Shard
+	if *shard != "" {
+		if part, err = exporter.ParseShard(*shard); err != nil {
+			fatal("Could not understand -shard", "err", err)
+		}
+	}
+
+	if *disableRatio < 0 || *disableRatio > 1 {
+		fatal("-scrape.disable-ratio must be between 0 and 1")
+	}
+	output.WaitForClockSync = *clockWait
+	settings := exporter.Config{Sinks: sinks(), Trace: *debugTrace,
+		OnDemand: *onDemand, ScrapeTimeout: *scrapeTimeout, SecretKey: key, Shard: part,
+		MaxGoroutines: *maxGoroutines, DisableRatio: *disableRatio, DisableWindow: *disableWindow,
+		DisableFor: *disableFor}
+	if *leaseFile != "" {
+		settings.Lease = exporter.FileLease(*leaseFile)
+	}
+	for _, lease := range leases {
+		if l := lease(); l != nil {
+			if settings.Lease != nil {
+				fatal("Give only one lease, -ha.lease-file, -ha.lease-consul or -ha.lease-kubernetes")
+			}
+			settings.Lease = l
+		}
+	}
+	if settings.Lease != nil {
+		settings.LeaseID, settings.LeaseDuration = *leaseID, *leaseDuration
+		if settings.LeaseID == "" {
+			if settings.LeaseID, err = os.Hostname(); err != nil {
+				fatal("Could not get the host name for -ha.id", "err", err)
+			}
+		}
+	}
+	e := exporter.New(settings)
+	e.Register(collectors...)
+	for _, k := range e.CollectorNames() {
+		slog.Debug("Found sensor type", "collector", k)
 	}
 
 	for _, v := range flag.Args() {
-		scraper, err := processArg(v)
+		if _, err := e.Add(v); err != nil {
+			fatal("Could not add sensor", "sensor", v, "err", err)
+		}
+	}
+	sources := &sensorSources{e: e, sensors: make([][]exporter.SensorConfig, 1+len(sensorStores))}
+	var actions *actuator.Actuator
+	helpers := supervisor.New()
+	if *configFile != "" {
+		config, err := exporter.LoadConfig(*configFile)
 		if err != nil {
-			log.Fatalf("Could not add “%s”. Err: %s\n", v, err)
-		}
-		scrapers = append(scrapers, scraper)
-	}
-
-	log.Println("Initializing sensors")
-	for _, v := range scrapers {
-		startSensor(v)
-	}
-
-	log.Printf("Initialization succesful. Listening on :%s\n", *port)
-	http.HandleFunc("/metrics", metricsHandler)
-	http.ListenAndServe(":"+*port, nil)
-
-}
-
-func startSensor(s *Scraper) {
-	var start time.Time
-	var end time.Duration
-	go func() {
-		tick := time.Tick(s.Interval)
-		for {
-			select {
-			case <-tick:
-				start = time.Now()
-				value, err := s.Collector.Scrape()
-				if err != nil {
-					log.Printf("Could not scrape %s. Err: %s\n", s.Type, err)
-					continue
-				}
-				end = time.Since(start)
-				s.Mutex.Lock()
-				s.Value = value
-				s.Mutex.Unlock()
-				// If it took too long for the scrape to finish, report it.
-				if end > s.Interval {
-					sensor.Incident()
-					log.Printf("Sensor %s scrape took %s whilst its scrape interval is only %s\n", s.Type, end, s.Interval)
-				}
+			fatal("Could not read configuration", "file", *configFile, "err", err)
+		}
+		// Before the sensors are initialized, which may need them.
+		helpers.SetHelpers(config.Helpers)
+		e.MustRegister(helpers)
+		if err := sources.apply(0, config.Sensors); err != nil {
+			helpers.Stop()
+			fatal("Could not add sensors of configuration", "file", *configFile, "err", err)
+		}
+		if err := decryptCommands(key, config); err != nil {
+			helpers.Stop()
+			fatal("Could not decrypt the actions of configuration", "file", *configFile, "err", err)
+		}
+		actions = actuator.New(config.Actions)
+		actions.SetTargets(config.Recovery)
+		e.MustRegister(actions)
+		go reloadOnHangup(sources, actions, helpers, key)
+	}
+	stores, stopStores := context.WithCancel(context.Background())
+	for i, s := range sensorStores {
+		go s(stores, func(sensors []exporter.SensorConfig) {
+			if err := sources.apply(1+i, sensors); err != nil {
+				sensor.Incident()
+				slog.Error("Could not add all sensors of the store", "err", err)
 			}
+		})
+	}
+
+	slog.Info("Initializing sensors")
+	e.Start()
+	for _, p := range pushers {
+		p(e)
+	}
+
+	if *grpcPort != "" {
+		conf, err := grpcTLS()
+		if err != nil {
+			fatal("Could not set up TLS of the gRPC server", "err", err)
+		}
+		if err := e.ServeGRPCTLS(":"+*grpcPort, conf); err != nil {
+			fatal("Could not start gRPC server", "err", err)
+		}
+		slog.Info("Serving gRPC", "addr", ":"+*grpcPort)
+	}
+
+	var server *http.Server
+	if *port == "" {
+		slog.Info("Initialization succesful. Not listening, as -p is empty")
+	} else {
+		slog.Info("Initialization succesful", "addr", ":"+*port)
+		http.Handle("/metrics", e.Handler())
+		http.Handle("/metrics/", e.TenantHandler())
+		http.Handle("/healthz", e.HealthHandler())
+		http.Handle("/ready", e.ReadyHandler())
+		http.Handle("/api/v1/metrics-docs", e.MetricsDocsHandler())
+		if *probeModules != "" {
+			http.Handle("/probe", e.ProbeHandler(strings.Split(*probeModules, ",")))
+		}
+		if *debugTrace {
+			http.Handle("/debug/scrapes", e.TraceHandler())
+		}
+		// Webhooks switch outlets and GPIO lines, so they are not left open
+		// to anyone either.
+		if actions != nil && webAuth() {
+			http.Handle("/alertmanager", actions)
+		} else if actions != nil {
+			slog.Warn("Not serving /alertmanager without basic auth or client certificates in -web.config.file")
+		}
+		if *adminAPI {
+			http.Handle("/admin/mute", e.MuteHandler())
+			http.Handle("/admin/debug-bundle", debugBundleHandler(e))
+			if chaosHandler != nil {
+				slog.Warn("Serving /admin/chaos, faults may be injected into the connections to devices")
+				http.Handle("/admin/chaos", chaosHandler)
+			}
+			// Power cycling hosts is not left open to anyone.
+			if actions != nil && webAuth() {
+				http.Handle("/admin/recover", actions.RecoverHandler())
+			} else if actions != nil {
+				slog.Warn("Not serving /admin/recover without basic auth or client certificates in -web.config.file")
+			}
+			// Nor is what devices send, which may name them and their owners.
+			if webAuth() {
+				http.Handle("/api/v1/raw", e.RawHandler())
+			} else {
+				slog.Warn("Not serving /api/v1/raw without basic auth or client certificates in -web.config.file")
+			}
+		}
+		server = &http.Server{}
+		go func() {
+			if err := serve(server, ":"+*port); err != http.ErrServerClosed {
+				fatal("Could not serve", "addr", ":"+*port, "err", err)
+			}
+		}()
+	}
+	var withdraw []func()
+	for _, a := range advertisers {
+		if w := a(*port); w != nil {
+			withdraw = append(withdraw, w)
 		}
-	}()
+	}
+	notifyReady()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	slog.Info("Shutting down", "signal", (<-stop).String())
+	for _, w := range withdraw {
+		w()
+	}
+	stopStores()
+	shutdown(e, server)
+	helpers.Stop()
+}
+
+// setUpLogging makes the logger of the -log.* flags the default of slog, and
+// of package log.
+func setUpLogging() {
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		fatal("Could not understand -log.level", "err", err)
+	}
+	h, err := logging.NewHandler(os.Stderr, *logFormat, level)
+	if err != nil {
+		fatal("Could not understand -log.format", "err", err)
+	}
+	recent := slog.NewTextHandler(recentLog, &slog.HandlerOptions{Level: level})
+	slog.SetDefault(slog.New(logging.Deduplicate(logging.Tee(h, recent), *logRepeat)))
 }
 
-func metricsHandler(w http.ResponseWriter, r *http.Request) {
-	for k, _ := range supportTexts {
-		fmt.Fprintln(w, k)
+// enableFeatures enables the experimental features of -enable-feature, of
+// the subsystems and of the collectors this binary is built with.
+func enableFeatures() {
+	for _, c := range collectors {
+		if c.Feature != "" {
+			sensor.RegisterFeature(c.Feature, "the "+c.Name+" sensor")
+		}
+	}
+	if *features == "" {
+		return
 	}
-	for _, v := range scrapers {
-		v.Mutex.RLock()
-		fmt.Fprintln(w, v.Value)
-		v.Mutex.RUnlock()
+	names := strings.Split(*features, ",")
+	if err := sensor.EnableFeatures(names); err != nil {
+		fatal("Could not understand -enable-feature", "err", err)
 	}
+	slog.Info("Enabled experimental features", "features", *features)
 }
 
-func processArg(arg string) (*Scraper, error) {
-	conf := strings.SplitN(arg, ",", 3)
-	//var scraper sensor.Scraper
-	var interval time.Duration
-	var opts string
-	var err error
+// remoteConfig is the experimental feature of the sensorStores.
+const remoteConfig = "remote-config"
 
-	switch len(conf) {
-	case 3: // Set opts
-		opts = conf[2]
-		fallthrough
-	case 2: // Set interval if given
-		interval, err = time.ParseDuration(conf[1])
-		if err != nil {
-			log.Printf("Could not understand scrape interval: %s. Using default.\n", conf[1])
-			interval = 0
+// requireFeature exits unless the experimental feature is enabled, for the
+// flag that needs it.
+func requireFeature(feature, name string) {
+	if !sensor.FeatureEnabled(feature) {
+		fatal(name + " is experimental, enable it with -enable-feature=" + feature)
+	}
+}
+
+// setUpRuntime sets the memory limit and garbage collection of the -runtime.*
+// flags, if given.
+func setUpRuntime() {
+	if *memoryLimit < 0 || *maxGoroutines < 0 || *gcPercent < -1 {
+		fatal("The -runtime.* limits cannot be negative")
+	}
+	if *gcPercent == -1 && *memoryLimit == 0 && os.Getenv("GOMEMLIMIT") == "" {
+		fatal("-runtime.gc-percent=-1 needs -runtime.memory-limit, else the memory is never collected")
+	}
+	if *memoryLimit > 0 {
+		debug.SetMemoryLimit(*memoryLimit)
+	}
+	if *gcPercent != 0 {
+		debug.SetGCPercent(*gcPercent)
+	}
+	if *memoryLimit > 0 || *gcPercent != 0 {
+		slog.Info("Limiting memory", "limit", debug.SetMemoryLimit(-1), "gc_percent", *gcPercent)
+	}
+}
+
+// fatal logs an error and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// shutdown stops serving and scraping, waiting up to -shutdown.timeout for
+// the requests and scrapes in flight.
+func shutdown(e *exporter.Exporter, server *http.Server) {
+	notifyStopping()
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if server != nil {
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Warn("Could not finish the requests in flight", "err", err)
 		}
-		fallthrough
-	case 1: // Check sensor and if needed default intervals
-		if _, exists := sensor.AvailableCollectors[conf[0]]; !exists {
-			return nil, errors.New("Sensor " + conf[0] + " not found")
+	}
+	if err := e.Shutdown(ctx); err != nil {
+		slog.Warn("Could not shut down cleanly", "err", err)
+	}
+}
+
+// reloadOnHangup applies the configuration file again on every SIGHUP. If
+// it cannot be read the sensors, actions and helpers are left as they are.
+func reloadOnHangup(sources *sensorSources, actions *actuator.Actuator, helpers *supervisor.Supervisor, key []byte) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		slog.Info("Reloading configuration", "file", *configFile)
+		config, err := exporter.LoadConfig(*configFile)
+		if err != nil {
+			sensor.Incident()
+			slog.Error("Could not read configuration, keeping the sensors", "file", *configFile, "err", err)
+			continue
 		}
-		if interval == 0 { // Try to assign scraper's suggested interval
-			interval = sensor.AvailableCollectors[conf[0]].DefaultInterval
+		helpers.SetHelpers(config.Helpers)
+		if err := sources.apply(0, config.Sensors); err != nil {
+			sensor.Incident()
+			slog.Error("Could not add all sensors of configuration", "file", *configFile, "err", err)
 		}
-		if interval == 0 { // Assign our interval if all else failed
-			interval = defaultInterval
+		if err := decryptCommands(key, config); err != nil {
+			sensor.Incident()
+			slog.Error("Could not decrypt the actions of configuration, keeping the old ones", "file", *configFile, "err", err)
+			continue
 		}
-		// Add sensors TYPE and HELP texts if needed to our supportTexts list
-		for k, _ := range sensor.AvailableCollectors[conf[0]].Type {
-			supportTexts[sensor.AvailableCollectors[conf[0]].Type[k]] = true
-			supportTexts[sensor.AvailableCollectors[conf[0]].Help[k]] = true
+		actions.SetActions(config.Actions)
+		actions.SetTargets(config.Recovery)
+	}
+}
+
+// sensorSources are the sensors of -config, first, and of each of the
+// sensorStores, which are applied together, as Exporter.Apply replaces the
+// sensors of its earlier calls.
+type sensorSources struct {
+	mutex   sync.Mutex
+	e       *exporter.Exporter
+	sensors [][]exporter.SensorConfig
+}
+
+// apply makes sensors those of source i and applies the sensors of all
+// sources.
+func (s *sensorSources) apply(i int, sensors []exporter.SensorConfig) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sensors[i] = sensors
+	var all []exporter.SensorConfig
+	for _, sensors := range s.sensors {
+		all = append(all, sensors...)
+	}
+	return s.e.Apply(all)
+}
+
+// storeSensors returns the function a watch of a key-value store calls with
+// the values below prefix, which reads the sensors of them and passes them
+// to apply. If they cannot be read the sensors are left as they are.
+func storeSensors(store, prefix string, apply func(sensors []exporter.SensorConfig)) func(values map[string][]byte) {
+	return func(values map[string][]byte) {
+		sensors, err := exporter.ParseSensorKeys(values)
+		if err != nil {
+			sensor.Incident()
+			slog.Error("Could not read the sensors of the store, keeping the sensors", "store", store, "prefix", prefix, "err", err)
+			return
 		}
+		slog.Info("Applying the sensors of the store", "store", store, "prefix", prefix, "sensors", len(sensors))
+		apply(sensors)
+	}
+}
 
-	default:
-		return nil, errors.New("Could not create sensor")
+// decryptCommands decrypts the ENC[...] values of the NUT commands of the
+// actions and recovery targets.
+func decryptCommands(key []byte, config *exporter.FileConfig) error {
+	var commands []*actuator.Command
+	for _, a := range config.Actions {
+		commands = append(commands, a.Firing, a.Resolved)
+	}
+	for _, t := range config.Recovery {
+		commands = append(commands, t.Off, t.On)
 	}
+	for _, c := range commands {
+		if c == nil || c.NUT == nil {
+			continue
+		}
+		ups, err := exporter.Decrypt(key, c.NUT.UPS)
+		if err != nil {
+			return err
+		}
+		c.NUT.UPS = ups
+	}
+	return nil
+}
 
-	log.Printf("Adding scraper for sensor %s with interval %s and opts: %s\n", conf[0], interval, opts)
+// encryptValues prints the lines of stdin encrypted with key.
+func encryptValues(key []byte) {
+	if key == nil {
+		fatal("Encrypting needs a key, see -config.key-file")
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		value, err := exporter.Encrypt(key, scanner.Text())
+		if err != nil {
+			fatal("Could not encrypt", "err", err)
+		}
+		fmt.Println(value)
+	}
+}
 
-	collector, err := sensor.AvailableCollectors[conf[0]].New(opts)
-	if err != nil {
-		return nil, errors.New("Could not init sensor: " + err.Error())
+// sinks creates the outputs enabled by flags.
+func sinks() []output.Sink {
+	var sinks []output.Sink
+	if *csvDir != "" {
+		sink, err := output.NewCSV(*csvDir, *csvMaxSize, *csvMaxAge)
+		if err != nil {
+			fatal("Could not create CSV output", "err", err)
+		}
+		sinks = append(sinks, sink)
 	}
-	value, err := collector.Scrape()
-	if err != nil {
-		return nil, errors.New("Could not perform first scrape: " + err.Error())
+	for _, o := range outputs {
+		if sink := o(); sink != nil {
+			sinks = append(sinks, sink)
+		}
 	}
-	scraper := &Scraper{collector, interval, conf[0], value, &sync.RWMutex{}}
-	return scraper, nil
+	return sinks
 }
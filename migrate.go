@@ -0,0 +1,569 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// migrateSensor is a sensor of the configuration migrate prints.
+type migrateSensor struct {
+	Type     string `yaml:"type"`
+	Interval string `yaml:"interval,omitempty"`
+	Options  string `yaml:"options,omitempty"`
+}
+
+// A migration is the configuration migrated so far, and what could not be.
+type migration struct {
+	Sensors []migrateSensor `yaml:"sensors"`
+	notes   []string
+}
+
+func (m *migration) add(typ string, interval time.Duration, opts ...string) {
+	s := migrateSensor{Type: typ, Options: strings.Join(opts, ",")}
+	if interval != 0 {
+		s.Interval = interval.String()
+	}
+	m.Sensors = append(m.Sensors, s)
+}
+
+func (m *migration) note(format string, args ...any) {
+	m.notes = append(m.notes, fmt.Sprintf(format, args...))
+}
+
+// migrate reads the configuration of collectd or munin and prints a
+// configuration file with the sensors that read the same hardware, the
+// sensors, nut, apcups and hddtemp plugins of collectd and the sensors_,
+// nut, apc_nis and hddtemp plugins of munin. What is not migrated is listed
+// in comments.
+func migrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s migrate collectd [FILE...]\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "       %s migrate munin [PLUGINS-DIR [PLUGIN-CONF-DIR]]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	m := &migration{}
+	var err error
+	switch fs.Arg(0) {
+	case "collectd":
+		files := fs.Args()[1:]
+		if len(files) == 0 {
+			files = []string{"/etc/collectd/collectd.conf"}
+		}
+		err = m.collectd(files)
+	case "munin":
+		if fs.NArg() > 3 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		plugins, conf := "/etc/munin/plugins", "/etc/munin/plugin-conf.d"
+		if fs.NArg() > 1 {
+			plugins = fs.Arg(1)
+			conf = filepath.Join(filepath.Dir(filepath.Clean(plugins)), "plugin-conf.d")
+		}
+		if fs.NArg() > 2 {
+			conf = fs.Arg(2)
+		}
+		err = m.munin(plugins, conf)
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fatal("Could not migrate", "from", fs.Arg(0), "err", err)
+	}
+
+	fmt.Printf("# Migrated from %s by sensor_exporter migrate.\n", strings.Join(fs.Args(), " "))
+	for _, n := range m.notes {
+		fmt.Printf("# %s\n", n)
+	}
+	if len(m.Sensors) == 0 {
+		fmt.Println("# No sensors found.")
+		return
+	}
+	enc := yaml.NewEncoder(os.Stdout)
+	enc.SetIndent(2)
+	if err := enc.Encode(m); err != nil {
+		fatal("Could not write the configuration", "err", err)
+	}
+}
+
+// A collectdOption is an option of the collectd configuration, or a block
+// with the options in it.
+type collectdOption struct {
+	key      string
+	values   []string
+	children []collectdOption
+}
+
+// value returns the first value of the last option key of o, or def.
+func (o collectdOption) value(key, def string) string {
+	for i := len(o.children) - 1; i >= 0; i-- {
+		if c := o.children[i]; strings.EqualFold(c.key, key) && len(c.values) > 0 {
+			return c.values[0]
+		}
+	}
+	return def
+}
+
+// collectd migrates the plugins of the collectd configuration files.
+func (m *migration) collectd(files []string) error {
+	var options []collectdOption
+	for _, file := range files {
+		o, err := readCollectd(file, 0)
+		if err != nil {
+			return err
+		}
+		options = append(options, o...)
+	}
+
+	var interval time.Duration
+	loaded := map[string]time.Duration{}
+	var order []string
+	load := func(name string, d time.Duration) {
+		if _, ok := loaded[name]; !ok {
+			order = append(order, name)
+		}
+		loaded[name] = d
+	}
+	blocks := map[string][]collectdOption{}
+	for _, o := range options {
+		if len(o.values) == 0 {
+			continue
+		}
+		name := strings.ToLower(o.values[0])
+		switch strings.ToLower(o.key) {
+		case "interval":
+			d, err := collectdInterval(o.values[0])
+			if err != nil {
+				return err
+			}
+			interval = d
+		case "loadplugin":
+			d, err := collectdInterval(o.value("Interval", "0"))
+			if err != nil {
+				return err
+			}
+			load(name, d)
+		case "plugin":
+			if _, ok := loaded[name]; !ok {
+				load(name, 0)
+			}
+			blocks[name] = append(blocks[name], o)
+		}
+	}
+
+	var skipped []string
+	for _, name := range order {
+		d := loaded[name]
+		if d == 0 {
+			d = interval
+		}
+		conf := blocks[name]
+		switch name {
+		case "sensors":
+			m.collectdSensors(d, conf)
+		case "nut":
+			m.collectdNUT(d, conf)
+		case "apcups":
+			if len(conf) == 0 {
+				conf = []collectdOption{{}}
+			}
+			for _, c := range conf {
+				m.add("apcupsd", d, c.value("Host", "localhost")+":"+c.value("Port", "3551"))
+			}
+		case "hddtemp":
+			if len(conf) == 0 {
+				conf = []collectdOption{{}}
+			}
+			for _, c := range conf {
+				m.add("hddtemp", d, c.value("Host", "127.0.0.1")+":"+c.value("Port", "7634"))
+			}
+		default:
+			skipped = append(skipped, name)
+		}
+	}
+	if len(skipped) > 0 {
+		m.note("Plugins not migrated: %s.", strings.Join(skipped, ", "))
+	}
+	return nil
+}
+
+// collectdSensors migrates the sensors plugin of lm-sensors to hwmon.
+func (m *migration) collectdSensors(interval time.Duration, conf []collectdOption) {
+	var patterns []string
+	option := "include"
+	for _, c := range conf {
+		if strings.EqualFold(c.value("IgnoreSelected", "false"), "true") {
+			option = "exclude"
+		}
+		if file := c.value("SensorConfigFile", ""); file != "" {
+			m.note("sensors: the labels and limits of %s are not migrated.", file)
+		}
+		for _, o := range c.children {
+			if !strings.EqualFold(o.key, "Sensor") || len(o.values) == 0 {
+				continue
+			}
+			// CHIP-BUS-ADDRESS/TYPE-FEATURE, e.g.
+			// coretemp-isa-0000/temperature-temp1; hwmon has the
+			// chip name and the feature, the sysfs channel.
+			chip, feature, ok := strings.Cut(o.values[0], "/")
+			_, channel, found := strings.Cut(feature, "-")
+			if !ok || !found {
+				m.note("sensors: Sensor %q is not migrated.", o.values[0])
+				continue
+			}
+			chip, _, _ = strings.Cut(chip, "-")
+			patterns = append(patterns, option+"="+chip+"*/"+channel)
+		}
+	}
+	m.add("hwmon", interval, patterns...)
+}
+
+// collectdNUT migrates the nut plugin to upsc.
+func (m *migration) collectdNUT(interval time.Duration, conf []collectdOption) {
+	var opts []string
+	tls := false
+	for _, c := range conf {
+		for _, o := range c.children {
+			if strings.EqualFold(o.key, "UPS") && len(o.values) > 0 {
+				opts = append(opts, o.values[0])
+			}
+		}
+		if strings.EqualFold(c.value("ForceSSL", "false"), "true") {
+			tls = true
+		}
+		if strings.EqualFold(c.value("VerifyPeer", "false"), "true") {
+			m.note("nut: VerifyPeer with CAPath is not migrated, give the CA file with tls.ca_file.")
+		}
+	}
+	if len(opts) == 0 {
+		m.note("nut: no UPS configured.")
+		return
+	}
+	if tls {
+		opts = append(opts, "tls", "tls.insecure_skip_verify")
+	}
+	m.add("upsc", interval, opts...)
+}
+
+// collectdInterval parses an interval of collectd, in seconds.
+func collectdInterval(s string) (time.Duration, error) {
+	seconds, err := strconv.ParseFloat(s, 64)
+	if err != nil || seconds < 0 {
+		return 0, errors.New("bad Interval " + s)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// readCollectd reads the options of a collectd configuration file, with the
+// files it includes.
+func readCollectd(file string, depth int) ([]collectdOption, error) {
+	if depth > 8 {
+		return nil, errors.New("too many nested includes at " + file)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	root := &collectdOption{}
+	stack := []*collectdOption{root}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		for strings.HasSuffix(line, "\\") && scanner.Scan() {
+			n++
+			line = strings.TrimSuffix(line, "\\") + strings.TrimSpace(scanner.Text())
+		}
+		bad := fmt.Errorf("%s:%d: bad line %q", file, n, line)
+		block := strings.HasPrefix(line, "<")
+		if block {
+			if !strings.HasSuffix(line, ">") {
+				return nil, bad
+			}
+			line = strings.TrimSuffix(strings.TrimPrefix(line, "<"), ">")
+			if strings.HasPrefix(line, "/") {
+				if len(stack) == 1 || !strings.EqualFold(line[1:], stack[len(stack)-1].key) {
+					return nil, bad
+				}
+				stack = stack[:len(stack)-1]
+				continue
+			}
+		}
+		words, err := collectdWords(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", file, n, err)
+		}
+		if len(words) == 0 {
+			continue
+		}
+		o := collectdOption{key: words[0], values: words[1:]}
+		parent := stack[len(stack)-1]
+		if block {
+			parent.children = append(parent.children, o)
+			stack = append(stack, &parent.children[len(parent.children)-1])
+			continue
+		}
+		if strings.EqualFold(o.key, "Include") && len(o.values) > 0 {
+			included, err := includeCollectd(file, o.values[0], "", depth)
+			if err != nil {
+				return nil, err
+			}
+			parent.children = append(parent.children, included...)
+			continue
+		}
+		parent.children = append(parent.children, o)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(stack) > 1 {
+		return nil, fmt.Errorf("%s: unclosed <%s>", file, stack[len(stack)-1].key)
+	}
+	// <Include PATH> blocks, with a Filter of the file names.
+	var options []collectdOption
+	for _, o := range root.children {
+		if strings.EqualFold(o.key, "Include") && len(o.values) > 0 {
+			included, err := includeCollectd(file, o.values[0], o.value("Filter", ""), depth)
+			if err != nil {
+				return nil, err
+			}
+			options = append(options, included...)
+			continue
+		}
+		options = append(options, o)
+	}
+	return options, nil
+}
+
+// includeCollectd reads the files of an Include of file, a glob pattern or a
+// directory, whose files matching filter are read.
+func includeCollectd(file, pattern, filter string, depth int) ([]collectdOption, error) {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(file), pattern)
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("%s: bad Include %s: %w", file, pattern, err)
+	}
+	var options []collectdOption
+	for _, match := range matches {
+		files := []string{match}
+		if info, err := os.Stat(match); err == nil && info.IsDir() {
+			entries, err := os.ReadDir(match)
+			if err != nil {
+				return nil, err
+			}
+			files = files[:0]
+			for _, e := range entries {
+				if ok, _ := filepath.Match(filter, e.Name()); !e.IsDir() && (filter == "" || ok) {
+					files = append(files, filepath.Join(match, e.Name()))
+				}
+			}
+		}
+		for _, f := range files {
+			o, err := readCollectd(f, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			options = append(options, o...)
+		}
+	}
+	return options, nil
+}
+
+// collectdWords splits a line of collectd into its words, unquoting quoted
+// strings and dropping comments.
+func collectdWords(line string) ([]string, error) {
+	var words []string
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" || line[0] == '#' {
+			return words, nil
+		}
+		if line[0] != '"' {
+			end := strings.IndexAny(line, " \t#")
+			if end < 0 {
+				end = len(line)
+			}
+			words = append(words, line[:end])
+			line = line[end:]
+			continue
+		}
+		var word strings.Builder
+		i := 1
+		for ; i < len(line) && line[i] != '"'; i++ {
+			if line[i] == '\\' && i+1 < len(line) {
+				i++
+			}
+			word.WriteByte(line[i])
+		}
+		if i == len(line) {
+			return nil, errors.New("unterminated string")
+		}
+		words = append(words, word.String())
+		line = line[i+1:]
+	}
+}
+
+// munin migrates the plugins linked in the plugins directory of munin-node,
+// with the environment of their plugin-conf.d sections.
+func (m *migration) munin(pluginDir, confDir string) error {
+	entries, err := os.ReadDir(pluginDir)
+	if err != nil {
+		return err
+	}
+	env, err := readMuninConf(confDir)
+	if err != nil {
+		return err
+	}
+
+	var hwmon, ups, skipped []string
+	for _, e := range entries {
+		name := e.Name()
+		plugin := env(name)
+		switch {
+		case strings.HasPrefix(name, "sensors_"):
+			switch name[len("sensors_"):] {
+			case "temp":
+				hwmon = append(hwmon, "include=*/temp*")
+			case "fan":
+				hwmon = append(hwmon, "include=*/fan*")
+			case "volt":
+				hwmon = append(hwmon, "include=*/in*")
+			default:
+				skipped = append(skipped, name)
+			}
+		case strings.HasPrefix(name, "nutups_"):
+			// nutups_UPS_MODE
+			i := strings.LastIndex(name, "_")
+			if i <= len("nutups_") {
+				skipped = append(skipped, name)
+				continue
+			}
+			ups = append(ups, name[len("nutups_"):i])
+		case name == "nut_misc" || name == "nut_volts":
+			ups = append(ups, plugin("upsname", "ups@localhost"))
+		case name == "apc_nis":
+			m.add("apcupsd", 0, plugin("host", "localhost")+":"+plugin("port", "3551"))
+		case name == "hddtempd":
+			m.add("hddtemp", 0, plugin("hostname", "localhost")+":"+plugin("port", "7634"))
+		case name == "hddtemp_smartctl":
+			var devices []string
+			for _, drive := range strings.Fields(plugin("drives", "")) {
+				if !strings.HasPrefix(drive, "/") {
+					drive = "/dev/" + drive
+				}
+				devices = append(devices, "device="+drive)
+			}
+			m.add("smart", 0, devices...)
+		default:
+			skipped = append(skipped, name)
+		}
+	}
+	if len(hwmon) > 0 {
+		if len(hwmon) == 3 {
+			hwmon = nil
+		}
+		m.add("hwmon", 0, hwmon...)
+	}
+	if len(ups) > 0 {
+		sort.Strings(ups)
+		m.add("upsc", 0, slices.Compact(ups)...)
+	}
+	if len(skipped) > 0 {
+		m.note("Plugins not migrated: %s.", strings.Join(skipped, ", "))
+	}
+	return nil
+}
+
+// readMuninConf reads the plugin-conf.d directory of munin-node, and returns
+// the environment of a plugin: its env.NAME setting, or def. Sections named
+// after the plugin win over those matching it with a wildcard.
+func readMuninConf(dir string) (func(plugin string) func(name, def string) string, error) {
+	type section struct {
+		pattern string
+		env     map[string]string
+	}
+	var sections []*section
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if info, err := os.Stat(file); err != nil || info.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var s *section
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || line[0] == '#' {
+				continue
+			}
+			if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+				s = &section{pattern: line[1 : len(line)-1], env: map[string]string{}}
+				sections = append(sections, s)
+				continue
+			}
+			key, value, _ := strings.Cut(line, " ")
+			if s != nil && strings.HasPrefix(key, "env.") {
+				s.env[key[len("env."):]] = strings.TrimSpace(value)
+			}
+		}
+	}
+	return func(plugin string) func(name, def string) string {
+		env := map[string]string{}
+		for _, exact := range []bool{false, true} {
+			for _, s := range sections {
+				ok, _ := filepath.Match(s.pattern, plugin)
+				if ok && (s.pattern == plugin) == exact {
+					for k, v := range s.env {
+						env[k] = v
+					}
+				}
+			}
+		}
+		return func(name, def string) string {
+			if v, ok := env[name]; ok {
+				return v
+			}
+			return def
+		}
+	}, nil
+}
@@ -0,0 +1,436 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package modbus talks to Modbus RTU slaves on a serial line, or on a serial to
+network bridge (tcp://host:port, see serial.Connect), and to Modbus TCP
+devices (modbus-tcp://host[:port], port 502 by default). It is a helper for
+sensors, not a sensor itself.
+
+Several slaves often share one RS-485 line or gateway, each read by its own
+sensor. Open returns the same Bus for the same device, and a Bus serializes
+all requests on it: one transaction at a time, with the silent interval the
+RTU framing needs between frames. A request whose answer has a bad CRC or
+does not come in time is retried, as both happen on long or noisy lines.
+Exception responses of a slave are returned as errors and not retried.
+
+The line or connection is opened with the first request and closed after an
+I/O error, to be opened again by the next request. After a failed attempt the
+next ones are delayed, doubling up to MaxBackoff, so that an unreachable
+gateway is not dialed on every scrape.
+*/
+package modbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+	"github.com/fmoessbauer/sensor_exporter/serial"
+)
+
+// Function codes.
+const (
+	ReadCoils              = 0x01
+	ReadDiscreteInputs     = 0x02
+	ReadHoldingRegisters   = 0x03
+	ReadInputRegisters     = 0x04
+	WriteSingleCoil        = 0x05
+	WriteSingleRegister    = 0x06
+	WriteMultipleCoils     = 0x0F
+	WriteMultipleRegisters = 0x10
+)
+
+var (
+	// Timeout is how long a slave has to start answering.
+	Timeout = 1 * time.Second
+	// Retries is how often a request is repeated after a CRC error or a
+	// timeout.
+	Retries = 2
+	// MaxBackoff is the longest delay between attempts to open a bus.
+	MaxBackoff = 5 * time.Minute
+)
+
+// tcpScheme is the device prefix of Modbus TCP devices.
+const tcpScheme = "modbus-tcp://"
+
+// ErrCRC is returned, after the retries, for answers with a bad checksum.
+var ErrCRC = errors.New("modbus: bad CRC")
+
+// ErrBackoff is returned for requests while a bus that failed to open waits
+// for its next attempt.
+var ErrBackoff = errors.New("modbus: waiting to reconnect")
+
+// An Exception is the error code a slave answers a request with.
+type Exception byte
+
+func (e Exception) Error() string {
+	return fmt.Sprintf("modbus: exception %d", byte(e))
+}
+
+// Stats count the requests sent to a slave, including retries, and how many
+// of them failed with a bad CRC or a timeout.
+type Stats struct {
+	Requests, CRCErrors, Timeouts int
+}
+
+// A Bus is a serial line, or a Modbus TCP connection, shared by the sensors
+// that read slaves on it. Its methods may be called concurrently.
+type Bus struct {
+	Device string
+
+	config   serial.Config
+	tcp      bool   // MBAP framing instead of RTU
+	tid      uint16 // last transaction identifier, for tcp
+	port     io.ReadWriteCloser
+	delay    time.Duration // silent interval between frames
+	last     time.Time     // end of the last frame on the line
+	retry    time.Time     // no attempt to open the port before
+	failures int           // failed attempts to open the port in a row
+	refs     int
+	mutex    sync.Mutex
+
+	// Counters for sensors to export, by slave, under mutex.
+	stats map[byte]*Stats
+}
+
+var (
+	buses      = make(map[string]*Bus)
+	busesMutex sync.Mutex
+)
+
+// Open returns the bus of device, with the line settings c for the first
+// call. Later calls get the same bus, whatever their settings. The device is
+// opened with the first request, so Open fails only for malformed devices.
+func Open(device string, c serial.Config) (*Bus, error) {
+	busesMutex.Lock()
+	defer busesMutex.Unlock()
+	if b, exists := buses[device]; exists {
+		b.refs++
+		return b, nil
+	}
+	b := &Bus{Device: device, config: c, delay: frameDelay(c), refs: 1, stats: make(map[byte]*Stats)}
+	if address, ok := strings.CutPrefix(device, tcpScheme); ok {
+		if address == "" {
+			return nil, errors.New("modbus: no address in " + device)
+		}
+		b.tcp = true
+	}
+	buses[device] = b
+	return b, nil
+}
+
+// frameDelay is the silent interval of 3.5 characters, of 11 bits each,
+// which the specification fixes at 1.75ms above 19200 baud.
+func frameDelay(c serial.Config) time.Duration {
+	if c.Baud == 0 || c.Baud > 19200 {
+		return 1750 * time.Microsecond
+	}
+	return time.Duration(3.5 * 11 * float64(time.Second) / float64(c.Baud))
+}
+
+// Close releases the bus. The line is closed when no sensor uses it anymore.
+func (b *Bus) Close() error {
+	busesMutex.Lock()
+	defer busesMutex.Unlock()
+	b.refs--
+	if b.refs > 0 {
+		return nil
+	}
+	delete(buses, b.Device)
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.port == nil {
+		return nil
+	}
+	return b.port.Close()
+}
+
+// Stats returns the counters of the requests sent to slave.
+func (b *Bus) Stats(slave byte) Stats {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if s, exists := b.stats[slave]; exists {
+		return *s
+	}
+	return Stats{}
+}
+
+// Connected tells whether the port is open.
+func (b *Bus) Connected() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.port != nil
+}
+
+// connect opens the port if it is not open, unless a failed attempt was too
+// recent. It is called with the mutex held.
+func (b *Bus) connect() error {
+	if b.port != nil {
+		return nil
+	}
+	if time.Now().Before(b.retry) {
+		return ErrBackoff
+	}
+	var port io.ReadWriteCloser
+	var err error
+	if address, ok := strings.CutPrefix(b.Device, tcpScheme); ok {
+		if _, _, e := net.SplitHostPort(address); e != nil {
+			address = net.JoinHostPort(address, "502")
+		}
+		port, err = serial.Connect("tcp://"+address, b.config)
+	} else {
+		port, err = serial.Connect(b.Device, b.config)
+	}
+	if err != nil {
+		if b.failures == 0 {
+			slog.Error("Modbus could not open bus, retrying with backoff", "device", b.Device, "err", err)
+		}
+		backoff := time.Second << uint(b.failures)
+		if backoff > MaxBackoff || backoff <= 0 {
+			backoff = MaxBackoff
+		}
+		b.retry = time.Now().Add(backoff)
+		b.failures++
+		return err
+	}
+	if b.failures > 0 {
+		slog.Info("Modbus opened bus again", "device", b.Device, "failed_attempts", b.failures)
+	}
+	b.port, b.failures, b.last = port, 0, time.Now()
+	return nil
+}
+
+// disconnect closes the port after an error, for the next request to open
+// it again. It is called with the mutex held.
+func (b *Bus) disconnect() {
+	if b.port != nil {
+		b.port.Close()
+		b.port = nil
+	}
+}
+
+// ReadRegisters reads count holding (ReadHoldingRegisters) or input
+// (ReadInputRegisters) registers of slave, starting at address.
+func (b *Bus) ReadRegisters(slave, function byte, address, count uint16) ([]uint16, error) {
+	regs, _, err := b.ReadRegistersTries(slave, function, address, count)
+	return regs, err
+}
+
+// ReadRegistersTries is ReadRegisters that also returns how many requests it
+// took, more than one if the answers to the first had a bad CRC or did not
+// come in time.
+func (b *Bus) ReadRegistersTries(slave, function byte, address, count uint16) ([]uint16, int, error) {
+	req := make([]byte, 4)
+	binary.BigEndian.PutUint16(req, address)
+	binary.BigEndian.PutUint16(req[2:], count)
+	data, tries, err := b.request(slave, function, req)
+	if err != nil {
+		return nil, tries, err
+	}
+	if len(data) != 1+2*int(count) || int(data[0]) != 2*int(count) {
+		return nil, tries, errors.New("modbus: unexpected response length")
+	}
+	regs := make([]uint16, count)
+	for i := range regs {
+		regs[i] = binary.BigEndian.Uint16(data[1+2*i:])
+	}
+	return regs, tries, nil
+}
+
+// Request sends a request with the given function code and data to slave
+// and returns the data of the response, without address, function and CRC.
+func (b *Bus) Request(slave, function byte, data []byte) ([]byte, error) {
+	res, _, err := b.request(slave, function, data)
+	return res, err
+}
+
+// request is Request that also returns how many requests it sent.
+func (b *Bus) request(slave, function byte, data []byte) ([]byte, int, error) {
+	frame := append([]byte{slave, function}, data...)
+	if !b.tcp {
+		frame = binary.LittleEndian.AppendUint16(frame, crc(frame))
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	stats, exists := b.stats[slave]
+	if !exists {
+		stats = &Stats{}
+		b.stats[slave] = stats
+	}
+	var err error
+	try := 0
+	for ; try <= Retries; try++ {
+		if err = b.connect(); err != nil {
+			return nil, try, err
+		}
+		stats.Requests++
+		var res []byte
+		if b.tcp {
+			res, err = b.tcpTransaction(frame)
+		} else {
+			res, err = b.transaction(frame)
+		}
+		sensor.RecordExchange(sensor.Exchange{Collector: "modbus", Device: b.Device, Sent: frame, Received: res})
+		switch {
+		case err == ErrCRC:
+			stats.CRCErrors++
+		case isTimeout(err):
+			stats.Timeouts++
+		case err != nil:
+			b.disconnect()
+			return nil, try + 1, err
+		default:
+			if res[0] != slave || res[1]&0x7F != function {
+				return nil, try + 1, errors.New("modbus: response from another slave or function")
+			}
+			if res[1]&0x80 != 0 {
+				return nil, try + 1, Exception(res[2])
+			}
+			return res[2:], try + 1, nil
+		}
+		// Let whatever is left of the bad answer pass before trying again.
+		// A late answer over TCP could still come, so start over there.
+		if b.tcp {
+			b.disconnect()
+		} else {
+			b.drain()
+		}
+	}
+	return nil, try, err
+}
+
+// tcpTransaction sends a frame, without CRC, with an MBAP header and reads
+// the answer, returned without its header. It is called with the mutex held.
+func (b *Bus) tcpTransaction(frame []byte) ([]byte, error) {
+	b.tid++
+	req := make([]byte, 6, 6+len(frame))
+	binary.BigEndian.PutUint16(req, b.tid)
+	binary.BigEndian.PutUint16(req[4:], uint16(len(frame)))
+	if _, err := b.port.Write(append(req, frame...)); err != nil {
+		return nil, err
+	}
+	b.deadline(time.Now().Add(Timeout))
+	defer b.deadline(time.Time{})
+
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(b.port, header); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint16(header[4:])
+	if binary.BigEndian.Uint16(header[2:]) != 0 || n < 3 || n > 254 {
+		return nil, errors.New("modbus: bad MBAP header")
+	}
+	res := make([]byte, n)
+	if _, err := io.ReadFull(b.port, res); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint16(header) != b.tid {
+		return nil, errors.New("modbus: answer to another transaction")
+	}
+	return res, nil
+}
+
+// transaction sends a frame and reads the answer, returned without its CRC,
+// waiting for the silent interval before. It is called with the mutex held.
+func (b *Bus) transaction(frame []byte) ([]byte, error) {
+	if wait := b.delay - time.Since(b.last); wait > 0 {
+		time.Sleep(wait)
+	}
+	defer func() { b.last = time.Now() }()
+	if _, err := b.port.Write(frame); err != nil {
+		return nil, err
+	}
+	b.deadline(time.Now().Add(Timeout))
+	defer b.deadline(time.Time{})
+
+	res := make([]byte, 3, 256)
+	if _, err := io.ReadFull(b.port, res); err != nil {
+		return nil, err
+	}
+	// The rest of the answer is a byte count and as many bytes, four bytes
+	// for writes or none for exceptions, then the CRC.
+	rest := 2
+	switch {
+	case res[1]&0x80 != 0:
+	case res[1] <= ReadInputRegisters:
+		rest += int(res[2])
+	default:
+		rest += 3
+	}
+	// A byte count beyond what fits an RTU frame of 256 bytes is noise.
+	if 3+rest > cap(res) {
+		return nil, errors.New("modbus: bad byte count")
+	}
+	res = res[:3+rest]
+	if _, err := io.ReadFull(b.port, res[3:]); err != nil {
+		return nil, err
+	}
+	if crc(res[:len(res)-2]) != binary.LittleEndian.Uint16(res[len(res)-2:]) {
+		return nil, ErrCRC
+	}
+	return res[:len(res)-2], nil
+}
+
+// deadline sets the read deadline of the port, if it supports one.
+func (b *Bus) deadline(t time.Time) {
+	if d, ok := b.port.(interface{ SetReadDeadline(time.Time) error }); ok {
+		d.SetReadDeadline(t)
+	}
+}
+
+// drain reads and drops input until the line has been silent for a while.
+func (b *Bus) drain() {
+	buf := make([]byte, 256)
+	for {
+		b.deadline(time.Now().Add(b.delay + 50*time.Millisecond))
+		if n, err := b.port.Read(buf); n == 0 || err != nil {
+			break
+		}
+	}
+	b.deadline(time.Time{})
+	b.last = time.Now()
+}
+
+func isTimeout(err error) bool {
+	t, ok := err.(interface{ Timeout() bool })
+	return ok && t.Timeout()
+}
+
+// crc is the CRC-16/MODBUS of data, sent low byte first.
+func crc(data []byte) uint16 {
+	c := uint16(0xFFFF)
+	for _, b := range data {
+		c ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if c&1 != 0 {
+				c = c>>1 ^ 0xA001
+			} else {
+				c >>= 1
+			}
+		}
+	}
+	return c
+}
@@ -0,0 +1,54 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package modbus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// line is a serial line that answers with the bytes it was given.
+type line struct {
+	io.Reader
+}
+
+func (line) Write(b []byte) (int, error) { return len(b), nil }
+func (line) Close() error                { return nil }
+
+func FuzzTransaction(f *testing.F) {
+	withCRC := func(b []byte) []byte { return binary.LittleEndian.AppendUint16(b, crc(b)) }
+	f.Add(withCRC([]byte{1, ReadHoldingRegisters, 4, 0, 1, 0, 2}))
+	f.Add(withCRC([]byte{1, ReadHoldingRegisters | 0x80, 2}))
+	f.Add(withCRC([]byte{1, 6, 0, 1, 0, 3}))
+	f.Add([]byte{1, ReadHoldingRegisters, 255})
+	f.Fuzz(func(t *testing.T, answer []byte) {
+		b := &Bus{port: line{bytes.NewReader(answer)}}
+		res, err := b.transaction(withCRC([]byte{1, ReadHoldingRegisters, 0, 0, 0, 2}))
+		if err != nil {
+			return
+		}
+		if len(res) < 3 || len(res) > 254 {
+			t.Fatalf("response of %d bytes", len(res))
+		}
+		if !bytes.Equal(res, answer[:len(res)]) {
+			t.Errorf("response %x is not the start of the answer %x", res, answer)
+		}
+	})
+}
@@ -0,0 +1,204 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package oauth gets and refreshes the OAuth2 tokens of the vendor cloud APIs
+that sensors read. It is a helper for sensors, not a sensor itself.
+
+Two grants are supported: client credentials, for APIs where the client ID
+and secret are enough, and refresh tokens, for APIs where the user authorizes
+the client once (Netatmo, ...) and puts the refresh token they got in the
+options of the sensor:
+
+	client, err := oauth.Client(oauth.Config{
+		TokenURL:     "https://api.netatmo.com/oauth2/token",
+		ClientID:     id,
+		ClientSecret: secret,
+		RefreshToken: refresh,
+		Cache:        "/var/lib/sensor_exporter/netatmo.json",
+	})
+
+The returned client adds the token to its requests and refreshes it before it
+expires. Sensors with the same token URL, client ID and cache share one token,
+as many vendors rotate the refresh token on every refresh and invalidate the
+old one.
+
+The token is kept in Cache, if set, so that a restart neither needs a new
+authorization nor uses a refresh token that was rotated meanwhile. Delete it after authorizing the client
+again, as the cached refresh token is preferred to the configured one. The
+file is written with mode 0600; it holds credentials, keep it on a private
+directory.
+*/
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// Config configures the token of a client.
+type Config struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	// RefreshToken selects the refresh token grant; without it the client
+	// credentials grant is used.
+	RefreshToken string
+	// Cache is the file the token is kept in between runs, if set.
+	Cache string
+}
+
+var (
+	sourcesMutex sync.Mutex
+	sources      = make(map[string]oauth2.TokenSource)
+)
+
+// Client returns an HTTP client that authorizes its requests with the token
+// of c.
+func Client(c Config) (*http.Client, error) {
+	ts, err := TokenSource(c)
+	if err != nil {
+		return nil, err
+	}
+	return oauth2.NewClient(context.Background(), ts), nil
+}
+
+// TokenSource returns the token source of c, shared with the other sensors
+// that use the same client.
+func TokenSource(c Config) (oauth2.TokenSource, error) {
+	if c.TokenURL == "" || c.ClientID == "" {
+		return nil, errors.New("OAuth needs a token URL and a client ID")
+	}
+	key := strings.Join([]string{c.TokenURL, c.ClientID, c.Cache}, "\x00")
+	sourcesMutex.Lock()
+	defer sourcesMutex.Unlock()
+	if ts, ok := sources[key]; ok {
+		return ts, nil
+	}
+
+	cached, err := load(c.Cache)
+	if err != nil {
+		return nil, errors.New("OAuth could not read token cache: " + err.Error())
+	}
+	ctx := context.Background()
+	var ts oauth2.TokenSource
+	if c.RefreshToken != "" {
+		conf := &oauth2.Config{ClientID: c.ClientID, ClientSecret: c.ClientSecret,
+			Endpoint: oauth2.Endpoint{TokenURL: c.TokenURL}, Scopes: c.Scopes}
+		// A cached token was refreshed after the configured one was issued.
+		if cached == nil || cached.RefreshToken == "" {
+			cached = &oauth2.Token{RefreshToken: c.RefreshToken}
+		}
+		ts = conf.TokenSource(ctx, cached)
+	} else {
+		conf := &clientcredentials.Config{ClientID: c.ClientID, ClientSecret: c.ClientSecret,
+			TokenURL: c.TokenURL, Scopes: c.Scopes}
+		ts = oauth2.ReuseTokenSource(cached, conf.TokenSource(ctx))
+	}
+	if c.Cache != "" {
+		ts = &cachingSource{source: ts, file: c.Cache, last: cached}
+	}
+	sources[key] = ts
+	return ts, nil
+}
+
+// cachingSource writes the tokens of source to file as they change.
+type cachingSource struct {
+	source oauth2.TokenSource
+	file   string
+
+	mutex sync.Mutex
+	last  *oauth2.Token
+}
+
+func (s *cachingSource) Token() (*oauth2.Token, error) {
+	t, err := s.source.Token()
+	if err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.last == nil || s.last.AccessToken != t.AccessToken || s.last.RefreshToken != t.RefreshToken {
+		if err := save(s.file, t); err != nil {
+			sensor.Incident()
+			slog.Warn("OAuth could not write token cache", "file", s.file, "err", err)
+		}
+		s.last = t
+	}
+	return t, nil
+}
+
+// load reads the token cached in file, nil if there is none.
+func load(file string) (*oauth2.Token, error) {
+	if file == "" {
+		return nil, nil
+	}
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err == nil && fi.Mode().Perm()&0077 != 0 {
+		slog.Warn("OAuth token cache is readable by others, it should have mode 0600", "file", file)
+	}
+	t := &oauth2.Token{}
+	if err := json.NewDecoder(f).Decode(t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// save writes t to file, through a temporary file so that a crash does not
+// lose the token.
+func save(file string, t *oauth2.Token) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	// CreateTemp makes it 0600.
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,96 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package output
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+// WaitForClockSync makes the outputs that time their readings for later,
+// the remote write Pusher and IoT, hold them while the wall clock is not
+// synchronized yet, e.g. on a device without a real time clock that boots
+// at the time it last shut down until NTP sets it. Once it is, the held
+// readings are sent in order, timed by the monotonic clock: now, less how
+// long ago they were read.
+var WaitForClockSync bool
+
+// clockSynced tells whether the wall clock is synchronized; clock_linux.go
+// asks the kernel. Elsewhere it always is.
+var clockSynced = func() bool { return true }
+
+// maxHeld is the most sends a holdback holds; the oldest are dropped beyond.
+var maxHeld = 1000
+
+// A holdback holds the sends of the readings of an output while the clock
+// is not synchronized, see WaitForClockSync.
+type holdback struct {
+	name  string // of the output, for the log
+	mutex sync.Mutex
+	held  []heldSend
+}
+
+type heldSend struct {
+	t    time.Time // with its monotonic clock reading
+	send func(t time.Time) error
+}
+
+// do calls send with t, the time of the readings it sends, once the clock
+// is synchronized, after the sends held before; it returns the error of
+// send, or nil if it is held. The errors of held sends are logged.
+func (h *holdback) do(t time.Time, send func(t time.Time) error) error {
+	if !WaitForClockSync {
+		return send(t)
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if !clockSynced() {
+		if len(h.held) == 0 {
+			slog.Warn("Holding readings until the clock is synchronized", "output", h.name)
+		}
+		if len(h.held) == maxHeld {
+			sensor.Incident()
+			slog.Warn("Too many readings held until the clock is synchronized, dropping the oldest", "output", h.name)
+			h.held = h.held[1:]
+		}
+		h.held = append(h.held, heldSend{t, send})
+		return nil
+	}
+	if len(h.held) > 0 {
+		slog.Info("Clock synchronized, sending the readings held", "output", h.name, "count", len(h.held))
+	}
+	for _, s := range h.held {
+		if err := s.send(anchor(s.t)); err != nil {
+			sensor.Incident()
+			slog.Error("Could not send readings held until the clock was synchronized", "output", h.name, "err", err)
+		}
+	}
+	h.held = nil
+	return send(anchor(t))
+}
+
+// anchor re-anchors t to the wall clock now by the monotonic clock, for
+// times read before the wall clock was set. Times without a monotonic clock
+// reading are returned as they are.
+func anchor(t time.Time) time.Time {
+	now := time.Now()
+	return now.Add(-now.Sub(t))
+}
@@ -0,0 +1,136 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package output
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+// CSV appends readings to CSV files in long format, one row per sample:
+//
+//	time,metric,labels,value
+//	2026-10-16T09:10:00.000Z,temperature_celsius,"{""sensor"":""sda""}",38
+//
+// Labels are a JSON object, so the files can be loaded as they are into a
+// table with a jsonb column (e.g. with TimescaleDB's COPY or
+// timescaledb-parallel-copy). A new file is started when the current one
+// reaches maxSize bytes or gets older than maxAge, so that finished files
+// can be picked up while the exporter runs.
+type CSV struct {
+	dir     string
+	maxSize int64
+	maxAge  time.Duration
+
+	mutex  sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+var csvHeader = []string{"time", "metric", "labels", "value"}
+
+// NewCSV writes files to dir, which is created if needed.
+func NewCSV(dir string, maxSize int64, maxAge time.Duration) (*CSV, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &CSV{dir: dir, maxSize: maxSize, maxAge: maxAge}, nil
+}
+
+func (c *CSV) Write(t time.Time, sensorType string, samples []sensor.Sample) error {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	ts := t.UTC().Format("2006-01-02T15:04:05.000Z")
+	for _, s := range samples {
+		js, err := json.Marshal(labelMap(s.Labels))
+		if err != nil {
+			return err
+		}
+		w.Write([]string{ts, s.Name, string(js), strconv.FormatFloat(s.Value, 'g', -1, 64)})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.f == nil || (c.maxSize > 0 && c.size >= c.maxSize) ||
+		(c.maxAge > 0 && time.Since(c.opened) >= c.maxAge) {
+		if err := c.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := c.f.Write(buf.Bytes())
+	c.size += int64(n)
+	return err
+}
+
+// rotate closes the current file and starts a new one.
+func (c *CSV) rotate() error {
+	if c.f != nil {
+		c.f.Sync()
+		c.f.Close()
+		c.f = nil
+	}
+	now := time.Now()
+	base := "readings-" + now.UTC().Format("20060102T150405Z")
+	name := filepath.Join(c.dir, base+".csv")
+	for i := 1; ; i++ {
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			break
+		}
+		name = filepath.Join(c.dir, fmt.Sprintf("%s-%d.csv", base, i))
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write(csvHeader)
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	c.f, c.size, c.opened = f, 0, now
+	return nil
+}
+
+// Close syncs and closes the current file.
+func (c *CSV) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.f == nil {
+		return nil
+	}
+	c.f.Sync()
+	err := c.f.Close()
+	c.f = nil
+	return err
+}
@@ -0,0 +1,220 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+//go:build !minimal || output_push
+
+package output
+
+import (
+	"errors"
+	"math"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Downsample configures what a Pusher in remote write mode sends of the
+// values it gathers, to save the bandwidth of sites on a cellular or LoRa
+// backhaul: of every Window, aligned to the clock, one value aggregated from
+// those gathered in it, e.g. the 1 minute average of readings taken every 10
+// seconds. The first of Overrides whose Metric matches the name of a metric
+// decides for it instead. A zero Window sends every value.
+type Downsample struct {
+	Window time.Duration
+	// Aggregation is avg (the default), min, max or last; counters are
+	// always sent as the last value, unless an override says otherwise.
+	Aggregation string
+	Overrides   []DownsampleRule
+}
+
+// A DownsampleRule sets the window and aggregation of the metrics whose name
+// matches the regular expression Metric.
+type DownsampleRule struct {
+	Metric      string
+	Window      time.Duration
+	Aggregation string // that of the Downsample if empty
+
+	re *regexp.Regexp
+}
+
+// ParseDownsampleRules parses comma separated rules METRIC=WINDOW or
+// METRIC=WINDOW:AGGREGATION, e.g. rain_.*=0,ups_status=5m:last.
+func ParseDownsampleRules(s string) ([]DownsampleRule, error) {
+	var rules []DownsampleRule
+	for _, rule := range strings.Split(s, ",") {
+		if rule == "" {
+			continue
+		}
+		i := strings.LastIndex(rule, "=")
+		if i < 0 {
+			return nil, errors.New("bad downsample rule, expected METRIC=WINDOW[:AGGREGATION]: " + rule)
+		}
+		r := DownsampleRule{Metric: rule[:i]}
+		window, aggregation, _ := strings.Cut(rule[i+1:], ":")
+		var err error
+		if r.Window, err = time.ParseDuration(window); err != nil {
+			return nil, errors.New("bad downsample window: " + window)
+		}
+		r.Aggregation = aggregation
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// compile checks d and compiles the expressions of its overrides.
+func (d *Downsample) compile() error {
+	if !validAggregation(d.Aggregation) {
+		return errors.New("bad downsample aggregation " + d.Aggregation + ", expected avg, min, max or last")
+	}
+	for i := range d.Overrides {
+		r := &d.Overrides[i]
+		if !validAggregation(r.Aggregation) {
+			return errors.New("bad downsample aggregation " + r.Aggregation + ", expected avg, min, max or last")
+		}
+		re, err := regexp.Compile("^(?:" + r.Metric + ")$")
+		if err != nil {
+			return errors.New("bad downsample metric: " + err.Error())
+		}
+		r.re = re
+	}
+	return nil
+}
+
+func validAggregation(a string) bool {
+	return a == "" || a == "avg" || a == "min" || a == "max" || a == "last"
+}
+
+// enabled tells whether d sends less than every value of some metric.
+func (d *Downsample) enabled() bool {
+	if d.Window > 0 {
+		return true
+	}
+	for _, r := range d.Overrides {
+		if r.Window > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// rule returns the window and aggregation of the metric name.
+func (d *Downsample) rule(name string, counter bool) (time.Duration, string) {
+	for _, r := range d.Overrides {
+		if r.re.MatchString(name) {
+			if r.Aggregation != "" {
+				return r.Window, r.Aggregation
+			}
+			return r.Window, d.aggregation(counter)
+		}
+	}
+	return d.Window, d.aggregation(counter)
+}
+
+func (d *Downsample) aggregation(counter bool) string {
+	switch {
+	case counter:
+		return "last"
+	case d.Aggregation == "":
+		return "avg"
+	}
+	return d.Aggregation
+}
+
+// A downsampler aggregates the values of series over their windows.
+type downsampler struct {
+	d      Downsample
+	series map[string]*window
+}
+
+// A window is the aggregate of the values of a series gathered in a window.
+type window struct {
+	sample      sensor.Sample
+	aggregation string
+	size        time.Duration
+	start       time.Time // of the window, a multiple of size
+	last        time.Time // of the last value
+	sum         float64
+	n           int // values in sum, NaNs left out
+}
+
+// add adds the values of families gathered at t and returns those to send:
+// the aggregates of the windows that ended and the values of the metrics
+// without a window.
+func (ds *downsampler) add(families []*dto.MetricFamily, t time.Time) []TimedSample {
+	var out []TimedSample
+	for key, w := range ds.series {
+		if !t.Truncate(w.size).Equal(w.start) {
+			out = append(out, w.point())
+			delete(ds.series, key)
+		}
+	}
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			value, ok := metricValue(m)
+			if !ok {
+				continue
+			}
+			sample := sensor.Sample{Name: mf.GetName(), Labels: metricLabels(m), Value: value}
+			size, aggregation := ds.d.rule(sample.Name, m.Counter != nil)
+			if size <= 0 {
+				out = append(out, TimedSample{Sample: sample, Time: t})
+				continue
+			}
+			key := sample.Name + sensor.LabelString(sample.Labels)
+			w, exists := ds.series[key]
+			if !exists {
+				w = &window{sample: sample, aggregation: aggregation, size: size, start: t.Truncate(size)}
+				ds.series[key] = w
+			}
+			w.add(value, t)
+		}
+	}
+	return out
+}
+
+// add adds the value gathered at t.
+func (w *window) add(value float64, t time.Time) {
+	w.last = t
+	if math.IsNaN(value) {
+		if w.n == 0 {
+			w.sample.Value = value
+		}
+		return
+	}
+	switch {
+	case w.n == 0 || w.aggregation == "last":
+		w.sample.Value = value
+	case w.aggregation == "min":
+		w.sample.Value = math.Min(w.sample.Value, value)
+	case w.aggregation == "max":
+		w.sample.Value = math.Max(w.sample.Value, value)
+	}
+	w.sum += value
+	w.n++
+}
+
+// point is the aggregate of the window at the time of its last value.
+func (w *window) point() TimedSample {
+	sample := w.sample
+	if w.aggregation == "avg" && w.n > 0 {
+		sample.Value = w.sum / float64(w.n)
+	}
+	return TimedSample{Sample: sample, Time: w.last}
+}
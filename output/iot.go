@@ -0,0 +1,291 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+//go:build !minimal || output_iot
+
+package output
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"math"
+	"net/url"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// IoT publishes the readings of every scrape as one device telemetry message
+// to Azure IoT Hub or AWS IoT Core, over MQTT with TLS, so that
+// sensor_exporter can be the device agent of a gateway:
+//
+//	{"time":"2026-10-16T09:10:00.000Z","sensor":"hddtemp","readings":[
+//	  {"metric":"temperature_celsius","labels":{"sensor":"sda"},"value":38}]}
+//
+// Azure devices authenticate with a shared access key, from which a SAS
+// token is made at every connection, or with an X.509 certificate. AWS
+// things always use their X.509 certificate.
+type IoT struct {
+	client mqtt.Client
+	topic  string
+	wal    *WAL
+	wake   chan struct{} // to send what the WAL has
+	done   chan struct{} // closed by Close
+	hold   holdback
+}
+
+// IoTConfig configures an IoT sink.
+type IoTConfig struct {
+	Provider string // azure or aws
+	Endpoint string // e.g. myhub.azure-devices.net or xxx-ats.iot.eu-west-1.amazonaws.com
+	Device   string // Azure device id or AWS thing name, also the MQTT client id
+	Key      string // Azure shared access key, base64
+	CertFile string // client certificate
+	KeyFile  string // client certificate key
+	CAFile   string // server CA, the system pool if empty
+	Topic    string // AWS topic, sensor_exporter/<device>/telemetry by default
+	// WAL, if set, buffers the telemetry while the hub cannot be reached,
+	// sent in order once it is connected again.
+	WAL *WAL
+}
+
+// sasValidity is how long an Azure SAS token is valid. A new one is made at
+// every reconnection.
+var sasValidity = 24 * time.Hour
+
+// NewIoT connects to the hub and returns the sink. Connecting is retried in
+// the background if the hub cannot be reached.
+func NewIoT(c IoTConfig) (*IoT, error) {
+	if c.Endpoint == "" || c.Device == "" {
+		return nil, errors.New("iot needs an endpoint and a device")
+	}
+	tlsConfig := &tls.Config{ServerName: c.Endpoint}
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates in " + c.CAFile)
+		}
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker("ssl://" + c.Endpoint + ":8883").
+		SetClientID(c.Device).
+		SetTLSConfig(tlsConfig).
+		SetProtocolVersion(4).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			sensor.Incident()
+			slog.Warn("Lost connection to IoT hub", "endpoint", c.Endpoint, "err", err)
+		})
+	sink := &IoT{wal: c.WAL, wake: make(chan struct{}, 1), done: make(chan struct{}),
+		hold: holdback{name: "iot"}}
+	opts.SetOnConnectHandler(func(mqtt.Client) { sink.wakeUp() })
+	switch c.Provider {
+	case "azure":
+		// Username and topic are fixed by IoT Hub.
+		opts.SetUsername(c.Endpoint + "/" + c.Device + "/?api-version=2021-04-12")
+		if c.Key != "" {
+			key, err := base64.StdEncoding.DecodeString(c.Key)
+			if err != nil {
+				return nil, errors.New("azure device key is not base64: " + err.Error())
+			}
+			resource := c.Endpoint + "/devices/" + c.Device
+			opts.SetCredentialsProvider(func() (string, string) {
+				return c.Endpoint + "/" + c.Device + "/?api-version=2021-04-12",
+					azureSAS(resource, key, time.Now().Add(sasValidity))
+			})
+		} else if c.CertFile == "" {
+			return nil, errors.New("azure needs a device key or certificate")
+		}
+		sink.topic = "devices/" + c.Device + "/messages/events/"
+	case "aws":
+		if c.CertFile == "" {
+			return nil, errors.New("aws needs the thing certificate and key")
+		}
+		sink.topic = c.Topic
+		if sink.topic == "" {
+			sink.topic = "sensor_exporter/" + c.Device + "/telemetry"
+		}
+	default:
+		return nil, errors.New("iot provider must be azure or aws")
+	}
+
+	sink.client = mqtt.NewClient(opts)
+	t := sink.client.Connect()
+	if t.WaitTimeout(10*time.Second) && t.Error() != nil {
+		return nil, t.Error()
+	}
+	if sink.wal != nil {
+		go sink.drain()
+	}
+	return sink, nil
+}
+
+// walRetry is how often the telemetry buffered is tried again while the
+// connection is up but the hub does not take it.
+var walRetry = 30 * time.Second
+
+// drain sends what the WAL has whenever the hub connects, until Close.
+func (i *IoT) drain() {
+	ticker := time.NewTicker(walRetry)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-i.done:
+			return
+		case <-i.wake:
+		case <-ticker.C:
+		}
+		if !i.client.IsConnectionOpen() || i.wal.Size() == 0 {
+			continue
+		}
+		if err := i.wal.Replay(i.publish); err != nil {
+			slog.Warn("Could not send the buffered telemetry", "err", err)
+		}
+	}
+}
+
+func (i *IoT) wakeUp() {
+	select {
+	case i.wake <- struct{}{}:
+	default:
+	}
+}
+
+// publish publishes payload and waits until the hub acknowledges it.
+func (i *IoT) publish(payload []byte) error {
+	token := i.client.Publish(i.topic, 1, false, payload)
+	if !token.WaitTimeout(time.Minute) {
+		return errors.New("not acknowledged in time")
+	}
+	return token.Error()
+}
+
+// azureSAS makes a SharedAccessSignature token for resource, signed with
+// the device key.
+func azureSAS(resource string, key []byte, expiry time.Time) string {
+	sr := url.QueryEscape(resource)
+	se := fmt.Sprint(expiry.Unix())
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(sr + "\n" + se))
+	sig := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return "SharedAccessSignature sr=" + sr + "&sig=" + url.QueryEscape(sig) + "&se=" + se
+}
+
+type iotReading struct {
+	Metric string            `json:"metric"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  *float64          `json:"value"`
+}
+
+// Write publishes the samples read at t, unless they are held until the clock
+// is synchronized, see WaitForClockSync.
+func (i *IoT) Write(t time.Time, sensorType string, samples []sensor.Sample) error {
+	return i.hold.do(t, func(t time.Time) error {
+		return i.write(t, sensorType, samples)
+	})
+}
+
+func (i *IoT) write(t time.Time, sensorType string, samples []sensor.Sample) error {
+	msg := struct {
+		Time     string       `json:"time"`
+		Sensor   string       `json:"sensor"`
+		Readings []iotReading `json:"readings"`
+	}{Time: t.UTC().Format("2006-01-02T15:04:05.000Z"), Sensor: sensorType}
+	for _, s := range samples {
+		r := iotReading{Metric: s.Name, Labels: labelMap(s.Labels)}
+		if !math.IsNaN(s.Value) && !math.IsInf(s.Value, 0) {
+			v := s.Value
+			r.Value = &v
+		}
+		msg.Readings = append(msg.Readings, r)
+	}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	// Behind what is buffered already, in order.
+	if i.wal != nil && (!i.client.IsConnectionOpen() || i.wal.Size() > 0) {
+		i.wakeUp()
+		return i.wal.Append(payload)
+	}
+	token := i.client.Publish(i.topic, 1, false, payload)
+	// Do not hold the scraper while the hub acknowledges.
+	go func() {
+		if !token.WaitTimeout(time.Minute) {
+			sensor.Incident()
+			slog.Warn("Telemetry was not acknowledged in time", "collector", sensorType)
+		} else if err := token.Error(); err != nil {
+			sensor.Incident()
+			slog.Error("Could not publish telemetry", "collector", sensorType, "err", err)
+		} else {
+			return
+		}
+		if i.wal != nil {
+			if err := i.wal.Append(payload); err != nil {
+				slog.Error("Could not buffer telemetry", "collector", sensorType, "err", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// Close disconnects, waiting a little for pending messages, and closes the
+// WAL.
+func (i *IoT) Close() error {
+	close(i.done)
+	i.client.Disconnect(1000)
+	if i.wal != nil {
+		return i.wal.Close()
+	}
+	return nil
+}
+
+// Describe describes the metrics of the WAL, if any.
+func (i *IoT) Describe(ch chan<- *prometheus.Desc) {
+	if i.wal != nil {
+		i.wal.Describe(ch)
+	}
+}
+
+func (i *IoT) Collect(ch chan<- prometheus.Metric) {
+	if i.wal != nil {
+		i.wal.Collect(ch)
+	}
+}
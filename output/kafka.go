@@ -0,0 +1,209 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+//go:build !minimal || output_kafka
+
+package output
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+	"github.com/segmentio/kafka-go"
+)
+
+// Kafka publishes every sample as one message to a topic, batched in the
+// background. Messages are JSON:
+//
+//	{"time":"2026-10-16T09:10:00.000Z","sensor":"hddtemp","metric":"temperature_celsius","labels":{"sensor":"sda"},"value":38}
+//
+// or Avro with single object encoding (marker, schema fingerprint, datum) of
+// KafkaAvroSchema. The message key selects the partition, so that readings
+// with the same key stay in order.
+type Kafka struct {
+	w      *kafka.Writer
+	format string
+	key    string
+}
+
+// KafkaAvroSchema is the Avro schema of the messages in avro format.
+const KafkaAvroSchema = `{"type":"record","name":"Reading","namespace":"sensor_exporter","fields":[` +
+	`{"name":"time","type":{"type":"long","logicalType":"timestamp-millis"}},` +
+	`{"name":"sensor","type":"string"},` +
+	`{"name":"metric","type":"string"},` +
+	`{"name":"labels","type":{"type":"map","values":"string"}},` +
+	`{"name":"value","type":"double"}]}`
+
+// The parsing canonical form of KafkaAvroSchema, which its fingerprint is
+// computed from.
+const kafkaAvroCanonical = `{"name":"sensor_exporter.Reading","type":"record","fields":[` +
+	`{"name":"time","type":"long"},` +
+	`{"name":"sensor","type":"string"},` +
+	`{"name":"metric","type":"string"},` +
+	`{"name":"labels","type":{"type":"map","values":"string"}},` +
+	`{"name":"value","type":"double"}]}`
+
+// KafkaConfig configures a Kafka sink.
+type KafkaConfig struct {
+	Brokers      []string
+	Topic        string
+	Format       string // json or avro
+	Key          string // sensor, metric, series or none
+	BatchSize    int
+	BatchTimeout time.Duration
+}
+
+// NewKafka returns a sink writing to c.Topic on c.Brokers.
+func NewKafka(c KafkaConfig) (*Kafka, error) {
+	if len(c.Brokers) == 0 || c.Topic == "" {
+		return nil, errors.New("kafka needs brokers and a topic")
+	}
+	switch c.Format {
+	case "json", "avro":
+	default:
+		return nil, errors.New("kafka format must be json or avro")
+	}
+	switch c.Key {
+	case "sensor", "metric", "series", "none":
+	default:
+		return nil, errors.New("kafka key must be sensor, metric, series or none")
+	}
+	w := &kafka.Writer{
+		Addr:         kafka.TCP(c.Brokers...),
+		Topic:        c.Topic,
+		Balancer:     &kafka.Hash{},
+		BatchSize:    c.BatchSize,
+		BatchTimeout: c.BatchTimeout,
+		RequiredAcks: kafka.RequireOne,
+		Async:        true,
+		Completion: func(messages []kafka.Message, err error) {
+			if err != nil {
+				sensor.Incident()
+				slog.Error("Could not publish readings to kafka", "readings", len(messages), "err", err)
+			}
+		},
+	}
+	return &Kafka{w: w, format: c.Format, key: c.Key}, nil
+}
+
+func (k *Kafka) Write(t time.Time, sensorType string, samples []sensor.Sample) error {
+	msgs := make([]kafka.Message, 0, len(samples))
+	for _, s := range samples {
+		var m kafka.Message
+		switch k.key {
+		case "sensor":
+			m.Key = []byte(sensorType)
+		case "metric":
+			m.Key = []byte(s.Name)
+		case "series":
+			m.Key = []byte(s.Name + sensor.LabelString(s.Labels))
+		}
+		var err error
+		if k.format == "avro" {
+			m.Value = avroReading(t, sensorType, s)
+		} else if m.Value, err = jsonReading(t, sensorType, s); err != nil {
+			return err
+		}
+		msgs = append(msgs, m)
+	}
+	// Asynchronous, errors are reported by the completion callback.
+	return k.w.WriteMessages(context.Background(), msgs...)
+}
+
+// Close flushes pending messages.
+func (k *Kafka) Close() error {
+	return k.w.Close()
+}
+
+func jsonReading(t time.Time, sensorType string, s sensor.Sample) ([]byte, error) {
+	// JSON has no NaN or infinities; they become null.
+	var value *float64
+	if !math.IsNaN(s.Value) && !math.IsInf(s.Value, 0) {
+		value = &s.Value
+	}
+	return json.Marshal(struct {
+		Time   string            `json:"time"`
+		Sensor string            `json:"sensor"`
+		Metric string            `json:"metric"`
+		Labels map[string]string `json:"labels"`
+		Value  *float64          `json:"value"`
+	}{t.UTC().Format("2006-01-02T15:04:05.000Z"), sensorType, s.Name, labelMap(s.Labels), value})
+}
+
+var avroHeader = func() []byte {
+	h := []byte{0xC3, 0x01, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint64(h[2:], avroFingerprint(kafkaAvroCanonical))
+	return h
+}()
+
+func avroReading(t time.Time, sensorType string, s sensor.Sample) []byte {
+	b := append([]byte(nil), avroHeader...)
+	b = avroLong(b, t.UnixNano()/int64(time.Millisecond))
+	b = avroString(b, sensorType)
+	b = avroString(b, s.Name)
+	if len(s.Labels) > 0 {
+		labels := labelMap(s.Labels)
+		names := make([]string, 0, len(labels))
+		for n := range labels {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		b = avroLong(b, int64(len(names)))
+		for _, n := range names {
+			b = avroString(b, n)
+			b = avroString(b, labels[n])
+		}
+	}
+	b = avroLong(b, 0) // end of map blocks
+	return binary.LittleEndian.AppendUint64(b, math.Float64bits(s.Value))
+}
+
+// avroLong appends a zig-zag varint.
+func avroLong(b []byte, v int64) []byte {
+	return binary.AppendUvarint(b, uint64((v<<1)^(v>>63)))
+}
+
+func avroString(b []byte, s string) []byte {
+	b = avroLong(b, int64(len(s)))
+	return append(b, s...)
+}
+
+// avroFingerprint is the CRC-64-AVRO (Rabin) fingerprint of a schema in
+// parsing canonical form.
+func avroFingerprint(schema string) uint64 {
+	const empty = 0xc15d213aa4d7a795
+	var table [256]uint64
+	for i := range table {
+		fp := uint64(i)
+		for j := 0; j < 8; j++ {
+			fp = (fp >> 1) ^ (empty & -(fp & 1))
+		}
+		table[i] = fp
+	}
+	fp := uint64(empty)
+	for _, c := range []byte(schema) {
+		fp = (fp >> 8) ^ table[byte(fp)^c]
+	}
+	return fp
+}
@@ -0,0 +1,44 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package output holds the sinks readings can be sent to besides the /metrics
+endpoint, for sites Prometheus cannot scrape.
+*/
+package output
+
+import (
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+// A Sink receives the samples of every successful scrape. Write may be
+// called concurrently by the scrapers of different sensors.
+type Sink interface {
+	Write(t time.Time, sensorType string, samples []sensor.Sample) error
+	Close() error
+}
+
+// labelMap returns labels as a map that is never nil, so that samples
+// without labels are encoded as {} rather than null.
+func labelMap(labels sensor.Labels) map[string]string {
+	if labels == nil {
+		return map[string]string{}
+	}
+	return labels
+}
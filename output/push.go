@@ -0,0 +1,344 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+//go:build !minimal || output_push
+
+package output
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// A Pusher pushes what /metrics serves at an interval, for hosts Prometheus
+// cannot reach, e.g. behind NAT: to a Prometheus compatible remote write
+// receiver (Prometheus with --web.enable-remote-write-receiver, Mimir,
+// VictoriaMetrics, ...) or to a Pushgateway. Every series gets the labels
+// job and instance, as a scrape would add them.
+type Pusher struct {
+	c           PushConfig
+	client      *http.Client
+	gateway     *push.Pusher
+	downsampler *downsampler
+	hold        holdback
+}
+
+// PushConfig configures a Pusher.
+type PushConfig struct {
+	URL      string
+	Mode     string // remote_write or pushgateway
+	Job      string
+	Instance string
+	User     string // basic auth, if set
+	Password string
+	Gatherer prometheus.Gatherer
+	// Downsample, in remote write mode, aggregates the values gathered over
+	// windows and sends one of every window.
+	Downsample Downsample
+	// WAL, in remote write mode, buffers the pushes that failed, to send
+	// them first when the receiver is back.
+	WAL *WAL
+}
+
+var pushTimeout = 10 * time.Second
+
+// NewPusher returns a Pusher of c.Gatherer.
+func NewPusher(c PushConfig) (*Pusher, error) {
+	if c.URL == "" || c.Job == "" || c.Instance == "" {
+		return nil, errors.New("push needs a URL, job and instance")
+	}
+	p := &Pusher{c: c, client: &http.Client{Timeout: pushTimeout}, hold: holdback{name: "remote_write"}}
+	switch c.Mode {
+	case "remote_write":
+	case "pushgateway":
+		p.gateway = push.New(c.URL, c.Job).Grouping("instance", c.Instance).
+			Gatherer(c.Gatherer).Client(p.client)
+		if c.User != "" {
+			p.gateway.BasicAuth(c.User, c.Password)
+		}
+	default:
+		return nil, errors.New("push mode must be remote_write or pushgateway")
+	}
+	if err := p.c.Downsample.compile(); err != nil {
+		return nil, err
+	}
+	if p.c.WAL != nil && p.gateway != nil {
+		return nil, errors.New("buffering pushes needs push mode remote_write")
+	}
+	if p.c.Downsample.enabled() {
+		if p.gateway != nil {
+			return nil, errors.New("downsampling needs push mode remote_write")
+		}
+		p.downsampler = &downsampler{d: p.c.Downsample, series: make(map[string]*window)}
+	}
+	return p, nil
+}
+
+// Run pushes every interval.
+func (p *Pusher) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := p.Push(); err != nil {
+			sensor.Incident()
+			slog.Error("Could not push", "url", p.c.URL, "err", err)
+		}
+	}
+}
+
+// Push pushes once. A Pushgateway gets the group of the job and instance
+// replaced. With downsampling, only the values of the windows that ended
+// and of the metrics without one are sent. With WaitForClockSync, the
+// values are held until the clock is synchronized.
+func (p *Pusher) Push() error {
+	if p.gateway != nil {
+		return p.gateway.Push()
+	}
+	families, err := p.c.Gatherer.Gather()
+	if err != nil && len(families) == 0 {
+		return err
+	}
+	return p.hold.do(time.Now(), func(t time.Time) error {
+		var message []byte
+		if p.downsampler != nil {
+			for _, s := range p.downsampler.add(families, t) {
+				message = p.appendSeries(message, s.Name, s.Labels, []TimedSample{s})
+			}
+		} else {
+			message = p.writeRequest(families, t)
+		}
+		return p.send(message)
+	})
+}
+
+// send posts message, if not empty. With a WAL, the pushes buffered are
+// sent first, and message is buffered after them if they or it fail.
+func (p *Pusher) send(message []byte) error {
+	if p.c.WAL == nil {
+		if len(message) == 0 {
+			return nil
+		}
+		return p.post(message)
+	}
+	err := p.c.WAL.Replay(p.resend)
+	if err == nil && len(message) > 0 {
+		if err = p.post(message); rejected(err) {
+			return err
+		}
+	}
+	if err != nil && len(message) > 0 {
+		if werr := p.c.WAL.Append(message); werr != nil {
+			return errors.Join(err, errors.New("could not buffer the push: "+werr.Error()))
+		}
+	}
+	return err
+}
+
+// resend posts a buffered push. One the receiver rejects, e.g. as too old,
+// is dropped rather than tried again forever.
+func (p *Pusher) resend(message []byte) error {
+	err := p.post(message)
+	if rejected(err) {
+		sensor.Incident()
+		slog.Warn("Dropping a buffered push the receiver rejected", "url", p.c.URL, "err", err)
+		return nil
+	}
+	return err
+}
+
+// A statusError is an error status of the receiver.
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string {
+	return e.msg
+}
+
+// rejected tells whether err is a client error status other than too many
+// requests, which sending the same again will not mend.
+func rejected(err error) bool {
+	var s *statusError
+	return errors.As(err, &s) && s.code/100 == 4 && s.code != http.StatusTooManyRequests
+}
+
+// A TimedSample is a sample with its own time, as read from a log.
+type TimedSample struct {
+	sensor.Sample
+	Time time.Time
+}
+
+// backfillBatch is the most samples Backfill sends in one request.
+var backfillBatch = 5000
+
+// Backfill writes samples with their own times to a remote write receiver,
+// series by series in time order, in requests of at most backfillBatch
+// samples. Receivers may reject samples older than what they already have
+// of a series, Prometheus unless it is run with an out of order time window.
+func (p *Pusher) Backfill(samples []TimedSample) error {
+	if p.gateway != nil {
+		return errors.New("backfill needs push mode remote_write")
+	}
+	series := make(map[string][]TimedSample)
+	var keys []string
+	for _, s := range samples {
+		key := s.Name + sensor.LabelString(s.Labels)
+		if _, exists := series[key]; !exists {
+			keys = append(keys, key)
+		}
+		series[key] = append(series[key], s)
+	}
+	sort.Strings(keys)
+	var out []byte
+	n := 0
+	for _, key := range keys {
+		points := series[key]
+		sort.SliceStable(points, func(i, j int) bool { return points[i].Time.Before(points[j].Time) })
+		for len(points) > 0 {
+			batch := points[:min(len(points), backfillBatch-n)]
+			points = points[len(batch):]
+			out = p.appendSeries(out, batch[0].Name, batch[0].Labels, batch)
+			if n += len(batch); n == backfillBatch {
+				if err := p.post(out); err != nil {
+					return err
+				}
+				out, n = nil, 0
+			}
+		}
+	}
+	if n > 0 {
+		return p.post(out)
+	}
+	return nil
+}
+
+// post sends the encoded WriteRequest message to the remote write receiver.
+func (p *Pusher) post(message []byte) error {
+	body := snappy.Encode(nil, message)
+	req, err := http.NewRequest(http.MethodPost, p.c.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if p.c.User != "" {
+		req.SetBasicAuth(p.c.User, p.c.Password)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return &statusError{resp.StatusCode, fmt.Sprintf("%s: %s", resp.Status, bytes.TrimSpace(msg))}
+	}
+	return nil
+}
+
+// writeRequest encodes families as the protobuf WriteRequest of remote write
+// 1.0, every series with one sample at t:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+//
+// The exporter makes gauges, counters and untyped metrics only.
+func (p *Pusher) writeRequest(families []*dto.MetricFamily, t time.Time) []byte {
+	var out []byte
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			value, ok := metricValue(m)
+			if !ok {
+				continue
+			}
+			out = p.appendSeries(out, mf.GetName(), metricLabels(m), []TimedSample{{Sample: sensor.Sample{Value: value}, Time: t}})
+		}
+	}
+	return out
+}
+
+// metricValue is the value of a gauge, counter or untyped metric; ok is
+// false for other types.
+func metricValue(m *dto.Metric) (value float64, ok bool) {
+	switch {
+	case m.Gauge != nil:
+		return m.Gauge.GetValue(), true
+	case m.Counter != nil:
+		return m.Counter.GetValue(), true
+	case m.Untyped != nil:
+		return m.Untyped.GetValue(), true
+	}
+	return 0, false
+}
+
+// metricLabels are the labels of m.
+func metricLabels(m *dto.Metric) sensor.Labels {
+	labels := make(sensor.Labels)
+	for _, l := range m.GetLabel() {
+		labels[l.GetName()] = l.GetValue()
+	}
+	return labels
+}
+
+// appendSeries appends to out the TimeSeries of the metric name with labels,
+// job and instance unless labels have them, and the values and times of
+// points.
+func (p *Pusher) appendSeries(out []byte, name string, labels sensor.Labels, points []TimedSample) []byte {
+	all := sensor.Labels{"__name__": name, "job": p.c.Job, "instance": p.c.Instance}
+	for name, value := range labels {
+		all[name] = value
+	}
+	var series []byte
+	// Receivers expect the labels sorted by name.
+	for _, name := range all.Names() {
+		var label []byte
+		label = protowire.AppendTag(label, 1, protowire.BytesType)
+		label = protowire.AppendString(label, name)
+		label = protowire.AppendTag(label, 2, protowire.BytesType)
+		label = protowire.AppendString(label, all[name])
+		series = protowire.AppendTag(series, 1, protowire.BytesType)
+		series = protowire.AppendBytes(series, label)
+	}
+	for _, point := range points {
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(point.Value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(point.Time.UnixMilli()))
+		series = protowire.AppendTag(series, 2, protowire.BytesType)
+		series = protowire.AppendBytes(series, sample)
+	}
+	out = protowire.AppendTag(out, 1, protowire.BytesType)
+	return protowire.AppendBytes(out, series)
+}
@@ -0,0 +1,297 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+//go:build !minimal || output_push || output_iot
+
+package output
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A WAL buffers on disk what a push output could not send, e.g. while the
+// uplink of a solar powered site is down, to send it in order when it is
+// back. Records are appended to segment files of the directory, each with
+// its length and CRC, and synced; beyond the maximum size the oldest
+// segments are dropped. A record torn by a power cut ends its segment. The
+// records sent survive restarts, so a record may be sent twice, but not
+// lost, if the exporter stops in between.
+type WAL struct {
+	name    string // of the output, the output label of the metrics
+	dir     string
+	maxSize int64
+
+	mutex    sync.Mutex
+	segments []int         // numbers of the segment files, oldest first
+	sizes    map[int]int64 // of the segment files
+	size     int64         // of all segment files
+	head     *os.File      // the last segment, for appending, nil for a new one
+	cursor   int64         // offset of the first record not sent in the oldest segment
+	dropped  int64         // bytes of records dropped unsent
+}
+
+// walSegmentSize is the size at which a new segment is begun, unless a
+// quarter of the maximum size is less.
+var walSegmentSize int64 = 1 << 20
+
+var (
+	walSizeDesc = prometheus.NewDesc("sensor_exporter_wal_size_bytes",
+		"Bytes of the records an output buffered on disk and has not sent yet.", []string{"output"}, nil)
+	walDroppedDesc = prometheus.NewDesc("sensor_exporter_wal_dropped_bytes_total",
+		"Bytes of the records an output dropped unsent, as its buffer was full or damaged.", []string{"output"}, nil)
+)
+
+// OpenWAL opens the WAL of the output name in dir, creating dir if need be,
+// keeping at most maxSize bytes.
+func OpenWAL(name, dir string, maxSize int64) (*WAL, error) {
+	if maxSize <= 0 {
+		return nil, errors.New("the WAL needs a positive maximum size")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	w := &WAL{name: name, dir: dir, maxSize: maxSize, sizes: make(map[int]int64)}
+	files, err := filepath.Glob(filepath.Join(dir, "*.wal"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		n, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(file), ".wal"))
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		w.segments = append(w.segments, n)
+		w.sizes[n] = info.Size()
+		w.size += info.Size()
+	}
+	sort.Ints(w.segments)
+	// Where the last replay stopped, if in the oldest segment still.
+	if b, err := os.ReadFile(filepath.Join(dir, "cursor")); err == nil && len(w.segments) > 0 {
+		var segment int
+		var offset int64
+		if _, err := fmt.Sscan(string(b), &segment, &offset); err == nil && segment == w.segments[0] {
+			w.cursor = min(offset, w.sizes[segment])
+		}
+	}
+	// Appending goes to a new segment, not after a record the last run may
+	// have torn.
+	return w, nil
+}
+
+func (w *WAL) segmentFile(n int) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%020d.wal", n))
+}
+
+// Append adds record, then drops the oldest segments beyond the maximum
+// size.
+func (w *WAL) Append(record []byte) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	last := -1
+	if len(w.segments) > 0 {
+		last = w.segments[len(w.segments)-1]
+	}
+	if w.head == nil || w.sizes[last] >= min(walSegmentSize, w.maxSize/4) {
+		if w.head != nil {
+			w.head.Close()
+		}
+		f, err := os.OpenFile(w.segmentFile(last+1), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			w.head = nil
+			return err
+		}
+		w.head, last = f, last+1
+		w.segments = append(w.segments, last)
+		w.sizes[last] = 0
+	}
+	buf := make([]byte, 8, 8+len(record))
+	binary.BigEndian.PutUint32(buf, uint32(len(record)))
+	binary.BigEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(record))
+	n, err := w.head.Write(append(buf, record...))
+	w.sizes[last] += int64(n)
+	w.size += int64(n)
+	if err == nil {
+		err = w.head.Sync()
+	}
+	for w.size > w.maxSize && len(w.segments) > 1 {
+		oldest := w.segments[0]
+		slog.Warn("Output buffer full, dropping the oldest records", "output", w.name, "bytes", w.sizes[oldest]-w.cursor)
+		w.dropped += w.sizes[oldest] - w.cursor
+		w.removeOldest()
+	}
+	return err
+}
+
+// removeOldest removes the oldest segment. The caller holds w.mutex.
+func (w *WAL) removeOldest() {
+	oldest := w.segments[0]
+	if len(w.segments) == 1 && w.head != nil {
+		w.head.Close()
+		w.head = nil
+	}
+	if err := os.Remove(w.segmentFile(oldest)); err != nil {
+		slog.Warn("Could not remove output buffer segment", "output", w.name, "err", err)
+	}
+	w.size -= w.sizes[oldest]
+	delete(w.sizes, oldest)
+	w.segments = w.segments[1:]
+	w.cursor = 0
+}
+
+// Replay sends the records in the order they were appended, removing those
+// sent, until send fails or all are sent, and returns the error of send.
+// Records can be appended meanwhile; it must not run concurrently with
+// itself.
+func (w *WAL) Replay(send func(record []byte) error) error {
+	defer w.saveCursor()
+	for {
+		record, segment, err := w.next()
+		if err != nil || record == nil {
+			return err
+		}
+		if err := send(record); err != nil {
+			return err
+		}
+		w.mutex.Lock()
+		// Unless retention dropped the segment meanwhile.
+		if len(w.segments) > 0 && w.segments[0] == segment {
+			w.cursor += 8 + int64(len(record))
+		}
+		w.mutex.Unlock()
+	}
+}
+
+// next returns the oldest record not sent and its segment, nil if there is
+// none, removing the segments sent. A damaged record drops the rest of its
+// segment.
+func (w *WAL) next() ([]byte, int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for len(w.segments) > 0 {
+		segment := w.segments[0]
+		if w.cursor >= w.sizes[segment] {
+			if len(w.segments) == 1 && w.head != nil && w.cursor == 0 {
+				return nil, 0, nil
+			}
+			w.removeOldest()
+			continue
+		}
+		record, err := w.read(segment)
+		if err == nil {
+			return record, segment, nil
+		}
+		slog.Warn("Output buffer damaged, dropping the rest of the segment", "output", w.name,
+			"segment", w.segmentFile(segment), "err", err)
+		w.dropped += w.sizes[segment] - w.cursor
+		w.cursor = w.sizes[segment]
+	}
+	return nil, 0, nil
+}
+
+// read reads the record at the cursor of segment. The caller holds w.mutex.
+func (w *WAL) read(segment int) ([]byte, error) {
+	f, err := os.Open(w.segmentFile(segment))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	header := make([]byte, 8)
+	if _, err := f.ReadAt(header, w.cursor); err != nil {
+		return nil, err
+	}
+	n := int64(binary.BigEndian.Uint32(header))
+	if n > w.sizes[segment]-w.cursor-8 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	record := make([]byte, n)
+	if _, err := f.ReadAt(record, w.cursor+8); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(record) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, errors.New("bad CRC")
+	}
+	return record, nil
+}
+
+// saveCursor keeps where Replay stopped, for the next run.
+func (w *WAL) saveCursor() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if len(w.segments) == 0 {
+		os.Remove(filepath.Join(w.dir, "cursor"))
+		return
+	}
+	tmp := filepath.Join(w.dir, "cursor.tmp")
+	data := fmt.Sprintf("%d %d\n", w.segments[0], w.cursor)
+	err := os.WriteFile(tmp, []byte(data), 0600)
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(w.dir, "cursor"))
+	}
+	if err != nil {
+		slog.Warn("Could not save where the output buffer was sent up to", "output", w.name, "err", err)
+	}
+}
+
+// Size is the size of the records not sent yet, about.
+func (w *WAL) Size() int64 {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.size - w.cursor
+}
+
+// Close keeps where Replay stopped and closes the last segment.
+func (w *WAL) Close() error {
+	w.saveCursor()
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.head == nil {
+		return nil
+	}
+	err := w.head.Close()
+	w.head = nil
+	return err
+}
+
+func (w *WAL) Describe(ch chan<- *prometheus.Desc) {
+	ch <- walSizeDesc
+	ch <- walDroppedDesc
+}
+
+func (w *WAL) Collect(ch chan<- prometheus.Metric) {
+	w.mutex.Lock()
+	size, dropped := w.size-w.cursor, w.dropped
+	w.mutex.Unlock()
+	ch <- prometheus.MustNewConstMetric(walSizeDesc, prometheus.GaugeValue, float64(size), w.name)
+	ch <- prometheus.MustNewConstMetric(walDroppedDesc, prometheus.CounterValue, float64(dropped), w.name)
+}
@@ -0,0 +1,80 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+//go:build !minimal || output_iot
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"strings"
+
+	"github.com/fmoessbauer/sensor_exporter/output"
+)
+
+var (
+	iotProvider = flag.String("iot.provider", "", "also publish readings as device telemetry to azure (IoT Hub) or aws (IoT Core)")
+	iotEndpoint = flag.String("iot.endpoint", "", "IoT Hub or IoT Core host name")
+	iotDevice   = flag.String("iot.device", "", "device id (azure) or thing name (aws)")
+	iotKeyFile  = flag.String("iot.sas-key-file", "", "file holding the azure device shared access key")
+	iotCert     = flag.String("iot.cert", "", "device certificate file")
+	iotCertKey  = flag.String("iot.cert-key", "", "device certificate key file")
+	iotCA       = flag.String("iot.ca", "", "CA file to verify the endpoint with, instead of the system ones")
+	iotTopic    = flag.String("iot.topic", "", "aws topic, sensor_exporter/<thing>/telemetry by default")
+	iotWALDir   = flag.String("iot.wal.dir", "", "buffer the telemetry in this directory while the hub cannot be reached, to publish it in order when it is back")
+	iotWALSize  = flag.Int64("iot.wal.max-size", 100<<20, "drop the oldest buffered telemetry beyond this many bytes")
+)
+
+func init() {
+	outputs = append(outputs, iotSink)
+}
+
+func iotSink() output.Sink {
+	if *iotProvider == "" {
+		return nil
+	}
+	var key []byte
+	if *iotKeyFile != "" {
+		var err error
+		if key, err = ioutil.ReadFile(*iotKeyFile); err != nil {
+			fatal("Could not read device key", "err", err)
+		}
+	}
+	var wal *output.WAL
+	if *iotWALDir != "" {
+		var err error
+		if wal, err = output.OpenWAL("iot", *iotWALDir, *iotWALSize); err != nil {
+			fatal("Could not open -iot.wal.dir", "err", err)
+		}
+	}
+	sink, err := output.NewIoT(output.IoTConfig{
+		Provider: *iotProvider,
+		Endpoint: *iotEndpoint,
+		Device:   *iotDevice,
+		Key:      strings.TrimSpace(string(key)),
+		CertFile: *iotCert,
+		KeyFile:  *iotCertKey,
+		CAFile:   *iotCA,
+		Topic:    *iotTopic,
+		WAL:      wal,
+	})
+	if err != nil {
+		fatal("Could not create IoT output", "err", err)
+	}
+	return sink
+}
@@ -0,0 +1,59 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+//go:build !minimal || output_kafka
+
+package main
+
+import (
+	"flag"
+	"strings"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/output"
+)
+
+var (
+	kafkaBrokers      = flag.String("kafka.brokers", "", "also publish readings to these comma separated kafka brokers")
+	kafkaTopic        = flag.String("kafka.topic", "sensor_readings", "kafka topic to publish readings to")
+	kafkaFormat       = flag.String("kafka.format", "json", "kafka message format, json or avro")
+	kafkaKey          = flag.String("kafka.key", "sensor", "kafka message key: sensor, metric, series or none")
+	kafkaBatchSize    = flag.Int("kafka.batch-size", 100, "readings per kafka batch")
+	kafkaBatchTimeout = flag.Duration("kafka.batch-timeout", time.Second, "longest wait before sending an incomplete kafka batch")
+)
+
+func init() {
+	outputs = append(outputs, kafkaSink)
+}
+
+func kafkaSink() output.Sink {
+	if *kafkaBrokers == "" {
+		return nil
+	}
+	sink, err := output.NewKafka(output.KafkaConfig{
+		Brokers:      strings.Split(*kafkaBrokers, ","),
+		Topic:        *kafkaTopic,
+		Format:       *kafkaFormat,
+		Key:          *kafkaKey,
+		BatchSize:    *kafkaBatchSize,
+		BatchTimeout: *kafkaBatchTimeout,
+	})
+	if err != nil {
+		fatal("Could not create kafka output", "err", err)
+	}
+	return sink
+}
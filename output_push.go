@@ -0,0 +1,112 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+//go:build !minimal || output_push
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/exporter"
+	"github.com/fmoessbauer/sensor_exporter/output"
+)
+
+var (
+	pushURL          = flag.String("push.url", "", "also push what /metrics serves to this remote write or Pushgateway URL")
+	pushMode         = flag.String("push.mode", "remote_write", "push protocol, remote_write or pushgateway")
+	pushInterval     = flag.Duration("push.interval", 0, "push interval, by default the shortest scrape interval of the sensors")
+	pushJob          = flag.String("push.job", "sensor_exporter", "job label of the pushed series")
+	pushInstance     = flag.String("push.instance", "", "instance label of the pushed series, the host name by default")
+	pushUser         = flag.String("push.user", "", "basic auth user of the push URL")
+	pushPasswordFile = flag.String("push.password-file", "", "file with the basic auth password of the push URL")
+
+	pushDownsample   = flag.Duration("push.downsample", 0, "with remote_write, send one value aggregated from those of every window this long, e.g. 1m, instead of every one, 0 to send every one")
+	pushAggregation  = flag.String("push.downsample.aggregation", "avg", "how -push.downsample aggregates the values of gauges: avg, min, max or last; counters are sent as the last value")
+	pushWALDir       = flag.String("push.wal.dir", "", "buffer the pushes that failed in this directory, to push them in order when the receiver is back; remote_write only")
+	pushWALMaxSize   = flag.Int64("push.wal.max-size", 100<<20, "drop the oldest buffered pushes beyond this many bytes")
+	pushDownOverride = flag.String("push.downsample.overrides", "", "comma separated METRIC=WINDOW[:AGGREGATION] overriding -push.downsample for the metrics whose name matches the regular expression METRIC, e.g. rain_.*=0,ups_status=5m:last")
+)
+
+func init() {
+	pushers = append(pushers, startPush)
+}
+
+func startPush(e *exporter.Exporter) {
+	if *pushURL == "" {
+		return
+	}
+	if *onDemand {
+		fatal("Pushing needs the sensors scraped in the background, not -scrape.on-demand")
+	}
+	c := pushConfig()
+	c.Gatherer = e.Gatherer()
+	if *pushWALDir != "" {
+		wal, err := output.OpenWAL("remote_write", *pushWALDir, *pushWALMaxSize)
+		if err != nil {
+			fatal("Could not open -push.wal.dir", "err", err)
+		}
+		e.MustRegister(wal)
+		c.WAL = wal
+	}
+	p, err := output.NewPusher(c)
+	if err != nil {
+		fatal("Could not create push output", "err", err)
+	}
+	interval := *pushInterval
+	if interval <= 0 {
+		for _, s := range e.Scrapers() {
+			if interval <= 0 || s.Interval < interval {
+				interval = s.Interval
+			}
+		}
+		if interval <= 0 {
+			interval = 15 * time.Second
+		}
+	}
+	slog.Info("Pushing", "url", c.URL, "interval", interval)
+	go p.Run(interval)
+}
+
+// pushConfig is the configuration of the -push.* flags.
+func pushConfig() output.PushConfig {
+	c := output.PushConfig{URL: *pushURL, Mode: *pushMode, Job: *pushJob,
+		Instance: *pushInstance, User: *pushUser,
+		Downsample: output.Downsample{Window: *pushDownsample, Aggregation: *pushAggregation}}
+	var err error
+	if c.Downsample.Overrides, err = output.ParseDownsampleRules(*pushDownOverride); err != nil {
+		fatal("Could not parse -push.downsample.overrides", "err", err)
+	}
+	if c.Instance == "" {
+		if c.Instance, err = os.Hostname(); err != nil {
+			fatal("Could not get the host name for -push.instance", "err", err)
+		}
+	}
+	if *pushPasswordFile != "" {
+		password, err := ioutil.ReadFile(*pushPasswordFile)
+		if err != nil {
+			fatal("Could not read -push.password-file", "err", err)
+		}
+		c.Password = strings.TrimSpace(string(password))
+	}
+	return c
+}
@@ -0,0 +1,187 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package ratelimit keeps sensors that read vendor cloud APIs (Netatmo,
+OpenWeatherMap, Growatt, ...) within the request quotas of the vendor. It is a
+helper for sensors, not a sensor itself.
+
+A sensor declares the quotas of its API and asks before every request:
+
+	l := ratelimit.Get("openweathermap", apiKey,
+		ratelimit.Quota{Requests: 60, Per: time.Minute},
+		ratelimit.Quota{Requests: 1000, Per: 24 * time.Hour})
+	...
+	if !l.Allow() {
+		// Skip the request, e.g. serve the last readings again.
+	}
+
+All sensors that use the same API key share one Limiter, so several instances
+of a sensor, for several stations of one account, do not exceed the quotas
+together. Quotas count requests in fixed windows that start with the first
+request, as most vendors do. Samples exposes the remaining requests of each
+window, labeled with the API and a short hash of the key, never the key.
+*/
+package ratelimit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+// A Quota allows Requests requests Per window.
+type Quota struct {
+	Requests int
+	Per      time.Duration
+}
+
+// Types and Help are the TYPE and HELP strings of the metrics written by
+// Samples.
+var (
+	Types = []string{
+		"# TYPE api_quota_remaining_requests gauge",
+		"# TYPE api_requests_denied_total counter",
+	}
+	Help = []string{
+		"# HELP api_quota_remaining_requests Requests left in the current window of a quota of a cloud API.",
+		"# HELP api_requests_denied_total Requests to a cloud API skipped as a quota was used up.",
+	}
+)
+
+type window struct {
+	Quota
+	start time.Time
+	used  int
+}
+
+// account is the state of one API key, shared by its Limiters.
+type account struct {
+	mutex   sync.Mutex
+	labels  sensor.Labels
+	windows []*window
+	denied  int
+}
+
+// A Limiter is the handle of a sensor on the quotas of an API key.
+type Limiter struct {
+	*account
+	// reports is set on the first Limiter of an account, which writes its
+	// samples, so that sensors sharing a key do not write them twice.
+	reports bool
+}
+
+var (
+	accountsMutex sync.Mutex
+	accounts      = make(map[string]*account)
+)
+
+// Get returns a Limiter for key of api. The quotas are declared by the first
+// caller for a key; later callers share them and their quotas are added if
+// they declare more.
+func Get(api, key string, quotas ...Quota) *Limiter {
+	sum := sha256.Sum256([]byte(api + "\x00" + key))
+	id := hex.EncodeToString(sum[:4])
+
+	accountsMutex.Lock()
+	defer accountsMutex.Unlock()
+	a, exists := accounts[id]
+	if !exists {
+		a = &account{labels: sensor.Labels{"api": api, "key": id}}
+		accounts[id] = a
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for _, q := range quotas {
+		if q.Requests <= 0 || q.Per <= 0 || a.has(q) {
+			continue
+		}
+		a.windows = append(a.windows, &window{Quota: q})
+	}
+	return &Limiter{account: a, reports: !exists}
+}
+
+func (a *account) has(q Quota) bool {
+	for _, w := range a.windows {
+		if w.Quota == q {
+			return true
+		}
+	}
+	return false
+}
+
+// Allow reports whether a request may be made now and, if so, counts it
+// against every quota.
+func (l *Limiter) Allow() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	t := time.Now()
+	for _, w := range l.windows {
+		if t.Sub(w.start) >= w.Per {
+			w.start, w.used = t, 0
+		}
+		if w.used >= w.Requests {
+			l.denied++
+			return false
+		}
+	}
+	for _, w := range l.windows {
+		w.used++
+	}
+	return true
+}
+
+// Remaining returns the requests left until the first quota is used up.
+func (l *Limiter) Remaining() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	remaining := -1
+	for _, w := range l.windows {
+		if r := w.remaining(time.Now()); remaining < 0 || r < remaining {
+			remaining = r
+		}
+	}
+	return remaining
+}
+
+func (w *window) remaining(t time.Time) int {
+	if t.Sub(w.start) >= w.Per {
+		return w.Requests
+	}
+	return w.Requests - w.used
+}
+
+// Samples returns the remaining requests of every quota, labeled with its
+// window, and the denied requests. Only the first Limiter of a key returns
+// them, the others none.
+func (l *Limiter) Samples() (out []sensor.Sample) {
+	if !l.reports {
+		return nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	t := time.Now()
+	for _, w := range l.windows {
+		out = append(out, sensor.Sample{Name: "api_quota_remaining_requests",
+			Labels: l.labels.With("window", w.Per.String()), Value: float64(w.remaining(t))})
+	}
+	out = append(out, sensor.Sample{Name: "api_requests_denied_total", Labels: l.labels, Value: float64(l.denied)})
+	return out
+}
@@ -0,0 +1,167 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package sensor
+
+// Pollutant keys understood by AirQualityIndex. Particulates are given in
+// µg/m³, gases in ppb, but CO2 in ppm.
+const (
+	PM25 = "pm2_5"
+	PM10 = "pm10"
+	O3   = "o3"
+	NO2  = "no2"
+	CO   = "co"
+	SO2  = "so2"
+	TVOC = "tvoc" // total volatile organic compounds, indoor scale only
+	CO2  = "co2"  // indoor scale only
+)
+
+// AQI scales understood by AirQualityIndex.
+const (
+	AQIEPA    = "epa"    // US EPA Air Quality Index, 0-500
+	AQICAQI   = "caqi"   // European Common Air Quality Index, 0-100+
+	AQIIndoor = "indoor" // indoor air, on the bands of the EPA index
+)
+
+// AQITypes and AQIHelp are the TYPE and HELP strings of the metric written by
+// AirQualityDerived.
+var (
+	AQITypes = []string{"# TYPE air_quality_index gauge"}
+	AQIHelp  = []string{"# HELP air_quality_index Air quality index of the worst pollutant, which is given as label."}
+)
+
+type breakpoint struct{ lo, hi, ilo, ihi float64 }
+
+// EPA breakpoints (2024 revision). Ozone is the 8 hour table, CO is in ppb
+// here to keep all gases in one unit.
+var epaBreakpoints = map[string][]breakpoint{
+	PM25: {{0, 9, 0, 50}, {9.1, 35.4, 51, 100}, {35.5, 55.4, 101, 150},
+		{55.5, 125.4, 151, 200}, {125.5, 225.4, 201, 300}, {225.5, 325.4, 301, 500}},
+	PM10: {{0, 54, 0, 50}, {55, 154, 51, 100}, {155, 254, 101, 150},
+		{255, 354, 151, 200}, {355, 424, 201, 300}, {425, 604, 301, 500}},
+	O3: {{0, 54, 0, 50}, {55, 70, 51, 100}, {71, 85, 101, 150},
+		{86, 105, 151, 200}, {106, 200, 201, 300}},
+	NO2: {{0, 53, 0, 50}, {54, 100, 51, 100}, {101, 360, 101, 150},
+		{361, 649, 151, 200}, {650, 1249, 201, 300}, {1250, 2049, 301, 500}},
+	CO: {{0, 4400, 0, 50}, {4500, 9400, 51, 100}, {9500, 12400, 101, 150},
+		{12500, 15400, 151, 200}, {15500, 30400, 201, 300}, {30500, 50400, 301, 500}},
+	SO2: {{0, 35, 0, 50}, {36, 75, 51, 100}, {76, 185, 101, 150},
+		{186, 304, 151, 200}, {305, 604, 201, 300}, {605, 1004, 301, 500}},
+}
+
+// Indoor breakpoints, on the bands of the EPA index: particulates as there,
+// TVOC on the five guide levels of the German Umweltbundesamt in the ppb of
+// Sensirion's sensors, CO2 on the indoor air classes IDA 1-4 of EN 13779
+// with 400 ppm outside, and 5000 ppm, the workplace limit, as the end of
+// the scale.
+var indoorBreakpoints = map[string][]breakpoint{
+	PM25: epaBreakpoints[PM25],
+	PM10: epaBreakpoints[PM10],
+	TVOC: {{0, 65, 0, 50}, {66, 220, 51, 100}, {221, 660, 101, 150},
+		{661, 2200, 151, 200}, {2201, 5500, 201, 300}},
+	CO2: {{0, 800, 0, 50}, {801, 1000, 51, 100}, {1001, 1400, 101, 150},
+		{1401, 2000, 151, 200}, {2001, 5000, 201, 300}},
+}
+
+// CAQI hourly background grid, all values in µg/m³.
+var caqiGrid = map[string][]float64{
+	PM25: {0, 15, 30, 55, 110},
+	PM10: {0, 25, 50, 90, 180},
+	O3:   {0, 60, 120, 180, 240},
+	NO2:  {0, 50, 100, 200, 400},
+	CO:   {0, 5000, 7500, 10000, 20000},
+	SO2:  {0, 50, 100, 350, 500},
+}
+
+// Molar masses (g/mol) to convert gases from ppb to µg/m³ at 25°C.
+var molarMass = map[string]float64{O3: 48.00, NO2: 46.01, CO: 28.01, SO2: 64.07}
+
+func epaSubIndex(bps []breakpoint, c float64) float64 {
+	for _, bp := range bps {
+		if c <= bp.hi {
+			if c < bp.lo { // In the gap between two rows, e.g. 9.05
+				c = bp.lo
+			}
+			return (bp.ihi-bp.ilo)/(bp.hi-bp.lo)*(c-bp.lo) + bp.ilo
+		}
+	}
+	return 500 // Beyond the index
+}
+
+func caqiSubIndex(pollutant string, c float64) float64 {
+	if m, gas := molarMass[pollutant]; gas {
+		c = c * m / 24.45
+	}
+	grid := caqiGrid[pollutant]
+	for i := 1; i < len(grid); i++ {
+		if c <= grid[i] {
+			return 25*float64(i-1) + 25*(c-grid[i-1])/(grid[i]-grid[i-1])
+		}
+	}
+	// Above 100 the scale continues with the slope of its last band.
+	last := len(grid) - 1
+	return 100 + 25*(c-grid[last])/(grid[last]-grid[last-1])
+}
+
+// AirQualityIndex computes the index of the given scale for a set of
+// pollutant concentrations, which is the highest sub-index of all pollutants.
+// It returns the index and the pollutant that determined it. Pollutants the
+// scale does not know are ignored; ok is false if none was usable.
+//
+// The concentrations are rated as given, so the index is an instantaneous
+// one like the NowCast of AirNow, not the official one of the scales, which
+// rate 24 hour averages of particulates and 8 hour ones of ozone and CO.
+// For that, average the concentrations over those windows first.
+func AirQualityIndex(scale string, readings map[string]float64) (index float64, dominant string, ok bool) {
+	for p, c := range readings {
+		var sub float64
+		switch scale {
+		case AQIEPA, AQIIndoor:
+			table := epaBreakpoints
+			if scale == AQIIndoor {
+				table = indoorBreakpoints
+			}
+			bps, exists := table[p]
+			if !exists {
+				continue
+			}
+			sub = epaSubIndex(bps, c)
+		case AQICAQI:
+			if _, exists := caqiGrid[p]; !exists {
+				continue
+			}
+			sub = caqiSubIndex(p, c)
+		default:
+			return 0, "", false
+		}
+		if !ok || sub > index || (sub == index && p < dominant) {
+			index, dominant, ok = sub, p, true
+		}
+	}
+	return index, dominant, ok
+}
+
+// AirQualityDerived returns the air_quality_index sample for a set of
+// readings, or none if no index could be computed. Scale and pollutant are
+// added to the labels of the readings.
+func AirQualityDerived(labels Labels, scale string, readings map[string]float64) []Sample {
+	index, dominant, ok := AirQualityIndex(scale, readings)
+	if !ok {
+		return nil
+	}
+	return []Sample{{Name: "air_quality_index", Labels: labels.With("scale", scale, "pollutant", dominant), Value: index}}
+}
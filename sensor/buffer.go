@@ -0,0 +1,97 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package sensor
+
+import "sync"
+
+// DefaultBufferSize is the capacity of a Buffer made without one.
+const DefaultBufferSize = 1000
+
+// A Buffer holds the samples a sensor received since the last scrape, at
+// most its capacity: when it is full the oldest sample is dropped for a new
+// one, so that a burst of MQTT messages or serial frames cannot grow the
+// memory of a small device without bound. A Collector embedding a *Buffer,
+// like those of mqtt and sds011, is a Dropper. It is safe for concurrent
+// use.
+type Buffer struct {
+	mutex   sync.Mutex
+	samples []Sample // a ring of n samples from start
+	start   int
+	n       int
+	dropped uint64
+}
+
+// A Dropper is a Collector that drops samples it cannot keep, like one with
+// a Buffer; the exporter serves how many as
+// sensor_exporter_dropped_samples_total.
+type Dropper interface {
+	Dropped() uint64
+}
+
+// NewBuffer makes a Buffer for size samples, DefaultBufferSize if size is
+// not positive.
+func NewBuffer(size int) *Buffer {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	return &Buffer{samples: make([]Sample, size)}
+}
+
+// Add adds samples, dropping the oldest ones when the buffer is full.
+func (b *Buffer) Add(samples ...Sample) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, sample := range samples {
+		if b.n == len(b.samples) {
+			b.samples[b.start] = sample
+			b.start = (b.start + 1) % len(b.samples)
+			b.dropped++
+			continue
+		}
+		b.samples[(b.start+b.n)%len(b.samples)] = sample
+		b.n++
+	}
+}
+
+// Drain returns the samples in the order they were added and empties the
+// buffer.
+func (b *Buffer) Drain() []Sample {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	out := make([]Sample, b.n)
+	for i := range out {
+		out[i] = b.samples[(b.start+i)%len(b.samples)]
+		b.samples[(b.start+i)%len(b.samples)] = Sample{}
+	}
+	b.start, b.n = 0, 0
+	return out
+}
+
+// Len is the number of samples in the buffer.
+func (b *Buffer) Len() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.n
+}
+
+// Dropped is the number of samples dropped as the buffer was full.
+func (b *Buffer) Dropped() uint64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.dropped
+}
@@ -0,0 +1,56 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package sensor
+
+import (
+	"time"
+)
+
+// ClockTypes, ClockHelp and ClockUnits are the TYPE, HELP and UNIT strings of
+// the metrics of devices that time-stamp their readings, like smart meters
+// their frames: the skew of their clock, see ClockSkew, and the readings left
+// out as too old, see Stale. Sensors that may emit them should append these
+// to their own lists when registering.
+var (
+	ClockTypes = []string{
+		"# TYPE device_clock_skew_seconds gauge",
+		"# TYPE device_stale_readings_total counter",
+	}
+	ClockHelp = []string{
+		"# HELP device_clock_skew_seconds Time a device reported in its last reading minus the time it was received, positive if the device clock is ahead.",
+		"# HELP device_stale_readings_total Readings of a device left out as their time was older than max_age.",
+	}
+	ClockUnits = []string{
+		"# UNIT device_clock_skew_seconds seconds",
+	}
+)
+
+// ClockSkew returns the device_clock_skew_seconds sample of a reading that
+// the device time-stamped reported and the exporter received at received.
+// It includes the time the reading took to arrive, e.g. the poll interval of
+// a daemon.
+func ClockSkew(labels Labels, reported, received time.Time) Sample {
+	return Sample{Name: "device_clock_skew_seconds", Labels: labels, Value: reported.Sub(received).Seconds()}
+}
+
+// Stale tells whether a reading the device time-stamped reported, received
+// at received, is older than maxAge, e.g. one a gateway buffered while the
+// exporter was not reading. With a maxAge of 0 none is.
+func Stale(reported, received time.Time, maxAge time.Duration) bool {
+	return maxAge > 0 && received.Sub(reported) > maxAge
+}
@@ -0,0 +1,30 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package sensor
+
+import "context"
+
+// A ContextCollector is a Collector that stops scraping when ctx is done,
+// e.g. by dialing with it and setting its deadline on the connection. The
+// exporter gives up on a scrape at its deadline anyway, but a collector
+// that does not notice keeps running until it returns and is not scraped
+// again before. t is nil unless the exporter traces, see TracedCollector.
+type ContextCollector interface {
+	Collector
+	ScrapeContext(ctx context.Context, t *Trace) ([]Sample, error)
+}
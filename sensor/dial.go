@@ -0,0 +1,122 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package sensor
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// FallbackDelay is how long Dial waits for a connection before it also
+// tries the other addresses of a host, of the other IP family first, Happy
+// Eyeballs (RFC 8305). Negative to try them one after the other.
+var FallbackDelay = 300 * time.Millisecond
+
+// connected are the addresses host names last connected to, by network and
+// host name with port.
+var connected sync.Map
+
+// Dial connects to address like net.Dialer, racing the IPv6 and IPv4
+// addresses of a host name, see FallbackDelay. The address a host name
+// connected to is dialed first the next time, so that a host whose AAAA
+// record is unreachable costs the fallback delay once, not at every scrape.
+// Collectors dial TCP with it, or DialTimeout.
+func Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	d := &net.Dialer{FallbackDelay: FallbackDelay}
+	key := network + " " + address
+	last, known := connected.Load(key)
+	var conn net.Conn
+	var err error
+	if known && FallbackDelay >= 0 {
+		conn, err = race(ctx, d, network, last.(string), address)
+	} else {
+		conn, err = d.DialContext(ctx, network, address)
+	}
+	if err != nil {
+		connected.Delete(key)
+		return nil, err
+	}
+	if host, _, _ := net.SplitHostPort(address); net.ParseIP(host) == nil {
+		connected.Store(key, conn.RemoteAddr().String())
+	}
+	if Faults != nil {
+		faulty, err := Faults.Conn(address, conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = faulty
+	}
+	return conn, nil
+}
+
+// DialTimeout is Dial with a timeout, like net.DialTimeout.
+func DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return Dial(ctx, network, address)
+}
+
+// race dials first, the address last connected to, and all addresses of
+// address as well once that failed or FallbackDelay passed. The first
+// connection wins, the other is closed.
+func race(ctx context.Context, d *net.Dialer, network, first, address string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type dialed struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan dialed, 2)
+	dial := func(address string) {
+		conn, err := d.DialContext(ctx, network, address)
+		results <- dialed{conn, err}
+	}
+	go dial(first)
+	fallback := time.NewTimer(FallbackDelay)
+	defer fallback.Stop()
+	started, pending := false, 1
+	var err error
+	for pending > 0 {
+		select {
+		case <-fallback.C:
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				if pending > 0 {
+					go func() {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}()
+				}
+				return r.conn, nil
+			}
+			err = r.err
+		}
+		if !started {
+			started = true
+			pending++
+			go dial(address)
+		}
+	}
+	// That of the dial that failed last.
+	return nil, err
+}
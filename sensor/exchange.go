@@ -0,0 +1,128 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package sensor
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// An Exchange is a request a collector sent to its device or server and the
+// answer it got, raw, kept for the debug bundle: protocol problems are found
+// in the bytes on the wire more than in the error they end in. Collectors
+// leave out exchanges with secrets, like logins.
+type Exchange struct {
+	Time      time.Time
+	Collector string
+	Device    string
+	Sent      []byte
+	Received  []byte
+}
+
+// The last maxExchanges exchanges are kept per collector and device, each
+// cut at maxExchangeBytes.
+const (
+	maxExchanges     = 10
+	maxExchangeBytes = 4096
+)
+
+// A capture gets the exchanges of a collector whole, up to maxCaptureBytes
+// each, see Capture.
+const maxCaptureBytes = 1 << 20
+
+type capture struct {
+	collector string
+	exchanges []Exchange
+}
+
+var (
+	exchanges      = make(map[[2]string][]Exchange)
+	captures       = make(map[*capture]bool)
+	exchangesMutex sync.Mutex
+)
+
+// RecordExchange keeps x as the last exchange of its collector and device,
+// at the time it is called if x.Time is zero. It copies Sent and Received.
+func RecordExchange(x Exchange) {
+	if x.Time.IsZero() {
+		x.Time = time.Now()
+	}
+	key := [2]string{x.Collector, x.Device}
+	exchangesMutex.Lock()
+	defer exchangesMutex.Unlock()
+	for c := range captures {
+		if c.collector == x.Collector {
+			whole := x
+			whole.Sent = append([]byte(nil), x.Sent[:min(len(x.Sent), maxCaptureBytes)]...)
+			whole.Received = append([]byte(nil), x.Received[:min(len(x.Received), maxCaptureBytes)]...)
+			c.exchanges = append(c.exchanges, whole)
+		}
+	}
+	x.Sent = clip(x.Sent)
+	x.Received = clip(x.Received)
+	last := append(exchanges[key], x)
+	if len(last) > maxExchanges {
+		last = append(last[:0:0], last[len(last)-maxExchanges:]...)
+	}
+	exchanges[key] = last
+}
+
+// clip copies b, up to maxExchangeBytes.
+func clip(b []byte) []byte {
+	return append([]byte(nil), b[:min(len(b), maxExchangeBytes)]...)
+}
+
+// Capture starts capturing the exchanges of collector, uncut, e.g. around a
+// scrape to show what a device sends. The exchanges of all sensors of the
+// collector are captured, those of other sensors scraped meanwhile too. The
+// returned function stops the capture and returns the exchanges in the order
+// they were recorded.
+func Capture(collector string) (stop func() []Exchange) {
+	c := &capture{collector: collector}
+	exchangesMutex.Lock()
+	captures[c] = true
+	exchangesMutex.Unlock()
+	return func() []Exchange {
+		exchangesMutex.Lock()
+		defer exchangesMutex.Unlock()
+		delete(captures, c)
+		return c.exchanges
+	}
+}
+
+// Exchanges returns the exchanges kept, by collector, device and time.
+func Exchanges() []Exchange {
+	exchangesMutex.Lock()
+	var out []Exchange
+	for _, last := range exchanges {
+		out = append(out, last...)
+	}
+	exchangesMutex.Unlock()
+	sort.SliceStable(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		if a.Collector != b.Collector {
+			return a.Collector < b.Collector
+		}
+		if a.Device != b.Device {
+			return a.Device < b.Device
+		}
+		return a.Time.Before(b.Time)
+	})
+	return out
+}
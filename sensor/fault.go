@@ -0,0 +1,39 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package sensor
+
+import (
+	"io"
+	"net"
+)
+
+// An Injector injects faults into the connections and ports collectors open
+// to their devices, to test how the exporter and the collectors cope with
+// dropped connections, slow reads and corrupt frames.
+type Injector interface {
+	// Conn returns conn, dialed to address, with faults, or the error to
+	// fail the dial with.
+	Conn(address string, conn net.Conn) (net.Conn, error)
+	// Port likewise returns the port of a serial device with faults.
+	Port(device string, port io.ReadWriteCloser) (io.ReadWriteCloser, error)
+}
+
+// Faults, if set, gets the connections of Dial and the serial ports opened
+// by the serial package. Only builds with the chaos tag set it, see the chaos
+// package.
+var Faults Injector
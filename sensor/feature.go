@@ -0,0 +1,83 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package sensor
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// features are the known experimental features by name, true if enabled.
+var (
+	featureMutex sync.RWMutex
+	features     = map[string]bool{}
+	featureHelp  = map[string]string{}
+)
+
+// RegisterFeature makes name a known experimental feature, which is off
+// until enabled with EnableFeatures, e.g. by -enable-feature. Large new
+// subsystems register one so that they can ship disabled and be tried per
+// deployment; registering a name again is a no-op.
+func RegisterFeature(name, description string) {
+	featureMutex.Lock()
+	defer featureMutex.Unlock()
+	if _, known := features[name]; !known {
+		features[name], featureHelp[name] = false, description
+	}
+}
+
+// EnableFeatures enables the features of names. Unknown names are an error,
+// to catch typos, and enable none.
+func EnableFeatures(names []string) error {
+	featureMutex.Lock()
+	defer featureMutex.Unlock()
+	for _, name := range names {
+		if _, known := features[name]; !known {
+			known := make([]string, 0, len(features))
+			for k := range features {
+				known = append(known, k)
+			}
+			sort.Strings(known)
+			return errors.New("unknown feature " + name + ", known are: " + strings.Join(known, ", "))
+		}
+	}
+	for _, name := range names {
+		features[name] = true
+	}
+	return nil
+}
+
+// FeatureEnabled tells whether the feature of name is enabled.
+func FeatureEnabled(name string) bool {
+	featureMutex.RLock()
+	defer featureMutex.RUnlock()
+	return features[name]
+}
+
+// Features returns the descriptions of the known features by name.
+func Features() map[string]string {
+	featureMutex.RLock()
+	defer featureMutex.RUnlock()
+	help := make(map[string]string, len(featureHelp))
+	for k, v := range featureHelp {
+		help[k] = v
+	}
+	return help
+}
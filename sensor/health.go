@@ -0,0 +1,176 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package sensor
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HealthTypes, HealthHelp and HealthUnits are the TYPE, HELP and UNIT strings
+// of the metrics written by DeviceHealth. Sensors that may emit them should
+// append these to their own lists when registering.
+var (
+	HealthTypes = []string{
+		"# TYPE sensor_battery_percent gauge",
+		"# TYPE sensor_last_seen_timestamp_seconds gauge",
+		"# TYPE sensor_missing gauge",
+		"# TYPE sensor_link_rssi_dbm gauge",
+		"# TYPE sensor_link_quality gauge",
+	}
+	HealthHelp = []string{
+		"# HELP sensor_battery_percent Battery level of a wireless sensor.",
+		"# HELP sensor_last_seen_timestamp_seconds When a wireless sensor last reported.",
+		"# HELP sensor_missing Whether a wireless sensor has not reported within its expected window.",
+		"# HELP sensor_link_rssi_dbm Received signal strength of a wireless sensor.",
+		"# HELP sensor_link_quality Link quality of a wireless sensor, from 0 to 1.",
+	}
+	HealthUnits = []string{
+		"# UNIT sensor_battery_percent percent",
+		"# UNIT sensor_last_seen_timestamp_seconds seconds",
+		"# UNIT sensor_link_rssi_dbm dbm",
+	}
+)
+
+// Transports of wireless sensors, for the transport label of link metrics.
+const (
+	TransportBLE     = "ble"
+	TransportZigbee  = "zigbee"
+	TransportLoRaWAN = "lorawan"
+	TransportWiFi    = "wifi"
+)
+
+// A DeviceReport is what a wireless device told about itself. Values it did
+// not tell are NaN.
+type DeviceReport struct {
+	Time      time.Time
+	Transport string
+	Battery   float64 // percent
+	RSSI      float64 // dBm
+	// LinkQuality is normalized to 0-1, e.g. a Zigbee LQI divided by 255.
+	LinkQuality float64
+}
+
+// NewDeviceReport returns a report of time t over transport with all values
+// unknown.
+func NewDeviceReport(t time.Time, transport string) DeviceReport {
+	return DeviceReport{Time: t, Transport: transport,
+		Battery: math.NaN(), RSSI: math.NaN(), LinkQuality: math.NaN()}
+}
+
+// DeviceHealth keeps the battery level, link quality and last report time of
+// the wireless devices of a collector (BLE, Zigbee, LoRaWAN, WiFi...) and
+// flags those that went silent, so that all of them can be alerted on and
+// dashboarded the same way. Its methods may be called concurrently.
+type DeviceHealth struct {
+	window  time.Duration
+	started time.Time
+
+	mutex   sync.Mutex
+	devices map[string]*deviceStatus
+}
+
+type deviceStatus struct {
+	labels Labels
+	last   DeviceReport
+}
+
+// NewDeviceHealth returns a DeviceHealth that reports a device missing once
+// it has not been seen for window.
+func NewDeviceHealth(window time.Duration) *DeviceHealth {
+	return &DeviceHealth{window: window, started: time.Now(),
+		devices: make(map[string]*deviceStatus)}
+}
+
+// Expect declares a device with its labels, e.g. device="kitchen", so that
+// it is reported missing even if it is never seen.
+func (h *DeviceHealth) Expect(device string, labels Labels) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if _, exists := h.devices[device]; !exists {
+		h.devices[device] = &deviceStatus{labels: labels, last: NewDeviceReport(time.Time{}, "")}
+	}
+}
+
+// Seen records a report of device. Values the report does not carry keep
+// their previous value.
+func (h *DeviceHealth) Seen(device string, labels Labels, r DeviceReport) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	d, exists := h.devices[device]
+	if !exists {
+		d = &deviceStatus{labels: labels, last: NewDeviceReport(time.Time{}, "")}
+		h.devices[device] = d
+	}
+	if r.Time.After(d.last.Time) {
+		d.last.Time = r.Time
+	}
+	if r.Transport != "" {
+		d.last.Transport = r.Transport
+	}
+	for _, v := range []struct{ to, from *float64 }{
+		{&d.last.Battery, &r.Battery},
+		{&d.last.RSSI, &r.RSSI},
+		{&d.last.LinkQuality, &r.LinkQuality},
+	} {
+		if !math.IsNaN(*v.from) {
+			*v.to = *v.from
+		}
+	}
+}
+
+// Metrics returns the health metrics of all known devices.
+func (h *DeviceHealth) Metrics() (out []Sample) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	names := make([]string, 0, len(h.devices))
+	for name := range h.devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	now := time.Now()
+	for _, name := range names {
+		d := h.devices[name]
+		if !math.IsNaN(d.last.Battery) {
+			out = append(out, Sample{Name: "sensor_battery_percent", Labels: d.labels, Value: d.last.Battery})
+		}
+		if d.last.Transport != "" {
+			link := d.labels.With("transport", d.last.Transport)
+			if !math.IsNaN(d.last.RSSI) {
+				out = append(out, Sample{Name: "sensor_link_rssi_dbm", Labels: link, Value: d.last.RSSI})
+			}
+			if !math.IsNaN(d.last.LinkQuality) {
+				out = append(out, Sample{Name: "sensor_link_quality", Labels: link, Value: d.last.LinkQuality})
+			}
+		}
+		since := d.last.Time
+		if !since.IsZero() {
+			out = append(out, Sample{Name: "sensor_last_seen_timestamp_seconds", Labels: d.labels, Value: float64(since.Unix())})
+		} else {
+			since = h.started
+		}
+		missing := 0.0
+		if now.Sub(since) > h.window {
+			missing = 1
+		}
+		out = append(out, Sample{Name: "sensor_missing", Labels: d.labels, Value: missing})
+	}
+	return out
+}
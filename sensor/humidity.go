@@ -0,0 +1,92 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package sensor
+
+import (
+	"math"
+)
+
+// HumidityTypes, HumidityHelp and HumidityUnits are the TYPE, HELP and UNIT
+// strings of the metrics written by HumidityDerived. Sensors that may emit
+// them should append these to their own lists when registering.
+var (
+	HumidityTypes = []string{
+		"# TYPE dew_point_celsius gauge",
+		"# TYPE absolute_humidity_grams_per_cubic_meter gauge",
+		"# TYPE heat_index_celsius gauge",
+	}
+	HumidityHelp = []string{
+		"# HELP dew_point_celsius Temperature at which the air would be saturated with its current water vapour.",
+		"# HELP absolute_humidity_grams_per_cubic_meter Mass of water vapour per volume of air.",
+		"# HELP heat_index_celsius Apparent temperature as felt by humans (NOAA heat index).",
+	}
+	HumidityUnits = []string{
+		"# UNIT dew_point_celsius celsius",
+		"# UNIT absolute_humidity_grams_per_cubic_meter grams_per_cubic_meter",
+		"# UNIT heat_index_celsius celsius",
+	}
+)
+
+// DewPoint returns the dew point in Celsius for a temperature in Celsius and a
+// relative humidity in percent, using the Magnus formula.
+func DewPoint(tempC, rh float64) float64 {
+	const a, b = 17.62, 243.12
+	gamma := math.Log(rh/100) + a*tempC/(b+tempC)
+	return b * gamma / (a - gamma)
+}
+
+// AbsoluteHumidity returns the water vapour density in g/m³.
+func AbsoluteHumidity(tempC, rh float64) float64 {
+	saturation := 6.112 * math.Exp(17.67*tempC/(tempC+243.5)) // hPa
+	return saturation * rh * 2.1674 / (273.15 + tempC)
+}
+
+// HeatIndex returns the NOAA heat index in Celsius. Below 80°F it falls back
+// to Steadman's simple formula, as NOAA does.
+func HeatIndex(tempC, rh float64) float64 {
+	t := tempC*1.8 + 32
+	hi := 0.5 * (t + 61 + (t-68)*1.2 + rh*0.094)
+	if (hi+t)/2 >= 80 {
+		hi = -42.379 + 2.04901523*t + 10.14333127*rh - 0.22475541*t*rh -
+			0.00683783*t*t - 0.05481717*rh*rh + 0.00122874*t*t*rh +
+			0.00085282*t*rh*rh - 0.00000199*t*t*rh*rh
+		if rh < 13 && t >= 80 && t <= 112 {
+			hi -= (13 - rh) / 4 * math.Sqrt((17-math.Abs(t-95))/17)
+		} else if rh > 85 && t >= 80 && t <= 87 {
+			hi += (rh - 85) / 10 * (87 - t) / 5
+		}
+	}
+	return (hi - 32) / 1.8
+}
+
+// HumidityDerived returns the dew point, absolute humidity and heat index
+// samples for a temperature (Celsius) and relative humidity (percent) reading
+// with labels. Sensors that read both values call it so users don't have to
+// write recording rules. Humidity sensors read a little above 100% when
+// saturated, which is taken as 100%, as the dew point matters most then.
+func HumidityDerived(labels Labels, tempC, rh float64) []Sample {
+	if !(rh > 0) {
+		return nil
+	}
+	rh = min(rh, 100)
+	return []Sample{
+		{Name: "dew_point_celsius", Labels: labels, Value: DewPoint(tempC, rh)},
+		{Name: "absolute_humidity_grams_per_cubic_meter", Labels: labels, Value: AbsoluteHumidity(tempC, rh)},
+		{Name: "heat_index_celsius", Labels: labels, Value: HeatIndex(tempC, rh)},
+	}
+}
@@ -23,45 +23,70 @@ import (
 )
 
 // A Collector Every sensor must implement this interface. When called the sensor must read
-// data from its source and return a prometheus compatible values string.
+// data from its source and return its samples.
 type Collector interface {
-	Scrape() (string, error)
+	Scrape() ([]Sample, error)
 }
 
 // A CollectorEntry contains information about a Collector:
+// - the name it is selected by on the command line
 // - the function that creates a new Collector
 // - the suggested scrape interval for this Collector
 // - a list of Prometheus TYPE and HELP strings for the Collector
 //   see <https://prometheus.io/docs/instrumenting/exposition_formats/>
+// - a list of OpenMetrics UNIT strings, e.g. "# UNIT temperature_celsius
+//   celsius", for the metrics whose name ends with their unit
 // - a description of the Collector. It is a good idea to document its opts
 //   here too.
+// - for sensors whose first readings after power-up are invalid, how long
+//   and how many scrapes to discard after the sensor is added or recovers
+//   from a failed scrape, e.g. while the fan of a particulate sensor spins
+//   up
+// - the plausible range of metrics by name, e.g. 0 to 100 for a battery
+//   charge, for the exporter to leave out the values of bit flips and
+//   protocol desyncs
+// - the metrics that enumerate a state, like the status of a UPS or a door
+//   contact, by name, with the label that names the state, or "" if the
+//   value is the state; the exporter counts their changes in
+//   state_changes_total
+// - the mappings of the readings that are strings to values, e.g. of the
+//   status of a UPS, see Mapping; those of the sensor's configuration come
+//   first
+// - the experimental feature the Collector is behind, if any: it can only be
+//   added when the feature is enabled, see RegisterFeature
+// - whether only a single sensor of it may be added, as the samples of two
+//   would collide, like those of log
+//
+// Each sensor package exports its entries and the main package registers the
+// ones it is built with, so that a binary only links the sensors it needs.
 type CollectorEntry struct {
+	Name            string
 	New             func(string) (Collector, error)
 	DefaultInterval time.Duration
 	Type            []string
 	Help            []string
+	Unit            []string
 	Description     string
+	WarmUp          time.Duration
+	WarmUpScrapes   int
+	Ranges          map[string]Range
+	States          map[string]string
+	Mappings        []Mapping
+	Feature         string
+	Single          bool
 }
 
-// The list of available collectors
-var AvailableCollectors = make(map[string]CollectorEntry)
+// A Range is the plausible range of the values of a metric, from Min to Max.
+// Values beyond them by at most Clamp are set to the bound, for sensors that
+// read a little beyond it, like humidity sensors at saturation; the others
+// are left out.
+type Range struct {
+	Min, Max float64
+	Clamp    float64
+}
 
 var incidents uint64 = 0
 
-// RegisterCollector shoukd be called at the init function of each sensor
-// package to register itself to sensor_exporter. It is like golang's
-// image and image/jpg, image/gif relation.
-func RegisterCollector(name string, f func(string) (Collector, error),
-	suggestedInterval time.Duration, sensorsType, sensorsHelp []string, description string) {
-	AvailableCollectors[name] = CollectorEntry{
-		New:             f,
-		DefaultInterval: suggestedInterval,
-		Type:            sensorsType,
-		Help:            sensorsHelp,
-		Description:     description,
-	}
-}
-
 // Incident increases atomically the number of incidents for the program. This
 // can be used by the sensors and the main package to export statistics about
 // serious but not fatal errors (e.g a scrape taking too long or failing). If
@@ -0,0 +1,79 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package sensor
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// A Mapping maps the readings of a sensor that are strings, the Text of its
+// samples, to values, e.g. the status strings of a vendor. Of the metric
+// Metric, or of all if empty, a Text equal to the Text of the mapping, or
+// matching its regular expression Regex in full, gets Value. Compile it before use.
+type Mapping struct {
+	Metric string  `yaml:"metric" toml:"metric"`
+	Text   string  `yaml:"text" toml:"text"`
+	Regex  string  `yaml:"regex" toml:"regex"`
+	Value  float64 `yaml:"value" toml:"value"`
+
+	re *regexp.Regexp
+}
+
+// Compile checks m and compiles its expression.
+func (m *Mapping) Compile() error {
+	if (m.Text == "") == (m.Regex == "") {
+		return errors.New("mapping needs either text or regex")
+	}
+	if m.Metric != "" && !metricNameRe.MatchString(m.Metric) {
+		return fmt.Errorf("bad metric name %q", m.Metric)
+	}
+	if m.Regex == "" {
+		return nil
+	}
+	re, err := regexp.Compile("^(?:" + m.Regex + ")$")
+	if err != nil {
+		return fmt.Errorf("bad mapping expression: %w", err)
+	}
+	m.re = re
+	return nil
+}
+
+// String describes m, the same for the same mapping.
+func (m Mapping) String() string {
+	return fmt.Sprintf("%s:%q/%q=%g", m.Metric, m.Text, m.Regex, m.Value)
+}
+
+// MapText sets the value of s, if it has a Text, by the first of mappings
+// that matches it, and clears the Text. It tells whether s has a value.
+func MapText(mappings []Mapping, s *Sample) bool {
+	if s.Text == "" {
+		return true
+	}
+	for _, m := range mappings {
+		if m.Metric != "" && m.Metric != s.Name {
+			continue
+		}
+		if m.Text != "" && m.Text == s.Text || m.re != nil && m.re.MatchString(s.Text) {
+			s.Value, s.Text = m.Value, ""
+			return true
+		}
+	}
+	return false
+}
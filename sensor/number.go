@@ -0,0 +1,113 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package sensor
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// groupSeparators separate thousands besides . and , in the numbers of some
+// locales: spaces, no-break spaces (fr) and apostrophes (ch).
+const groupSeparators = " '\u2019\u00a0\u202f"
+
+// ParseNumber parses a number as devices and vendor APIs write it for
+// people, in any locale: with a decimal comma, with thousands separators and
+// with a unit after it, like 23,5°C, 1.234,5 kWh, 12 345.6 or 1'234.5 W.
+// Numbers strconv.ParseFloat reads are read by it. Of a number with both .
+// and , the last is the decimal separator; one that occurs more than once
+// separates thousands; a single one is the decimal separator, so 1,234 is
+// 1.234, not 1234. Spaces and apostrophes separate thousands only before
+// groups of three digits. An exponent may follow the digits, like in
+// 1.5e-3 A.
+func ParseNumber(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	if v, err := strconv.ParseFloat(s, 64); err == nil {
+		return v, nil
+	}
+	bad := errors.New("no number in " + strconv.Quote(s))
+	text := strings.Replace(s, "\u2212", "-", 1) // minus sign
+	sign := ""
+	if text != "" && (text[0] == '-' || text[0] == '+') {
+		sign, text = text[:1], text[1:]
+	}
+	// The digits and separators, up to the unit.
+	end := strings.IndexFunc(text, func(r rune) bool {
+		return !isDigit(r) && !strings.ContainsRune(".,"+groupSeparators, r)
+	})
+	if end < 0 {
+		end = len(text)
+	}
+	number := strings.TrimRight(text[:end], ".,"+groupSeparators)
+	if number == "" || !isDigit(rune(number[0])) {
+		return 0, bad
+	}
+	exponent := ""
+	if rest := text[end:]; number == text[:end] && rest != "" && (rest[0] == 'e' || rest[0] == 'E') {
+		digits := rest[1:]
+		if digits != "" && (digits[0] == '-' || digits[0] == '+') {
+			digits = digits[1:]
+		}
+		n := strings.IndexFunc(digits, func(r rune) bool { return !isDigit(r) })
+		if n < 0 {
+			n = len(digits)
+		}
+		if n > 0 { // else the e starts the unit, like in 5 eV
+			exponent = rest[:len(rest)-len(digits)+n]
+		}
+	}
+	groups := strings.FieldsFunc(number, func(r rune) bool { return strings.ContainsRune(groupSeparators, r) })
+	for _, g := range groups[1:] {
+		// Only the last group may have decimals.
+		if digits := strings.IndexAny(g+".", ".,"); digits != 3 {
+			return 0, bad
+		}
+	}
+	number = strings.Join(groups, "")
+	var decimal rune
+	switch dots, commas := strings.Count(number, "."), strings.Count(number, ","); {
+	case dots > 0 && commas > 0:
+		decimal = rune(number[strings.LastIndexAny(number, ".,")])
+	case dots == 1:
+		decimal = '.'
+	case commas == 1:
+		decimal = ','
+	}
+	var b strings.Builder
+	b.WriteString(sign)
+	for _, r := range number {
+		switch {
+		case isDigit(r):
+			b.WriteRune(r)
+		case r == decimal:
+			b.WriteByte('.')
+		}
+	}
+	b.WriteString(exponent)
+	v, err := strconv.ParseFloat(b.String(), 64)
+	if err != nil {
+		return 0, bad
+	}
+	return v, nil
+}
+
+// isDigit tells whether r is an ASCII digit.
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
@@ -0,0 +1,54 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package sensor
+
+import "testing"
+
+func TestParseNumber(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		want float64
+	}{
+		{"23.5", 23.5},
+		{"23,5°C", 23.5},
+		{"1.234,5 kWh", 1234.5},
+		{"1,234.5 kWh", 1234.5},
+		{"12 345.6", 12345.6},
+		{"12 345,6", 12345.6},
+		{"1'234.5 W", 1234.5},
+		{"1,234", 1.234},
+		{"1.234.567", 1234567},
+		{"−5", -5},
+		{"-3,5 °C", -3.5},
+		{"1.5e-3 A", 0.0015},
+		{"2E+02 W", 200},
+		{"1,5e3Wh", 1500},
+		{"5 eV", 5},
+		{"42%", 42},
+	} {
+		got, err := ParseNumber(c.in)
+		if err != nil || got != c.want {
+			t.Errorf("ParseNumber(%q) = %v, %v, want %v", c.in, got, err, c.want)
+		}
+	}
+	for _, in := range []string{"", "abc", "°C", "12 34", "1 2345", "-", "e5"} {
+		if got, err := ParseNumber(in); err == nil {
+			t.Errorf("ParseNumber(%q) = %v, want an error", in, got)
+		}
+	}
+}
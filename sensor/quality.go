@@ -0,0 +1,51 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package sensor
+
+// A Quality tells how far a reading can be trusted, for consumers to weight
+// questionable ones. Collectors set it on the samples of such readings; the
+// exporter serves it as a companion metric, the name of the sample with
+// QualitySuffix, with the labels of the sample and the Quality as value,
+// for the samples whose Quality is not Good.
+type Quality uint8
+
+const (
+	// Good readings were read as they should be; it is the zero value.
+	Good Quality = iota
+	// Degraded readings were read, but not as they should be, e.g. only
+	// after retrying a request whose answer had a bad CRC.
+	Degraded
+	// Estimated readings were not read but estimated, e.g. interpolated
+	// between others.
+	Estimated
+)
+
+// QualitySuffix is the suffix of the companion metrics of Quality.
+const QualitySuffix = "_quality"
+
+func (q Quality) String() string {
+	switch q {
+	case Good:
+		return "good"
+	case Degraded:
+		return "degraded"
+	case Estimated:
+		return "estimated"
+	}
+	return "unknown"
+}
@@ -0,0 +1,126 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package sensor
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Redacted replaces the values of redacted labels.
+const Redacted = "redacted"
+
+// A Redaction hides what the metrics of a sensor reveal of where it is, like
+// a GPS position, the SSID of a network or an external IP address, from the
+// readers of the metrics, e.g. of a public dashboard. Of the metrics whose
+// name matches the regular expression Metric in full, or of all if empty,
+// the value is rounded to a multiple of Round, the values of the labels
+// Labels become Redacted, or, with neither, the metric is left out. Compile
+// it before use.
+type Redaction struct {
+	Metric string   `yaml:"metric" toml:"metric"`
+	Round  float64  `yaml:"round" toml:"round"`
+	Labels []string `yaml:"labels" toml:"labels"`
+
+	re *regexp.Regexp
+}
+
+// Compile checks r and compiles its expression.
+func (r *Redaction) Compile() error {
+	if r.Round < 0 {
+		return errors.New("redaction needs a positive round")
+	}
+	if r.Metric == "" && r.Round == 0 && len(r.Labels) == 0 {
+		return errors.New("redaction of all metrics needs round or labels")
+	}
+	if r.Metric == "" {
+		r.re = nil
+		return nil
+	}
+	re, err := regexp.Compile("^(?:" + r.Metric + ")$")
+	if err != nil {
+		return fmt.Errorf("bad redaction expression: %w", err)
+	}
+	r.re = re
+	return nil
+}
+
+// String describes r, the same for the same redaction.
+func (r Redaction) String() string {
+	return fmt.Sprintf("%s:%g:%s", r.Metric, r.Round, strings.Join(r.Labels, "|"))
+}
+
+// Redact returns samples with redactions applied, the first that matches a
+// sample. Redacted samples are copies, samples is not changed.
+func Redact(redactions []Redaction, samples []Sample) []Sample {
+	if len(redactions) == 0 {
+		return samples
+	}
+	out := make([]Sample, 0, len(samples))
+	for _, s := range samples {
+		i := 0
+		for i < len(redactions) && !redactions[i].matches(s.Name) {
+			i++
+		}
+		if i == len(redactions) {
+			out = append(out, s)
+			continue
+		}
+		r := redactions[i]
+		if r.Round == 0 && len(r.Labels) == 0 {
+			continue
+		}
+		if r.Round > 0 {
+			s.Value = round(s.Value, r.Round)
+		}
+		if len(r.Labels) > 0 {
+			labels := make(Labels, len(s.Labels))
+			for name, value := range s.Labels {
+				labels[name] = value
+			}
+			for _, name := range r.Labels {
+				if _, ok := labels[name]; ok {
+					labels[name] = Redacted
+				}
+			}
+			s.Labels = labels
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// matches tells whether r applies to the metric name.
+func (r Redaction) matches(name string) bool {
+	return r.re == nil || r.re.MatchString(name)
+}
+
+// round rounds v to a multiple of step, without the float noise of the
+// division for steps like 0.1.
+func round(v, step float64) float64 {
+	v = math.Round(v/step) * step
+	if _, decimals, ok := strings.Cut(strconv.FormatFloat(step, 'f', -1, 64), "."); ok {
+		p := math.Pow(10, float64(len(decimals)))
+		v = math.Round(v*p) / p
+	}
+	return v
+}
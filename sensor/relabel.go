@@ -0,0 +1,129 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package sensor
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// A Relabel renames and leaves out the metrics of a sensor before they are
+// served, e.g. to match the dashboards of another exporter. Metrics whose
+// name matches one of the regular expressions of Drop, in full, are left out;
+// those in Rename get the name given there, and the others get Prefix before
+// their name. Compile it before use.
+type Relabel struct {
+	Prefix string            `yaml:"prefix" toml:"prefix"`
+	Rename map[string]string `yaml:"rename" toml:"rename"`
+	Drop   []string          `yaml:"drop" toml:"drop"`
+
+	drop []*regexp.Regexp
+}
+
+// Compile checks the names and compiles the expressions of r.
+func (r *Relabel) Compile() error {
+	if r.Prefix != "" && !metricNameRe.MatchString(r.Prefix) {
+		return fmt.Errorf("bad prefix %q", r.Prefix)
+	}
+	for from, to := range r.Rename {
+		if !metricNameRe.MatchString(to) {
+			return fmt.Errorf("bad name %q for %s", to, from)
+		}
+	}
+	r.drop = r.drop[:0]
+	for _, expr := range r.Drop {
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return fmt.Errorf("bad drop expression: %w", err)
+		}
+		r.drop = append(r.drop, re)
+	}
+	return nil
+}
+
+// String describes r, the same for the same rules.
+func (r *Relabel) String() string {
+	if r == nil {
+		return ""
+	}
+	renames := make(Labels, len(r.Rename))
+	for from, to := range r.Rename {
+		renames[from] = to
+	}
+	return fmt.Sprintf("prefix=%s rename=%s drop=%s", r.Prefix, LabelString(renames), strings.Join(r.Drop, "|"))
+}
+
+var metricNameRe = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// Name returns the name a metric is served with, and false if it is left
+// out. A nil Relabel leaves names alone.
+func (r *Relabel) Name(name string) (string, bool) {
+	if r == nil {
+		return name, true
+	}
+	for _, re := range r.drop {
+		if re.MatchString(name) {
+			return "", false
+		}
+	}
+	if to, ok := r.Rename[name]; ok {
+		return to, true
+	}
+	return r.Prefix + name, true
+}
+
+// Apply renames samples and leaves out those dropped, in place.
+func (r *Relabel) Apply(samples []Sample) []Sample {
+	if r == nil {
+		return samples
+	}
+	kept := samples[:0]
+	for _, s := range samples {
+		name, ok := r.Name(s.Name)
+		if !ok {
+			continue
+		}
+		s.Name = name
+		kept = append(kept, s)
+	}
+	return kept
+}
+
+// Lines renames the metrics of TYPE, HELP and UNIT lines of a CollectorEntry,
+// for the samples renamed by Apply, and leaves out those of the dropped ones.
+func (r *Relabel) Lines(lines []string) []string {
+	if r == nil {
+		return lines
+	}
+	out := make([]string, 0, len(lines))
+	for _, line := range lines {
+		fields := strings.SplitN(line, " ", 4)
+		if len(fields) < 3 || fields[0] != "#" {
+			out = append(out, line)
+			continue
+		}
+		name, ok := r.Name(fields[2])
+		if !ok {
+			continue
+		}
+		fields[2] = name
+		out = append(out, strings.Join(fields, " "))
+	}
+	return out
+}
@@ -0,0 +1,157 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package sensor
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Labels are the label names and values of a sample.
+type Labels map[string]string
+
+// With returns a copy of l with the name and value pairs added, e.g.
+// l.With("transport", "ble").
+func (l Labels) With(pairs ...string) Labels {
+	c := make(Labels, len(l)+len(pairs)/2)
+	for name, value := range l {
+		c[name] = value
+	}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		c[pairs[i]] = pairs[i+1]
+	}
+	return c
+}
+
+// Names returns the label names, sorted.
+func (l Labels) Names() []string {
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// A Sample is one value of a metric, as returned by a Collector. The TYPE
+// and HELP of the metric are those of the collector's entry. A reading that
+// is a string, like the status of a UPS, is given as Text instead; the
+// exporter sets the value by the mappings of the sensor and of the entry,
+// see Mapping, and leaves the sample out if none matches. A questionable
+// reading has a Quality other than Good.
+type Sample struct {
+	Name    string
+	Labels  Labels
+	Value   float64
+	Text    string
+	Quality Quality
+}
+
+// LabelString writes labels in the Prometheus text format, sorted by name,
+// {a="b",c="d"}, or an empty string if there are none.
+func LabelString(labels Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range labels.Names() {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(EscapeLabelValue(labels[name]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// EscapeLabelValue escapes backslashes, quotes and newlines of a label value.
+func EscapeLabelValue(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+var labelNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// ValidLabelName tells whether name is a valid Prometheus label name, not
+// reserved for internal use by a leading __.
+func ValidLabelName(name string) bool {
+	return labelNameRe.MatchString(name) && !strings.HasPrefix(name, "__")
+}
+
+// ParseLabels parses the labels at the start of s in the format of
+// LabelString, {a="b",c="d"}, and returns them and the rest of s. Values are
+// unescaped.
+func ParseLabels(s string) (Labels, string, error) {
+	if !strings.HasPrefix(s, "{") {
+		return nil, s, errors.New("labels must start with {")
+	}
+	labels := Labels{}
+	s = strings.TrimLeft(s[1:], " ")
+	for !strings.HasPrefix(s, "}") {
+		eq := strings.Index(s, "=")
+		if eq < 0 {
+			return nil, s, errors.New("expected name=\"value\"")
+		}
+		name := strings.TrimSpace(s[:eq])
+		if !ValidLabelName(name) {
+			return nil, s, errors.New("bad label name: " + name)
+		}
+		s = strings.TrimLeft(s[eq+1:], " ")
+		if !strings.HasPrefix(s, `"`) {
+			return nil, s, errors.New("value of " + name + " must be quoted")
+		}
+		var value strings.Builder
+		i := 1
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] == '\\' && i+1 < len(s) {
+				i++
+				switch s[i] {
+				case 'n':
+					value.WriteByte('\n')
+				case '\\', '"':
+					value.WriteByte(s[i])
+				default:
+					return nil, s, errors.New("bad escape in value of " + name)
+				}
+				continue
+			}
+			value.WriteByte(s[i])
+		}
+		if i == len(s) {
+			return nil, s, errors.New("unterminated value of " + name)
+		}
+		if _, dup := labels[name]; dup {
+			return nil, s, errors.New("duplicate label " + name)
+		}
+		labels[name] = value.String()
+		s = strings.TrimLeft(s[i+1:], " ")
+		if strings.HasPrefix(s, ",") {
+			s = strings.TrimLeft(s[1:], " ")
+		} else if !strings.HasPrefix(s, "}") {
+			return nil, s, errors.New("expected , or } after the value of " + name)
+		}
+	}
+	return labels, s[1:], nil
+}
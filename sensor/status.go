@@ -0,0 +1,57 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package sensor
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrNoSamples is the error of a scrape that returned no samples, which
+// sensors do when they logged what went wrong themselves.
+var ErrNoSamples = errors.New("returned no samples")
+
+// A Status is the health of a collector, kept from the outcome of every
+// scrape, for health checks that need more than the incidents of the whole
+// program: whether the last scrape succeeded and when one last did, and how
+// many failed, in all and in a row, with the last error.
+type Status struct {
+	Up                bool
+	LastUp            time.Time
+	Errors            int
+	ConsecutiveErrors int
+	LastError         string
+	LastErrorTime     time.Time
+}
+
+// Record records a scrape at t that returned samples or failed with err. A
+// scrape without samples failed too, with ErrNoSamples.
+func (s *Status) Record(t time.Time, samples int, err error) {
+	if err == nil && samples == 0 {
+		err = ErrNoSamples
+	}
+	s.Up = err == nil
+	if s.Up {
+		s.LastUp = t
+		s.ConsecutiveErrors = 0
+		return
+	}
+	s.Errors++
+	s.ConsecutiveErrors++
+	s.LastError, s.LastErrorTime = err.Error(), t
+}
@@ -0,0 +1,38 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package sensor
+
+import "time"
+
+// A Streamer is a Collector that listens to its device continuously rather
+// than polling it, like one for a serial stream, an audio capture or pulse
+// counters; Scrape returns what it received since the last
+// scrape. The exporter calls Start in a goroutine of its own when the sensor
+// is added, again after a while whenever it returns, and Stop when the
+// sensor is removed.
+type Streamer interface {
+	Collector
+	// Start listens until the device fails or Stop is called, and returns
+	// why it stopped, nil after Stop.
+	Start() error
+	// Stop ends the stream for good: Start returns, also when it is called
+	// only after Stop.
+	Stop()
+	// Received is when data last arrived from the device, zero if never.
+	Received() time.Time
+}
@@ -0,0 +1,83 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package sensor
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A TracedCollector is a Collector that can break a scrape down into
+// stages, e.g. dial, request, read and parse, to find out which one makes a
+// device slow. Scrape usually is ScrapeTrace(nil).
+type TracedCollector interface {
+	Collector
+	ScrapeTrace(t *Trace) ([]Sample, error)
+}
+
+// A Stage is a named part of a scrape and how long it took.
+type Stage struct {
+	Name     string
+	Duration time.Duration
+}
+
+// A Trace records the stages of one scrape. Its methods do nothing on a nil
+// Trace, so collectors may call them unconditionally.
+type Trace struct {
+	Start  time.Time
+	Stages []Stage
+	last   time.Time
+}
+
+// NewTrace starts a trace now.
+func NewTrace() *Trace {
+	now := time.Now()
+	return &Trace{Start: now, last: now}
+}
+
+// Mark ends the stage name, which began at the previous Mark or at the start
+// of the trace.
+func (t *Trace) Mark(name string) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	t.Stages = append(t.Stages, Stage{name, now.Sub(t.last)})
+	t.last = now
+}
+
+// Total is the time from the start of the trace to its last stage.
+func (t *Trace) Total() time.Duration {
+	if t == nil {
+		return 0
+	}
+	return t.last.Sub(t.Start)
+}
+
+func (t *Trace) String() string {
+	if t == nil {
+		return ""
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s took %s", t.Start.Format(time.RFC3339), t.Total())
+	for _, s := range t.Stages {
+		fmt.Fprintf(&b, ", %s %s", s.Name, s.Duration)
+	}
+	return b.String()
+}
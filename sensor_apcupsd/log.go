@@ -0,0 +1,134 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package sensor_apcupsd
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+// dataKeys are the keys of the status report of the values of the data
+// lines apcupsd logs every DATATIME: minimum, maximum line voltage, output
+// voltage, battery voltage, line frequency, load, UPS temperature, ambient
+// temperature, humidity, line voltage, battery charge and a toggle.
+var dataKeys = []string{"MINLINEV", "MAXLINEV", "OUTPUTV", "BATTV", "LINEFREQ",
+	"LOADPCT", "ITEMP", "AMBTEMP", "HUMIDITY", "LINEV", "BCHARGE"}
+
+// eventFlags are the flags of STATUS that events of apcupsd begin.
+var eventFlags = []struct {
+	prefix string
+	flag   string
+}{
+	{"Power failure", "ONBATT"},
+	{"Running on UPS batteries", "ONBATT"},
+	{"Mains returned", "ONLINE"},
+	{"Power is back", "ONLINE"},
+	{"Battery power exhausted", "LOWBATT"},
+	{"Battery charge below low limit", "LOWBATT"},
+}
+
+// syslogLayout is that of the time of classic syslog lines, without a year.
+var syslogLayout = "Jan _2 15:04:05"
+
+// ReadLog reads a log of apcupsd, its events file or the lines it sends to
+// syslog, and calls f with the time and readings of the data lines and of
+// the events that change the status, with the labels of the sensor for ups
+// and host. Data lines are logged with DATATIME set in apcupsd.conf. Classic
+// syslog times, without a year, are taken to be within the year up to now.
+// Lines without a time are skipped and counted.
+func ReadLog(r io.Reader, ups, host string, now time.Time, f func(time.Time, []sensor.Sample)) (skipped int, err error) {
+	s := &Sensor{Host: host}
+	labels := s.labels(map[string]string{"UPSNAME": ups})
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		t, message, ok := logLine(scanner.Text(), now)
+		if !ok {
+			skipped++
+			continue
+		}
+		if values := strings.Split(message, ","); len(values) >= len(dataKeys) {
+			status := make(map[string]string)
+			for i, key := range dataKeys {
+				if _, err := strconv.ParseFloat(values[i], 64); err != nil {
+					status = nil
+					break
+				}
+				status[key] = values[i]
+			}
+			if status != nil {
+				status["UPSNAME"] = ups
+				f(t, s.samples(status))
+				continue
+			}
+		}
+		for _, e := range eventFlags {
+			if strings.HasPrefix(message, e.prefix) {
+				value, _ := online(map[string]bool{e.flag: true})
+				f(t, []sensor.Sample{{Name: "upsc_ups_online", Labels: labels, Value: value}})
+				break
+			}
+		}
+	}
+	return skipped, scanner.Err()
+}
+
+// logLine returns the time and message of a line of the events file,
+//
+//	2026-10-16 11:40:23 +0200  Power failure.
+//
+// or of syslog, with a classic or an RFC 3339 time:
+//
+//	Oct 16 11:40:23 host apcupsd[812]: Power failure.
+func logLine(line string, now time.Time) (time.Time, string, bool) {
+	if len(line) > len(dateLayout) {
+		if t, err := time.Parse(dateLayout, line[:len(dateLayout)]); err == nil {
+			return t, strings.TrimSpace(line[len(dateLayout):]), true
+		}
+	}
+	var t time.Time
+	var rest string
+	if len(line) > len(syslogLayout) {
+		var err error
+		if t, err = time.ParseInLocation(syslogLayout, line[:len(syslogLayout)], time.Local); err == nil {
+			t = t.AddDate(now.Year(), 0, 0)
+			if t.After(now) {
+				t = t.AddDate(-1, 0, 0)
+			}
+			rest = line[len(syslogLayout):]
+		}
+	}
+	if rest == "" {
+		stamp, after, _ := strings.Cut(line, " ")
+		var err error
+		if t, err = time.Parse(time.RFC3339Nano, stamp); err != nil {
+			return time.Time{}, "", false
+		}
+		rest = after
+	}
+	// host apcupsd[812]: message
+	_, message, found := strings.Cut(rest, ": ")
+	if !found {
+		return time.Time{}, "", false
+	}
+	return t, strings.TrimSpace(message), true
+}
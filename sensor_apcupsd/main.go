@@ -0,0 +1,365 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package sensor_apcupsd reads an APC UPS through apcupsd, with the network
+information server (NIS) protocol that apcaccess uses, on port 3551 by
+default:
+
+	sensor_exporter apcupsd,,HOST
+	sensor_exporter apcupsd,,HOST:PORT
+
+Readings that NUT also has are exported under the metric names and labels
+(ups, host) of the upsc sensor, so dashboards work with either backend. The
+rest, like the estimated runtime, are apcupsd_ metrics.
+
+apcupsd reports when it last read the UPS, DATE; the skew of its clock is
+exported. With max_age=DURATION after the address, a report older than that,
+of an apcupsd that lost the UPS but keeps serving its last status, fails the
+scrape:
+
+	sensor_exporter apcupsd,,HOST,max_age=5m
+
+The protocol is described at http://www.apcupsd.org/manual/manual.html#nis-network-server
+*/
+package sensor_apcupsd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+var suggestedScrapeInterval = time.Duration(10 * time.Second)
+var description = `Apcupsd reads an APC UPS from apcupsd over its NIS protocol, like apcaccess.
+Its option is the address of apcupsd, default localhost:3551, and max_age=5m
+to fail the scrape if the report of apcupsd is older. Readings are named like
+those of upsc, so dashboards work with either:
+
+  sensor_exporter apcupsd,,HOST`
+var timeOut = 10 * time.Second
+
+// A value of the status report and its metric.
+type metric struct {
+	name   string
+	factor float64
+}
+
+// metrics maps the keys of the status report that are plain numbers.
+var metrics = map[string]metric{
+	"BCHARGE":   {"upsc_battery_charge", 1},
+	"MBATTCHG":  {"upsc_battery_charge_low", 1},
+	"BATTV":     {"upsc_battery_voltage", 1},
+	"NOMBATTV":  {"upsc_battery_voltage_nominal", 1},
+	"LINEFREQ":  {"upsc_input_frequency", 1},
+	"LINEV":     {"upsc_input_voltage", 1},
+	"NOMINV":    {"upsc_input_voltage_nominal", 1},
+	"OUTPUTV":   {"upsc_output_voltage", 1},
+	"LOADPCT":   {"upsc_ups_load", 1},
+	"ITEMP":     {"upsc_ups_temperature", 1},
+	"NUMXFERS":  {"upsc_input_transfers_total", 1},
+	"TIMELEFT":  {"apcupsd_battery_runtime_seconds", 60}, // minutes
+	"TONBATT":   {"apcupsd_time_on_battery_seconds", 1},
+	"CUMONBATT": {"apcupsd_time_on_battery_seconds_total", 1},
+	"NOMPOWER":  {"apcupsd_nominal_power_watts", 1},
+}
+
+// dateLayout is that of DATE in the status report.
+var dateLayout = "2006-01-02 15:04:05 -0700"
+
+type Sensor struct {
+	Host string
+	Addr string
+	// MaxAge, if set, is the age of the report beyond which a scrape fails.
+	MaxAge time.Duration
+
+	stale float64 // reports older than MaxAge
+}
+
+func NewSensor(opts string) (sensor.Collector, error) {
+	args := strings.Split(opts, ",")
+	host := args[0]
+	if host == "" {
+		host = "localhost"
+	}
+	if strings.ContainsAny(host, "@=") {
+		return nil, errors.New("Apcupsd, expected HOST or HOST:PORT, got: " + opts)
+	}
+	s := &Sensor{Host: host, Addr: host}
+	for _, opt := range args[1:] {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 || kv[0] != "max_age" {
+			return nil, errors.New("Apcupsd, unknown option: " + opt)
+		}
+		d, err := time.ParseDuration(kv[1])
+		if err != nil || d <= 0 {
+			return nil, errors.New("Apcupsd, bad max_age: " + kv[1])
+		}
+		s.MaxAge = d
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		s.Host = h
+	} else {
+		s.Addr = net.JoinHostPort(host, "3551")
+	}
+	conn, err := sensor.DialTimeout("tcp", s.Addr, timeOut)
+	if err != nil {
+		slog.Warn("Adding apcupsd sensor but could not connect to remote", "addr", s.Addr)
+	} else {
+		conn.Close()
+	}
+	return s, nil
+}
+
+func (s *Sensor) Scrape() (out []sensor.Sample, e error) {
+	return s.ScrapeTrace(nil)
+}
+
+// ScrapeTrace scrapes, marking the dial, read and parse stages.
+func (s *Sensor) ScrapeTrace(t *sensor.Trace) (out []sensor.Sample, e error) {
+	conn, err := sensor.DialTimeout("tcp", s.Addr, timeOut)
+	t.Mark("dial")
+	if err != nil {
+		sensor.Incident()
+		slog.Error("Apcupsd failed to connect", "addr", s.Addr, "err", err)
+		return nil, nil
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeOut))
+	// The raw report is kept for debug bundles.
+	var raw bytes.Buffer
+	status, err := readStatus(struct {
+		io.Reader
+		io.Writer
+	}{io.TeeReader(conn, &raw), conn})
+	sensor.RecordExchange(sensor.Exchange{Collector: "apcupsd", Device: s.Addr, Sent: statusRequest, Received: raw.Bytes()})
+	t.Mark("read")
+	received := time.Now()
+	if err != nil {
+		sensor.Incident()
+		slog.Error("Apcupsd could not read status", "addr", s.Addr, "err", err)
+		return nil, nil
+	}
+	reported, err := time.Parse(dateLayout, status["DATE"])
+	dated := err == nil
+	if dated && sensor.Stale(reported, received, s.MaxAge) {
+		s.stale++
+		sensor.Incident()
+		slog.Error("Apcupsd status is too old", "addr", s.Addr, "date", status["DATE"])
+		return []sensor.Sample{{Name: "device_stale_readings_total", Labels: s.labels(status), Value: s.stale}}, nil
+	}
+	out = s.samples(status)
+	if dated {
+		out = append(out, sensor.ClockSkew(s.labels(status), reported, received))
+	}
+	if s.MaxAge > 0 {
+		out = append(out, sensor.Sample{Name: "device_stale_readings_total", Labels: s.labels(status), Value: s.stale})
+	}
+	t.Mark("parse")
+	return out, nil
+}
+
+// statusRequest is the status command, prefixed with its length.
+var statusRequest = append([]byte{0, 6}, "status"...)
+
+// maxRecords and maxStatusSize bound a status report; apcupsd sends about
+// 50 records of a few KiB together, so more is a broken or hostile server
+// streaming without end.
+const (
+	maxRecords    = 1000
+	maxStatusSize = 256 << 10
+)
+
+// readStatus sends the status command and returns the key and value pairs
+// of the report. Messages either way are prefixed with their length, the
+// report ends with an empty one.
+func readStatus(conn io.ReadWriter) (map[string]string, error) {
+	if _, err := conn.Write(statusRequest); err != nil {
+		return nil, err
+	}
+	status := make(map[string]string)
+	read := 0
+	for records := 0; ; records++ {
+		if records == maxRecords {
+			return nil, errors.New("too many records")
+		}
+		var size [2]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return nil, err
+		}
+		n := binary.BigEndian.Uint16(size[:])
+		if n == 0 {
+			return status, nil
+		}
+		if read += int(n); read > maxStatusSize {
+			return nil, errors.New("report too long")
+		}
+		line := make([]byte, n)
+		if _, err := io.ReadFull(conn, line); err != nil {
+			return nil, err
+		}
+		// LOADPCT  :  12.0 Percent
+		kv := strings.SplitN(string(line), ":", 2)
+		if len(kv) == 2 {
+			status[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+}
+
+// labels are the labels of the UPS of status.
+func (s *Sensor) labels(status map[string]string) sensor.Labels {
+	ups := status["UPSNAME"]
+	if ups == "" {
+		ups = "apcupsd"
+	}
+	return sensor.Labels{"ups": ups, "host": s.Host}
+}
+
+func (s *Sensor) samples(status map[string]string) (out []sensor.Sample) {
+	labels := s.labels(status)
+
+	for key, value := range status {
+		m, exists := metrics[key]
+		if !exists {
+			continue
+		}
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			continue
+		}
+		v, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			slog.Warn("Apcupsd could not parse value", "addr", s.Addr, "key", key, "value", value)
+			continue
+		}
+		out = append(out, sensor.Sample{Name: m.name, Labels: labels, Value: v * m.factor})
+	}
+
+	if status["STATUS"] != "" {
+		flags := make(map[string]bool)
+		for _, flag := range strings.Fields(status["STATUS"]) {
+			flags[flag] = true
+		}
+		if online, ok := online(flags); ok {
+			out = append(out, sensor.Sample{Name: "upsc_ups_online", Labels: labels, Value: online})
+		}
+		replace := 0.0
+		if flags["REPLACEBATT"] {
+			replace = 1
+		}
+		out = append(out, sensor.Sample{Name: "upsc_battery_replace_needed", Labels: labels, Value: replace})
+	}
+
+	if reason := status["LASTXFER"]; reason != "" && !strings.HasPrefix(reason, "No transfers") {
+		out = append(out, sensor.Sample{Name: "upsc_input_transfer_reason",
+			Labels: labels.With("reason", reason), Value: 1})
+	}
+	for _, layout := range []string{"2006-01-02", "01/02/06", "01/02/2006"} {
+		if date, err := time.Parse(layout, status["BATTDATE"]); err == nil {
+			out = append(out, sensor.Sample{Name: "upsc_battery_age_seconds", Labels: labels,
+				Value: time.Since(date).Seconds()})
+			break
+		}
+	}
+	return out
+}
+
+// online returns the value of upsc_ups_online, that of ups.status in the
+// upsc sensor, for the flags of STATUS; ok is false without any of them.
+func online(flags map[string]bool) (value float64, ok bool) {
+	switch {
+	case flags["LOWBATT"]:
+		return 0, true
+	case flags["ONBATT"]:
+		value = 1
+	case flags["ONLINE"]:
+		value = 2
+	default:
+		return 0, false
+	}
+	if flags["SHUTTING"] {
+		value -= 0.5
+	}
+	return value, true
+}
+
+// Collector is the apcupsd sensor, for the main package to register. The
+// upsc_ lines are those of the upsc sensor.
+var Collector = sensor.CollectorEntry{
+	Name:            "apcupsd",
+	New:             NewSensor,
+	DefaultInterval: suggestedScrapeInterval,
+	Type: append([]string{"# TYPE upsc_battery_charge gauge",
+		"# TYPE upsc_battery_charge_low gauge",
+		"# TYPE upsc_battery_voltage gauge",
+		"# TYPE upsc_battery_voltage_nominal gauge",
+		"# TYPE upsc_input_frequency gauge",
+		"# TYPE upsc_input_voltage gauge",
+		"# TYPE upsc_input_voltage_nominal gauge",
+		"# TYPE upsc_output_voltage gauge",
+		"# TYPE upsc_ups_load gauge",
+		"# TYPE upsc_ups_online gauge",
+		"# TYPE upsc_ups_temperature gauge",
+		"# TYPE upsc_input_transfers_total counter",
+		"# TYPE upsc_input_transfer_reason gauge",
+		"# TYPE upsc_battery_replace_needed gauge",
+		"# TYPE upsc_battery_age_seconds gauge",
+		"# TYPE apcupsd_battery_runtime_seconds gauge",
+		"# TYPE apcupsd_time_on_battery_seconds gauge",
+		"# TYPE apcupsd_time_on_battery_seconds_total counter",
+		"# TYPE apcupsd_nominal_power_watts gauge"}, sensor.ClockTypes...),
+	Help: append([]string{"# HELP upsc_battery_charge gauge Battery charge (percent)",
+		"# HELP upsc_battery_charge_low gauge Low battery charge threshold (percent)",
+		"# HELP upsc_battery_voltage Battery voltage (V)",
+		"# HELP upsc_battery_voltage_nominal Battery voltage nominal / expected (V)",
+		"# HELP upsc_input_frequency Input line frequency (Hz)",
+		"# HELP upsc_input_voltage Input voltage (V)",
+		"# HELP upsc_input_voltage_nominal Input voltage nominal / expected (V)",
+		"# HELP upsc_output_voltage Output voltage (V)",
+		"# HELP upsc_ups_load Load on UPS (percent)",
+		"# HELP upsc_ups_online UPS is online (bool)",
+		"# HELP upsc_ups_temperature UPS temperature (degrees C)",
+		"# HELP upsc_input_transfers_total Transfers to battery, as reported by the driver or else counted from status changes since start",
+		"# HELP upsc_input_transfer_reason Reason of the last transfer to battery, as reported by the driver (1 for the current reason)",
+		"# HELP upsc_battery_replace_needed UPS asks for its battery to be replaced, RB in ups.status (bool)",
+		"# HELP upsc_battery_age_seconds Time since battery.date, or else battery.mfr.date (s)",
+		"# HELP apcupsd_battery_runtime_seconds Estimated runtime left on battery.",
+		"# HELP apcupsd_time_on_battery_seconds Time on battery of the current transfer, 0 when online.",
+		"# HELP apcupsd_time_on_battery_seconds_total Time on battery since apcupsd started.",
+		"# HELP apcupsd_nominal_power_watts Nominal output power of the UPS."}, sensor.ClockHelp...),
+	Unit: append([]string{"# UNIT apcupsd_battery_runtime_seconds seconds",
+		"# UNIT apcupsd_time_on_battery_seconds seconds",
+		"# UNIT apcupsd_time_on_battery_seconds_total seconds",
+		"# UNIT apcupsd_nominal_power_watts watts"}, sensor.ClockUnits...),
+	Description: description,
+	Ranges: map[string]sensor.Range{
+		"upsc_battery_charge": {Min: 0, Max: 100},
+		"upsc_ups_load":       {Min: 0, Max: 1000},
+	},
+	States: map[string]string{
+		"upsc_ups_online":            "",
+		"upsc_input_transfer_reason": "reason",
+	},
+}
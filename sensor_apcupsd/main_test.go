@@ -0,0 +1,48 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package sensor_apcupsd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func FuzzReadStatus(f *testing.F) {
+	var report []byte
+	for _, line := range []string{"UPSNAME  : back\n", "LOADPCT  :  12.0 Percent\n", "BCHARGE  : 100.0 Percent\n", ""} {
+		report = binary.BigEndian.AppendUint16(report, uint16(len(line)))
+		report = append(report, line...)
+	}
+	f.Add(report)
+	f.Add([]byte{0xff, 0xff, 'x'})
+	f.Fuzz(func(t *testing.T, answer []byte) {
+		status, err := readStatus(struct {
+			io.Reader
+			io.Writer
+		}{bytes.NewReader(answer), io.Discard})
+		if err != nil {
+			return
+		}
+		if len(status) > maxRecords {
+			t.Errorf("%d records, more than %d", len(status), maxRecords)
+		}
+		(&Sensor{}).samples(status)
+	})
+}
@@ -0,0 +1,285 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package sensor_as3935 reads the ams AS3935 Franklin lightning sensor over I2C
+or SPI.
+
+The chip raises its IRQ pin and sets its interrupt register when it detects
+lightning, a disturber (man-made noise that looks like lightning) or a noise
+level too high to work. Instead of wiring the IRQ pin, the interrupt
+register is polled every 100ms in the background, which is fast enough as
+the chip needs about a second to classify an event. Strikes, disturbers and
+noise events are counted and the distance estimate and energy of the last
+strike are kept.
+
+	sensor_exporter as3935,,bus=1,address=0x03,location=outdoor
+	sensor_exporter as3935,,spi=/dev/spidev0.0
+*/
+package sensor_as3935
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/i2c"
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+	"github.com/fmoessbauer/sensor_exporter/spi"
+)
+
+var suggestedScrapeInterval = time.Duration(15 * time.Second)
+var description = `As3935 counts lightning strikes, disturbers and noise events detected by an
+AS3935 lightning sensor and exposes the estimated distance of the last strike.
+Use bus and address (default 1 and 0x03) for I2C or spi=/dev/spidevB.C for SPI.
+Set location to indoor (default) or outdoor to match the antenna gain:
+
+  sensor_exporter as3935,,bus=1,address=0x03,location=outdoor`
+
+var pollInterval = 100 * time.Millisecond
+
+// Interrupt reasons of register 0x03.
+const (
+	intNoise     = 0x01
+	intDisturber = 0x04
+	intLightning = 0x08
+)
+
+// registers abstracts the bus the chip is on.
+type registers interface {
+	read(reg byte) (byte, error)
+	write(reg, value byte) error
+	Close() error
+	String() string
+}
+
+type i2cRegisters struct{ *i2c.Device }
+
+func (r i2cRegisters) read(reg byte) (byte, error) {
+	b := make([]byte, 1)
+	err := r.ReadReg(reg, b)
+	return b[0], err
+}
+
+func (r i2cRegisters) write(reg, value byte) error { return r.WriteReg(reg, value) }
+
+// On SPI the first byte is the mode (00 write, 01 read) and the address.
+type spiRegisters struct{ *spi.Device }
+
+func (r spiRegisters) read(reg byte) (byte, error) {
+	rx, err := r.Transfer([]byte{0x40 | reg, 0})
+	if err != nil {
+		return 0, err
+	}
+	return rx[1], nil
+}
+
+func (r spiRegisters) write(reg, value byte) error {
+	_, err := r.Transfer([]byte{reg & 0x3F, value})
+	return err
+}
+
+type Sensor struct {
+	regs   registers
+	labels sensor.Labels
+
+	mutex      sync.Mutex
+	strikes    uint64
+	disturbers uint64
+	noise      uint64
+	distance   float64
+	energy     float64
+	lastStrike time.Time
+	pollError  error
+
+	stop     chan struct{}
+	done     chan struct{} // closed when poll returned
+	stopOnce sync.Once
+}
+
+func NewSensor(opts string) (sensor.Collector, error) {
+	bus, address := 1, 0x03
+	var spiDev string
+	afeGain := byte(0x12) // indoor
+	for _, opt := range strings.Split(opts, ",") {
+		if opt == "" {
+			continue
+		}
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("As3935, could not understand option: " + opt)
+		}
+		var err error
+		switch kv[0] {
+		case "bus":
+			_, err = fmt.Sscanf(kv[1], "%d", &bus)
+		case "address":
+			address, err = i2c.ParseAddress(kv[1])
+		case "spi":
+			spiDev = kv[1]
+		case "location":
+			switch kv[1] {
+			case "indoor":
+				afeGain = 0x12
+			case "outdoor":
+				afeGain = 0x0E
+			default:
+				err = errors.New("must be indoor or outdoor")
+			}
+		default:
+			err = errors.New("unknown option")
+		}
+		if err != nil {
+			return nil, errors.New("As3935, bad option " + opt + ": " + err.Error())
+		}
+	}
+
+	s := &Sensor{stop: make(chan struct{}), done: make(chan struct{})}
+	if spiDev != "" {
+		dev, err := spi.Open(spiDev, 1, 2000000) // SPI mode 1
+		if err != nil {
+			return nil, errors.New("As3935 could not open spi device: " + err.Error())
+		}
+		s.regs = spiRegisters{dev}
+	} else {
+		dev, err := i2c.Open(bus, address)
+		if err != nil {
+			return nil, errors.New("As3935 could not open i2c device: " + err.Error())
+		}
+		s.regs = i2cRegisters{dev}
+	}
+	s.labels = sensor.Labels{"device": fmt.Sprint(s.regs)}
+
+	// Reset to defaults, calibrate the internal oscillators, set the gain.
+	steps := [][2]byte{{0x3C, 0x96}, {0x3D, 0x96}, {0x00, afeGain << 1}}
+	for _, st := range steps {
+		if err := s.regs.write(st[0], st[1]); err != nil {
+			s.regs.Close()
+			return nil, errors.New("As3935 could not initialize: " + err.Error())
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	go s.poll()
+	return s, nil
+}
+
+func (s *Sensor) poll() {
+	defer close(s.done)
+	tick := time.NewTicker(pollInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-tick.C:
+		}
+		reason, err := s.regs.read(0x03)
+		if err == nil {
+			err = s.handle(reason & 0x0F)
+		}
+		s.mutex.Lock()
+		s.pollError = err
+		s.mutex.Unlock()
+	}
+}
+
+func (s *Sensor) handle(reason byte) error {
+	switch reason {
+	case intNoise:
+		s.mutex.Lock()
+		s.noise++
+		s.mutex.Unlock()
+	case intDisturber:
+		s.mutex.Lock()
+		s.disturbers++
+		s.mutex.Unlock()
+	case intLightning:
+		dist, err := s.regs.read(0x07)
+		if err != nil {
+			return err
+		}
+		var e [3]byte
+		for i := range e {
+			if e[i], err = s.regs.read(0x04 + byte(i)); err != nil {
+				return err
+			}
+		}
+		s.mutex.Lock()
+		s.strikes++
+		s.lastStrike = time.Now()
+		s.distance = float64(dist & 0x3F) // 0x3F means out of range, 1 overhead
+		s.energy = float64(uint32(e[2]&0x1F)<<16 | uint32(e[1])<<8 | uint32(e[0]))
+		s.mutex.Unlock()
+		slog.Info("As3935 detected lightning", "device", s.regs, "distance_km", dist&0x3F)
+	}
+	return nil
+}
+
+// Close stops polling and closes the device.
+func (s *Sensor) Close() error {
+	var err error
+	s.stopOnce.Do(func() {
+		close(s.stop)
+		<-s.done
+		err = s.regs.Close()
+	})
+	return err
+}
+
+func (s *Sensor) Scrape() (out []sensor.Sample, e error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.pollError != nil {
+		sensor.Incident()
+		slog.Error("As3935 polling failed", "device", s.regs, "err", s.pollError)
+		return nil, nil
+	}
+	out = append(out, sensor.Sample{Name: "lightning_strikes_total", Labels: s.labels, Value: float64(s.strikes)})
+	out = append(out, sensor.Sample{Name: "lightning_disturbers_total", Labels: s.labels, Value: float64(s.disturbers)})
+	out = append(out, sensor.Sample{Name: "lightning_noise_events_total", Labels: s.labels, Value: float64(s.noise)})
+	if !s.lastStrike.IsZero() {
+		out = append(out, sensor.Sample{Name: "lightning_last_strike_distance_km", Labels: s.labels, Value: s.distance})
+		out = append(out, sensor.Sample{Name: "lightning_last_strike_energy", Labels: s.labels, Value: s.energy})
+		out = append(out, sensor.Sample{Name: "lightning_last_strike_timestamp_seconds", Labels: s.labels, Value: float64(s.lastStrike.Unix())})
+	}
+	return out, nil
+}
+
+// Collector is the as3935 sensor, for the main package to register.
+var Collector = sensor.CollectorEntry{
+	Name:            "as3935",
+	New:             NewSensor,
+	DefaultInterval: suggestedScrapeInterval,
+	Type: []string{"# TYPE lightning_strikes_total counter",
+		"# TYPE lightning_disturbers_total counter",
+		"# TYPE lightning_noise_events_total counter",
+		"# TYPE lightning_last_strike_distance_km gauge",
+		"# TYPE lightning_last_strike_energy gauge",
+		"# TYPE lightning_last_strike_timestamp_seconds gauge"},
+	Help: []string{"# HELP lightning_strikes_total Lightning strikes detected.",
+		"# HELP lightning_disturbers_total Man-made disturbers rejected by the sensor.",
+		"# HELP lightning_noise_events_total Times the noise level was too high for detection.",
+		"# HELP lightning_last_strike_distance_km Estimated distance to the storm front at the last strike, 63 means out of range.",
+		"# HELP lightning_last_strike_energy Energy of the last strike, without physical unit.",
+		"# HELP lightning_last_strike_timestamp_seconds Time of the last strike."},
+	Unit: []string{"# UNIT lightning_last_strike_distance_km km",
+		"# UNIT lightning_last_strike_timestamp_seconds seconds"},
+	Description: description,
+}
@@ -0,0 +1,375 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package sensor_bme680 reads a Bosch BME680 over I2C: temperature, humidity,
+pressure and the resistance of its heated metal oxide gas sensor.
+
+Every scrape triggers one forced mode measurement with the heater at 320°C
+for 150ms, using the float compensation formulas of the datasheet.
+
+Bosch's IAQ algorithm (BSEC) is a closed binary blob, so the air quality
+index is estimated here the way most open source projects do it: the gas
+resistance is compared to a baseline, the resistance of clean air, and the
+humidity to an ideal 40%. The baseline is the average of the first five
+minutes and then follows the highest resistances seen, slowly decaying. It
+is kept in the state file, if one is given, so it survives restarts:
+
+	sensor_exporter bme680,,bus=1,address=0x77,state=/var/lib/sensor_exporter/bme680.json
+
+The index goes from 0 (excellent) to 500 (very bad), like BSEC's IAQ.
+*/
+package sensor_bme680
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/i2c"
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+var suggestedScrapeInterval = time.Duration(10 * time.Second)
+var description = `Bme680 reads temperature, humidity, pressure and gas resistance from a Bosch
+BME680 on I2C and estimates an air quality index (0 good - 500 bad) from them.
+Options are bus (default 1), address (default 0x76), state (file to keep the
+gas baseline in) and derived=off to not export dew point and friends:
+
+  sensor_exporter bme680,,bus=1,address=0x77,state=/var/lib/sensor_exporter/bme680.json`
+
+var (
+	heaterTemp     = 320.0      // °C
+	heaterDuration = byte(0x65) // 37 * 4 = 148ms
+	burnIn         = 5 * time.Minute
+	baselineDecay  = 0.9999 // per scrape, lets the baseline follow sensor drift
+	humidityIdeal  = 40.0
+	humidityWeight = 0.25
+)
+
+// Gas range lookup tables of the datasheet.
+var (
+	gasRange1 = []float64{1, 1, 1, 1, 1, 0.99, 1, 0.992, 1, 1, 0.998, 0.995, 1, 0.99, 1, 1}
+	gasRange2 = []float64{8000000, 4000000, 2000000, 1000000, 499500.4995, 248262.1648,
+		125000, 63004.03226, 31281.28128, 15625, 7812.5, 3906.25, 1953.125,
+		976.5625, 488.28125, 244.140625}
+)
+
+type calibration struct {
+	t1, t2, t3                                 float64
+	p1, p2, p3, p4, p5, p6, p7, p8, p9, p10    float64
+	h1, h2, h3, h4, h5, h6, h7                 float64
+	g1, g2, g3, heatRange, heatVal, rangeSwErr float64
+}
+
+type Sensor struct {
+	dev       *i2c.Device
+	labels    sensor.Labels
+	cal       calibration
+	stateFile string
+	derived   bool
+
+	ambient  float64 // last temperature, for the heater setting
+	started  time.Time
+	burnSum  float64
+	burnN    int
+	baseline float64
+	lastSave time.Time
+}
+
+// State is what is kept in the state file.
+type State struct {
+	Saved    time.Time
+	Baseline float64
+}
+
+func NewSensor(opts string) (sensor.Collector, error) {
+	bus, address := 1, 0x76
+	s := &Sensor{derived: true, ambient: 25}
+	for _, opt := range strings.Split(opts, ",") {
+		if opt == "" {
+			continue
+		}
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("Bme680, could not understand option: " + opt)
+		}
+		var err error
+		switch kv[0] {
+		case "bus":
+			_, err = fmt.Sscanf(kv[1], "%d", &bus)
+		case "address":
+			address, err = i2c.ParseAddress(kv[1])
+		case "state":
+			s.stateFile = kv[1]
+		case "derived":
+			switch kv[1] {
+			case "on":
+				s.derived = true
+			case "off":
+				s.derived = false
+			default:
+				err = errors.New("expected on or off")
+			}
+		default:
+			err = errors.New("unknown option")
+		}
+		if err != nil {
+			return nil, errors.New("Bme680, bad option " + opt + ": " + err.Error())
+		}
+	}
+
+	dev, err := i2c.Open(bus, address)
+	if err != nil {
+		return nil, errors.New("Bme680 could not open i2c device: " + err.Error())
+	}
+	s.dev = dev
+	s.labels = sensor.Labels{"device": dev.String()}
+	id := make([]byte, 1)
+	if err = dev.ReadReg(0xD0, id); err != nil || id[0] != 0x61 {
+		dev.Close()
+		return nil, fmt.Errorf("Bme680, no BME680 at %s (chip id %x, err %v)", dev, id, err)
+	}
+	if err = s.readCalibration(); err != nil {
+		dev.Close()
+		return nil, errors.New("Bme680 could not read calibration: " + err.Error())
+	}
+
+	s.started = time.Now()
+	if s.stateFile != "" {
+		var st State
+		if err := sensor.LoadState(s.stateFile, &st); err == nil && time.Since(st.Saved) < 7*24*time.Hour {
+			s.baseline = st.Baseline
+		} else if err != nil {
+			slog.Info("Bme680 restored no baseline", "device", dev, "err", err)
+		}
+	}
+	return s, nil
+}
+
+func (s *Sensor) readCalibration() error {
+	a := make([]byte, 25) // 0x8A - 0xA2
+	b := make([]byte, 16) // 0xE1 - 0xF0
+	c := make([]byte, 5)  // 0x00 - 0x04
+	if err := s.dev.ReadReg(0x8A, a); err != nil {
+		return err
+	}
+	if err := s.dev.ReadReg(0xE1, b); err != nil {
+		return err
+	}
+	if err := s.dev.ReadReg(0x00, c); err != nil {
+		return err
+	}
+	u16 := func(buf []byte, lsb int) float64 { return float64(uint16(buf[lsb+1])<<8 | uint16(buf[lsb])) }
+	s16 := func(buf []byte, lsb int) float64 { return float64(int16(uint16(buf[lsb+1])<<8 | uint16(buf[lsb]))) }
+	s8 := func(v byte) float64 { return float64(int8(v)) }
+	ra := func(reg int) int { return reg - 0x8A }
+	rb := func(reg int) int { return reg - 0xE1 }
+
+	s.cal = calibration{
+		t1: u16(b, rb(0xE9)), t2: s16(a, ra(0x8A)), t3: s8(a[ra(0x8C)]),
+		p1: u16(a, ra(0x8E)), p2: s16(a, ra(0x90)), p3: s8(a[ra(0x92)]),
+		p4: s16(a, ra(0x94)), p5: s16(a, ra(0x96)), p6: s8(a[ra(0x99)]),
+		p7: s8(a[ra(0x98)]), p8: s16(a, ra(0x9C)), p9: s16(a, ra(0x9E)),
+		p10: float64(a[ra(0xA0)]),
+		h1:  float64(uint16(b[rb(0xE3)])<<4 | uint16(b[rb(0xE2)]&0x0F)),
+		h2:  float64(uint16(b[rb(0xE1)])<<4 | uint16(b[rb(0xE2)]>>4)),
+		h3:  s8(b[rb(0xE4)]), h4: s8(b[rb(0xE5)]), h5: s8(b[rb(0xE6)]),
+		h6: float64(b[rb(0xE7)]), h7: s8(b[rb(0xE8)]),
+		g1: s8(b[rb(0xED)]), g2: s16(b, rb(0xEB)), g3: s8(b[rb(0xEE)]),
+		heatRange:  float64((c[0x02] & 0x30) >> 4),
+		heatVal:    s8(c[0x00]),
+		rangeSwErr: float64(int8(c[0x04]&0xF0) >> 4),
+	}
+	return nil
+}
+
+// heaterResistance is the res_heat_0 register value for a target
+// temperature, given the ambient temperature.
+func (c calibration) heaterResistance(ambient float64) byte {
+	v1 := c.g1/16 + 49
+	v2 := c.g2/32768*0.0005 + 0.00235
+	v3 := c.g3 / 1024
+	v4 := v1 * (1 + v2*heaterTemp)
+	v5 := v4 + v3*ambient
+	r := 3.4 * (v5*(4/(4+c.heatRange))*(1/(1+c.heatVal*0.002)) - 25)
+	return byte(math.Max(0, math.Min(255, r)))
+}
+
+type measurement struct {
+	temp, pressure, humidity, gas float64
+	gasValid                      bool
+}
+
+func (s *Sensor) measure(ambient float64) (m measurement, err error) {
+	d := s.dev
+	steps := [][2]byte{
+		{0x72, 0x01},                            // ctrl_hum: humidity oversampling x1
+		{0x5A, s.cal.heaterResistance(ambient)}, // res_heat_0
+		{0x64, heaterDuration},                  // gas_wait_0
+		{0x71, 0x10},                            // ctrl_gas_1: run_gas, heater profile 0
+		{0x74, 2<<5 | 5<<2 | 1},                 // ctrl_meas: T x2, P x16, forced mode
+	}
+	for _, st := range steps {
+		if err = d.WriteReg(st[0], st[1]); err != nil {
+			return m, err
+		}
+	}
+	status := make([]byte, 1)
+	for i := 0; ; i++ {
+		time.Sleep(50 * time.Millisecond)
+		if err = d.ReadReg(0x1D, status); err != nil {
+			return m, err
+		}
+		if status[0]&0x80 != 0 { // new_data_0
+			break
+		}
+		if i > 20 {
+			return m, errors.New("measurement timed out")
+		}
+	}
+	r := make([]byte, 13) // 0x1F - 0x2B
+	if err = d.ReadReg(0x1F, r); err != nil {
+		return m, err
+	}
+	adcP := float64(uint32(r[0])<<12 | uint32(r[1])<<4 | uint32(r[2])>>4)
+	adcT := float64(uint32(r[3])<<12 | uint32(r[4])<<4 | uint32(r[5])>>4)
+	adcH := float64(uint16(r[6])<<8 | uint16(r[7]))
+	adcG := float64(uint16(r[11])<<2 | uint16(r[12])>>6)
+	gasRange := r[12] & 0x0F
+	m.gasValid = r[12]&0x20 != 0 && r[12]&0x10 != 0 // gas_valid and heat_stab
+
+	c := s.cal
+	v1 := (adcT/16384 - c.t1/1024) * c.t2
+	v2 := (adcT/131072 - c.t1/8192) * (adcT/131072 - c.t1/8192) * c.t3 * 16
+	tFine := v1 + v2
+	m.temp = tFine / 5120
+
+	v1 = tFine/2 - 64000
+	v2 = v1 * v1 * c.p6 / 131072
+	v2 = v2 + v1*c.p5*2
+	v2 = v2/4 + c.p4*65536
+	v1 = (c.p3*v1*v1/16384 + c.p2*v1) / 524288
+	v1 = (1 + v1/32768) * c.p1
+	if v1 != 0 {
+		p := 1048576 - adcP
+		p = (p - v2/4096) * 6250 / v1
+		v1 = c.p9 * p * p / 2147483648
+		v2 = p * c.p8 / 32768
+		v3 := (p / 256) * (p / 256) * (p / 256) * c.p10 / 131072
+		m.pressure = p + (v1+v2+v3+c.p7*128)/16
+	}
+
+	v1 = adcH - (c.h1*16 + c.h3/2*m.temp)
+	v2 = v1 * (c.h2 / 262144 * (1 + c.h4/16384*m.temp + c.h5/1048576*m.temp*m.temp))
+	h := v2 + (c.h6/16384+c.h7/2097152*m.temp)*v2*v2
+	m.humidity = math.Max(0, math.Min(100, h))
+
+	v1 = (1340 + 5*c.rangeSwErr) * gasRange1[gasRange]
+	m.gas = v1 * gasRange2[gasRange] / (adcG - 512 + v1)
+	return m, nil
+}
+
+// iaq estimates an air quality index from gas resistance and humidity.
+func (s *Sensor) iaq(gas, humidity float64) (float64, bool) {
+	if time.Since(s.started) < burnIn && s.baseline == 0 {
+		s.burnSum += gas
+		s.burnN++
+		return 0, false
+	}
+	if s.baseline == 0 {
+		s.baseline = s.burnSum / float64(s.burnN)
+	}
+	s.baseline = math.Max(s.baseline*baselineDecay, gas)
+
+	var humScore float64
+	if offset := humidity - humidityIdeal; offset > 0 {
+		humScore = (100 - humidityIdeal - offset) / (100 - humidityIdeal) * humidityWeight * 100
+	} else {
+		humScore = (humidityIdeal + offset) / humidityIdeal * humidityWeight * 100
+	}
+	gasScore := math.Min(gas/s.baseline, 1) * (100 - humidityWeight*100)
+	// Score is 100 for perfect air; turn it into an index where 0 is perfect.
+	return (100 - (humScore + gasScore)) * 5, true
+}
+
+func (s *Sensor) Scrape() (out []sensor.Sample, e error) {
+	m, err := s.measure(s.ambient)
+	if err != nil {
+		sensor.Incident()
+		slog.Error("Bme680 measurement failed", "device", s.dev, "err", err)
+		return nil, nil
+	}
+	s.ambient = m.temp
+	out = append(out, sensor.Sample{Name: "temperature_celsius", Labels: s.labels, Value: m.temp})
+	out = append(out, sensor.Sample{Name: "relative_humidity_percent", Labels: s.labels, Value: m.humidity})
+	out = append(out, sensor.Sample{Name: "air_pressure_pascals", Labels: s.labels, Value: m.pressure})
+	if s.derived {
+		out = append(out, sensor.HumidityDerived(s.labels, m.temp, m.humidity)...)
+	}
+	if !m.gasValid {
+		slog.Warn("Bme680 gas reading not valid, heater not stable", "device", s.dev)
+		return out, nil
+	}
+	out = append(out, sensor.Sample{Name: "gas_resistance_ohms", Labels: s.labels, Value: m.gas})
+	if iaq, ok := s.iaq(m.gas, m.humidity); ok {
+		out = append(out, sensor.Sample{Name: "gas_iaq", Labels: s.labels, Value: iaq})
+		out = append(out, sensor.Sample{Name: "gas_resistance_baseline_ohms", Labels: s.labels, Value: s.baseline})
+		if s.stateFile != "" && time.Since(s.lastSave) >= time.Hour {
+			s.lastSave = time.Now()
+			if err := sensor.SaveState(s.stateFile, State{Saved: s.lastSave, Baseline: s.baseline}); err != nil {
+				sensor.Incident()
+				slog.Warn("Bme680 could not save baseline", "device", s.dev, "err", err)
+			}
+		}
+	}
+	return out, nil
+}
+
+// Collector is the bme680 sensor, for the main package to register.
+var Collector = sensor.CollectorEntry{
+	Name:            "bme680",
+	New:             NewSensor,
+	DefaultInterval: suggestedScrapeInterval,
+	Type: append([]string{"# TYPE temperature_celsius gauge",
+		"# TYPE relative_humidity_percent gauge",
+		"# TYPE air_pressure_pascals gauge",
+		"# TYPE gas_resistance_ohms gauge",
+		"# TYPE gas_resistance_baseline_ohms gauge",
+		"# TYPE gas_iaq gauge"}, sensor.HumidityTypes...),
+	Help: append([]string{"# HELP temperature_celsius Current air temperature.",
+		"# HELP relative_humidity_percent Current relative humidity.",
+		"# HELP air_pressure_pascals Current air pressure.",
+		"# HELP gas_resistance_ohms Resistance of the heated gas sensor, lower means more VOCs.",
+		"# HELP gas_resistance_baseline_ohms Gas resistance considered clean air.",
+		"# HELP gas_iaq Estimated indoor air quality index, 0 is excellent and 500 very bad."}, sensor.HumidityHelp...),
+	Unit: append([]string{"# UNIT temperature_celsius celsius",
+		"# UNIT relative_humidity_percent percent",
+		"# UNIT air_pressure_pascals pascals",
+		"# UNIT gas_resistance_ohms ohms",
+		"# UNIT gas_resistance_baseline_ohms ohms"}, sensor.HumidityUnits...),
+	Description: description,
+	// The operating range of the datasheet.
+	Ranges: map[string]sensor.Range{
+		"temperature_celsius":       {Min: -40, Max: 85},
+		"relative_humidity_percent": {Min: 0, Max: 100, Clamp: 5},
+		"air_pressure_pascals":      {Min: 30000, Max: 110000},
+	},
+}
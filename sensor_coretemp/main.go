@@ -19,7 +19,6 @@ package sensor_coretemp
 
 import (
 	"errors"
-	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -28,7 +27,7 @@ import (
 	"strings"
 	"time"
 
-	"github.com/andmarios/sensor_exporter/sensor"
+	"github.com/fmoessbauer/sensor_exporter/sensor"
 )
 
 var suggestedScrapeInterval = time.Duration(4800 * time.Millisecond)
@@ -62,34 +61,35 @@ func NewSensor(opts string) (sensor.Collector, error) {
 	return s, nil
 }
 
-func (s Sensor) Scrape() (out string, e error) {
+func (s Sensor) Scrape() (out []sensor.Sample, e error) {
 	for k, file := range cpuTempFiles {
 		// Read from sysfs
 		dat, err := ioutil.ReadFile(file)
 		if err != nil {
-			return "", errors.New("Coretemp could not scrape: " + err.Error())
+			return nil, errors.New("Coretemp could not scrape: " + err.Error())
 		}
 		valueString := strings.TrimSuffix(string(dat), "\n")
 		value, err := strconv.ParseFloat(string(valueString), 64)
 		if err != nil {
-			return "", errors.New("Coretemp could not scrape: " + err.Error())
+			return nil, errors.New("Coretemp could not scrape: " + err.Error())
 		}
 		value = value / 1000
 		// Write value
-		out += fmt.Sprintf("cpu_temperature_celsius{sensor=\"%s\"} %.1f\n", cpuLabel[k], value)
+		out = append(out, sensor.Sample{Name: "cpu_temperature_celsius", Labels: sensor.Labels{"sensor": cpuLabel[k]}, Value: value})
 	}
 
 	return out, nil
 }
 
-func init() {
-	var sensorsType, sensorsHelp []string
-	sensorsType = append(sensorsType,
-		[]string{"# TYPE cpu_temperature_celsius gauge"}...)
-	sensorsHelp = append(sensorsHelp,
-		[]string{"# HELP cpu_temperature_celsius Current temperature of the CPU."}...)
-	sensor.RegisterCollector("coretemp", NewSensor, suggestedScrapeInterval,
-		sensorsType, sensorsHelp, description)
+// Collector is the coretemp sensor, for the main package to register.
+var Collector = sensor.CollectorEntry{
+	Name:            "coretemp",
+	New:             NewSensor,
+	DefaultInterval: suggestedScrapeInterval,
+	Type:            []string{"# TYPE cpu_temperature_celsius gauge"},
+	Help:            []string{"# HELP cpu_temperature_celsius Current temperature of the CPU."},
+	Unit:            []string{"# UNIT cpu_temperature_celsius celsius"},
+	Description:     description,
 }
 
 // Here are stored the filenames of the sysfs files we use.
@@ -0,0 +1,195 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package sensor_cputemp reads CPU temperatures from the coretemp (Intel) and
+k10temp/zenpower (AMD) hwmon drivers and exposes them with consistent
+package and core labels, no matter how the driver numbers its channels.
+
+For every reading with a known TjMax it also exposes the headroom, the
+distance in degrees from the temperature at which the CPU starts
+throttling. Intel CPUs report TjMax as tempN_crit. AMD drivers usually do
+not, so it may be set with the tjmax option:
+
+	sensor_exporter cputemp,,tjmax=95
+*/
+package sensor_cputemp
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/hwmon"
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+var suggestedScrapeInterval = time.Duration(4800 * time.Millisecond)
+var description = `Cputemp reads CPU temperatures from the coretemp, k10temp and zenpower hwmon
+drivers and exposes them per package and core. If TjMax is known, the
+headroom to it is exposed too. The only option is tjmax, which overrides
+(or sets, for AMD CPUs) the throttling temperature in Celsius:
+
+  sensor_exporter cputemp
+  sensor_exporter cputemp,,tjmax=95`
+
+var (
+	packageRe = regexp.MustCompile(`^(?:Package|Physical) id ([0-9]+)$`)
+	coreRe    = regexp.MustCompile(`^Core ([0-9]+)$`)
+	ccdRe     = regexp.MustCompile(`^Tccd([0-9]+)$`)
+)
+
+// A reading is a temperature channel mapped to its place in the CPU.
+type reading struct {
+	channel hwmon.Channel
+	metric  string
+	labels  sensor.Labels
+	tjmax   float64
+}
+
+type Sensor struct {
+	readings []reading
+}
+
+func NewSensor(opts string) (sensor.Collector, error) {
+	var tjmax float64
+	for _, opt := range strings.Split(opts, ",") {
+		if opt == "" {
+			continue
+		}
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 || kv[0] != "tjmax" {
+			return nil, errors.New("Cputemp, unknown option: " + opt)
+		}
+		v, err := strconv.ParseFloat(kv[1], 64)
+		if err != nil {
+			return nil, errors.New("Cputemp, could not parse tjmax: " + err.Error())
+		}
+		tjmax = v
+	}
+
+	chips, err := hwmon.ChipsByName("coretemp", "k10temp", "zenpower")
+	if err != nil {
+		return nil, errors.New("Cputemp could not list hwmon chips: " + err.Error())
+	}
+
+	s := Sensor{}
+	for pkg, chip := range chips {
+		r, err := detectReadings(chip, pkg, tjmax)
+		if err != nil {
+			return nil, errors.New("Cputemp could not read chip " + chip.Name + ": " + err.Error())
+		}
+		s.readings = append(s.readings, r...)
+	}
+	if len(s.readings) == 0 {
+		return nil, errors.New("Cputemp could not find any sensors.")
+	}
+	return s, nil
+}
+
+// detectReadings maps the temperature channels of a chip to packages and
+// cores. Each coretemp chip is one package, which it names in its "Package
+// id" label. The AMD drivers are loaded once per node, so their order is the
+// package number.
+func detectReadings(chip hwmon.Chip, pkg int, tjmax float64) ([]reading, error) {
+	chans, err := chip.Channels("temp")
+	if err != nil {
+		return nil, err
+	}
+	for _, ch := range chans {
+		if m := packageRe.FindStringSubmatch(ch.Label); m != nil {
+			pkg, _ = strconv.Atoi(m[1])
+		}
+	}
+
+	var readings []reading
+	var tctl *reading
+	for _, ch := range chans {
+		r := reading{channel: ch, tjmax: tjmax}
+		if r.tjmax == 0 && ch.Has("crit") {
+			r.tjmax, _ = ch.Read("crit")
+		}
+		switch {
+		case packageRe.MatchString(ch.Label), ch.Label == "Tdie":
+			r.metric = "cpu_package_temperature_celsius"
+			r.labels = sensor.Labels{"package": strconv.Itoa(pkg)}
+		case ch.Label == "Tctl":
+			// Tctl carries an offset on some CPUs; use it only if there is no Tdie.
+			r.metric = "cpu_package_temperature_celsius"
+			r.labels = sensor.Labels{"package": strconv.Itoa(pkg)}
+			tctl = &r
+			continue
+		case coreRe.MatchString(ch.Label):
+			core := coreRe.FindStringSubmatch(ch.Label)[1]
+			r.metric = "cpu_core_temperature_celsius"
+			r.labels = sensor.Labels{"package": strconv.Itoa(pkg), "core": core}
+		case ccdRe.MatchString(ch.Label):
+			ccd := ccdRe.FindStringSubmatch(ch.Label)[1]
+			r.metric = "cpu_ccd_temperature_celsius"
+			r.labels = sensor.Labels{"package": strconv.Itoa(pkg), "ccd": ccd}
+		default:
+			continue
+		}
+		readings = append(readings, r)
+	}
+	if tctl != nil {
+		hasPackage := false
+		for _, r := range readings {
+			hasPackage = hasPackage || r.metric == tctl.metric
+		}
+		if !hasPackage {
+			readings = append(readings, *tctl)
+		}
+	}
+	return readings, nil
+}
+
+func (s Sensor) Scrape() (out []sensor.Sample, e error) {
+	for _, r := range s.readings {
+		value, err := r.channel.Read("input")
+		if err != nil {
+			return nil, errors.New("Cputemp could not scrape: " + err.Error())
+		}
+		out = append(out, sensor.Sample{Name: r.metric, Labels: r.labels, Value: value})
+		if r.tjmax > 0 {
+			out = append(out, sensor.Sample{Name: "cpu_temperature_headroom_celsius", Labels: r.labels, Value: r.tjmax - value})
+		}
+	}
+	return out, nil
+}
+
+// Collector is the cputemp sensor, for the main package to register.
+var Collector = sensor.CollectorEntry{
+	Name:            "cputemp",
+	New:             NewSensor,
+	DefaultInterval: suggestedScrapeInterval,
+	Type: []string{"# TYPE cpu_package_temperature_celsius gauge",
+		"# TYPE cpu_core_temperature_celsius gauge",
+		"# TYPE cpu_ccd_temperature_celsius gauge",
+		"# TYPE cpu_temperature_headroom_celsius gauge"},
+	Help: []string{"# HELP cpu_package_temperature_celsius Current temperature of the CPU package.",
+		"# HELP cpu_core_temperature_celsius Current temperature of a CPU core.",
+		"# HELP cpu_ccd_temperature_celsius Current temperature of a CPU core complex die.",
+		"# HELP cpu_temperature_headroom_celsius Degrees left until the CPU reaches TjMax and throttles."},
+	Unit: []string{"# UNIT cpu_package_temperature_celsius celsius",
+		"# UNIT cpu_core_temperature_celsius celsius",
+		"# UNIT cpu_ccd_temperature_celsius celsius",
+		"# UNIT cpu_temperature_headroom_celsius celsius"},
+	Description: description,
+}
@@ -0,0 +1,170 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package sensor_door tracks door and window contacts, for cold-chain
+monitoring of freezers and fridges or just for doors left open.
+
+Contacts are polled in the background (poll, default 1s) and besides the
+current state the time spent open is accumulated, so a rule like
+
+	increase(door_open_seconds_total{door="freezer"}[1h]) > 300
+
+catches a freezer that keeps being left open briefly, and
+door_open_duration_seconds one that stays open. To track the closed state
+instead, invert the source with !.
+
+Options are door=source pairs, sources as in package binarysensor:
+
+	sensor_exporter door,,freezer=gpio:gpiochip0/22,garage=deconz:gw/KEY/7
+
+Wireless contacts also get battery and last report metrics, and are flagged
+missing when silent for longer than missing (default 12h).
+*/
+package sensor_door
+
+import (
+	"errors"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/binarysensor"
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+var suggestedScrapeInterval = time.Duration(15 * time.Second)
+var description = `Door tracks door and window contacts and accumulates how long they were open.
+Options are door=source pairs, where a source is gpio:chip/line, shelly:host,
+deconz:host/apikey/id or file:path, prefixed with ! to invert it, poll, how
+often contacts are read (default 1s), and missing, after which silent
+wireless contacts are flagged (default 12h):
+
+  sensor_exporter door,,freezer=gpio:gpiochip0/22,poll=500ms`
+
+type Sensor struct {
+	doors    []string
+	trackers map[string]*binarysensor.Tracker
+	health   *sensor.DeviceHealth
+}
+
+func NewSensor(opts string) (sensor.Collector, error) {
+	s := &Sensor{trackers: make(map[string]*binarysensor.Tracker)}
+	poll, missing := time.Second, 12*time.Hour
+	sources := make(map[string]binarysensor.Source)
+	for _, opt := range strings.Split(opts, ",") {
+		if opt == "" {
+			continue
+		}
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("Door, could not understand option: " + opt)
+		}
+		if kv[0] == "poll" || kv[0] == "missing" {
+			d, err := time.ParseDuration(kv[1])
+			if err != nil || d <= 0 {
+				return nil, errors.New("Door, bad duration: " + opt)
+			}
+			if kv[0] == "poll" {
+				poll = d
+			} else {
+				missing = d
+			}
+			continue
+		}
+		if _, exists := sources[kv[0]]; exists {
+			return nil, errors.New("Door, duplicate door: " + kv[0])
+		}
+		src, err := binarysensor.Parse(kv[1], binarysensor.Open)
+		if err != nil {
+			return nil, errors.New("Door, bad source for " + kv[0] + ": " + err.Error())
+		}
+		sources[kv[0]] = src
+		s.doors = append(s.doors, kv[0])
+	}
+	if len(s.doors) == 0 {
+		return nil, errors.New("Door needs at least one door=source option.")
+	}
+	sort.Strings(s.doors)
+	s.health = sensor.NewDeviceHealth(missing)
+	for door, src := range sources {
+		s.trackers[door] = binarysensor.Track(src, poll)
+		if _, wireless := binarysensor.Report(src); wireless {
+			s.health.Expect(door, s.labels(door))
+		}
+	}
+	return s, nil
+}
+
+func (s *Sensor) labels(door string) sensor.Labels {
+	return sensor.Labels{"door": door, "source": s.trackers[door].String()}
+}
+
+func (s *Sensor) Scrape() (out []sensor.Sample, e error) {
+	for _, door := range s.doors {
+		t := s.trackers[door]
+		st, err := t.Stats()
+		if r, wireless := binarysensor.Report(t); wireless && !r.Time.IsZero() {
+			s.health.Seen(door, s.labels(door), r)
+		}
+		if err != nil {
+			sensor.Incident()
+			slog.Error("Door could not be read", "door", door, "source", t, "err", err)
+			continue
+		}
+		labels := s.labels(door)
+		open := 0
+		if st.Active {
+			open = 1
+		}
+		out = append(out, sensor.Sample{Name: "door_open", Labels: labels, Value: float64(open)})
+		out = append(out, sensor.Sample{Name: "door_open_duration_seconds", Labels: labels, Value: st.Current.Seconds()})
+		out = append(out, sensor.Sample{Name: "door_open_seconds_total", Labels: labels, Value: st.ActiveTotal.Seconds()})
+		out = append(out, sensor.Sample{Name: "door_openings_total", Labels: labels, Value: float64(st.Activations)})
+	}
+	out = append(out, s.health.Metrics()...)
+	return out, nil
+}
+
+// Close stops polling the doors and releases their sources.
+func (s *Sensor) Close() error {
+	var errs []error
+	for _, t := range s.trackers {
+		errs = append(errs, binarysensor.Close(t))
+	}
+	return errors.Join(errs...)
+}
+
+// Collector is the door sensor, for the main package to register.
+var Collector = sensor.CollectorEntry{
+	Name:            "door",
+	New:             NewSensor,
+	DefaultInterval: suggestedScrapeInterval,
+	Type: append([]string{"# TYPE door_open gauge",
+		"# TYPE door_open_duration_seconds gauge",
+		"# TYPE door_open_seconds_total counter",
+		"# TYPE door_openings_total counter"}, sensor.HealthTypes...),
+	Help: append([]string{"# HELP door_open Whether the door is open.",
+		"# HELP door_open_duration_seconds How long the door has been open, 0 if closed.",
+		"# HELP door_open_seconds_total Time the door was open since sensor_exporter started.",
+		"# HELP door_openings_total Times the door was opened since sensor_exporter started."}, sensor.HealthHelp...),
+	Unit: append([]string{"# UNIT door_open_duration_seconds seconds",
+		"# UNIT door_open_seconds_total seconds"}, sensor.HealthUnits...),
+	Description: description,
+	States:      map[string]string{"door_open": ""},
+}
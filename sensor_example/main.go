@@ -21,19 +21,24 @@ template.
 
 In general your sensor should have:
 
-(a) a Sensor struct (can be empty) that implements the Scrape() function.
+(a) a Sensor struct (can be empty) that implements the Scrape() function,
+
+	returning its samples.
+
 (b) a function with a signature like NewSensor() which creates a new sensor.
-(c) use the init() function to register itself to the main package.
+(c) an exported sensor.CollectorEntry, usually named Collector, that the main
+
+	package registers.
 */
 package sensor_example
 
 import (
-	"fmt"
-	"log"
+	"log/slog"
 	"math/rand"
+	"strconv"
 	"time"
 
-	"github.com/andmarios/sensor_exporter/sensor"
+	"github.com/fmoessbauer/sensor_exporter/sensor"
 )
 
 var suggestedScrapeInterval = time.Duration(1 * time.Second)
@@ -52,22 +57,23 @@ func NewSensor(opts string) (sensor.Collector, error) {
 	return s, nil
 }
 
-func (s Sensor) Scrape() (out string, e error) {
+func (s Sensor) Scrape() (out []sensor.Sample, e error) {
 	value := rand.Float64()
 	if value == 0 { // A serious incident that should be reported
 		sensor.Incident()
-		log.Println("Sensor example got a zero!")
+		slog.Warn("Sensor example got a zero!")
 	}
-	out += fmt.Sprintf("sensor_sample_random{id=\"%d\"} %.1f\n", s.Id, value)
+	out = append(out, sensor.Sample{Name: "sensor_sample_random",
+		Labels: sensor.Labels{"id": strconv.Itoa(s.Id)}, Value: value})
 	return out, nil
 }
 
-func init() {
-	var sensorsType, sensorsHelp []string
-	sensorsType = append(sensorsType,
-		[]string{"# TYPE sensor_sample_random gauge"}...)
-	sensorsHelp = append(sensorsHelp,
-		[]string{"# HELP sensor_sample_random A random number in [0.0, 1.0)"}...)
-	sensor.RegisterCollector("example", NewSensor, suggestedScrapeInterval,
-		sensorsType, sensorsHelp, description)
+// Collector is the example sensor, for the main package to register.
+var Collector = sensor.CollectorEntry{
+	Name:            "example",
+	New:             NewSensor,
+	DefaultInterval: suggestedScrapeInterval,
+	Type:            []string{"# TYPE sensor_sample_random gauge"},
+	Help:            []string{"# HELP sensor_sample_random A random number in [0.0, 1.0)"},
+	Description:     description,
 }
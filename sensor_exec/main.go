@@ -0,0 +1,282 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package sensor_exec runs a command on every scrape and exports what it
+prints, to read hardware that has no sensor of its own without writing Go.
+It is like the textfile collector of node_exporter, but the readings are
+taken when scraped.
+
+Options, comma separated; command comes last and takes the rest of them,
+commas included:
+
+	format=text            what the command prints: text, the Prometheus
+	                       text format, or pairs, lines of NAME VALUE
+	timeout=10s            how long the command may run before it is killed
+	env=NAME=VALUE         set in the environment of the command, which
+	                       inherits that of the exporter; may be repeated
+	command=PROGRAM ARGS   the command, split at spaces, not run by a shell
+
+For example:
+
+	sensor_exporter 'exec,1m,format=pairs,env=BUS=1,command=/usr/local/bin/read-probe --bus 1'
+
+The text format is checked by the parser of Prometheus; histograms and
+summaries are split into their series. Families keep their names and
+labels but are served untyped, as the sensor cannot know them beforehand.
+In pairs, empty lines and lines starting with # are skipped. exec_up tells
+whether the command ran, exited with 0 and printed what it should; if not,
+its other samples are left out and its standard error is logged.
+*/
+package sensor_exec
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+var suggestedScrapeInterval = time.Duration(1 * time.Minute)
+var description = `Exec runs a command on every scrape and exports what it prints to stdout,
+the Prometheus text format (format=text, the default) or lines of NAME VALUE
+(format=pairs), whose values may be written like 23,5°C. Options are format, timeout (default 10s), env=NAME=VALUE, to
+set in the environment of the command, and last command, split at spaces and
+not run by a shell:
+
+  sensor_exporter 'exec,1m,format=pairs,command=/usr/local/bin/read-probe --bus 1'`
+
+var timeOut = 10 * time.Second
+
+var nameRe = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+type Sensor struct {
+	Command []string
+	Pairs   bool // format=pairs
+	Timeout time.Duration
+	Env     []string // NAME=VALUE, added to the environment of the exporter
+	Labels  sensor.Labels
+}
+
+func NewSensor(opts string) (sensor.Collector, error) {
+	s := &Sensor{Timeout: timeOut}
+	for opts != "" {
+		var opt string
+		if strings.HasPrefix(opts, "command=") {
+			opt, opts = opts, ""
+		} else if i := strings.IndexByte(opts, ','); i >= 0 {
+			opt, opts = opts[:i], opts[i+1:]
+		} else {
+			opt, opts = opts, ""
+		}
+		if opt == "" {
+			continue
+		}
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("Exec, could not understand option: " + opt)
+		}
+		switch kv[0] {
+		case "format":
+			if kv[1] != "text" && kv[1] != "pairs" {
+				return nil, errors.New("Exec, unknown format: " + kv[1])
+			}
+			s.Pairs = kv[1] == "pairs"
+		case "timeout":
+			d, err := time.ParseDuration(kv[1])
+			if err != nil || d <= 0 {
+				return nil, errors.New("Exec, bad timeout: " + kv[1])
+			}
+			s.Timeout = d
+		case "env":
+			if !strings.Contains(kv[1], "=") {
+				return nil, errors.New("Exec, expected env=NAME=VALUE, got: " + opt)
+			}
+			s.Env = append(s.Env, kv[1])
+		case "command":
+			s.Command = strings.Fields(kv[1])
+		default:
+			return nil, errors.New("Exec, unknown option: " + kv[0])
+		}
+	}
+	if len(s.Command) == 0 {
+		return nil, errors.New("Exec needs a command, the last option")
+	}
+	if _, err := exec.LookPath(s.Command[0]); err != nil {
+		return nil, errors.New("Exec, cannot run " + s.Command[0] + ": " + err.Error())
+	}
+	s.Labels = sensor.Labels{"command": s.Command[0]}
+	return s, nil
+}
+
+func (s *Sensor) Scrape() (out []sensor.Sample, e error) {
+	return s.ScrapeContext(context.Background(), nil)
+}
+
+// ScrapeContext runs the command, marking the run and parse stages, and
+// kills it when ctx is done or it runs longer than its timeout.
+func (s *Sensor) ScrapeContext(ctx context.Context, t *sensor.Trace) (out []sensor.Sample, e error) {
+	res, err := s.run(ctx)
+	t.Mark("run")
+	if err == nil {
+		if s.Pairs {
+			out, err = parsePairs(res)
+		} else {
+			out, err = parseText(res)
+		}
+		t.Mark("parse")
+	}
+	if err != nil {
+		sensor.Incident()
+		slog.Error("Exec failed", "command", s.Command[0], "err", err)
+		return []sensor.Sample{{Name: "exec_up", Labels: s.Labels, Value: 0}}, nil
+	}
+	return append(out, sensor.Sample{Name: "exec_up", Labels: s.Labels, Value: 1}), nil
+}
+
+// run runs the command and returns its stdout.
+func (s *Sensor) run(ctx context.Context) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, s.Command[0], s.Command[1:]...)
+	if len(s.Env) > 0 {
+		cmd.Env = append(os.Environ(), s.Env...)
+	}
+	// Do not wait for children that keep stdout open after it is killed.
+	cmd.WaitDelay = time.Second
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("killed after %s", s.Timeout)
+	}
+	if err != nil && stderr.Len() > 0 {
+		err = errors.New(err.Error() + ": " + strings.TrimSpace(stderr.String()))
+	}
+	return out, err
+}
+
+// parsePairs parses lines of NAME VALUE.
+func parsePairs(res []byte) (out []sensor.Sample, e error) {
+	scanner := bufio.NewScanner(bytes.NewReader(res))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d, expected NAME VALUE, got: %s", n, line)
+		}
+		if !nameRe.MatchString(fields[0]) {
+			return nil, fmt.Errorf("line %d, bad metric name: %s", n, fields[0])
+		}
+		value, err := sensor.ParseNumber(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d, bad value: %s", n, fields[1])
+		}
+		out = append(out, sensor.Sample{Name: fields[0], Value: value})
+	}
+	return out, scanner.Err()
+}
+
+// parseText parses the Prometheus text format, splitting histograms and
+// summaries into their series.
+func parseText(res []byte) (out []sensor.Sample, e error) {
+	parser := expfmt.NewTextParser(model.LegacyValidation)
+	families, err := parser.TextToMetricFamilies(bytes.NewReader(res))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, m := range families[name].GetMetric() {
+			labels := make(sensor.Labels, len(m.GetLabel()))
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			out = append(out, samples(name, labels, m)...)
+		}
+	}
+	return out, nil
+}
+
+// samples are the series of m, of the family name.
+func samples(name string, labels sensor.Labels, m *dto.Metric) []sensor.Sample {
+	switch {
+	case m.Counter != nil:
+		return []sensor.Sample{{Name: name, Labels: labels, Value: m.Counter.GetValue()}}
+	case m.Gauge != nil:
+		return []sensor.Sample{{Name: name, Labels: labels, Value: m.Gauge.GetValue()}}
+	case m.Untyped != nil:
+		return []sensor.Sample{{Name: name, Labels: labels, Value: m.Untyped.GetValue()}}
+	case m.Summary != nil:
+		var out []sensor.Sample
+		for _, q := range m.Summary.GetQuantile() {
+			out = append(out, sensor.Sample{Name: name,
+				Labels: labels.With("quantile", formatFloat(q.GetQuantile())), Value: q.GetValue()})
+		}
+		return append(out, sensor.Sample{Name: name + "_sum", Labels: labels, Value: m.Summary.GetSampleSum()},
+			sensor.Sample{Name: name + "_count", Labels: labels, Value: float64(m.Summary.GetSampleCount())})
+	case m.Histogram != nil:
+		var out []sensor.Sample
+		for _, b := range m.Histogram.GetBucket() {
+			out = append(out, sensor.Sample{Name: name + "_bucket",
+				Labels: labels.With("le", formatFloat(b.GetUpperBound())), Value: float64(b.GetCumulativeCount())})
+		}
+		return append(out, sensor.Sample{Name: name + "_sum", Labels: labels, Value: m.Histogram.GetSampleSum()},
+			sensor.Sample{Name: name + "_count", Labels: labels, Value: float64(m.Histogram.GetSampleCount())})
+	}
+	return nil
+}
+
+// formatFloat formats the quantile and le labels like Prometheus does.
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Collector is the exec sensor, for the main package to register.
+var Collector = sensor.CollectorEntry{
+	Name:            "exec",
+	New:             NewSensor,
+	DefaultInterval: suggestedScrapeInterval,
+	Type:            []string{"# TYPE exec_up gauge"},
+	Help:            []string{"# HELP exec_up Whether the command ran, exited with 0 and printed what it should."},
+	Description:     description,
+}
@@ -0,0 +1,292 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package sensor_ezo reads Atlas Scientific EZO circuits over I2C, for aquarium,
+pool and hydroponics water quality: pH, ORP, conductivity (EC), dissolved
+oxygen (DO) and temperature (RTD).
+
+The circuits speak ASCII commands. The type of each circuit is asked for at
+startup ("i") and so are the outputs an EC or DO circuit has enabled ("O,?"),
+so one instance may read all the circuits on a bus:
+
+	sensor_exporter ezo,,address=0x63,address=0x64,address=0x66
+
+pH, EC and DO readings depend on the water temperature. If one of the
+circuits is an RTD its reading is sent to the others before they are read
+("T,n"). Otherwise set temp to a fixed temperature or to a hwmon channel,
+e.g. temp=w1_slave_temp/temp1 for a DS18B20 in the water.
+*/
+package sensor_ezo
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/hwmon"
+	"github.com/fmoessbauer/sensor_exporter/i2c"
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+var suggestedScrapeInterval = time.Duration(60 * time.Second)
+var description = `Ezo reads Atlas Scientific EZO pH, ORP, EC, DO and RTD circuits on the I2C bus
+(default 1). Give one address option per circuit; the circuit type is
+detected. For temperature compensation an RTD circuit among them is used, or
+temp, a fixed temperature or a hwmon channel:
+
+  sensor_exporter ezo,,bus=1,address=0x63,address=0x64,temp=25`
+
+// How long a circuit needs to answer a command, from the datasheets.
+var (
+	readDelay    = 900 * time.Millisecond
+	commandDelay = 300 * time.Millisecond
+)
+
+// Metric name and scale factor of each output, by circuit and output name.
+var outputs = map[string]map[string]struct {
+	metric string
+	factor float64
+}{
+	"pH":  {"pH": {"water_ph", 1}},
+	"ORP": {"ORP": {"water_orp_volts", 0.001}},
+	"RTD": {"RTD": {"water_temperature_celsius", 1}},
+	"EC": {
+		"EC":  {"water_conductivity_microsiemens_per_centimeter", 1},
+		"TDS": {"water_tds_ppm", 1},
+		"S":   {"water_salinity_psu", 1},
+		"SG":  {"water_specific_gravity", 1},
+	},
+	"DO": {
+		"MG": {"water_dissolved_oxygen_milligrams_per_liter", 1},
+		"%":  {"water_oxygen_saturation_percent", 1},
+	},
+}
+
+type circuit struct {
+	dev     *i2c.Device
+	kind    string
+	outputs []string // in the order of a reading
+	labels  sensor.Labels
+}
+
+type Sensor struct {
+	circuits  []*circuit
+	fixedTemp float64
+	tempChan  *hwmon.Channel
+}
+
+func NewSensor(opts string) (sensor.Collector, error) {
+	s := &Sensor{fixedTemp: -1}
+	bus := 1
+	var addresses []int
+	for _, opt := range strings.Split(opts, ",") {
+		if opt == "" {
+			continue
+		}
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("Ezo, could not understand option: " + opt)
+		}
+		var err error
+		switch kv[0] {
+		case "bus":
+			bus, err = strconv.Atoi(kv[1])
+		case "address":
+			var a int
+			a, err = i2c.ParseAddress(kv[1])
+			addresses = append(addresses, a)
+		case "temp":
+			if t, perr := strconv.ParseFloat(kv[1], 64); perr == nil {
+				s.fixedTemp = t
+			} else {
+				var ch hwmon.Channel
+				ch, err = hwmon.Find(kv[1])
+				s.tempChan = &ch
+			}
+		default:
+			err = errors.New("unknown option")
+		}
+		if err != nil {
+			return nil, errors.New("Ezo, bad option " + opt + ": " + err.Error())
+		}
+	}
+	if len(addresses) == 0 {
+		return nil, errors.New("Ezo needs at least one circuit address.")
+	}
+
+	for _, a := range addresses {
+		dev, err := i2c.Open(bus, a)
+		if err != nil {
+			return nil, errors.New("Ezo could not open i2c device: " + err.Error())
+		}
+		c := &circuit{dev: dev, labels: sensor.Labels{"device": dev.String()}}
+		info, err := c.command("i", commandDelay)
+		if err != nil {
+			return nil, fmt.Errorf("Ezo %s, could not identify circuit: %s", dev, err)
+		}
+		// ?I,pH,2.16
+		fields := strings.Split(info, ",")
+		if len(fields) < 2 || outputs[fields[1]] == nil {
+			return nil, fmt.Errorf("Ezo %s, unsupported circuit: %s", dev, info)
+		}
+		c.kind = fields[1]
+		c.outputs = []string{c.kind}
+		if c.kind == "EC" || c.kind == "DO" {
+			// ?O,EC,TDS,S,SG
+			enabled, err := c.command("O,?", commandDelay)
+			if err != nil {
+				return nil, fmt.Errorf("Ezo %s, could not query outputs: %s", dev, err)
+			}
+			c.outputs = strings.Split(strings.ToUpper(enabled), ",")[1:]
+			for i, o := range c.outputs {
+				if o == "%SAT" {
+					c.outputs[i] = "%"
+				}
+			}
+		}
+		slog.Info("Ezo found circuit", "device", dev, "kind", c.kind, "outputs", c.outputs)
+		s.circuits = append(s.circuits, c)
+	}
+	return s, nil
+}
+
+// command sends cmd and returns the answer, without its status byte.
+func (c *circuit) command(cmd string, delay time.Duration) (string, error) {
+	if err := c.dev.Write([]byte(cmd)); err != nil {
+		return "", err
+	}
+	time.Sleep(delay)
+	buf := make([]byte, 41)
+	for tries := 0; ; tries++ {
+		if err := c.dev.Read(buf); err != nil {
+			return "", err
+		}
+		switch buf[0] {
+		case 1:
+			return strings.TrimRight(string(buf[1:]), "\x00"), nil
+		case 2:
+			return "", errors.New("circuit rejected command " + cmd)
+		case 254: // still processing
+			if tries < 10 {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+		}
+		return "", fmt.Errorf("unexpected status %d", buf[0])
+	}
+}
+
+// temperature returns the compensation temperature, or false if unknown.
+func (s *Sensor) temperature(rtd float64, haveRTD bool) (float64, bool) {
+	switch {
+	case haveRTD:
+		return rtd, true
+	case s.tempChan != nil:
+		t, err := s.tempChan.Read("input")
+		if err != nil {
+			sensor.Incident()
+			slog.Warn("Ezo could not read temperature", "channel", s.tempChan.Name(), "err", err)
+			return 0, false
+		}
+		return t, true
+	case s.fixedTemp >= 0:
+		return s.fixedTemp, true
+	}
+	return 0, false
+}
+
+func (s *Sensor) Scrape() (out []sensor.Sample, e error) {
+	var rtd float64
+	haveRTD := false
+	// Read the RTD circuits first, to compensate the others.
+	for _, pass := range []bool{true, false} {
+		for _, c := range s.circuits {
+			if (c.kind == "RTD") != pass {
+				continue
+			}
+			if c.kind != "RTD" && c.kind != "ORP" {
+				if t, ok := s.temperature(rtd, haveRTD); ok {
+					if _, err := c.command(fmt.Sprintf("T,%.1f", t), commandDelay); err != nil {
+						sensor.Incident()
+						slog.Warn("Ezo could not set temperature", "device", c.dev, "err", err)
+					}
+				}
+			}
+			reading, err := c.command("R", readDelay)
+			if err != nil {
+				sensor.Incident()
+				slog.Error("Ezo could not read circuit", "device", c.dev, "kind", c.kind, "err", err)
+				continue
+			}
+			values := strings.Split(reading, ",")
+			if len(values) != len(c.outputs) {
+				sensor.Incident()
+				slog.Error("Ezo returned an unexpected reading", "device", c.dev, "reading", reading)
+				continue
+			}
+			for i, o := range c.outputs {
+				m, known := outputs[c.kind][o]
+				v, err := strconv.ParseFloat(values[i], 64)
+				if !known || err != nil {
+					continue
+				}
+				out = append(out, sensor.Sample{Name: m.metric, Labels: c.labels, Value: v * m.factor})
+				if c.kind == "RTD" && v > -126 { // -1023 means no probe
+					rtd, haveRTD = v, true
+				}
+			}
+		}
+	}
+	return out, nil
+}
+
+// Collector is the ezo sensor, for the main package to register.
+var Collector = sensor.CollectorEntry{
+	Name:            "ezo",
+	New:             NewSensor,
+	DefaultInterval: suggestedScrapeInterval,
+	Type: []string{"# TYPE water_ph gauge",
+		"# TYPE water_orp_volts gauge",
+		"# TYPE water_temperature_celsius gauge",
+		"# TYPE water_conductivity_microsiemens_per_centimeter gauge",
+		"# TYPE water_tds_ppm gauge",
+		"# TYPE water_salinity_psu gauge",
+		"# TYPE water_specific_gravity gauge",
+		"# TYPE water_dissolved_oxygen_milligrams_per_liter gauge",
+		"# TYPE water_oxygen_saturation_percent gauge"},
+	Help: []string{"# HELP water_ph pH of the water.",
+		"# HELP water_orp_volts Oxidation reduction potential of the water.",
+		"# HELP water_temperature_celsius Water temperature.",
+		"# HELP water_conductivity_microsiemens_per_centimeter Electrical conductivity of the water.",
+		"# HELP water_tds_ppm Total dissolved solids, estimated from conductivity.",
+		"# HELP water_salinity_psu Salinity in practical salinity units.",
+		"# HELP water_specific_gravity Specific gravity of sea water, estimated from conductivity.",
+		"# HELP water_dissolved_oxygen_milligrams_per_liter Dissolved oxygen.",
+		"# HELP water_oxygen_saturation_percent Dissolved oxygen relative to saturation."},
+	Unit: []string{"# UNIT water_orp_volts volts",
+		"# UNIT water_temperature_celsius celsius",
+		"# UNIT water_conductivity_microsiemens_per_centimeter microsiemens_per_centimeter",
+		"# UNIT water_tds_ppm ppm",
+		"# UNIT water_salinity_psu psu",
+		"# UNIT water_dissolved_oxygen_milligrams_per_liter milligrams_per_liter",
+		"# UNIT water_oxygen_saturation_percent percent"},
+	Description: description,
+}
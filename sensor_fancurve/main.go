@@ -0,0 +1,264 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package sensor_fancurve watches how fans react to temperature and reports
+when they stop behaving like they used to.
+
+For every fan it learns a linear fan curve, RPM as a function of a reference
+temperature, using an exponentially weighted least squares fit. On every
+scrape the measured RPM is compared to the RPM the curve predicts and the
+difference is exposed, together with an anomaly score: the absolute
+residual divided by its usual spread. A failing fan bearing or a clogged
+heatsink shows up as a growing score long before temperatures get critical.
+
+Options are comma separated:
+
+	fan=chip/channel     a fan to watch, may be given many times (default: all)
+	temp=chip/channel    the reference temperature (default: CPU package)
+	halflife=duration    how fast old samples are forgotten (default: 6h)
+
+Channels are given as hwmon chip name and channel name or label, e.g.
+"fancurve,,fan=nct6775/fan2,temp=coretemp/Package id 0".
+*/
+package sensor_fancurve
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/hwmon"
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+var suggestedScrapeInterval = time.Duration(10 * time.Second)
+var description = `Fancurve learns the relation between fan speed and a reference temperature
+and exposes the deviation of every fan from its learned curve as an anomaly
+score. Options: fan=chip/channel (repeatable, default all fans),
+temp=chip/channel (default the CPU package), halflife=duration (default 6h).
+
+  sensor_exporter fancurve
+  sensor_exporter fancurve,,fan=nct6775/fan2,temp=coretemp/temp1,halflife=12h`
+
+var defaultHalfLife = 6 * time.Hour
+
+// A fan needs this many samples before its curve is trusted.
+var minSamples = 30.0
+
+// Fans are never steadier than this, it keeps a perfectly flat history from
+// turning every small wobble into a huge score.
+var minSpread = 50.0
+
+// model is an exponentially weighted linear regression of rpm on temperature.
+// It also keeps the weighted variance of its own prediction errors.
+type model struct {
+	w, sx, sy, sxx, sxy float64
+	n                   float64
+	resVar              float64
+}
+
+func (m *model) decay(f float64) {
+	m.w *= f
+	m.sx *= f
+	m.sy *= f
+	m.sxx *= f
+	m.sxy *= f
+}
+
+func (m *model) predict(x float64) float64 {
+	meanX, meanY := m.sx/m.w, m.sy/m.w
+	varX := m.sxx/m.w - meanX*meanX
+	if varX < 1e-6 { // Temperature never moved, the curve is a constant
+		return meanY
+	}
+	slope := (m.sxy/m.w - meanX*meanY) / varX
+	return meanY + slope*(x-meanX)
+}
+
+func (m *model) add(x, y float64) {
+	m.w++
+	m.sx += x
+	m.sy += y
+	m.sxx += x * x
+	m.sxy += x * y
+	m.n++
+}
+
+type fan struct {
+	channel hwmon.Channel
+	labels  sensor.Labels
+	model   model
+}
+
+type Sensor struct {
+	temp hwmon.Channel
+	fans []*fan
+	last time.Time
+	half time.Duration
+}
+
+func NewSensor(opts string) (sensor.Collector, error) {
+	var fanSpecs []string
+	var tempSpec string
+	halfLife := defaultHalfLife
+	for _, opt := range strings.Split(opts, ",") {
+		if opt == "" {
+			continue
+		}
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("Fancurve, could not understand option: " + opt)
+		}
+		switch kv[0] {
+		case "fan":
+			fanSpecs = append(fanSpecs, kv[1])
+		case "temp":
+			tempSpec = kv[1]
+		case "halflife":
+			d, err := time.ParseDuration(kv[1])
+			if err != nil || d <= 0 {
+				return nil, errors.New("Fancurve, could not parse halflife: " + kv[1])
+			}
+			halfLife = d
+		default:
+			return nil, errors.New("Fancurve, unknown option: " + kv[0])
+		}
+	}
+
+	s := &Sensor{half: halfLife}
+	var err error
+	if tempSpec != "" {
+		s.temp, err = hwmon.Find(tempSpec)
+	} else {
+		s.temp, err = defaultTemperature()
+	}
+	if err != nil {
+		return nil, errors.New("Fancurve could not find reference temperature: " + err.Error())
+	}
+
+	var chans []hwmon.Channel
+	if len(fanSpecs) == 0 {
+		chips, err := hwmon.Chips()
+		if err != nil {
+			return nil, errors.New("Fancurve could not list hwmon chips: " + err.Error())
+		}
+		for _, c := range chips {
+			fans, err := c.Channels("fan")
+			if err != nil {
+				return nil, errors.New("Fancurve could not read chip " + c.Name + ": " + err.Error())
+			}
+			chans = append(chans, fans...)
+		}
+	}
+	for _, spec := range fanSpecs {
+		ch, err := hwmon.Find(spec)
+		if err != nil {
+			return nil, errors.New("Fancurve: " + err.Error())
+		}
+		chans = append(chans, ch)
+	}
+	for _, ch := range chans {
+		s.fans = append(s.fans, &fan{channel: ch,
+			labels: sensor.Labels{"chip": ch.Chip.Name, "fan": ch.Label}})
+	}
+	if len(s.fans) == 0 {
+		return nil, errors.New("Fancurve could not find any fans.")
+	}
+	return s, nil
+}
+
+// defaultTemperature returns the first CPU package temperature, which is
+// what most fan curves are driven by.
+func defaultTemperature() (hwmon.Channel, error) {
+	chips, err := hwmon.ChipsByName("coretemp", "k10temp", "zenpower")
+	if err != nil {
+		return hwmon.Channel{}, err
+	}
+	for _, c := range chips {
+		temps, err := c.Channels("temp")
+		if err != nil {
+			return hwmon.Channel{}, err
+		}
+		if len(temps) > 0 {
+			return temps[0], nil
+		}
+	}
+	return hwmon.Channel{}, errors.New("no CPU temperature sensor, please set temp=chip/channel")
+}
+
+func (s *Sensor) Scrape() (out []sensor.Sample, e error) {
+	temp, err := s.temp.Read("input")
+	if err != nil {
+		return nil, errors.New("Fancurve could not read temperature: " + err.Error())
+	}
+	now := time.Now()
+	decay := 1.0
+	if !s.last.IsZero() {
+		decay = math.Pow(0.5, float64(now.Sub(s.last))/float64(s.half))
+	}
+	s.last = now
+
+	for _, f := range s.fans {
+		rpm, err := f.channel.Read("input")
+		if err != nil {
+			return nil, errors.New("Fancurve could not read fan: " + err.Error())
+		}
+		out = append(out, sensor.Sample{Name: "fan_speed_rpm", Labels: f.labels, Value: rpm})
+
+		m := &f.model
+		m.decay(decay)
+		m.resVar *= decay
+		if m.n >= minSamples {
+			expected := m.predict(temp)
+			residual := rpm - expected
+			// The score is computed before this sample is learned, so a
+			// sudden failure is not hidden by the sample itself.
+			sd := math.Max(math.Sqrt(m.resVar/m.w), minSpread)
+			score := math.Abs(residual) / sd
+			out = append(out, sensor.Sample{Name: "fan_expected_speed_rpm", Labels: f.labels, Value: expected})
+			out = append(out, sensor.Sample{Name: "fan_speed_residual_rpm", Labels: f.labels, Value: residual})
+			out = append(out, sensor.Sample{Name: "fan_anomaly_score", Labels: f.labels, Value: score})
+			m.resVar += residual * residual
+		} else if m.n > 1 {
+			residual := rpm - m.predict(temp)
+			m.resVar += residual * residual
+		}
+		m.add(temp, rpm)
+	}
+	return out, nil
+}
+
+// Collector is the fancurve sensor, for the main package to register.
+var Collector = sensor.CollectorEntry{
+	Name:            "fancurve",
+	New:             NewSensor,
+	DefaultInterval: suggestedScrapeInterval,
+	Type: []string{"# TYPE fan_speed_rpm gauge",
+		"# TYPE fan_expected_speed_rpm gauge",
+		"# TYPE fan_speed_residual_rpm gauge",
+		"# TYPE fan_anomaly_score gauge"},
+	Help: []string{"# HELP fan_speed_rpm Current fan speed.",
+		"# HELP fan_expected_speed_rpm Fan speed predicted by the learned fan curve for the current temperature.",
+		"# HELP fan_speed_residual_rpm Measured minus expected fan speed.",
+		"# HELP fan_anomaly_score Absolute residual in units of its usual spread. Values above 3 deserve a look."},
+	Unit: []string{"# UNIT fan_speed_rpm rpm",
+		"# UNIT fan_expected_speed_rpm rpm",
+		"# UNIT fan_speed_residual_rpm rpm"},
+	Description: description,
+}
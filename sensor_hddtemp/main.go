@@ -30,15 +30,13 @@ package sensor_hddtemp
 
 import (
 	"bufio"
-	"fmt"
-	"log"
-	"net"
+	"log/slog"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/andmarios/sensor_exporter/sensor"
+	"github.com/fmoessbauer/sensor_exporter/sensor"
 )
 
 var suggestedScrapeInterval = time.Duration(4800 * time.Millisecond)
@@ -58,7 +56,7 @@ func NewSensor(opts string) (sensor.Collector, error) {
 	var host string
 	hostArray := regexp.MustCompile("^(.*):[0-9]{1,5}$").FindStringSubmatch(opts)
 	if len(hostArray) == 0 && opts == "" {
-		log.Println("Hddtemp: using default url localhost:7634")
+		slog.Info("Hddtemp using default url localhost:7634")
 		opts = "localhost:7634"
 		host = "localhost"
 	} else if len(hostArray) == 0 {
@@ -69,9 +67,9 @@ func NewSensor(opts string) (sensor.Collector, error) {
 	}
 	s := Sensor{Url: opts, Host: host}
 
-	conn, err := net.DialTimeout("tcp", s.Url, timeOut)
+	conn, err := sensor.DialTimeout("tcp", s.Url, timeOut)
 	if err != nil {
-		log.Printf("Adding hddtemp sensor at %s but could not connect to remote.\n", s.Url)
+		slog.Warn("Adding hddtemp sensor but could not connect to remote", "url", s.Url)
 	} else {
 		defer conn.Close()
 	}
@@ -83,16 +81,23 @@ var (
 	temp                   float64
 )
 
-func (s Sensor) Scrape() (out string, e error) {
-	conn, err := net.DialTimeout("tcp", s.Url, timeOut)
+func (s Sensor) Scrape() (out []sensor.Sample, e error) {
+	return s.ScrapeTrace(nil)
+}
+
+// ScrapeTrace scrapes, marking the dial, read and parse stages.
+func (s Sensor) ScrapeTrace(t *sensor.Trace) (out []sensor.Sample, e error) {
+	conn, err := sensor.DialTimeout("tcp", s.Url, timeOut)
+	t.Mark("dial")
 	if err != nil {
 		sensor.Incident()
-		log.Printf("Hddtemp @ %s, failed to connect: %s\n", s.Url, err.Error())
-		return "", nil
+		slog.Error("Hddtemp failed to connect", "url", s.Url, "err", err)
+		return nil, nil
 	}
 	defer conn.Close()
 
 	reader, _ := bufio.NewReader(conn).ReadString('\n')
+	t.Mark("read")
 	// We get something like: |diskA|model|temp|degree|diskB|model|temp|degree
 	// And the regexp below it breaks it to parts: |disk|model|temp|degree
 	for _, v := range re.FindAllString(reader, -1) {
@@ -106,26 +111,28 @@ func (s Sensor) Scrape() (out string, e error) {
 			temp, err = strconv.ParseFloat(v2[2], 64)
 			if err != nil {
 				sensor.Incident()
-				log.Printf("Hddtemp: hddtemp daemon returned a funny string: %s\n", v)
+				slog.Warn("Hddtemp daemon returned a funny string", "url", s.Url, "string", v)
 				continue
 			}
 			if degrees == "F" {
 				temp = (temp - 32) / 1.8 // Convert to Celsius
 			}
-			out += fmt.Sprintf("hdd_temperature_celsius{host=\"%s\",disk=\"%s\",model=\"%s\"} %.0f\n",
-				s.Host, device, model, temp)
+			out = append(out, sensor.Sample{Name: "hdd_temperature_celsius",
+				Labels: sensor.Labels{"host": s.Host, "disk": device, "model": model}, Value: temp})
 		}
 	}
+	t.Mark("parse")
 
 	return out, nil
 }
 
-func init() {
-	var sensorsType, sensorsHelp []string
-	sensorsType = append(sensorsType,
-		[]string{"# TYPE hdd_temperature_celsius gauge"}...)
-	sensorsHelp = append(sensorsHelp,
-		[]string{"# HELP hdd_temperature_celsius Current temperature of the disk."}...)
-	sensor.RegisterCollector("hddtemp", NewSensor, suggestedScrapeInterval,
-		sensorsType, sensorsHelp, description)
+// Collector is the hddtemp sensor, for the main package to register.
+var Collector = sensor.CollectorEntry{
+	Name:            "hddtemp",
+	New:             NewSensor,
+	DefaultInterval: suggestedScrapeInterval,
+	Type:            []string{"# TYPE hdd_temperature_celsius gauge"},
+	Help:            []string{"# HELP hdd_temperature_celsius Current temperature of the disk."},
+	Unit:            []string{"# UNIT hdd_temperature_celsius celsius"},
+	Description:     description,
 }
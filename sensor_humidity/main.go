@@ -0,0 +1,136 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package sensor_humidity reads temperature and relative humidity from hwmon
+chips that provide both, like the sht3x, sht4x, hdc2010, htu21 or dht11
+drivers. By default it also exposes the dew point, absolute humidity and
+heat index computed from each pair of readings. To turn that off:
+
+	sensor_exporter humidity,,derived=off
+*/
+package sensor_humidity
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/hwmon"
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+var suggestedScrapeInterval = time.Duration(10 * time.Second)
+var description = `Humidity reads temperature and relative humidity from hwmon chips that
+provide both (sht3x, sht4x, hdc2010, htu21, dht11, ...). It also exposes the dew
+point, absolute humidity and heat index, unless called with derived=off:
+
+  sensor_exporter humidity
+  sensor_exporter humidity,,derived=off`
+
+type pair struct {
+	temp, humidity hwmon.Channel
+	labels         sensor.Labels
+}
+
+type Sensor struct {
+	pairs   []pair
+	derived bool
+}
+
+func NewSensor(opts string) (sensor.Collector, error) {
+	s := Sensor{derived: true}
+	for _, opt := range strings.Split(opts, ",") {
+		switch opt {
+		case "":
+		case "derived=on":
+			s.derived = true
+		case "derived=off":
+			s.derived = false
+		default:
+			return nil, errors.New("Humidity, unknown option: " + opt)
+		}
+	}
+
+	chips, err := hwmon.Chips()
+	if err != nil {
+		return nil, errors.New("Humidity could not list hwmon chips: " + err.Error())
+	}
+	for _, c := range chips {
+		hums, err := c.Channels("humidity")
+		if err != nil || len(hums) == 0 {
+			continue
+		}
+		temps, err := c.Channels("temp")
+		if err != nil || len(temps) == 0 {
+			continue
+		}
+		for _, h := range hums {
+			// Pair humidityN with tempN if the chip has it, else with temp1.
+			t := temps[0]
+			for _, ct := range temps {
+				if ct.Index == h.Index {
+					t = ct
+				}
+			}
+			s.pairs = append(s.pairs, pair{temp: t, humidity: h,
+				labels: sensor.Labels{"chip": c.Name, "sensor": h.Label}})
+		}
+	}
+	if len(s.pairs) == 0 {
+		return nil, errors.New("Humidity could not find any hwmon chip with humidity and temperature.")
+	}
+	return s, nil
+}
+
+func (s Sensor) Scrape() (out []sensor.Sample, e error) {
+	for _, p := range s.pairs {
+		temp, err := p.temp.Read("input")
+		if err != nil {
+			return nil, errors.New("Humidity could not scrape: " + err.Error())
+		}
+		rh, err := p.humidity.Read("input")
+		if err != nil {
+			return nil, errors.New("Humidity could not scrape: " + err.Error())
+		}
+		out = append(out, sensor.Sample{Name: "temperature_celsius", Labels: p.labels, Value: temp})
+		out = append(out, sensor.Sample{Name: "relative_humidity_percent", Labels: p.labels, Value: rh})
+		if s.derived {
+			out = append(out, sensor.HumidityDerived(p.labels, temp, rh)...)
+		}
+	}
+	return out, nil
+}
+
+// Collector is the humidity sensor, for the main package to register.
+var Collector = sensor.CollectorEntry{
+	Name:            "humidity",
+	New:             NewSensor,
+	DefaultInterval: suggestedScrapeInterval,
+	Type: append([]string{"# TYPE temperature_celsius gauge",
+		"# TYPE relative_humidity_percent gauge"}, sensor.HumidityTypes...),
+	Help: append([]string{"# HELP temperature_celsius Current air temperature.",
+		"# HELP relative_humidity_percent Current relative humidity."}, sensor.HumidityHelp...),
+	Unit: append([]string{"# UNIT temperature_celsius celsius",
+		"# UNIT relative_humidity_percent percent"}, sensor.HumidityUnits...),
+	Description: description,
+	// Humidity sensors read a little above 100% when saturated.
+	Ranges: map[string]sensor.Range{
+		"temperature_celsius":       {Min: -40, Max: 125},
+		"relative_humidity_percent": {Min: 0, Max: 100, Clamp: 5},
+	},
+}
@@ -0,0 +1,259 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package sensor_hwmon exports every temperature, fan, voltage, current, power
+and humidity input of the hwmon chips under /sys/class/hwmon, like the
+sensors program of lm-sensors does, without running it.
+
+Readings are labeled with the chip name and the channel label, or the sysfs
+channel name (temp1, fan2) if the chip has no labels. Chips that share a name,
+like drivetemp for every disk, get their device appended to it.
+
+Channels may be picked with include and exclude options, glob patterns on
+chip/label or chip/channel, given many times. Without include every channel
+is read, excludes are applied last:
+
+	sensor_exporter hwmon
+	sensor_exporter hwmon,,include=nct6775/*,exclude=nct6775/in*
+	sensor_exporter hwmon,,exclude=nouveau/*
+
+Inputs that cannot be read at startup, e.g. unconnected fan headers, are
+left out.
+
+For each humidity input the dew point, absolute humidity and heat index are
+computed with the temperature of the same index on the chip, or else its
+first one, unless derived=off is given.
+*/
+package sensor_hwmon
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/hwmon"
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+var suggestedScrapeInterval = time.Duration(10 * time.Second)
+var description = `Hwmon reads all temperatures, fan speeds, voltages, currents, power and
+humidity inputs of the hwmon chips under /sys/class/hwmon, like lm-sensors.
+Channels may be filtered with include= and exclude=, glob patterns on
+chip/label or chip/channel, both repeatable. The dew point and friends of
+humidity inputs are left out with derived=off:
+
+  sensor_exporter hwmon
+  sensor_exporter hwmon,,include=coretemp/*,include=nct6775/fan*`
+
+// Metric names by channel kind.
+var metrics = map[string]string{
+	"temp":     "hwmon_temperature_celsius",
+	"fan":      "hwmon_fan_speed_rpm",
+	"in":       "hwmon_voltage_volts",
+	"curr":     "hwmon_current_amperes",
+	"power":    "hwmon_power_watts",
+	"humidity": "hwmon_humidity_percent",
+}
+
+type channel struct {
+	hwmon.Channel
+	labels sensor.Labels
+}
+
+type Sensor struct {
+	channels []channel
+	// pairs are the humidity and temperature channels of a chip the
+	// derived metrics are computed from, by their index in channels.
+	pairs [][2]int
+}
+
+func NewSensor(opts string) (sensor.Collector, error) {
+	var include, exclude []string
+	derived := true
+	for _, opt := range strings.Split(opts, ",") {
+		if opt == "" {
+			continue
+		}
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("Hwmon, could not understand option: " + opt)
+		}
+		if _, err := path.Match(kv[1], ""); err != nil {
+			return nil, errors.New("Hwmon, bad pattern " + kv[1] + ": " + err.Error())
+		}
+		switch kv[0] {
+		case "include":
+			include = append(include, kv[1])
+		case "exclude":
+			exclude = append(exclude, kv[1])
+		case "derived":
+			switch kv[1] {
+			case "on":
+				derived = true
+			case "off":
+				derived = false
+			default:
+				return nil, errors.New("Hwmon, derived must be on or off: " + kv[1])
+			}
+		default:
+			return nil, errors.New("Hwmon, unknown option: " + kv[0])
+		}
+	}
+
+	chips, err := hwmon.Chips()
+	if err != nil {
+		return nil, errors.New("Hwmon could not list chips: " + err.Error())
+	}
+	names := make(map[string]int)
+	for _, c := range chips {
+		names[c.Name]++
+	}
+	s := &Sensor{}
+	for _, c := range chips {
+		chipLabel := c.Name
+		if names[c.Name] > 1 {
+			chipLabel += "-" + device(c)
+		}
+		chans, err := c.Channels("")
+		if err != nil {
+			return nil, errors.New("Hwmon could not read chip " + c.Name + ": " + err.Error())
+		}
+		first := len(s.channels)
+		for _, ch := range chans {
+			if _, known := metrics[ch.Kind]; !known {
+				continue
+			}
+			if !selected(include, exclude, c.Name, ch) {
+				continue
+			}
+			if _, err := ch.Read("input"); err != nil {
+				slog.Info("Hwmon leaving out channel", "channel", c.Name+"/"+ch.Name(), "err", err)
+				continue
+			}
+			s.channels = append(s.channels, channel{Channel: ch,
+				labels: sensor.Labels{"chip": chipLabel, "label": ch.Label}})
+		}
+		if derived {
+			s.pair(first)
+		}
+	}
+	if len(s.channels) == 0 {
+		return nil, errors.New("Hwmon could not find any inputs.")
+	}
+	return s, nil
+}
+
+// pair pairs the humidity channels from channels[first:], those of one chip,
+// with the temperature channel of the same index, or else the first one.
+func (s *Sensor) pair(first int) {
+	temps := make(map[int]int)
+	firstTemp := -1
+	for i := first; i < len(s.channels); i++ {
+		if ch := s.channels[i]; ch.Kind == "temp" {
+			temps[ch.Index] = i
+			if firstTemp < 0 {
+				firstTemp = i
+			}
+		}
+	}
+	for i := first; i < len(s.channels); i++ {
+		ch := s.channels[i]
+		if ch.Kind != "humidity" || firstTemp < 0 {
+			continue
+		}
+		t, ok := temps[ch.Index]
+		if !ok {
+			t = firstTemp
+		}
+		s.pairs = append(s.pairs, [2]int{i, t})
+	}
+}
+
+// device names the device of a chip, to tell apart chips of the same name.
+func device(c hwmon.Chip) string {
+	if target, err := os.Readlink(filepath.Join(c.Path, "device")); err == nil {
+		return filepath.Base(target)
+	}
+	return filepath.Base(c.Path)
+}
+
+// selected applies the include and exclude patterns to a channel.
+func selected(include, exclude []string, chip string, ch hwmon.Channel) bool {
+	matches := func(patterns []string) bool {
+		for _, p := range patterns {
+			byLabel, _ := path.Match(p, chip+"/"+ch.Label)
+			byName, _ := path.Match(p, chip+"/"+ch.Name())
+			if byLabel || byName {
+				return true
+			}
+		}
+		return false
+	}
+	return (len(include) == 0 || matches(include)) && !matches(exclude)
+}
+
+func (s *Sensor) Scrape() (out []sensor.Sample, e error) {
+	values := make([]float64, len(s.channels))
+	read := make([]bool, len(s.channels))
+	for i, ch := range s.channels {
+		v, err := ch.Read("input")
+		if err != nil {
+			sensor.Incident()
+			slog.Error("Hwmon could not read channel", "channel", ch.Chip.Name+"/"+ch.Name(), "err", err)
+			continue
+		}
+		values[i], read[i] = v, true
+		out = append(out, sensor.Sample{Name: metrics[ch.Kind], Labels: ch.labels, Value: v})
+	}
+	for _, p := range s.pairs {
+		if read[p[0]] && read[p[1]] {
+			out = append(out, sensor.HumidityDerived(s.channels[p[0]].labels, values[p[1]], values[p[0]])...)
+		}
+	}
+	return out, nil
+}
+
+// Collector is the hwmon sensor, for the main package to register.
+var Collector = sensor.CollectorEntry{
+	Name:            "hwmon",
+	New:             NewSensor,
+	DefaultInterval: suggestedScrapeInterval,
+	Type: append([]string{"# TYPE hwmon_temperature_celsius gauge",
+		"# TYPE hwmon_fan_speed_rpm gauge",
+		"# TYPE hwmon_voltage_volts gauge",
+		"# TYPE hwmon_current_amperes gauge",
+		"# TYPE hwmon_power_watts gauge",
+		"# TYPE hwmon_humidity_percent gauge"}, sensor.HumidityTypes...),
+	Help: append([]string{"# HELP hwmon_temperature_celsius Temperature input of a hwmon chip.",
+		"# HELP hwmon_fan_speed_rpm Fan speed input of a hwmon chip.",
+		"# HELP hwmon_voltage_volts Voltage input of a hwmon chip.",
+		"# HELP hwmon_current_amperes Current input of a hwmon chip.",
+		"# HELP hwmon_power_watts Power input of a hwmon chip.",
+		"# HELP hwmon_humidity_percent Relative humidity input of a hwmon chip."}, sensor.HumidityHelp...),
+	Unit: append([]string{"# UNIT hwmon_temperature_celsius celsius",
+		"# UNIT hwmon_fan_speed_rpm rpm",
+		"# UNIT hwmon_voltage_volts volts",
+		"# UNIT hwmon_current_amperes amperes",
+		"# UNIT hwmon_power_watts watts",
+		"# UNIT hwmon_humidity_percent percent"}, sensor.HumidityUnits...),
+	Description: description,
+}
@@ -0,0 +1,238 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package sensor_hx711 reads a load cell through an HX711 24 bit ADC, bit-banged
+over two GPIO lines, for scales under beehives, propane tanks or pellet
+hoppers.
+
+The weight in grams is (raw - tare) / scale. To calibrate, start with the
+scale empty and tare=auto, note the tare value that is logged, put a known
+weight on it and divide the change of hx711_raw_value by that weight to get
+scale. Then set both values, as an automatic tare is wrong whenever the
+exporter restarts with a load on the scale:
+
+	sensor_exporter hx711,,dout=5,sck=6,tare=-81234,scale=419.6,name=hive1
+
+Each scrape takes the median of a few readings, as the bit-banged protocol
+occasionally gets a bad one when the process is descheduled while clocking.
+*/
+package sensor_hx711
+
+import (
+	"errors"
+	"log/slog"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/gpio"
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+var suggestedScrapeInterval = time.Duration(30 * time.Second)
+var description = `Hx711 reads a load cell through an HX711 ADC bit-banged over the GPIO lines dout
+and sck of chip (default gpiochip0) and exposes the weight in grams. Calibrate
+with tare (raw reading when empty, or auto to tare at startup) and scale (raw
+counts per gram). Other options: gain (128, 64 or 32), samples (median of,
+default 5) and name (label):
+
+  sensor_exporter hx711,,dout=5,sck=6,tare=-81234,scale=419.6,name=hive1`
+
+var readyTimeout = 500 * time.Millisecond
+
+type Sensor struct {
+	dout, sck *gpio.Line
+	pulses    int // 25, 26 or 27 clock pulses select the gain of the next reading
+	samples   int
+	tare      float64
+	scale     float64
+	name      string
+	labels    sensor.Labels
+}
+
+func NewSensor(opts string) (sensor.Collector, error) {
+	s := &Sensor{pulses: 25, samples: 5, scale: 1, name: "default"}
+	chip := "gpiochip0"
+	dout, sck := -1, -1
+	autoTare := false
+	for _, opt := range strings.Split(opts, ",") {
+		if opt == "" {
+			continue
+		}
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("Hx711, could not understand option: " + opt)
+		}
+		var err error
+		switch kv[0] {
+		case "chip":
+			chip = kv[1]
+		case "dout":
+			dout, err = strconv.Atoi(kv[1])
+		case "sck":
+			sck, err = strconv.Atoi(kv[1])
+		case "gain":
+			switch kv[1] {
+			case "128":
+				s.pulses = 25
+			case "64":
+				s.pulses = 27
+			case "32": // channel B
+				s.pulses = 26
+			default:
+				err = errors.New("must be 128, 64 or 32")
+			}
+		case "samples":
+			s.samples, err = strconv.Atoi(kv[1])
+			if err == nil && s.samples < 1 {
+				err = errors.New("must be at least 1")
+			}
+		case "tare":
+			if kv[1] == "auto" {
+				autoTare = true
+			} else {
+				s.tare, err = strconv.ParseFloat(kv[1], 64)
+			}
+		case "scale":
+			s.scale, err = strconv.ParseFloat(kv[1], 64)
+			if err == nil && s.scale == 0 {
+				err = errors.New("must not be zero")
+			}
+		case "name":
+			s.name = kv[1]
+		default:
+			err = errors.New("unknown option")
+		}
+		if err != nil {
+			return nil, errors.New("Hx711, bad option " + opt + ": " + err.Error())
+		}
+	}
+	if dout < 0 || sck < 0 {
+		return nil, errors.New("Hx711 needs the dout and sck gpio lines.")
+	}
+	s.labels = sensor.Labels{"name": s.name}
+
+	var err error
+	if s.dout, err = gpio.Request(chip, dout, gpio.Input, 0); err != nil {
+		return nil, errors.New("Hx711 could not request dout line: " + err.Error())
+	}
+	if s.sck, err = gpio.Request(chip, sck, gpio.Output, 0); err != nil {
+		return nil, errors.New("Hx711 could not request sck line: " + err.Error())
+	}
+	// A low clock wakes the chip up; the first reading has the default gain
+	// and sets ours for the next.
+	if err = s.sck.SetValue(0); err == nil {
+		_, err = s.read()
+	}
+	if err != nil {
+		return nil, errors.New("Hx711 could not read the ADC: " + err.Error())
+	}
+	if autoTare {
+		raw, err := s.median()
+		if err != nil {
+			return nil, errors.New("Hx711 could not tare: " + err.Error())
+		}
+		s.tare = raw
+		slog.Info("Hx711 tared", "scale", s.name, "raw", raw)
+	}
+	return s, nil
+}
+
+// read clocks out one 24 bit two's complement reading.
+func (s *Sensor) read() (int32, error) {
+	deadline := time.Now().Add(readyTimeout)
+	for {
+		v, err := s.dout.Value()
+		if err != nil {
+			return 0, err
+		}
+		if v == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			return 0, errors.New("chip not ready, check wiring")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Holding the clock high for over 60µs powers the chip down, so keep
+	// the goroutine on its thread while clocking.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	var raw uint32
+	for i := 0; i < s.pulses; i++ {
+		if err := s.sck.SetValue(1); err != nil {
+			return 0, err
+		}
+		v, err := s.dout.Value()
+		if err != nil {
+			return 0, err
+		}
+		if err := s.sck.SetValue(0); err != nil {
+			return 0, err
+		}
+		if i < 24 {
+			raw = raw<<1 | uint32(v)
+		}
+	}
+	return int32(raw<<8) >> 8, nil
+}
+
+func (s *Sensor) median() (float64, error) {
+	var values []float64
+	var err error
+	for i := 0; i < s.samples; i++ {
+		var raw int32
+		if raw, err = s.read(); err != nil {
+			continue
+		}
+		values = append(values, float64(raw))
+	}
+	if len(values) == 0 {
+		return 0, err
+	}
+	sort.Float64s(values)
+	return values[len(values)/2], nil
+}
+
+func (s *Sensor) Scrape() (out []sensor.Sample, e error) {
+	raw, err := s.median()
+	if err != nil {
+		sensor.Incident()
+		slog.Error("Hx711 could not read the ADC", "scale", s.name, "err", err)
+		return nil, nil
+	}
+	out = append(out, sensor.Sample{Name: "hx711_raw_value", Labels: s.labels, Value: raw})
+	out = append(out, sensor.Sample{Name: "weight_grams", Labels: s.labels, Value: (raw - s.tare) / s.scale})
+	return out, nil
+}
+
+// Collector is the hx711 sensor, for the main package to register.
+var Collector = sensor.CollectorEntry{
+	Name:            "hx711",
+	New:             NewSensor,
+	DefaultInterval: suggestedScrapeInterval,
+	Type: []string{"# TYPE hx711_raw_value gauge",
+		"# TYPE weight_grams gauge"},
+	Help: []string{"# HELP hx711_raw_value Raw reading of the HX711 ADC, for calibration.",
+		"# HELP weight_grams Weight on the load cell."},
+	Unit:        []string{"# UNIT weight_grams grams"},
+	Description: description,
+}
@@ -0,0 +1,277 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package sensor_ipmi reads the sensors of a server's baseboard management
+controller with ipmitool: temperatures, fan speeds, voltages, currents and
+power consumption.
+
+Every scrape runs ipmitool -c sdr elist and exports the threshold sensors
+with a reading, labeled with the target and the sensor name, lower cased and
+with runs of other characters than letters and digits replaced by _, e.g.
+"CPU1 Temp" becomes cpu1_temp. Readings in Fahrenheit are converted to
+Celsius.
+
+Options, comma separated:
+
+	device=/dev/ipmi0      the local BMC, the default
+	host=HOST[:PORT]       a remote BMC over the LAN instead
+	user=NAME              user of the remote BMC
+	password=SECRET        its password, passed to ipmitool in IPMI_PASSWORD
+	interface=lanplus      ipmitool interface of the remote BMC, lanplus (IPMI
+	                       2.0) by default, or lan
+	ipmitool=PATH          the program
+
+For example:
+
+	sensor_exporter ipmi
+	sensor_exporter ipmi,,host=bmc1.rack,user=monitor,password=ENC[...]
+
+Reading the local BMC needs the ipmi_devintf kernel module and usually root.
+*/
+package sensor_ipmi
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+var suggestedScrapeInterval = time.Duration(30 * time.Second)
+var description = `Ipmi reads the baseboard sensors of a server with ipmitool -c sdr elist:
+temperatures, fan speeds, voltages, currents and power. Options are device
+(default /dev/ipmi0) for the local BMC, or host, user, password and interface
+(lanplus or lan) for a remote one, and ipmitool, the path of the program:
+
+  sensor_exporter ipmi
+  sensor_exporter ipmi,,host=bmc1.rack,user=monitor,password=secret`
+
+var timeOut = 30 * time.Second
+
+var deviceRe = regexp.MustCompile(`^/dev/ipmi(\d+)$`)
+
+// nonAlnum are the runs of characters replaced in sensor names.
+var nonAlnum = regexp.MustCompile(`[^a-z0-9]+`)
+
+// metrics are the metric names of the ipmitool units exported.
+var metrics = map[string]string{
+	"degrees C": "ipmi_temperature_celsius",
+	"degrees F": "ipmi_temperature_celsius",
+	"RPM":       "ipmi_fan_speed_rpm",
+	"Volts":     "ipmi_voltage_volts",
+	"Amps":      "ipmi_current_amperes",
+	"Watts":     "ipmi_power_watts",
+}
+
+type Sensor struct {
+	Ipmitool string
+	Target   string
+	Labels   sensor.Labels
+	args     []string
+	password string
+}
+
+func NewSensor(opts string) (sensor.Collector, error) {
+	s := &Sensor{Ipmitool: "ipmitool"}
+	device, host, user, iface := "/dev/ipmi0", "", "", "lanplus"
+	for _, opt := range strings.Split(opts, ",") {
+		if opt == "" {
+			continue
+		}
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("Ipmi, could not understand option: " + opt)
+		}
+		switch kv[0] {
+		case "device":
+			device = kv[1]
+		case "host":
+			host = kv[1]
+		case "user":
+			user = kv[1]
+		case "password":
+			s.password = kv[1]
+		case "interface":
+			if kv[1] != "lanplus" && kv[1] != "lan" {
+				return nil, errors.New("Ipmi, unknown interface: " + kv[1])
+			}
+			iface = kv[1]
+		case "ipmitool":
+			s.Ipmitool = kv[1]
+		default:
+			return nil, errors.New("Ipmi, unknown option: " + kv[0])
+		}
+	}
+
+	if host == "" {
+		if user != "" || s.password != "" {
+			return nil, errors.New("Ipmi, user and password need a host")
+		}
+		m := deviceRe.FindStringSubmatch(device)
+		if m == nil {
+			return nil, errors.New("Ipmi, expected a device like /dev/ipmi0, got: " + device)
+		}
+		s.Target = device
+		s.args = []string{"-I", "open", "-d", m[1]}
+	} else {
+		s.Target = host
+		s.args = []string{"-I", iface}
+		if h, port, err := net.SplitHostPort(host); err == nil {
+			s.Target = h
+			s.args = append(s.args, "-H", h, "-p", port)
+		} else {
+			s.args = append(s.args, "-H", host)
+		}
+		if user != "" {
+			s.args = append(s.args, "-U", user)
+		}
+		// -E takes the password from IPMI_PASSWORD, keeping it out of ps.
+		s.args = append(s.args, "-E")
+	}
+	s.Labels = sensor.Labels{"target": s.Target}
+
+	if _, err := exec.LookPath(s.Ipmitool); err != nil {
+		return nil, errors.New("Ipmi needs ipmitool: " + err.Error())
+	}
+	return s, nil
+}
+
+// run runs ipmitool with args after those of the target.
+func (s *Sensor) run(args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeOut)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, s.Ipmitool, append(append([]string{}, s.args...), args...)...)
+	if s.password != "" {
+		cmd.Env = append(os.Environ(), "IPMI_PASSWORD="+s.password)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil && stderr.Len() > 0 {
+		err = errors.New(err.Error() + ": " + strings.TrimSpace(stderr.String()))
+	}
+	return out, err
+}
+
+func (s *Sensor) Scrape() (out []sensor.Sample, e error) {
+	res, err := s.run("-c", "sdr", "elist")
+	if err == nil {
+		out, err = s.parse(res)
+	}
+	if err != nil {
+		sensor.Incident()
+		slog.Error("Ipmi could not read the sensors", "target", s.Target, "err", err)
+		return []sensor.Sample{{Name: "ipmi_up", Labels: s.Labels, Value: 0}}, nil
+	}
+	return append(out, sensor.Sample{Name: "ipmi_up", Labels: s.Labels, Value: 1}), nil
+}
+
+// parse parses the CSV lines of ipmitool -c sdr elist. Those of threshold
+// sensors are NAME,READING,UNIT,STATUS; discrete sensors and sensors without
+// a reading are left out.
+func (s *Sensor) parse(res []byte) (out []sensor.Sample, e error) {
+	r := csv.NewReader(bytes.NewReader(res))
+	r.FieldsPerRecord = -1
+	seen := make(map[string]int)
+	for {
+		fields, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) < 4 {
+			continue
+		}
+		name, unit, status := fields[0], fields[2], fields[3]
+		metric, ok := metrics[unit]
+		if !ok {
+			continue
+		}
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil { // no reading
+			continue
+		}
+		if unit == "degrees F" {
+			value = (value - 32) * 5 / 9
+		}
+		label := sanitize(name)
+		// Boards may have several sensors of the same name.
+		if seen[label]++; seen[label] > 1 {
+			label += "_" + strconv.Itoa(seen[label])
+		}
+		labels := s.Labels.With("sensor", label)
+		out = append(out, sensor.Sample{Name: metric, Labels: labels, Value: value})
+		if status != "ns" {
+			ok := 0.0
+			if status == "ok" {
+				ok = 1
+			}
+			out = append(out, sensor.Sample{Name: "ipmi_sensor_ok", Labels: labels, Value: ok})
+		}
+	}
+	return out, nil
+}
+
+// sanitize lower cases a sensor name and replaces the runs of other
+// characters than letters and digits with _.
+func sanitize(name string) string {
+	name = strings.Trim(nonAlnum.ReplaceAllString(strings.ToLower(name), "_"), "_")
+	if name == "" {
+		return "unnamed"
+	}
+	return name
+}
+
+// Collector is the ipmi sensor, for the main package to register.
+var Collector = sensor.CollectorEntry{
+	Name:            "ipmi",
+	New:             NewSensor,
+	DefaultInterval: suggestedScrapeInterval,
+	Type: []string{"# TYPE ipmi_up gauge",
+		"# TYPE ipmi_temperature_celsius gauge",
+		"# TYPE ipmi_fan_speed_rpm gauge",
+		"# TYPE ipmi_voltage_volts gauge",
+		"# TYPE ipmi_current_amperes gauge",
+		"# TYPE ipmi_power_watts gauge",
+		"# TYPE ipmi_sensor_ok gauge"},
+	Help: []string{"# HELP ipmi_up Whether ipmitool could read the sensors of the BMC.",
+		"# HELP ipmi_temperature_celsius Temperature reported by the BMC.",
+		"# HELP ipmi_fan_speed_rpm Fan speed reported by the BMC.",
+		"# HELP ipmi_voltage_volts Voltage reported by the BMC.",
+		"# HELP ipmi_current_amperes Current reported by the BMC.",
+		"# HELP ipmi_power_watts Power consumption reported by the BMC.",
+		"# HELP ipmi_sensor_ok Whether the reading of a sensor is within its thresholds, 0 if the BMC reports it non-critical, critical or non-recoverable."},
+	Unit: []string{"# UNIT ipmi_temperature_celsius celsius",
+		"# UNIT ipmi_voltage_volts volts",
+		"# UNIT ipmi_current_amperes amperes",
+		"# UNIT ipmi_power_watts watts"},
+	Description: description,
+}
@@ -0,0 +1,145 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package sensor_leak gathers water leak detectors of any kind (GPIO rope
+sensors and float switches, Shelly Flood, Zigbee water sensors through
+deCONZ) into one water_leak_detected metric, labeled by location, so one
+alert rule covers them all.
+
+Options are location=source pairs, sources as in package binarysensor:
+
+	sensor_exporter leak,,kitchen=gpio:gpiochip0/17,basement=shelly:192.168.1.20
+
+The battery level and last report of wireless detectors are exported too,
+and they are flagged missing when silent for longer than missing (default
+12h).
+*/
+package sensor_leak
+
+import (
+	"errors"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/binarysensor"
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+var suggestedScrapeInterval = time.Duration(10 * time.Second)
+var description = `Leak reports water leak detectors as one metric labeled by location. Options
+are location=source pairs, where a source is gpio:chip/line, shelly:host,
+deconz:host/apikey/id or file:path, prefixed with ! to invert it. Wireless
+detectors silent for longer than missing (default 12h) are flagged:
+
+  sensor_exporter leak,,kitchen=gpio:gpiochip0/17,basement=shelly:192.168.1.20`
+
+type Sensor struct {
+	locations []string
+	sources   map[string]binarysensor.Source
+	health    *sensor.DeviceHealth
+}
+
+func NewSensor(opts string) (sensor.Collector, error) {
+	s := &Sensor{sources: make(map[string]binarysensor.Source)}
+	missing := 12 * time.Hour
+	for _, opt := range strings.Split(opts, ",") {
+		if opt == "" {
+			continue
+		}
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("Leak, could not understand option: " + opt)
+		}
+		if kv[0] == "missing" {
+			var err error
+			if missing, err = time.ParseDuration(kv[1]); err != nil {
+				return nil, errors.New("Leak, bad missing window: " + kv[1])
+			}
+			continue
+		}
+		if _, exists := s.sources[kv[0]]; exists {
+			return nil, errors.New("Leak, duplicate location: " + kv[0])
+		}
+		src, err := binarysensor.Parse(kv[1], binarysensor.Water)
+		if err != nil {
+			return nil, errors.New("Leak, bad source for " + kv[0] + ": " + err.Error())
+		}
+		s.sources[kv[0]] = src
+		s.locations = append(s.locations, kv[0])
+	}
+	if len(s.locations) == 0 {
+		return nil, errors.New("Leak needs at least one location=source option.")
+	}
+	sort.Strings(s.locations)
+	s.health = sensor.NewDeviceHealth(missing)
+	for _, loc := range s.locations {
+		if _, wireless := binarysensor.Report(s.sources[loc]); wireless {
+			s.health.Expect(loc, s.labels(loc))
+		}
+	}
+	return s, nil
+}
+
+func (s *Sensor) labels(loc string) sensor.Labels {
+	return sensor.Labels{"location": loc, "source": s.sources[loc].String()}
+}
+
+func (s *Sensor) Scrape() (out []sensor.Sample, e error) {
+	for _, loc := range s.locations {
+		src := s.sources[loc]
+		wet, err := src.State()
+		if r, wireless := binarysensor.Report(src); wireless && !r.Time.IsZero() {
+			s.health.Seen(loc, s.labels(loc), r)
+		}
+		if err != nil {
+			sensor.Incident()
+			slog.Error("Leak could not be read", "location", loc, "source", src, "err", err)
+			continue
+		}
+		v := 0.0
+		if wet {
+			v = 1
+		}
+		out = append(out, sensor.Sample{Name: "water_leak_detected", Labels: s.labels(loc), Value: v})
+	}
+	out = append(out, s.health.Metrics()...)
+	return out, nil
+}
+
+// Close releases the sources of the detectors.
+func (s *Sensor) Close() error {
+	var errs []error
+	for _, src := range s.sources {
+		errs = append(errs, binarysensor.Close(src))
+	}
+	return errors.Join(errs...)
+}
+
+// Collector is the leak sensor, for the main package to register.
+var Collector = sensor.CollectorEntry{
+	Name:            "leak",
+	New:             NewSensor,
+	DefaultInterval: suggestedScrapeInterval,
+	Type:            append([]string{"# TYPE water_leak_detected gauge"}, sensor.HealthTypes...),
+	Help:            append([]string{"# HELP water_leak_detected Whether the leak detector at a location senses water."}, sensor.HealthHelp...),
+	Unit:            sensor.HealthUnits,
+	Description:     description,
+	States:          map[string]string{"water_leak_detected": ""},
+}
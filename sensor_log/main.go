@@ -22,11 +22,9 @@ may use it to easily detect abnormal behaviour.
 package sensor_log
 
 import (
-	"errors"
-	"fmt"
 	"time"
 
-	"github.com/andmarios/sensor_exporter/sensor"
+	"github.com/fmoessbauer/sensor_exporter/sensor"
 )
 
 var suggestedScrapeInterval = time.Duration(3 * time.Second)
@@ -39,28 +37,23 @@ or taking too long. To use it with the suggested scrape interval:
 type Sensor struct {
 }
 
-var initialized = false
-
 func NewSensor(opts string) (sensor.Collector, error) {
-	if initialized == true {
-		return nil, errors.New("Only one log sensor may be set.")
-	}
-	initialized = true
 	s := Sensor{}
 	return s, nil
 }
 
-func (s Sensor) Scrape() (out string, e error) {
-	out += fmt.Sprintf("sensor_exporter_incidents %d\n", sensor.GetIncident())
+func (s Sensor) Scrape() (out []sensor.Sample, e error) {
+	out = append(out, sensor.Sample{Name: "sensor_exporter_incidents", Value: float64(sensor.GetIncident())})
 	return out, nil
 }
 
-func init() {
-	var sensorsType, sensorsHelp []string
-	sensorsType = append(sensorsType,
-		[]string{"# TYPE sensor_exporter_incidents counter"}...)
-	sensorsHelp = append(sensorsHelp,
-		[]string{"# HELP sensor_exporter_incidents Counter of serious incidents for sensor_exporter that an admin should investigate."}...)
-	sensor.RegisterCollector("log", NewSensor, suggestedScrapeInterval,
-		sensorsType, sensorsHelp, description)
+// Collector is the log sensor, for the main package to register.
+var Collector = sensor.CollectorEntry{
+	Name:            "log",
+	New:             NewSensor,
+	DefaultInterval: suggestedScrapeInterval,
+	Type:            []string{"# TYPE sensor_exporter_incidents counter"},
+	Help:            []string{"# HELP sensor_exporter_incidents Counter of serious incidents for sensor_exporter that an admin should investigate."},
+	Description:     description,
+	Single:          true,
 }
@@ -0,0 +1,330 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package sensor_modbus polls the registers of Modbus devices, like energy
+meters, solar inverters and industrial sensors, over serial RTU or Modbus TCP.
+
+What to read is given with the register option, many times, as
+
+	register=NAME:TABLE:ADDRESS:TYPE[:SCALE]
+
+NAME is the name of the metric, TABLE holding or input, ADDRESS the register
+number counted from 0, in decimal or 0x hex, TYPE one of uint16, int16,
+uint32, int32, uint64, int64, float32 and float64, and SCALE a factor the
+value is multiplied with, e.g. 0.1 for a register in tenths of a volt. Values
+of more than one register are read high word first, unless
+word_order=little. For an Eastron SDM120 on a USB RS-485 adapter:
+
+	sensor_exporter modbus,,device=/dev/ttyUSB0,baud=2400,slave=1,register=sdm_voltage_volts:input:0:float32,register=sdm_power_watts:input:0x0C:float32,register=sdm_import_energy_kwh:input:0x48:float32
+
+The device is a serial port, with baud (9600 by default) and line (8N1 by
+default, or 8E1, 8O1, 8N2), a serial to network bridge (tcp://host:port) with
+the line settings in its own configuration, or a Modbus TCP device or
+gateway (modbus-tcp://host[:port]), whose unit identifier is given as slave.
+Sensors with the same device share the bus, so several slaves on one line
+are each read by their own sensor.
+
+Registers next to each other in the same table are read with one request.
+A device that is unreachable is tried again with a backoff, doubling up to
+five minutes; modbus_up tells whether the last scrape read all registers.
+*/
+package sensor_modbus
+
+import (
+	"errors"
+	"log/slog"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/modbus"
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+	"github.com/fmoessbauer/sensor_exporter/serial"
+)
+
+var suggestedScrapeInterval = time.Duration(15 * time.Second)
+var description = `Modbus polls registers of Modbus devices, like energy meters and inverters, over
+serial RTU or Modbus TCP. Options are device (default /dev/ttyUSB0,
+tcp://host:port of a serial bridge or modbus-tcp://host[:port]), baud (9600),
+line (8N1), slave (1), word_order (big or little) and, repeatable,
+register=NAME:TABLE:ADDRESS:TYPE[:SCALE] with TABLE holding or input and TYPE
+one of uint16, int16, uint32, int32, uint64, int64, float32, float64.
+
+  sensor_exporter modbus,,device=modbus-tcp://inverter,register=inverter_power_watts:holding:40083:int16`
+
+var defaultDevice = "/dev/ttyUSB0"
+
+// maxRegisters is the most registers one read request may ask for.
+const maxRegisters = 125
+
+// words are the registers the values of a type take.
+var words = map[string]int{"uint16": 1, "int16": 1, "uint32": 2, "int32": 2,
+	"uint64": 4, "int64": 4, "float32": 2, "float64": 4}
+
+var tables = map[string]byte{"holding": modbus.ReadHoldingRegisters, "input": modbus.ReadInputRegisters}
+
+var validName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// A register is a value to read, of one or more registers.
+type register struct {
+	name     string
+	function byte
+	address  uint16
+	typ      string
+	scale    float64
+}
+
+// A block is a run of registers read with one request.
+type block struct {
+	function byte
+	address  uint16
+	count    uint16
+	values   []register
+}
+
+type Sensor struct {
+	Device    string
+	Slave     byte
+	Little    bool
+	registers []register
+
+	bus    *modbus.Bus
+	blocks []block
+	labels sensor.Labels
+}
+
+func NewSensor(opts string) (sensor.Collector, error) {
+	s := &Sensor{Device: defaultDevice, Slave: 1}
+	c := serial.Config{Baud: 9600}
+	for _, opt := range strings.Split(opts, ",") {
+		// Options may be spread over lines in the configuration file.
+		opt = strings.TrimSpace(opt)
+		if opt == "" {
+			continue
+		}
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("Modbus, could not understand option: " + opt)
+		}
+		switch kv[0] {
+		case "device":
+			s.Device = kv[1]
+		case "baud":
+			baud, err := strconv.Atoi(kv[1])
+			if err != nil || baud <= 0 {
+				return nil, errors.New("Modbus, bad baud rate: " + kv[1])
+			}
+			c.Baud = baud
+		case "line":
+			if err := parseLine(kv[1], &c); err != nil {
+				return nil, err
+			}
+		case "slave":
+			slave, err := strconv.ParseUint(kv[1], 0, 8)
+			if err != nil {
+				return nil, errors.New("Modbus, bad slave address: " + kv[1])
+			}
+			s.Slave = byte(slave)
+		case "word_order":
+			if kv[1] != "big" && kv[1] != "little" {
+				return nil, errors.New("Modbus, word_order must be big or little: " + kv[1])
+			}
+			s.Little = kv[1] == "little"
+		case "register":
+			r, err := parseRegister(kv[1])
+			if err != nil {
+				return nil, err
+			}
+			s.registers = append(s.registers, r)
+		default:
+			return nil, errors.New("Modbus, unknown option: " + kv[0])
+		}
+	}
+	if len(s.registers) == 0 {
+		return nil, errors.New("Modbus, no register to read")
+	}
+	s.blocks = blocks(s.registers)
+	s.labels = sensor.Labels{"device": s.Device, "slave": strconv.Itoa(int(s.Slave))}
+
+	bus, err := modbus.Open(s.Device, c)
+	if err != nil {
+		return nil, errors.New("Modbus could not open bus: " + err.Error())
+	}
+	s.bus = bus
+	return s, nil
+}
+
+// parseLine parses line settings like 8N1 into c.
+func parseLine(line string, c *serial.Config) error {
+	parities := map[byte]int{'N': serial.ParityNone, 'E': serial.ParityEven, 'O': serial.ParityOdd}
+	if len(line) != 3 || line[0] < '5' || line[0] > '8' || (line[2] != '1' && line[2] != '2') {
+		return errors.New("Modbus, bad line settings, expected like 8N1: " + line)
+	}
+	parity, exists := parities[line[1]]
+	if !exists {
+		return errors.New("Modbus, bad parity, expected N, E or O: " + line)
+	}
+	c.DataBits, c.Parity, c.StopBits = int(line[0]-'0'), parity, int(line[2]-'0')
+	return nil
+}
+
+// parseRegister parses NAME:TABLE:ADDRESS:TYPE[:SCALE].
+func parseRegister(spec string) (register, error) {
+	fields := strings.Split(spec, ":")
+	if len(fields) != 4 && len(fields) != 5 {
+		return register{}, errors.New("Modbus, expected register=NAME:TABLE:ADDRESS:TYPE[:SCALE], got: " + spec)
+	}
+	r := register{name: fields[0], typ: fields[3], scale: 1}
+	if !validName.MatchString(r.name) {
+		return r, errors.New("Modbus, bad metric name: " + r.name)
+	}
+	function, exists := tables[fields[1]]
+	if !exists {
+		return r, errors.New("Modbus, register table must be holding or input: " + fields[1])
+	}
+	r.function = function
+	address, err := strconv.ParseUint(fields[2], 0, 16)
+	if err != nil {
+		return r, errors.New("Modbus, bad register address: " + fields[2])
+	}
+	r.address = uint16(address)
+	n, exists := words[r.typ]
+	if !exists {
+		return r, errors.New("Modbus, unknown register type: " + r.typ)
+	}
+	if int(r.address)+n > 0x10000 {
+		return r, errors.New("Modbus, register beyond the address space: " + spec)
+	}
+	if len(fields) == 5 {
+		if r.scale, err = strconv.ParseFloat(fields[4], 64); err != nil {
+			return r, errors.New("Modbus, bad scale: " + fields[4])
+		}
+	}
+	return r, nil
+}
+
+// blocks groups the registers into as few read requests as possible, joining
+// those of the same table that follow or overlap each other. Gaps are not
+// bridged, as devices may answer reads of unmapped registers with exceptions.
+func blocks(registers []register) []block {
+	sorted := append([]register(nil), registers...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].function != sorted[j].function {
+			return sorted[i].function < sorted[j].function
+		}
+		return sorted[i].address < sorted[j].address
+	})
+	var out []block
+	for _, r := range sorted {
+		end := int(r.address) + words[r.typ]
+		if n := len(out); n > 0 {
+			b := &out[n-1]
+			start := int(b.address)
+			if b.function == r.function && int(r.address) <= start+int(b.count) && end-start <= maxRegisters {
+				b.count = uint16(max(int(b.count), end-start))
+				b.values = append(b.values, r)
+				continue
+			}
+		}
+		out = append(out, block{function: r.function, address: r.address, count: uint16(words[r.typ]), values: []register{r}})
+	}
+	return out
+}
+
+func (s *Sensor) Scrape() (out []sensor.Sample, e error) {
+	up := 1.0
+	for _, b := range s.blocks {
+		regs, tries, err := s.bus.ReadRegistersTries(s.Slave, b.function, b.address, b.count)
+		if err != nil {
+			up = 0
+			// The bus logs failing to open it, once until it opens again.
+			if err != modbus.ErrBackoff {
+				sensor.Incident()
+				slog.Error("Modbus could not read registers", "device", s.Device, "slave", s.Slave, "address", b.address, "count", b.count, "err", err)
+			}
+			continue
+		}
+		// A block read only after retries may be read right, or be a
+		// bad answer that passed the CRC by chance.
+		quality := sensor.Good
+		if tries > 1 {
+			quality = sensor.Degraded
+		}
+		for _, r := range b.values {
+			offset := int(r.address - b.address)
+			value := decode(regs[offset:offset+words[r.typ]], r.typ, s.Little) * r.scale
+			out = append(out, sensor.Sample{Name: r.name, Labels: s.labels, Value: value, Quality: quality})
+		}
+	}
+	stats := s.bus.Stats(s.Slave)
+	out = append(out, sensor.Sample{Name: "modbus_up", Labels: s.labels, Value: up},
+		sensor.Sample{Name: "modbus_requests_total", Labels: s.labels, Value: float64(stats.Requests)},
+		sensor.Sample{Name: "modbus_crc_errors_total", Labels: s.labels, Value: float64(stats.CRCErrors)},
+		sensor.Sample{Name: "modbus_timeouts_total", Labels: s.labels, Value: float64(stats.Timeouts)})
+	return out, nil
+}
+
+// decode returns the value of type typ in regs, high word first unless
+// little.
+func decode(regs []uint16, typ string, little bool) float64 {
+	var u uint64
+	for i := range regs {
+		w := regs[i]
+		if little {
+			w = regs[len(regs)-1-i]
+		}
+		u = u<<16 | uint64(w)
+	}
+	switch typ {
+	case "int16":
+		return float64(int16(u))
+	case "int32":
+		return float64(int32(u))
+	case "int64":
+		return float64(int64(u))
+	case "float32":
+		return float64(math.Float32frombits(uint32(u)))
+	case "float64":
+		return math.Float64frombits(u)
+	}
+	return float64(u)
+}
+
+// Close releases the bus, for the sensor to be replaced on reload.
+func (s *Sensor) Close() error {
+	return s.bus.Close()
+}
+
+// Collector is the modbus sensor, for the main package to register.
+var Collector = sensor.CollectorEntry{
+	Name:            "modbus",
+	New:             NewSensor,
+	DefaultInterval: suggestedScrapeInterval,
+	Type: []string{"# TYPE modbus_up gauge",
+		"# TYPE modbus_requests_total counter",
+		"# TYPE modbus_crc_errors_total counter",
+		"# TYPE modbus_timeouts_total counter"},
+	Help: []string{"# HELP modbus_up Whether the last scrape read all registers of the slave.",
+		"# HELP modbus_requests_total Requests sent to the slave, including retries.",
+		"# HELP modbus_crc_errors_total Answers of the slave with a bad CRC.",
+		"# HELP modbus_timeouts_total Requests the slave did not answer in time."},
+	Description: description,
+}
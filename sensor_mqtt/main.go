@@ -0,0 +1,479 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package sensor_mqtt subscribes to MQTT topics of devices that publish their
+readings, like Tasmota, Shelly or ESPHome ones, and exposes the latest value
+of each as a gauge.
+
+The options up to the next topic apply to a topic filter. A value is taken
+from the payload by a dot separated path into a JSON object, json=PATH, by
+the first group of a regular expression, regex=RE, or else is the whole
+payload; ON and OFF count as 1 and 0, and numbers may have a decimal comma,
+thousands separators and a unit, like 23,5°C. A topic may have several json
+or regex values, each named by the last element of its path, or "value",
+unless a name option follows it:
+
+	sensor_exporter mqtt,,broker=nas.local,\
+	topic=tele/+device/SENSOR,json=AM2301.Temperature,json=AM2301.Humidity,\
+	topic=shellies/+device/relay/0/power,name=power
+
+A level +NAME of a filter is the wildcard + whose level of the topic becomes
+the label NAME, and a last level #NAME likewise the rest of the topic; every
+value is labeled with its topic and name too. Regular expressions cannot
+contain commas, as those separate the options.
+
+Other options are user and password, client_id, expire=DURATION, after which
+values that were not published again are dropped, buffer=N, the most values
+kept between scrapes (default 1000), beyond which the oldest are dropped and
+counted, derived=off and the TLS options of the tlsconfig package.
+
+A topic with values named temperature, in Celsius, and humidity, in
+percent, in any case, like the AM2301 ones of Tasmota, gets the dew point,
+absolute humidity and heat index computed from them too, unless derived=off
+is given. mqtt_last_update_timestamp_seconds tells when each topic
+last had a value, so publishers that went silent can be alerted on.
+*/
+package sensor_mqtt
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+	"github.com/fmoessbauer/sensor_exporter/tlsconfig"
+)
+
+var suggestedScrapeInterval = time.Duration(15 * time.Second)
+var description = `Mqtt subscribes to MQTT topics and exposes the latest value published on each,
+taken from JSON payloads with json=PATH, by regex=RE or as the plain payload.
+Options: broker=HOST[:PORT], user, password, then per topic filter
+topic=FILTER, where a level +NAME becomes the label NAME, followed by its
+json, regex and name options:
+
+  sensor_exporter mqtt,,broker=nas.local,topic=tele/+device/SENSOR,json=AM2301.Temperature`
+
+var timeOut = 10 * time.Second
+
+// A topic is a topic filter subscribed to.
+type topic struct {
+	filter string   // as subscribed, with plain wildcards
+	labels []string // label of each level, "" for none
+	values []*value
+}
+
+// A value is taken from the payloads of a topic.
+type value struct {
+	name  string
+	path  []string       // into a JSON payload
+	regex *regexp.Regexp // first group
+}
+
+// A reading is the latest value of a topic.
+type reading struct {
+	labels sensor.Labels
+	value  float64
+	time   time.Time
+}
+
+type Sensor struct {
+	// The values received since the last scrape, so that a burst of
+	// messages cannot grow the memory.
+	*sensor.Buffer
+
+	broker  string
+	expire  time.Duration
+	derived bool
+	client  mqtt.Client
+
+	mutex    sync.Mutex
+	readings map[string]reading // by topic and value name
+	updated  map[string]reading // the time of the last value of a topic
+	failing  map[string]bool    // values that could not be parsed, logged once
+}
+
+func NewSensor(opts string) (sensor.Collector, error) {
+	s := &Sensor{readings: make(map[string]reading), updated: make(map[string]reading),
+		failing: make(map[string]bool), derived: true}
+	var topics []*topic
+	var user, password, clientID string
+	size := 0
+	var tlsConf tlsconfig.Config
+	var last *value // for name
+	for _, opt := range strings.Split(opts, ",") {
+		if opt == "" {
+			continue
+		}
+		if ok, err := tlsConf.Option(opt); ok {
+			if err != nil {
+				return nil, errors.New("Mqtt, bad option " + opt + ": " + err.Error())
+			}
+			continue
+		}
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("Mqtt, could not understand option: " + opt)
+		}
+		var err error
+		switch kv[0] {
+		case "broker":
+			s.broker = kv[1]
+		case "user":
+			user = kv[1]
+		case "password":
+			password = kv[1]
+		case "client_id":
+			clientID = kv[1]
+		case "expire":
+			s.expire, err = time.ParseDuration(kv[1])
+		case "derived":
+			switch kv[1] {
+			case "on":
+				s.derived = true
+			case "off":
+				s.derived = false
+			default:
+				err = errors.New("expected on or off")
+			}
+		case "buffer":
+			if size, err = strconv.Atoi(kv[1]); err == nil && size <= 0 {
+				err = errors.New("must be positive")
+			}
+		case "topic":
+			var t *topic
+			t, err = parseTopic(kv[1])
+			topics, last = append(topics, t), nil
+		case "json", "regex", "name":
+			if len(topics) == 0 {
+				err = errors.New("no topic before it")
+				break
+			}
+			t := topics[len(topics)-1]
+			switch kv[0] {
+			case "json":
+				path := strings.Split(kv[1], ".")
+				last = &value{name: path[len(path)-1], path: path}
+				t.values = append(t.values, last)
+			case "regex":
+				last = &value{name: "value"}
+				if last.regex, err = regexp.Compile(kv[1]); err == nil && last.regex.NumSubexp() < 1 {
+					err = errors.New("no group")
+				}
+				t.values = append(t.values, last)
+			case "name":
+				if last == nil {
+					last = &value{}
+					t.values = append(t.values, last)
+				}
+				last.name = kv[1]
+			}
+		default:
+			err = errors.New("unknown option")
+		}
+		if err != nil {
+			return nil, errors.New("Mqtt, bad option " + opt + ": " + err.Error())
+		}
+	}
+	if s.broker == "" || len(topics) == 0 {
+		return nil, errors.New("Mqtt, needs broker=HOST[:PORT] and at least one topic=FILTER")
+	}
+	s.Buffer = sensor.NewBuffer(size)
+	for _, t := range topics {
+		if len(t.values) == 0 {
+			t.values = []*value{{name: "value"}}
+		}
+	}
+
+	if clientID == "" {
+		// Brokers disconnect the older of two clients with the same id.
+		random := make([]byte, 4)
+		rand.Read(random)
+		clientID = "sensor_exporter-" + hex.EncodeToString(random)
+	}
+	scheme, port := "tcp://", "1883"
+	if tlsConf.Enabled {
+		if err := tlsConf.Check(); err != nil {
+			return nil, errors.New("Mqtt, bad TLS options: " + err.Error())
+		}
+		scheme, port = "ssl://", "8883"
+	}
+	host := s.broker
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, port)
+	}
+	options := mqtt.NewClientOptions().
+		AddBroker(scheme + host).
+		SetClientID(clientID).
+		SetUsername(user).
+		SetPassword(password).
+		SetConnectTimeout(timeOut).
+		SetDialer(&net.Dialer{Timeout: timeOut, FallbackDelay: sensor.FallbackDelay}).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			sensor.Incident()
+			slog.Warn("Mqtt lost connection", "broker", s.broker, "err", err)
+		}).
+		// The session is clean, so subscribe again on every connect.
+		SetOnConnectHandler(func(c mqtt.Client) {
+			for _, t := range topics {
+				t := t
+				c.Subscribe(t.filter, 0, func(_ mqtt.Client, m mqtt.Message) {
+					s.receive(t, m)
+				})
+			}
+		})
+	if tlsConf.Enabled {
+		conf, err := tlsConf.TLS(host)
+		if err != nil {
+			return nil, errors.New("Mqtt, bad TLS options: " + err.Error())
+		}
+		options.SetTLSConfig(conf)
+	}
+	// Connecting goes on in the background until the broker is reachable.
+	s.client = mqtt.NewClient(options)
+	s.client.Connect()
+	return s, nil
+}
+
+// parseTopic parses a topic filter whose wildcards may name labels.
+func parseTopic(filter string) (*topic, error) {
+	levels := strings.Split(filter, "/")
+	t := &topic{labels: make([]string, len(levels))}
+	for i, level := range levels {
+		if level == "" || (level[0] != '+' && level[0] != '#') {
+			continue
+		}
+		if level[0] == '#' && i != len(levels)-1 {
+			return nil, errors.New("# must be the last level")
+		}
+		if name := level[1:]; name != "" {
+			if !sensor.ValidLabelName(name) || name == "topic" || name == "name" {
+				return nil, errors.New("bad label name " + name)
+			}
+			t.labels[i] = name
+		}
+		levels[i] = level[:1]
+	}
+	t.filter = strings.Join(levels, "/")
+	return t, nil
+}
+
+// receive buffers the values of a message on a topic of t, for the next
+// scrape.
+func (s *Sensor) receive(t *topic, m mqtt.Message) {
+	labels := sensor.Labels{"topic": m.Topic()}
+	levels := strings.Split(m.Topic(), "/")
+	for i, name := range t.labels {
+		if name == "" || i >= len(levels) {
+			continue
+		}
+		if i == len(t.labels)-1 && t.filter[len(t.filter)-1] == '#' {
+			labels[name] = strings.Join(levels[i:], "/")
+		} else {
+			labels[name] = levels[i]
+		}
+	}
+	now := time.Now()
+	var samples []sensor.Sample
+	s.mutex.Lock()
+	for _, v := range t.values {
+		key := m.Topic() + "\x00" + v.name
+		x, err := v.parse(m.Payload())
+		if err != nil {
+			if !s.failing[key] {
+				s.failing[key] = true
+				sensor.Incident()
+				slog.Warn("Mqtt could not get value", "name", v.name, "topic", m.Topic(), "err", err)
+			}
+			continue
+		}
+		delete(s.failing, key)
+		l := sensor.Labels{"name": v.name}
+		for k, v := range labels {
+			l[k] = v
+		}
+		samples = append(samples, sensor.Sample{Name: "mqtt_value", Labels: l, Value: x})
+	}
+	s.mutex.Unlock()
+	if len(samples) > 0 {
+		samples = append(samples, sensor.Sample{Name: "mqtt_last_update_timestamp_seconds",
+			Labels: labels, Value: float64(now.UnixNano()) / 1e9})
+		s.Add(samples...)
+	}
+}
+
+// update takes the values buffered since the last scrape as the latest
+// ones. The caller holds s.mutex.
+func (s *Sensor) update() {
+	samples := s.Drain()
+	now := time.Now()
+	published := make(map[string]time.Time)
+	for _, sample := range samples {
+		if sample.Name == "mqtt_last_update_timestamp_seconds" {
+			t := time.Unix(0, int64(sample.Value*1e9))
+			published[sample.Labels["topic"]] = t
+			s.updated[sample.Labels["topic"]] = reading{sample.Labels, sample.Value, t}
+		}
+	}
+	for _, sample := range samples {
+		if sample.Name == "mqtt_value" {
+			t, ok := published[sample.Labels["topic"]]
+			if !ok { // its update was dropped
+				t = now
+			}
+			key := sample.Labels["topic"] + "\x00" + sample.Labels["name"]
+			s.readings[key] = reading{sample.Labels, sample.Value, t}
+		}
+	}
+}
+
+// parse takes v from a payload.
+func (v *value) parse(payload []byte) (float64, error) {
+	text := strings.TrimSpace(string(payload))
+	switch {
+	case v.path != nil:
+		var doc interface{}
+		if err := json.Unmarshal(payload, &doc); err != nil {
+			return 0, err
+		}
+		for _, key := range v.path {
+			switch node := doc.(type) {
+			case map[string]interface{}:
+				doc = node[key]
+			case []interface{}:
+				i, err := strconv.Atoi(key)
+				if err != nil || i < 0 || i >= len(node) {
+					return 0, errors.New("no element " + key)
+				}
+				doc = node[i]
+			default:
+				doc = nil
+			}
+			if doc == nil {
+				return 0, errors.New("no " + strings.Join(v.path, "."))
+			}
+		}
+		switch x := doc.(type) {
+		case float64:
+			return x, nil
+		case bool:
+			if x {
+				return 1, nil
+			}
+			return 0, nil
+		case string:
+			text = x
+		default:
+			return 0, errors.New(strings.Join(v.path, ".") + " is no number")
+		}
+	case v.regex != nil:
+		match := v.regex.FindStringSubmatch(text)
+		if match == nil {
+			return 0, errors.New("no match of " + v.regex.String())
+		}
+		text = match[1]
+	}
+	switch strings.ToUpper(text) {
+	case "ON", "TRUE":
+		return 1, nil
+	case "OFF", "FALSE":
+		return 0, nil
+	}
+	return sensor.ParseNumber(text)
+}
+
+func (s *Sensor) Scrape() (out []sensor.Sample, e error) {
+	connected := 0.0
+	if s.client.IsConnectionOpen() {
+		connected = 1
+	}
+	out = append(out, sensor.Sample{Name: "mqtt_connected", Labels: sensor.Labels{"broker": s.broker}, Value: connected})
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.update()
+	temps, hums := make(map[string]reading), make(map[string]float64)
+	for key, r := range s.readings {
+		if s.expire > 0 && time.Since(r.time) > s.expire {
+			delete(s.readings, key)
+			continue
+		}
+		out = append(out, sensor.Sample{Name: "mqtt_value", Labels: r.labels, Value: r.value})
+		switch strings.ToLower(r.labels["name"]) {
+		case "temperature":
+			temps[r.labels["topic"]] = r
+		case "humidity":
+			hums[r.labels["topic"]] = r.value
+		}
+	}
+	if s.derived {
+		for topic, rh := range hums {
+			t, ok := temps[topic]
+			if !ok {
+				continue
+			}
+			// Labeled like the topic, without the name of a value.
+			labels := sensor.Labels{}
+			for k, v := range t.labels {
+				if k != "name" {
+					labels[k] = v
+				}
+			}
+			out = append(out, sensor.HumidityDerived(labels, t.value, rh)...)
+		}
+	}
+	for key, r := range s.updated {
+		if s.expire > 0 && time.Since(r.time) > s.expire {
+			delete(s.updated, key)
+			continue
+		}
+		out = append(out, sensor.Sample{Name: "mqtt_last_update_timestamp_seconds", Labels: r.labels, Value: r.value})
+	}
+	return out, nil
+}
+
+// Close disconnects from the broker.
+func (s *Sensor) Close() error {
+	s.client.Disconnect(250)
+	return nil
+}
+
+// Collector is the MQTT sensor, for the main package to register.
+var Collector = sensor.CollectorEntry{
+	Name:            "mqtt",
+	New:             NewSensor,
+	DefaultInterval: suggestedScrapeInterval,
+	Type: append([]string{"# TYPE mqtt_value gauge",
+		"# TYPE mqtt_last_update_timestamp_seconds gauge",
+		"# TYPE mqtt_connected gauge"}, sensor.HumidityTypes...),
+	Help: append([]string{"# HELP mqtt_value Latest value published on an MQTT topic.",
+		"# HELP mqtt_last_update_timestamp_seconds When a value was last published on the topic.",
+		"# HELP mqtt_connected Whether the connection to the MQTT broker is up."}, sensor.HumidityHelp...),
+	Unit:        append([]string{"# UNIT mqtt_last_update_timestamp_seconds seconds"}, sensor.HumidityUnits...),
+	Description: description,
+}
@@ -0,0 +1,295 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package sensor_nvme reads the SMART / health log of NVMe controllers with the
+admin passthrough ioctl of /dev/nvmeN, without nvme-cli or smartctl.
+
+It exports the composite temperature, the percentage of the rated life used,
+the available spare and its threshold, the critical warning bits, media
+errors and unsafe shutdowns of every controller, labeled with the device and
+its serial number. NVMe drives are not read by hddtemp and overheat silently
+in small servers without airflow over the M.2 slots.
+
+Controllers are given with the device option, many times; without it all
+controllers under /sys/class/nvme are read:
+
+	sensor_exporter nvme
+	sensor_exporter nvme,,device=/dev/nvme0,device=/dev/nvme1
+
+Reading the log needs root, or CAP_SYS_ADMIN. Without it only the composite
+temperature is exported, from the hwmon device of the controller in sysfs
+(Linux 5.5 or newer).
+*/
+package sensor_nvme
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+var suggestedScrapeInterval = time.Duration(1 * time.Minute)
+var description = `Nvme reads the SMART / health log of NVMe controllers with an ioctl: composite
+temperature, percentage used, available spare, critical warnings, media errors
+and unsafe shutdowns, labeled with device and serial. Options: device=path
+(repeatable, default all controllers of /sys/class/nvme). Needs root, else only
+the temperature of sysfs is exported.
+
+  sensor_exporter nvme
+  sensor_exporter nvme,,device=/dev/nvme0`
+
+var sysfsRoot = "/sys/class/nvme"
+
+// NVME_IOCTL_ADMIN_CMD of linux/nvme_ioctl.h, _IOWR('N', 0x41, struct
+// nvme_admin_cmd).
+const nvmeIoctlAdminCmd = 0xC0484E41
+
+// The Get Log Page admin command and the log of the SMART / health
+// information, of the NVMe base specification.
+const (
+	opGetLogPage = 0x02
+	logSmart     = 0x02
+	logSize      = 512
+)
+
+// adminCmd is struct nvme_admin_cmd of linux/nvme_ioctl.h.
+type adminCmd struct {
+	opcode      uint8
+	flags       uint8
+	rsvd1       uint16
+	nsid        uint32
+	cdw2        uint32
+	cdw3        uint32
+	metadata    uint64
+	addr        uint64
+	metadataLen uint32
+	dataLen     uint32
+	cdw10       uint32
+	cdw11       uint32
+	cdw12       uint32
+	cdw13       uint32
+	cdw14       uint32
+	cdw15       uint32
+	timeoutMs   uint32
+	result      uint32
+}
+
+// smartLog is the part of the SMART / health log that is exported.
+type smartLog struct {
+	criticalWarning float64
+	temperature     float64 // Kelvin
+	availableSpare  float64
+	spareThreshold  float64
+	percentageUsed  float64
+	unsafeShutdowns float64
+	mediaErrors     float64
+}
+
+type controller struct {
+	name   string // nvme0
+	path   string // /dev/nvme0
+	serial string
+
+	sysfsOnly bool // the log cannot be read, see Scrape
+}
+
+type Sensor struct {
+	controllers []*controller
+}
+
+func NewSensor(opts string) (sensor.Collector, error) {
+	var paths []string
+	for _, opt := range strings.Split(opts, ",") {
+		if opt == "" {
+			continue
+		}
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 || kv[0] != "device" || kv[1] == "" {
+			return nil, errors.New("Nvme, unknown option: " + opt)
+		}
+		paths = append(paths, kv[1])
+	}
+	if len(paths) == 0 {
+		names, err := filepath.Glob(filepath.Join(sysfsRoot, "nvme*"))
+		if err != nil || len(names) == 0 {
+			return nil, errors.New("Nvme, found no controller in " + sysfsRoot)
+		}
+		for _, name := range names {
+			paths = append(paths, "/dev/"+filepath.Base(name))
+		}
+	}
+	s := &Sensor{}
+	for _, path := range paths {
+		name := filepath.Base(path)
+		if !strings.HasPrefix(name, "nvme") {
+			return nil, errors.New("Nvme, expected a controller like /dev/nvme0, got: " + path)
+		}
+		if !strings.HasPrefix(path, "/") {
+			path = "/dev/" + name
+		}
+		c := &controller{name: name, path: path, serial: readSysfs(name, "serial")}
+		if c.serial == "" {
+			slog.Warn("Nvme could not read the serial number", "device", path)
+		}
+		s.controllers = append(s.controllers, c)
+	}
+	return s, nil
+}
+
+func (s *Sensor) Scrape() (out []sensor.Sample, e error) {
+	for _, c := range s.controllers {
+		labels := sensor.Labels{"device": c.name, "serial": c.serial}
+		if !c.sysfsOnly {
+			log, err := readSmartLog(c.path)
+			if err == nil {
+				out = append(out, sensor.Sample{Name: "nvme_temperature_celsius", Labels: labels, Value: log.temperature - 273.15},
+					sensor.Sample{Name: "nvme_life_used_percent", Labels: labels, Value: log.percentageUsed},
+					sensor.Sample{Name: "nvme_available_spare_percent", Labels: labels, Value: log.availableSpare},
+					sensor.Sample{Name: "nvme_available_spare_threshold_percent", Labels: labels, Value: log.spareThreshold},
+					sensor.Sample{Name: "nvme_critical_warning", Labels: labels, Value: log.criticalWarning},
+					sensor.Sample{Name: "nvme_media_errors_total", Labels: labels, Value: log.mediaErrors},
+					sensor.Sample{Name: "nvme_unsafe_shutdowns_total", Labels: labels, Value: log.unsafeShutdowns})
+				continue
+			}
+			if errors.Is(err, os.ErrPermission) {
+				// It stays so, do not try every scrape.
+				c.sysfsOnly = true
+				slog.Warn("Nvme may not read the SMART log, exporting the temperature of sysfs only", "device", c.path, "err", err)
+			} else {
+				sensor.Incident()
+				slog.Error("Nvme could not read the SMART log", "device", c.path, "err", err)
+			}
+		}
+		celsius, err := readTemperature(c.name)
+		if err != nil {
+			sensor.Incident()
+			slog.Error("Nvme could not read the temperature", "device", c.path, "err", err)
+			continue
+		}
+		out = append(out, sensor.Sample{Name: "nvme_temperature_celsius", Labels: labels, Value: celsius})
+	}
+	return out, nil
+}
+
+// readSmartLog reads the SMART / health log of the controller at path.
+func readSmartLog(path string) (smartLog, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return smartLog{}, err
+	}
+	defer f.Close()
+	b := make([]byte, logSize)
+	cmd := adminCmd{opcode: opGetLogPage, nsid: 0xffffffff,
+		addr: uint64(uintptr(unsafe.Pointer(&b[0]))), dataLen: logSize,
+		// The number of dwords, zero based, and the log.
+		cdw10: (logSize/4-1)<<16 | logSmart}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), nvmeIoctlAdminCmd, uintptr(unsafe.Pointer(&cmd)))
+	if errno != 0 {
+		return smartLog{}, fmt.Errorf("get log page: %w", errno)
+	}
+	if cmd.result != 0 {
+		return smartLog{}, fmt.Errorf("get log page: status 0x%x", cmd.result)
+	}
+	return parseSmartLog(b), nil
+}
+
+// parseSmartLog decodes the log, little endian. The counters are 128 bits
+// wide; their upper halves are left out.
+func parseSmartLog(b []byte) smartLog {
+	return smartLog{
+		criticalWarning: float64(b[0]),
+		temperature:     float64(binary.LittleEndian.Uint16(b[1:3])),
+		availableSpare:  float64(b[3]),
+		spareThreshold:  float64(b[4]),
+		percentageUsed:  float64(b[5]),
+		unsafeShutdowns: float64(binary.LittleEndian.Uint64(b[144:152])),
+		mediaErrors:     float64(binary.LittleEndian.Uint64(b[160:168])),
+	}
+}
+
+// readTemperature reads the composite temperature of a controller from its
+// hwmon device, temp1.
+func readTemperature(name string) (float64, error) {
+	files, _ := filepath.Glob(filepath.Join(sysfsRoot, name, "hwmon*", "temp1_input"))
+	if len(files) == 0 {
+		// Before Linux 5.10 hwmon is under the PCI device.
+		files, _ = filepath.Glob(filepath.Join(sysfsRoot, name, "device", "hwmon", "hwmon*", "temp1_input"))
+	}
+	if len(files) == 0 {
+		return 0, errors.New("no hwmon device in sysfs")
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		return 0, err
+	}
+	millis, err := strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+	if err != nil {
+		return 0, err
+	}
+	return millis / 1000, nil
+}
+
+// readSysfs reads an attribute of a controller, like serial, trimmed.
+func readSysfs(name, attr string) string {
+	data, err := os.ReadFile(filepath.Join(sysfsRoot, name, attr))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// Collector is the nvme sensor, for the main package to register.
+var Collector = sensor.CollectorEntry{
+	Name:            "nvme",
+	New:             NewSensor,
+	DefaultInterval: suggestedScrapeInterval,
+	Type: []string{"# TYPE nvme_temperature_celsius gauge",
+		"# TYPE nvme_life_used_percent gauge",
+		"# TYPE nvme_available_spare_percent gauge",
+		"# TYPE nvme_available_spare_threshold_percent gauge",
+		"# TYPE nvme_critical_warning gauge",
+		"# TYPE nvme_media_errors_total counter",
+		"# TYPE nvme_unsafe_shutdowns_total counter"},
+	Help: []string{"# HELP nvme_temperature_celsius Composite temperature of the controller.",
+		"# HELP nvme_life_used_percent Percentage used of the rated life, may exceed 100.",
+		"# HELP nvme_available_spare_percent Remaining spare capacity.",
+		"# HELP nvme_available_spare_threshold_percent Available spare below which the controller warns.",
+		"# HELP nvme_critical_warning Critical warning bits: 1 spare low, 2 temperature, 4 reliability degraded, 8 read only, 16 volatile backup failed.",
+		"# HELP nvme_media_errors_total Unrecovered data integrity errors.",
+		"# HELP nvme_unsafe_shutdowns_total Power losses without a shutdown notification."},
+	Unit: []string{"# UNIT nvme_temperature_celsius celsius",
+		"# UNIT nvme_life_used_percent percent",
+		"# UNIT nvme_available_spare_percent percent",
+		"# UNIT nvme_available_spare_threshold_percent percent"},
+	Description: description,
+	Ranges: map[string]sensor.Range{
+		"nvme_available_spare_percent":           {Min: 0, Max: 100},
+		"nvme_available_spare_threshold_percent": {Min: 0, Max: 100},
+		"nvme_life_used_percent":                 {Min: 0, Max: 255},
+	},
+}
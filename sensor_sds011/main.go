@@ -0,0 +1,249 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package sensor_sds011 reads particulate matter (PM2.5 and PM10) from a Nova
+Fitness SDS011 sensor connected over its USB-serial adapter.
+
+The sensor sends a 10 byte frame every second in its default active mode:
+
+	AA C0 PM25_LO PM25_HI PM10_LO PM10_HI ID_LO ID_HI CHECKSUM AB
+
+A background reader keeps the frames coming in and every scrape exposes the
+average of the frames received since the previous one. From those the air
+quality index is computed, on the US EPA scale unless set otherwise, as an
+instantaneous index rather than from the 24 hour averages of the scales:
+
+	sensor_exporter sds011,,device=/dev/ttyUSB0,aqi=caqi
+
+A sensor far from the server can be read through a serial to network bridge
+like ser2net or esp-link, set to 9600 8N1: device=tcp://host:port.
+*/
+package sensor_sds011
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+	"github.com/fmoessbauer/sensor_exporter/serial"
+)
+
+var suggestedScrapeInterval = time.Duration(10 * time.Second)
+var description = `Sds011 reads PM2.5 and PM10 from a Nova Fitness SDS011 particulate sensor on a
+serial port and exposes the air quality index derived from them. Options are
+device (default /dev/ttyUSB0, or tcp://host:port of a ser2net bridge) and aqi, one of epa (default), caqi, indoor or off:
+
+  sensor_exporter sds011,,device=/dev/ttyUSB0,aqi=epa`
+
+var defaultDevice = "/dev/ttyUSB0"
+
+type Sensor struct {
+	// The readings of the frames since the last scrape, two per frame.
+	*sensor.Buffer
+
+	Device string
+	Labels sensor.Labels
+	Scale  string
+
+	mutex       *sync.Mutex
+	readerError error
+	received    time.Time
+	port        io.ReadWriteCloser // open, nil while closed
+	stopped     bool
+}
+
+func NewSensor(opts string) (sensor.Collector, error) {
+	s := &Sensor{Buffer: sensor.NewBuffer(0), Device: defaultDevice, Scale: sensor.AQIEPA, mutex: &sync.Mutex{}}
+	for _, opt := range strings.Split(opts, ",") {
+		if opt == "" {
+			continue
+		}
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("Sds011, could not understand option: " + opt)
+		}
+		switch kv[0] {
+		case "device":
+			s.Device = kv[1]
+		case "aqi":
+			if kv[1] != sensor.AQIEPA && kv[1] != sensor.AQICAQI && kv[1] != sensor.AQIIndoor && kv[1] != "off" {
+				return nil, errors.New("Sds011, unknown aqi scale: " + kv[1])
+			}
+			s.Scale = kv[1]
+		default:
+			return nil, errors.New("Sds011, unknown option: " + kv[0])
+		}
+	}
+	s.Labels = sensor.Labels{"device": s.Device}
+
+	port, err := serial.Connect(s.Device, serial.Config{Baud: 9600})
+	if err != nil {
+		return nil, errors.New("Sds011 could not open serial port: " + err.Error())
+	}
+	s.port = port
+	return s, nil
+}
+
+// Start parses frames from the port, reopened if it was closed, until it
+// fails or Stop is called.
+func (s *Sensor) Start() error {
+	s.mutex.Lock()
+	port := s.port
+	s.mutex.Unlock()
+	if port == nil {
+		var err error
+		if port, err = serial.Connect(s.Device, serial.Config{Baud: 9600}); err != nil {
+			return err
+		}
+	}
+	s.mutex.Lock()
+	if s.stopped {
+		s.mutex.Unlock()
+		return port.Close()
+	}
+	s.port = port
+	s.mutex.Unlock()
+
+	err := s.readFrames(bufio.NewReader(port))
+	port.Close()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.port = nil
+	if s.stopped {
+		return nil
+	}
+	s.readerError = err
+	return err
+}
+
+// Stop closes the port, for Start to return.
+func (s *Sensor) Stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stopped = true
+	if s.port != nil {
+		s.port.Close()
+	}
+}
+
+func (s *Sensor) Received() time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.received
+}
+
+func (s *Sensor) readFrames(r *bufio.Reader) error {
+	frame := make([]byte, 10)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b != 0xAA {
+			continue
+		}
+		frame[0] = b
+		for i := 1; i < 10; i++ {
+			if frame[i], err = r.ReadByte(); err != nil {
+				return err
+			}
+		}
+		pm25, pm10, ok := parseFrame(frame)
+		if !ok {
+			continue
+		}
+		s.Add(sensor.Sample{Name: "pm2.5", Value: pm25}, sensor.Sample{Name: "pm10", Value: pm10})
+		s.mutex.Lock()
+		s.readerError = nil
+		s.received = time.Now()
+		s.mutex.Unlock()
+	}
+}
+
+// parseFrame checks a data frame and returns its readings in µg/m³.
+func parseFrame(f []byte) (pm25, pm10 float64, ok bool) {
+	if len(f) != 10 || f[0] != 0xAA || f[1] != 0xC0 || f[9] != 0xAB {
+		return 0, 0, false
+	}
+	var sum byte
+	for _, b := range f[2:8] {
+		sum += b
+	}
+	if sum != f[8] {
+		return 0, 0, false
+	}
+	pm25 = float64(int(f[3])<<8|int(f[2])) / 10
+	pm10 = float64(int(f[5])<<8|int(f[4])) / 10
+	return pm25, pm10, true
+}
+
+func (s *Sensor) Scrape() (out []sensor.Sample, e error) {
+	var pm25, pm10 float64
+	var n25, n10 int
+	for _, r := range s.Drain() {
+		if r.Name == "pm2.5" {
+			pm25, n25 = pm25+r.Value, n25+1
+		} else {
+			pm10, n10 = pm10+r.Value, n10+1
+		}
+	}
+	s.mutex.Lock()
+	readerError := s.readerError
+	s.mutex.Unlock()
+
+	if n25 == 0 || n10 == 0 {
+		sensor.Incident()
+		if readerError != nil {
+			slog.Error("Sds011 sent no data", "device", s.Device, "err", readerError)
+		} else {
+			slog.Error("Sds011 sent no data since last scrape", "device", s.Device)
+		}
+		return nil, nil
+	}
+	pm25 /= float64(n25)
+	pm10 /= float64(n10)
+
+	out = append(out, sensor.Sample{Name: "particulate_matter_micrograms_per_cubic_meter",
+		Labels: s.Labels.With("size", "pm2.5"), Value: pm25})
+	out = append(out, sensor.Sample{Name: "particulate_matter_micrograms_per_cubic_meter",
+		Labels: s.Labels.With("size", "pm10"), Value: pm10})
+	if s.Scale != "off" {
+		out = append(out, sensor.AirQualityDerived(s.Labels, s.Scale,
+			map[string]float64{sensor.PM25: pm25, sensor.PM10: pm10})...)
+	}
+	return out, nil
+}
+
+// Collector is the sds011 sensor, for the main package to register.
+var Collector = sensor.CollectorEntry{
+	Name:            "sds011",
+	New:             NewSensor,
+	DefaultInterval: suggestedScrapeInterval,
+	Type:            append([]string{"# TYPE particulate_matter_micrograms_per_cubic_meter gauge"}, sensor.AQITypes...),
+	Help:            append([]string{"# HELP particulate_matter_micrograms_per_cubic_meter Mass concentration of particulate matter averaged since the last scrape."}, sensor.AQIHelp...),
+	Unit:            []string{"# UNIT particulate_matter_micrograms_per_cubic_meter micrograms_per_cubic_meter"},
+	Description:     description,
+	// The fan needs 30s to give stable readings, says the datasheet.
+	WarmUp: 30 * time.Second,
+	Ranges: map[string]sensor.Range{"particulate_matter_micrograms_per_cubic_meter": {Min: 0, Max: 999.9}},
+}
@@ -0,0 +1,507 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package sensor_sgp reads the Sensirion SGP30 and SGP40 VOC sensors over I2C.
+It registers two sensors, sgp30 and sgp40.
+
+Both chips must be measured every second for their baseline algorithms to
+work, so a background loop does that and scrapes return the latest values.
+
+The SGP30 computes eCO2 and TVOC itself, but it needs about 12 hours to learn
+its baseline after every power up. With the state option the baseline is
+stored hourly and restored on start (if less than a week old), as Sensirion
+recommends:
+
+	sensor_exporter sgp30,,bus=1,state=/var/lib/sensor_exporter/sgp30.json
+
+The SGP40 only returns a raw signal. The VOC index is computed here: it is
+100 for the average air of the last hours, lower for cleaner and up to 500
+for worse air. It is a simpler version of Sensirion's gas index algorithm,
+the numbers are comparable but not identical. Its learned mean and spread
+are kept in the state file too.
+
+Both chips read better when they know the air humidity. Set compensate to the
+name of a hwmon chip with temperature and humidity (see the humidity sensor)
+and it will be used, e.g. compensate=sht3x.
+*/
+package sensor_sgp
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/hwmon"
+	"github.com/fmoessbauer/sensor_exporter/i2c"
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+var suggestedScrapeInterval = time.Duration(10 * time.Second)
+var description30 = `Sgp30 reads eCO2 and TVOC from a Sensirion SGP30 on I2C and rates them on the
+indoor air quality index. Options are bus (default 1), address (default
+0x58), state (file to keep the baseline in), compensate (a hwmon chip with
+temperature and humidity) and aqi=off to leave out the index:
+
+  sensor_exporter sgp30,,bus=1,state=/var/lib/sensor_exporter/sgp30.json`
+var description40 = `Sgp40 reads a Sensirion SGP40 on I2C and computes a VOC index from it (100 is
+the usual air, up to 500 is worse). Options are bus (default 1), address
+(default 0x59), state (file to keep the learned mean in) and compensate (a
+hwmon chip with temperature and humidity):
+
+  sensor_exporter sgp40,,bus=1,compensate=sht3x`
+
+// How often the state is stored and how old it may be to be restored.
+var (
+	stateInterval = time.Hour
+	stateMaxAge   = 7 * 24 * time.Hour
+	// The SGP30 needs this long to learn a baseline of its own.
+	sgp30LearnTime = 12 * time.Hour
+)
+
+type Sensor struct {
+	model      string
+	dev        *i2c.Device
+	labels     sensor.Labels
+	stateFile  string
+	compensate []hwmon.Channel
+	aqi        bool // export the indoor air quality index, sgp30 only
+
+	mutex   sync.Mutex
+	valid   bool
+	lastErr error
+	eco2    float64
+	tvoc    float64
+	raw     float64
+	voc     vocIndex
+
+	stop     chan struct{}
+	done     chan struct{} // closed when the loop returned
+	stopOnce sync.Once
+}
+
+// State is what is kept in the state file.
+type State struct {
+	Saved        time.Time
+	BaselineECO2 uint16  `json:",omitempty"`
+	BaselineTVOC uint16  `json:",omitempty"`
+	VOCMean      float64 `json:",omitempty"`
+	VOCVar       float64 `json:",omitempty"`
+}
+
+func newSensor(model string, address int, opts string) (*Sensor, error) {
+	bus := 1
+	aqi := model == "sgp30"
+	var stateFile, chip string
+	for _, opt := range strings.Split(opts, ",") {
+		if opt == "" {
+			continue
+		}
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("Sgp, could not understand option: " + opt)
+		}
+		var err error
+		switch kv[0] {
+		case "bus":
+			_, err = fmt.Sscanf(kv[1], "%d", &bus)
+		case "address":
+			address, err = i2c.ParseAddress(kv[1])
+		case "state":
+			stateFile = kv[1]
+		case "compensate":
+			chip = kv[1]
+		case "aqi":
+			switch {
+			case model != "sgp30":
+				err = errors.New("only the sgp30 reads gases the index rates")
+			case kv[1] == sensor.AQIIndoor:
+				aqi = true
+			case kv[1] == "off":
+				aqi = false
+			default:
+				err = errors.New("expected indoor or off")
+			}
+		default:
+			err = errors.New("unknown option")
+		}
+		if err != nil {
+			return nil, errors.New("Sgp, bad option " + opt + ": " + err.Error())
+		}
+	}
+
+	s := &Sensor{model: model, stateFile: stateFile, aqi: aqi, stop: make(chan struct{}), done: make(chan struct{})}
+	if chip != "" {
+		var err error
+		s.compensate, err = compensationChannels(chip)
+		if err != nil {
+			return nil, errors.New("Sgp could not find compensation chip: " + err.Error())
+		}
+	}
+	dev, err := i2c.Open(bus, address)
+	if err != nil {
+		return nil, errors.New("Sgp could not open i2c device: " + err.Error())
+	}
+	s.dev = dev
+	s.labels = sensor.Labels{"device": dev.String()}
+	return s, nil
+}
+
+// compensationChannels returns the temp1 and humidity1 channels of a chip.
+func compensationChannels(chip string) ([]hwmon.Channel, error) {
+	t, err := hwmon.Find(chip + "/temp1")
+	if err != nil {
+		return nil, err
+	}
+	h, err := hwmon.Find(chip + "/humidity1")
+	if err != nil {
+		return nil, err
+	}
+	return []hwmon.Channel{t, h}, nil
+}
+
+// climate reads the compensation chip. Without one it returns the defaults
+// the chips assume: 25°C, 50%.
+func (s *Sensor) climate() (tempC, rh float64, ok bool) {
+	if s.compensate == nil {
+		return 25, 50, false
+	}
+	t, err := s.compensate[0].Read("input")
+	if err != nil {
+		return 25, 50, false
+	}
+	h, err := s.compensate[1].Read("input")
+	if err != nil {
+		return 25, 50, false
+	}
+	return t, h, true
+}
+
+func (s *Sensor) loadState() (State, bool) {
+	var st State
+	if s.stateFile == "" {
+		return st, false
+	}
+	if err := sensor.LoadState(s.stateFile, &st); err != nil {
+		slog.Info("Restored no state", "model", s.model, "device", s.dev, "err", err)
+		return st, false
+	}
+	if time.Since(st.Saved) > stateMaxAge {
+		slog.Info("State is too old, not restored", "model", s.model, "device", s.dev, "file", s.stateFile)
+		return st, false
+	}
+	return st, true
+}
+
+func (s *Sensor) saveState(st State) {
+	if s.stateFile == "" {
+		return
+	}
+	st.Saved = time.Now()
+	if err := sensor.SaveState(s.stateFile, st); err != nil {
+		sensor.Incident()
+		slog.Warn("Could not save state", "model", s.model, "device", s.dev, "err", err)
+	}
+}
+
+// command writes a command word with optional data words, each followed by
+// its CRC, waits and reads n data words back.
+func (s *Sensor) command(cmd uint16, data []uint16, wait time.Duration, n int) ([]uint16, error) {
+	buf := []byte{byte(cmd >> 8), byte(cmd)}
+	for _, d := range data {
+		w := []byte{byte(d >> 8), byte(d)}
+		buf = append(buf, w[0], w[1], crc8(w))
+	}
+	if err := s.dev.Write(buf); err != nil {
+		return nil, err
+	}
+	time.Sleep(wait)
+	if n == 0 {
+		return nil, nil
+	}
+	resp := make([]byte, 3*n)
+	if err := s.dev.Read(resp); err != nil {
+		return nil, err
+	}
+	words := make([]uint16, n)
+	for i := range words {
+		w := resp[3*i : 3*i+3]
+		if crc8(w[:2]) != w[2] {
+			return nil, errors.New("crc mismatch")
+		}
+		words[i] = uint16(w[0])<<8 | uint16(w[1])
+	}
+	return words, nil
+}
+
+// crc8 is Sensirion's CRC-8, polynomial 0x31, init 0xFF.
+func crc8(b []byte) byte {
+	crc := byte(0xFF)
+	for _, v := range b {
+		crc ^= v
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x31
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func (s *Sensor) setResult(err error) {
+	s.mutex.Lock()
+	s.lastErr = err
+	if err == nil {
+		s.valid = true
+	}
+	s.mutex.Unlock()
+	if err != nil {
+		slog.Error("Measurement failed", "model", s.model, "device", s.dev, "err", err)
+	}
+}
+
+func NewSGP30(opts string) (sensor.Collector, error) {
+	s, err := newSensor("sgp30", 0x58, opts)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = s.command(0x2003, nil, 10*time.Millisecond, 0); err != nil { // sgp30_iaq_init
+		s.dev.Close()
+		return nil, errors.New("Sgp30 could not initialize: " + err.Error())
+	}
+	st, restored := s.loadState()
+	if restored && st.BaselineECO2 != 0 {
+		// set_iaq_baseline takes TVOC first, the reverse of get_iaq_baseline.
+		_, err = s.command(0x201e, []uint16{st.BaselineTVOC, st.BaselineECO2}, 10*time.Millisecond, 0)
+		if err != nil {
+			slog.Warn("Sgp30 could not restore baseline", "device", s.dev, "err", err)
+			restored = false
+		}
+	}
+	go s.loop30(restored)
+	return s, nil
+}
+
+func (s *Sensor) loop30(restored bool) {
+	defer close(s.done)
+	start := time.Now()
+	lastSave := start
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-tick.C:
+		}
+		if t, rh, ok := s.climate(); ok {
+			ah := sensor.AbsoluteHumidity(t, rh)
+			// 8.8 fixed point g/m³, 0 would disable the compensation.
+			fixed := uint16(math.Max(math.Min(ah*256, 0xFFFF), 1))
+			if _, err := s.command(0x2061, []uint16{fixed}, 10*time.Millisecond, 0); err != nil {
+				s.setResult(err)
+				continue
+			}
+		}
+		w, err := s.command(0x2008, nil, 12*time.Millisecond, 2) // sgp30_measure_iaq
+		if err != nil {
+			s.setResult(err)
+			continue
+		}
+		s.mutex.Lock()
+		s.eco2, s.tvoc = float64(w[0]), float64(w[1])
+		s.mutex.Unlock()
+		s.setResult(nil)
+
+		if time.Since(lastSave) >= stateInterval && (restored || time.Since(start) >= sgp30LearnTime) {
+			lastSave = time.Now()
+			b, err := s.command(0x2015, nil, 10*time.Millisecond, 2) // sgp30_get_iaq_baseline
+			if err != nil {
+				slog.Warn("Sgp30 could not read baseline", "device", s.dev, "err", err)
+				continue
+			}
+			s.saveState(State{BaselineECO2: b[0], BaselineTVOC: b[1]})
+		}
+	}
+}
+
+func NewSGP40(opts string) (sensor.Collector, error) {
+	s, err := newSensor("sgp40", 0x59, opts)
+	if err != nil {
+		return nil, err
+	}
+	if st, restored := s.loadState(); restored && st.VOCVar > 0 {
+		s.voc = vocIndex{mean: st.VOCMean, variance: st.VOCVar, samples: vocBlackout}
+	}
+	go s.loop40()
+	return s, nil
+}
+
+func (s *Sensor) loop40() {
+	defer close(s.done)
+	lastSave := time.Now()
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-s.stop:
+			// Keep what was learned since the last save for the next start.
+			s.mutex.Lock()
+			st := State{VOCMean: s.voc.mean, VOCVar: s.voc.variance}
+			s.mutex.Unlock()
+			if st.VOCVar > 0 {
+				s.saveState(st)
+			}
+			return
+		case <-tick.C:
+		}
+		t, rh, _ := s.climate()
+		rhTicks := uint16(math.Max(math.Min(rh, 100), 0) * 65535 / 100)
+		tTicks := uint16(math.Max(math.Min(t+45, 175), 0) * 65535 / 175)
+		w, err := s.command(0x260f, []uint16{rhTicks, tTicks}, 30*time.Millisecond, 1) // sgp40_measure_raw
+		if err != nil {
+			s.setResult(err)
+			continue
+		}
+		s.mutex.Lock()
+		s.raw = float64(w[0])
+		s.voc.add(s.raw)
+		st := State{VOCMean: s.voc.mean, VOCVar: s.voc.variance}
+		s.mutex.Unlock()
+		s.setResult(nil)
+
+		if time.Since(lastSave) >= stateInterval {
+			lastSave = time.Now()
+			s.saveState(st)
+		}
+	}
+}
+
+// Close stops the measurements and closes the device.
+func (s *Sensor) Close() error {
+	var err error
+	s.stopOnce.Do(func() {
+		close(s.stop)
+		<-s.done
+		err = s.dev.Close()
+	})
+	return err
+}
+
+// The first samples after power up are not representative.
+const vocBlackout = 45
+
+// vocIndex learns the usual raw signal of an SGP40 and maps the current
+// signal to an index around 100. More VOCs mean a lower raw signal.
+type vocIndex struct {
+	mean, variance float64
+	samples        int
+}
+
+// The learning time constant is 12 hours of one second samples.
+var vocAlpha = 1.0 / (12 * 3600)
+
+func (v *vocIndex) add(raw float64) {
+	v.samples++
+	if v.samples < vocBlackout {
+		return
+	}
+	if v.samples == vocBlackout && v.variance == 0 {
+		v.mean, v.variance = raw, 100*100 // Typical spread to start from
+		return
+	}
+	// A plain average at first, then settle to the long time constant.
+	alpha := math.Max(vocAlpha, 1/float64(v.samples-vocBlackout+1))
+	d := raw - v.mean
+	v.mean += alpha * d
+	v.variance = (1 - alpha) * (v.variance + alpha*d*d)
+}
+
+func (v *vocIndex) index(raw float64) (float64, bool) {
+	if v.samples < vocBlackout || v.variance <= 0 {
+		return 0, false
+	}
+	z := (v.mean - raw) / math.Sqrt(v.variance)
+	// A logistic curve through 100 at z=0, saturating at 500.
+	return math.Max(1, 500/(1+4*math.Exp(-0.8*z))), true
+}
+
+func (s *Sensor) Scrape() (out []sensor.Sample, e error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.valid || s.lastErr != nil {
+		sensor.Incident()
+		if s.lastErr != nil {
+			slog.Error("No reading", "model", s.model, "device", s.dev, "err", s.lastErr)
+		}
+		return nil, nil
+	}
+	switch s.model {
+	case "sgp30":
+		out = append(out, sensor.Sample{Name: "gas_eco2_ppm", Labels: s.labels, Value: s.eco2})
+		out = append(out, sensor.Sample{Name: "gas_tvoc_ppb", Labels: s.labels, Value: s.tvoc})
+		if s.aqi {
+			out = append(out, sensor.AirQualityDerived(s.labels, sensor.AQIIndoor,
+				map[string]float64{sensor.TVOC: s.tvoc, sensor.CO2: s.eco2})...)
+		}
+	case "sgp40":
+		out = append(out, sensor.Sample{Name: "gas_voc_raw_ticks", Labels: s.labels, Value: s.raw})
+		if index, ok := s.voc.index(s.raw); ok {
+			out = append(out, sensor.Sample{Name: "gas_voc_index", Labels: s.labels, Value: index})
+		}
+	}
+	return out, nil
+}
+
+// SGP30 is the sgp30 sensor, for the main package to register.
+var SGP30 = sensor.CollectorEntry{
+	Name:            "sgp30",
+	New:             NewSGP30,
+	DefaultInterval: suggestedScrapeInterval,
+	Type: append([]string{"# TYPE gas_eco2_ppm gauge",
+		"# TYPE gas_tvoc_ppb gauge"}, sensor.AQITypes...),
+	Help: append([]string{"# HELP gas_eco2_ppm Equivalent CO2 estimated from the VOC signal.",
+		"# HELP gas_tvoc_ppb Total volatile organic compounds."}, sensor.AQIHelp...),
+	Unit: []string{"# UNIT gas_eco2_ppm ppm",
+		"# UNIT gas_tvoc_ppb ppb"},
+	Description: description30,
+	// For 15s after init the SGP30 returns 400 ppm and 0 ppb.
+	WarmUp: 15 * time.Second,
+	// The measurement range of the datasheet.
+	Ranges: map[string]sensor.Range{
+		"gas_eco2_ppm": {Min: 400, Max: 60000},
+		"gas_tvoc_ppb": {Min: 0, Max: 60000},
+	},
+}
+
+// SGP40 is the sgp40 sensor, for the main package to register.
+var SGP40 = sensor.CollectorEntry{
+	Name:            "sgp40",
+	New:             NewSGP40,
+	DefaultInterval: suggestedScrapeInterval,
+	Type: []string{"# TYPE gas_voc_raw_ticks gauge",
+		"# TYPE gas_voc_index gauge"},
+	Help: []string{"# HELP gas_voc_raw_ticks Raw signal of the VOC sensor, lower means more VOCs.",
+		"# HELP gas_voc_index VOC index, 100 is the usual air of the last hours, up to 500 is worse."},
+	Description: description40,
+}
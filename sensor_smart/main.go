@@ -0,0 +1,296 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package sensor_smart reads SMART health data of disks with smartctl from
+smartmontools, using its JSON output (smartmontools 7.0 or newer).
+
+Every scrape runs smartctl -i -H -A -j for each device and exports the drive
+temperature, power-on time, overall health, reallocated sectors and, for
+SSDs, how much of their rated life is used, plus the normalized, threshold
+and raw values of every ATA attribute. Readings are labeled with the device
+and the model.
+
+Devices are given with the device option, as a path or path:type where type
+is a smartctl -d device type. Without devices, those found by smartctl --scan
+at startup are used:
+
+	sensor_exporter smart
+	sensor_exporter smart,,device=/dev/sda,device=/dev/sdb:sat,device=/dev/nvme0
+
+Disks in standby are not woken up (-n standby) and have no readings until
+they spin up again. smartctl usually needs root.
+*/
+package sensor_smart
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+var suggestedScrapeInterval = time.Duration(5 * time.Minute)
+var description = `Smart reads SMART health data of disks with smartctl -j (smartmontools 7.0+):
+temperature, power-on time, health, reallocated sectors, SSD wear and all ATA
+attributes. Options: device=path[:type] (repeatable, default the devices of
+smartctl --scan), smartctl=path of the program. Disks in standby are not woken.
+
+  sensor_exporter smart
+  sensor_exporter smart,,device=/dev/sda,device=/dev/nvme0`
+
+var timeOut = 30 * time.Second
+
+// ATA attributes whose normalized value is the remaining life of an SSD, in
+// percent, by vendor: Samsung, Intel, Crucial/Micron, SandForce.
+var lifeAttributes = []int{177, 233, 202, 231}
+
+// Bits of the smartctl exit status that mean the device was not read.
+const exitFailed = 1 | 2
+
+type device struct {
+	path, kind string
+}
+
+type Sensor struct {
+	Smartctl string
+	devices  []device
+}
+
+// report is the part of the smartctl JSON output that is exported.
+type report struct {
+	Smartctl struct {
+		ExitStatus int `json:"exit_status"`
+		Messages   []struct {
+			String string `json:"string"`
+		} `json:"messages"`
+	} `json:"smartctl"`
+	ModelName   string `json:"model_name"`
+	SmartStatus *struct {
+		Passed bool `json:"passed"`
+	} `json:"smart_status"`
+	Temperature *struct {
+		Current float64 `json:"current"`
+	} `json:"temperature"`
+	PowerOnTime *struct {
+		Hours float64 `json:"hours"`
+	} `json:"power_on_time"`
+	ATA *struct {
+		Table []struct {
+			ID     int     `json:"id"`
+			Name   string  `json:"name"`
+			Value  float64 `json:"value"`
+			Thresh float64 `json:"thresh"`
+			Raw    struct {
+				Value float64 `json:"value"`
+			} `json:"raw"`
+		} `json:"table"`
+	} `json:"ata_smart_attributes"`
+	NVMe *struct {
+		PercentageUsed *float64 `json:"percentage_used"`
+		AvailableSpare *float64 `json:"available_spare"`
+		MediaErrors    *float64 `json:"media_errors"`
+	} `json:"nvme_smart_health_information_log"`
+}
+
+func NewSensor(opts string) (sensor.Collector, error) {
+	s := &Sensor{Smartctl: "smartctl"}
+	for _, opt := range strings.Split(opts, ",") {
+		if opt == "" {
+			continue
+		}
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("Smart, could not understand option: " + opt)
+		}
+		switch kv[0] {
+		case "device":
+			d := strings.SplitN(kv[1], ":", 2)
+			dev := device{path: d[0]}
+			if len(d) == 2 {
+				dev.kind = d[1]
+			}
+			s.devices = append(s.devices, dev)
+		case "smartctl":
+			s.Smartctl = kv[1]
+		default:
+			return nil, errors.New("Smart, unknown option: " + kv[0])
+		}
+	}
+	if _, err := exec.LookPath(s.Smartctl); err != nil {
+		return nil, errors.New("Smart needs smartctl from smartmontools: " + err.Error())
+	}
+	if len(s.devices) == 0 {
+		devices, err := s.scan()
+		if err != nil {
+			return nil, errors.New("Smart could not scan for devices: " + err.Error())
+		}
+		s.devices = devices
+	}
+	if len(s.devices) == 0 {
+		return nil, errors.New("Smart could not find any devices.")
+	}
+	for _, d := range s.devices {
+		slog.Info("Smart reading disk", "device", d.path, "type", d.kind)
+	}
+	return s, nil
+}
+
+// scan returns the devices smartctl finds.
+func (s *Sensor) scan() ([]device, error) {
+	out, err := s.run("--scan", "-j")
+	if err != nil {
+		return nil, err
+	}
+	var scan struct {
+		Devices []struct {
+			Name string `json:"name"`
+			Type string `json:"type"`
+		} `json:"devices"`
+	}
+	if err := json.Unmarshal(out, &scan); err != nil {
+		return nil, err
+	}
+	var devices []device
+	for _, d := range scan.Devices {
+		devices = append(devices, device{path: d.Name, kind: d.Type})
+	}
+	return devices, nil
+}
+
+// run runs smartctl. A non-zero exit status is not an error as long as
+// there is output, smartctl uses it to report disk problems too.
+func (s *Sensor) run(args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeOut)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, s.Smartctl, args...).Output()
+	if _, exited := err.(*exec.ExitError); exited && len(out) > 0 {
+		err = nil
+	}
+	return out, err
+}
+
+func (s *Sensor) Scrape() (out []sensor.Sample, e error) {
+	for _, d := range s.devices {
+		args := []string{"-i", "-H", "-A", "-j", "-n", "standby,0"}
+		if d.kind != "" {
+			args = append(args, "-d", d.kind)
+		}
+		res, err := s.run(append(args, d.path)...)
+		var r report
+		if err == nil {
+			err = json.Unmarshal(res, &r)
+		}
+		if err == nil && r.Smartctl.ExitStatus&exitFailed != 0 {
+			err = errors.New("smartctl exit status " + strconv.Itoa(r.Smartctl.ExitStatus))
+			if len(r.Smartctl.Messages) > 0 {
+				err = errors.New(r.Smartctl.Messages[0].String)
+			}
+		}
+		if err != nil {
+			sensor.Incident()
+			slog.Error("Smart could not read disk", "device", d.path, "err", err)
+			continue
+		}
+		out = append(out, r.samples(sensor.Labels{"device": d.path, "model": r.ModelName})...)
+	}
+	return out, nil
+}
+
+func (r *report) samples(labels sensor.Labels) (out []sensor.Sample) {
+	if r.SmartStatus != nil {
+		healthy := 0.0
+		if r.SmartStatus.Passed {
+			healthy = 1
+		}
+		out = append(out, sensor.Sample{Name: "smart_healthy", Labels: labels, Value: healthy})
+	}
+	if r.Temperature != nil {
+		out = append(out, sensor.Sample{Name: "smart_temperature_celsius", Labels: labels, Value: r.Temperature.Current})
+	}
+	if r.PowerOnTime != nil {
+		out = append(out, sensor.Sample{Name: "smart_power_on_seconds", Labels: labels, Value: r.PowerOnTime.Hours * 3600})
+	}
+	if r.ATA != nil {
+		lifeFound := false
+		for _, a := range r.ATA.Table {
+			attr := labels.With("id", strconv.Itoa(a.ID), "attribute", a.Name)
+			out = append(out, sensor.Sample{Name: "smart_attribute_value", Labels: attr, Value: a.Value})
+			out = append(out, sensor.Sample{Name: "smart_attribute_threshold", Labels: attr, Value: a.Thresh})
+			out = append(out, sensor.Sample{Name: "smart_attribute_raw", Labels: attr, Value: a.Raw.Value})
+			if a.ID == 5 {
+				out = append(out, sensor.Sample{Name: "smart_reallocated_sectors", Labels: labels, Value: a.Raw.Value})
+			}
+			for _, id := range lifeAttributes {
+				if a.ID == id && !lifeFound {
+					out = append(out, sensor.Sample{Name: "smart_life_used_percent", Labels: labels, Value: 100 - a.Value})
+					lifeFound = true
+				}
+			}
+		}
+	}
+	if n := r.NVMe; n != nil {
+		if n.PercentageUsed != nil {
+			out = append(out, sensor.Sample{Name: "smart_life_used_percent", Labels: labels, Value: *n.PercentageUsed})
+		}
+		if n.AvailableSpare != nil {
+			out = append(out, sensor.Sample{Name: "smart_available_spare_percent", Labels: labels, Value: *n.AvailableSpare})
+		}
+		if n.MediaErrors != nil {
+			out = append(out, sensor.Sample{Name: "smart_media_errors_total", Labels: labels, Value: *n.MediaErrors})
+		}
+	}
+	return out
+}
+
+// Collector is the smart sensor, for the main package to register.
+var Collector = sensor.CollectorEntry{
+	Name:            "smart",
+	New:             NewSensor,
+	DefaultInterval: suggestedScrapeInterval,
+	Type: []string{"# TYPE smart_healthy gauge",
+		"# TYPE smart_temperature_celsius gauge",
+		"# TYPE smart_power_on_seconds gauge",
+		"# TYPE smart_reallocated_sectors gauge",
+		"# TYPE smart_life_used_percent gauge",
+		"# TYPE smart_available_spare_percent gauge",
+		"# TYPE smart_media_errors_total counter",
+		"# TYPE smart_attribute_value gauge",
+		"# TYPE smart_attribute_threshold gauge",
+		"# TYPE smart_attribute_raw gauge"},
+	Help: []string{"# HELP smart_healthy Whether the drive passes its SMART overall health self-assessment.",
+		"# HELP smart_temperature_celsius Current drive temperature.",
+		"# HELP smart_power_on_seconds Time the drive has been powered on, in whole hours.",
+		"# HELP smart_reallocated_sectors Reallocated sectors count, ATA attribute 5.",
+		"# HELP smart_life_used_percent Used rated life of an SSD, percentage used for NVMe, else 100 minus the vendor's wear attribute.",
+		"# HELP smart_available_spare_percent Remaining spare capacity of an NVMe drive.",
+		"# HELP smart_media_errors_total Unrecovered data integrity errors of an NVMe drive.",
+		"# HELP smart_attribute_value Normalized value of an ATA SMART attribute.",
+		"# HELP smart_attribute_threshold Threshold below which the normalized value of an ATA SMART attribute means failure.",
+		"# HELP smart_attribute_raw Raw value of an ATA SMART attribute."},
+	Unit: []string{"# UNIT smart_temperature_celsius celsius",
+		"# UNIT smart_power_on_seconds seconds",
+		"# UNIT smart_life_used_percent percent",
+		"# UNIT smart_available_spare_percent percent"},
+	Description: description,
+}
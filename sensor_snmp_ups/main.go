@@ -0,0 +1,489 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package sensor_snmp_ups reads UPSes and PDUs that only speak SNMP. It queries
+the standard UPS-MIB (RFC 1628) and, for devices without it, the APC
+PowerNet MIB, its UPS part or the load of the outlet banks of APC rack PDUs.
+
+Options, comma separated:
+
+	target=HOST[:PORT]     the device, port 161 by default
+	version=2c|3           SNMP version, 2c by default
+	community=public       v2c community
+	user=NAME              v3 user
+	auth=SHA|MD5|SHA256|.. v3 authentication protocol, with authpass=
+	priv=AES|DES|AES256|.. v3 privacy protocol, with privpass=
+	mib=auto|ups|apc|pdu   which MIB to read, auto tries them in this order
+
+For example:
+
+	sensor_exporter snmp_ups,,target=ups1.rack,community=monitor
+	sensor_exporter snmp_ups,,target=pdu2.rack,version=3,user=mon,auth=SHA,authpass=ENC[...],priv=AES,privpass=ENC[...]
+
+The readings are labeled with the target, and those of output lines or
+outlet banks with the outlet, its index in the MIB.
+*/
+package sensor_snmp_ups
+
+import (
+	"errors"
+	"log/slog"
+	"math"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+	"github.com/gosnmp/gosnmp"
+)
+
+var suggestedScrapeInterval = time.Duration(30 * time.Second)
+var description = `Snmp_ups reads UPSes and PDUs over SNMP v2c or v3, from the UPS-MIB (RFC 1628)
+or the APC PowerNet MIB: battery charge, runtime, input and output voltage
+and load per output line or outlet bank. Options are target, version (2c or
+3), community, user, auth, authpass, priv, privpass and mib (auto, ups, apc
+or pdu):
+
+  sensor_exporter snmp_ups,,target=ups1.rack,community=public`
+
+var timeOut = 5 * time.Second
+
+// OIDs of the UPS-MIB, RFC 1628.
+const (
+	upsMIB                   = ".1.3.6.1.2.1.33.1"
+	upsSecondsOnBattery      = upsMIB + ".2.2.0"
+	upsEstimatedMinutes      = upsMIB + ".2.3.0"
+	upsEstimatedCharge       = upsMIB + ".2.4.0"
+	upsBatteryVoltage        = upsMIB + ".2.5.0" // 0.1 V
+	upsBatteryTemperature    = upsMIB + ".2.7.0"
+	upsInputFrequency        = upsMIB + ".3.3.1.2" // 0.1 Hz, per line
+	upsInputVoltage          = upsMIB + ".3.3.1.3" // per line
+	upsOutputSource          = upsMIB + ".4.1.0"   // 5 is battery
+	upsOutputVoltage         = upsMIB + ".4.4.1.2" // per line
+	upsOutputCurrent         = upsMIB + ".4.4.1.3" // 0.1 A, per line
+	upsOutputPower           = upsMIB + ".4.4.1.4" // W, per line
+	upsOutputPercentLoad     = upsMIB + ".4.4.1.5" // per line
+	upsOutputSourceBattery   = 5
+	apcUPS                   = ".1.3.6.1.4.1.318.1.1.1"
+	apcBasicOutputStatus     = apcUPS + ".4.1.1.0" // 3 is on battery
+	apcBatteryCapacity       = apcUPS + ".2.2.1.0"
+	apcBatteryTemperature    = apcUPS + ".2.2.2.0"
+	apcBatteryRunTime        = apcUPS + ".2.2.3.0" // timeticks
+	apcBatteryTimeOn         = apcUPS + ".2.1.2.0" // timeticks
+	apcInputLineVoltage      = apcUPS + ".3.2.1.0"
+	apcInputFrequency        = apcUPS + ".3.2.4.0"
+	apcOutputVoltage         = apcUPS + ".4.2.1.0"
+	apcOutputLoad            = apcUPS + ".4.2.3.0"
+	apcOutputCurrent         = apcUPS + ".4.2.4.0"
+	apcOutputStatusOnBattery = 3
+	rPDULoadStatusLoad       = ".1.3.6.1.4.1.318.1.1.12.2.3.1.1.2" // 0.1 A, per bank
+)
+
+var authProtocols = map[string]gosnmp.SnmpV3AuthProtocol{
+	"MD5": gosnmp.MD5, "SHA": gosnmp.SHA, "SHA224": gosnmp.SHA224,
+	"SHA256": gosnmp.SHA256, "SHA384": gosnmp.SHA384, "SHA512": gosnmp.SHA512,
+}
+
+var privProtocols = map[string]gosnmp.SnmpV3PrivProtocol{
+	"DES": gosnmp.DES, "AES": gosnmp.AES, "AES192": gosnmp.AES192,
+	"AES256": gosnmp.AES256, "AES192C": gosnmp.AES192C, "AES256C": gosnmp.AES256C,
+}
+
+type Sensor struct {
+	Target string
+	MIB    string
+	Labels sensor.Labels
+
+	mutex sync.Mutex
+	snmp  *gosnmp.GoSNMP
+}
+
+func NewSensor(opts string) (sensor.Collector, error) {
+	s := &Sensor{MIB: "auto"}
+	g := &gosnmp.GoSNMP{Port: 161, Transport: "udp", Community: "public",
+		Version: gosnmp.Version2c, Timeout: timeOut, Retries: 2, MaxOids: gosnmp.MaxOids}
+	usm := &gosnmp.UsmSecurityParameters{}
+	for _, opt := range strings.Split(opts, ",") {
+		if opt == "" {
+			continue
+		}
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("Snmp_ups, could not understand option: " + opt)
+		}
+		var err error
+		switch kv[0] {
+		case "target":
+			s.Target = kv[1]
+		case "version":
+			switch kv[1] {
+			case "2c":
+				g.Version = gosnmp.Version2c
+			case "3":
+				g.Version = gosnmp.Version3
+			default:
+				err = errors.New("version must be 2c or 3")
+			}
+		case "community":
+			g.Community = kv[1]
+		case "user":
+			usm.UserName = kv[1]
+		case "auth":
+			var ok bool
+			if usm.AuthenticationProtocol, ok = authProtocols[strings.ToUpper(kv[1])]; !ok {
+				err = errors.New("unknown authentication protocol")
+			}
+		case "authpass":
+			usm.AuthenticationPassphrase = kv[1]
+		case "priv":
+			var ok bool
+			if usm.PrivacyProtocol, ok = privProtocols[strings.ToUpper(kv[1])]; !ok {
+				err = errors.New("unknown privacy protocol")
+			}
+		case "privpass":
+			usm.PrivacyPassphrase = kv[1]
+		case "mib":
+			if kv[1] != "auto" && kv[1] != "ups" && kv[1] != "apc" && kv[1] != "pdu" {
+				err = errors.New("mib must be auto, ups, apc or pdu")
+			}
+			s.MIB = kv[1]
+		default:
+			err = errors.New("unknown option")
+		}
+		if err != nil {
+			return nil, errors.New("Snmp_ups, bad option " + opt + ": " + err.Error())
+		}
+	}
+	if s.Target == "" {
+		return nil, errors.New("Snmp_ups needs a target=HOST option.")
+	}
+	g.Target = s.Target
+	if host, port, err := net.SplitHostPort(s.Target); err == nil {
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return nil, errors.New("Snmp_ups, bad port in target: " + s.Target)
+		}
+		g.Target, g.Port = host, uint16(p)
+	}
+	if g.Version == gosnmp.Version3 {
+		if usm.UserName == "" {
+			return nil, errors.New("Snmp_ups, SNMP v3 needs a user.")
+		}
+		g.SecurityModel = gosnmp.UserSecurityModel
+		g.MsgFlags = gosnmp.NoAuthNoPriv
+		if usm.AuthenticationProtocol != 0 {
+			g.MsgFlags = gosnmp.AuthNoPriv
+			if usm.PrivacyProtocol != 0 {
+				g.MsgFlags = gosnmp.AuthPriv
+			}
+		} else if usm.PrivacyProtocol != 0 {
+			return nil, errors.New("Snmp_ups, privacy needs authentication too.")
+		}
+		g.SecurityParameters = usm
+	}
+	if err := g.Connect(); err != nil {
+		return nil, errors.New("Snmp_ups could not set up SNMP: " + err.Error())
+	}
+	s.snmp = g
+	s.Labels = sensor.Labels{"target": s.Target}
+	return s, nil
+}
+
+func (s *Sensor) Scrape() (out []sensor.Sample, e error) {
+	return s.ScrapeTrace(nil)
+}
+
+// ScrapeTrace scrapes, marking the detect, get and walk stages.
+func (s *Sensor) ScrapeTrace(t *sensor.Trace) (out []sensor.Sample, e error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	mib := s.MIB
+	if mib == "auto" {
+		var err error
+		mib, err = s.detect()
+		t.Mark("detect")
+		if err != nil {
+			sensor.Incident()
+			slog.Error("Snmp_ups could not query", "target", s.Target, "err", err)
+			return s.down(), nil
+		}
+		if mib == "" {
+			sensor.Incident()
+			slog.Error("Snmp_ups found neither UPS-MIB nor APC PowerNet MIB", "target", s.Target)
+			return s.down(), nil
+		}
+		// Devices do not change their MIBs.
+		slog.Info("Snmp_ups reading MIB", "target", s.Target, "mib", mib)
+		s.MIB = mib
+	}
+
+	var samples []sensor.Sample
+	var err error
+	switch mib {
+	case "ups":
+		samples, err = s.upsMIB(t)
+	case "apc":
+		samples, err = s.apcMIB(t)
+	case "pdu":
+		samples, err = s.pduMIB(t)
+	}
+	if err != nil {
+		sensor.Incident()
+		slog.Error("Snmp_ups could not query", "target", s.Target, "err", err)
+		return s.down(), nil
+	}
+	out = append(out, sensor.Sample{Name: "snmp_ups_up", Labels: s.Labels, Value: 1})
+	return append(out, samples...), nil
+}
+
+// down are the samples of a device that does not answer.
+func (s *Sensor) down() []sensor.Sample {
+	return []sensor.Sample{{Name: "snmp_ups_up", Labels: s.Labels, Value: 0}}
+}
+
+// detect returns the first MIB the device has, "" if none.
+func (s *Sensor) detect() (string, error) {
+	values, err := s.get(upsEstimatedCharge, apcBatteryCapacity)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := values[upsEstimatedCharge]; ok {
+		return "ups", nil
+	}
+	if _, ok := values[apcBatteryCapacity]; ok {
+		return "apc", nil
+	}
+	banks, err := s.snmp.BulkWalkAll(rPDULoadStatusLoad)
+	if err != nil {
+		return "", err
+	}
+	if len(banks) > 0 {
+		return "pdu", nil
+	}
+	return "", nil
+}
+
+func (s *Sensor) upsMIB(t *sensor.Trace) (out []sensor.Sample, err error) {
+	values, err := s.get(upsSecondsOnBattery, upsEstimatedMinutes, upsEstimatedCharge,
+		upsBatteryVoltage, upsBatteryTemperature, upsOutputSource)
+	t.Mark("get")
+	if err != nil {
+		return nil, err
+	}
+	add := func(name, oid string, factor float64) {
+		if v, ok := values[oid]; ok {
+			out = append(out, sensor.Sample{Name: name, Labels: s.Labels, Value: scale(v, factor)})
+		}
+	}
+	add("snmp_ups_battery_charge_percent", upsEstimatedCharge, 1)
+	add("snmp_ups_battery_runtime_seconds", upsEstimatedMinutes, 60)
+	add("snmp_ups_battery_voltage_volts", upsBatteryVoltage, 0.1)
+	add("snmp_ups_battery_temperature_celsius", upsBatteryTemperature, 1)
+	add("snmp_ups_time_on_battery_seconds", upsSecondsOnBattery, 1)
+	if v, ok := values[upsOutputSource]; ok {
+		out = append(out, onBattery(s.Labels, v == upsOutputSourceBattery))
+	}
+
+	for _, table := range []struct {
+		oid, name, label string
+		factor           float64
+	}{
+		{upsInputVoltage, "snmp_ups_input_voltage_volts", "line", 1},
+		{upsInputFrequency, "snmp_ups_input_frequency_hertz", "line", 0.1},
+		{upsOutputVoltage, "snmp_ups_output_voltage_volts", "outlet", 1},
+		{upsOutputCurrent, "snmp_ups_output_current_amperes", "outlet", 0.1},
+		{upsOutputPower, "snmp_ups_output_power_watts", "outlet", 1},
+		{upsOutputPercentLoad, "snmp_ups_load_percent", "outlet", 1},
+	} {
+		rows, err := s.walk(table.oid)
+		if err != nil {
+			return nil, err
+		}
+		for index, v := range rows {
+			out = append(out, sensor.Sample{Name: table.name,
+				Labels: s.Labels.With(table.label, index), Value: scale(v, table.factor)})
+		}
+	}
+	t.Mark("walk")
+	return out, nil
+}
+
+func (s *Sensor) apcMIB(t *sensor.Trace) (out []sensor.Sample, err error) {
+	values, err := s.get(apcBasicOutputStatus, apcBatteryCapacity, apcBatteryTemperature,
+		apcBatteryRunTime, apcBatteryTimeOn, apcInputLineVoltage, apcInputFrequency,
+		apcOutputVoltage, apcOutputLoad, apcOutputCurrent)
+	t.Mark("get")
+	if err != nil {
+		return nil, err
+	}
+	outlet := s.Labels.With("outlet", "1")
+	line := s.Labels.With("line", "1")
+	for _, v := range []struct {
+		oid, name string
+		labels    sensor.Labels
+		factor    float64
+	}{
+		{apcBatteryCapacity, "snmp_ups_battery_charge_percent", s.Labels, 1},
+		{apcBatteryRunTime, "snmp_ups_battery_runtime_seconds", s.Labels, 0.01},
+		{apcBatteryTemperature, "snmp_ups_battery_temperature_celsius", s.Labels, 1},
+		{apcBatteryTimeOn, "snmp_ups_time_on_battery_seconds", s.Labels, 0.01},
+		{apcInputLineVoltage, "snmp_ups_input_voltage_volts", line, 1},
+		{apcInputFrequency, "snmp_ups_input_frequency_hertz", line, 1},
+		{apcOutputVoltage, "snmp_ups_output_voltage_volts", outlet, 1},
+		{apcOutputCurrent, "snmp_ups_output_current_amperes", outlet, 1},
+		{apcOutputLoad, "snmp_ups_load_percent", outlet, 1},
+	} {
+		if value, ok := values[v.oid]; ok {
+			out = append(out, sensor.Sample{Name: v.name, Labels: v.labels, Value: scale(value, v.factor)})
+		}
+	}
+	if v, ok := values[apcBasicOutputStatus]; ok {
+		out = append(out, onBattery(s.Labels, v == apcOutputStatusOnBattery))
+	}
+	return out, nil
+}
+
+func (s *Sensor) pduMIB(t *sensor.Trace) (out []sensor.Sample, err error) {
+	rows, err := s.walk(rPDULoadStatusLoad)
+	t.Mark("walk")
+	if err != nil {
+		return nil, err
+	}
+	for index, v := range rows {
+		out = append(out, sensor.Sample{Name: "snmp_ups_output_current_amperes",
+			Labels: s.Labels.With("outlet", index), Value: scale(v, 0.1)})
+	}
+	return out, nil
+}
+
+// scale multiplies v by factor, dividing for factors like 0.1 to keep
+// 272 * 0.1 at 27.2.
+func scale(v, factor float64) float64 {
+	if factor < 1 {
+		return v / math.Round(1/factor)
+	}
+	return v * factor
+}
+
+func onBattery(labels sensor.Labels, on bool) sensor.Sample {
+	value := 0.0
+	if on {
+		value = 1
+	}
+	return sensor.Sample{Name: "snmp_ups_on_battery", Labels: labels, Value: value}
+}
+
+// get returns the numeric values of oids, leaving out those the device
+// does not have.
+func (s *Sensor) get(oids ...string) (map[string]float64, error) {
+	result, err := s.snmp.Get(oids)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]float64)
+	for _, v := range result.Variables {
+		if f, ok := number(v); ok {
+			values[v.Name] = f
+		}
+	}
+	return values, nil
+}
+
+// walk returns the numeric values of a table column by row index.
+func (s *Sensor) walk(oid string) (map[string]float64, error) {
+	pdus, err := s.snmp.BulkWalkAll(oid)
+	if err != nil {
+		return nil, err
+	}
+	rows := make(map[string]float64)
+	for _, v := range pdus {
+		if f, ok := number(v); ok {
+			rows[strings.TrimPrefix(v.Name, oid+".")] = f
+		}
+	}
+	return rows, nil
+}
+
+func number(v gosnmp.SnmpPDU) (float64, bool) {
+	switch v.Type {
+	case gosnmp.Integer, gosnmp.Counter32, gosnmp.Gauge32, gosnmp.TimeTicks,
+		gosnmp.Counter64, gosnmp.Uinteger32:
+		f, _ := new(big.Float).SetInt(gosnmp.ToBigInt(v.Value)).Float64()
+		return f, true
+	}
+	return 0, false
+}
+
+// Close closes the SNMP socket.
+func (s *Sensor) Close() error {
+	return s.snmp.Close()
+}
+
+// Collector is the snmp_ups sensor, for the main package to register.
+var Collector = sensor.CollectorEntry{
+	Name:            "snmp_ups",
+	New:             NewSensor,
+	DefaultInterval: suggestedScrapeInterval,
+	Type: []string{
+		"# TYPE snmp_ups_up gauge",
+		"# TYPE snmp_ups_battery_charge_percent gauge",
+		"# TYPE snmp_ups_battery_runtime_seconds gauge",
+		"# TYPE snmp_ups_battery_voltage_volts gauge",
+		"# TYPE snmp_ups_battery_temperature_celsius gauge",
+		"# TYPE snmp_ups_time_on_battery_seconds gauge",
+		"# TYPE snmp_ups_on_battery gauge",
+		"# TYPE snmp_ups_input_voltage_volts gauge",
+		"# TYPE snmp_ups_input_frequency_hertz gauge",
+		"# TYPE snmp_ups_output_voltage_volts gauge",
+		"# TYPE snmp_ups_output_current_amperes gauge",
+		"# TYPE snmp_ups_output_power_watts gauge",
+		"# TYPE snmp_ups_load_percent gauge",
+	},
+	Help: []string{
+		"# HELP snmp_ups_up Whether the device answered SNMP queries.",
+		"# HELP snmp_ups_battery_charge_percent Estimated battery charge.",
+		"# HELP snmp_ups_battery_runtime_seconds Estimated time until the battery is depleted at the current load.",
+		"# HELP snmp_ups_battery_voltage_volts Battery voltage.",
+		"# HELP snmp_ups_battery_temperature_celsius Battery temperature.",
+		"# HELP snmp_ups_time_on_battery_seconds Time since the UPS switched to battery, 0 when on line power.",
+		"# HELP snmp_ups_on_battery Whether the UPS runs on battery.",
+		"# HELP snmp_ups_input_voltage_volts Input voltage per input line.",
+		"# HELP snmp_ups_input_frequency_hertz Input frequency per input line.",
+		"# HELP snmp_ups_output_voltage_volts Output voltage per output line.",
+		"# HELP snmp_ups_output_current_amperes Output current per output line or PDU outlet bank.",
+		"# HELP snmp_ups_output_power_watts Output power per output line.",
+		"# HELP snmp_ups_load_percent Load per output line, in percent of the rated capacity.",
+	},
+	Unit: []string{
+		"# UNIT snmp_ups_battery_charge_percent percent",
+		"# UNIT snmp_ups_battery_runtime_seconds seconds",
+		"# UNIT snmp_ups_battery_voltage_volts volts",
+		"# UNIT snmp_ups_battery_temperature_celsius celsius",
+		"# UNIT snmp_ups_time_on_battery_seconds seconds",
+		"# UNIT snmp_ups_input_voltage_volts volts",
+		"# UNIT snmp_ups_input_frequency_hertz hertz",
+		"# UNIT snmp_ups_output_voltage_volts volts",
+		"# UNIT snmp_ups_output_current_amperes amperes",
+		"# UNIT snmp_ups_output_power_watts watts",
+		"# UNIT snmp_ups_load_percent percent",
+	},
+	Description: description,
+}
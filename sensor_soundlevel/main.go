@@ -0,0 +1,282 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package sensor_soundlevel turns a microphone into a sound level meter. It
+records from an ALSA capture device, which may be an I2S MEMS microphone
+(INMP441, SPH0645, ...) or a USB one, with the arecord program of
+alsa-utils.
+
+The samples go through an A-weighting filter and their energy is averaged
+over windows of configurable length (1s by default). Every scrape exposes
+the quietest and loudest window and the energy average (Leq) of all windows
+since the previous scrape, in dB(A).
+
+Levels are computed in dB relative to digital full scale and then shifted by
+the offset option, the sound pressure level at which the microphone reaches
+full scale. The default of 120 fits most I2S MEMS microphones (-26 dBFS
+sensitivity at 94 dB SPL). For accurate numbers calibrate against a known
+sound level meter and adjust:
+
+	sensor_exporter soundlevel,,device=plughw:1,offset=117.5,window=125ms
+
+ALSA device names may contain commas (hw:1,0); use the plughw:CARD form or an
+alias from asound.conf, as commas separate options here.
+*/
+package sensor_soundlevel
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"math/cmplx"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+var suggestedScrapeInterval = time.Duration(15 * time.Second)
+var description = `Soundlevel records from an ALSA capture device (I2S or USB microphone) with
+arecord and exposes the min, max and average A-weighted sound level in dB(A)
+since the last scrape. Options are device (default "default"), rate (default
+48000), window (default 1s) and offset, the dB SPL at digital full scale
+(default 120):
+
+  sensor_exporter soundlevel,,device=plughw:1,window=1s,offset=120`
+
+// A biquad is one second order section of the filter, in direct form I.
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+	x1, x2, y1, y2     float64
+}
+
+func (q *biquad) process(x float64) float64 {
+	y := q.b0*x + q.b1*q.x1 + q.b2*q.x2 - q.a1*q.y1 - q.a2*q.y2
+	q.x2, q.x1 = q.x1, x
+	q.y2, q.y1 = q.y1, y
+	return y
+}
+
+func (q *biquad) response(w float64) complex128 {
+	z1 := cmplx.Exp(complex(0, -w))
+	z2 := z1 * z1
+	return (complex(q.b0, 0) + complex(q.b1, 0)*z1 + complex(q.b2, 0)*z2) /
+		(1 + complex(q.a1, 0)*z1 + complex(q.a2, 0)*z2)
+}
+
+// aWeighting builds the IEC 61672 A-weighting filter for a sample rate. The
+// analog poles are mapped with the bilinear transform, the four zeros at
+// DC stay at z=1 and the two excess poles add zeros at z=-1. The gain is
+// then set to 0 dB at 1 kHz, which is how A-weighting is defined.
+func aWeighting(rate float64) []*biquad {
+	pole := func(f float64) float64 {
+		p := -2 * math.Pi * f / (2 * rate)
+		return (1 + p) / (1 - p)
+	}
+	section := func(zero, p1, p2 float64) *biquad {
+		return &biquad{b0: 1, b1: -2 * zero, b2: zero * zero, a1: -(p1 + p2), a2: p1 * p2}
+	}
+	f1, f2, f3, f4 := 20.598997, 107.65265, 737.86223, 12194.217
+	filter := []*biquad{
+		section(1, pole(f1), pole(f1)),
+		section(1, pole(f2), pole(f3)),
+		section(-1, pole(f4), pole(f4)),
+	}
+	gain := complex(1, 0)
+	for _, q := range filter {
+		gain *= q.response(2 * math.Pi * 1000 / rate)
+	}
+	g := 1 / cmplx.Abs(gain)
+	filter[0].b0 *= g
+	filter[0].b1 *= g
+	filter[0].b2 *= g
+	return filter
+}
+
+type Sensor struct {
+	Device string
+	Rate   int
+	Window time.Duration
+	Offset float64
+	labels sensor.Labels
+
+	mutex   sync.Mutex
+	min     float64
+	max     float64
+	energy  float64
+	windows int
+
+	received time.Time
+	cmd      *exec.Cmd // the running arecord, nil if none
+	stopped  bool
+}
+
+func NewSensor(opts string) (sensor.Collector, error) {
+	s := &Sensor{Device: "default", Rate: 48000, Window: time.Second, Offset: 120}
+	for _, opt := range strings.Split(opts, ",") {
+		if opt == "" {
+			continue
+		}
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("Soundlevel, could not understand option: " + opt)
+		}
+		var err error
+		switch kv[0] {
+		case "device":
+			s.Device = kv[1]
+		case "rate":
+			s.Rate, err = strconv.Atoi(kv[1])
+		case "window":
+			s.Window, err = time.ParseDuration(kv[1])
+		case "offset":
+			s.Offset, err = strconv.ParseFloat(kv[1], 64)
+		default:
+			err = errors.New("unknown option")
+		}
+		if err != nil {
+			return nil, errors.New("Soundlevel, bad option " + opt + ": " + err.Error())
+		}
+	}
+	if s.Rate < 8000 || s.Window < 10*time.Millisecond {
+		return nil, errors.New("Soundlevel, rate must be at least 8000 and window at least 10ms")
+	}
+	if _, err := exec.LookPath("arecord"); err != nil {
+		return nil, errors.New("Soundlevel needs arecord from alsa-utils: " + err.Error())
+	}
+	s.labels = sensor.Labels{"device": s.Device}
+	return s, nil
+}
+
+// Start runs arecord and processes what it records until it dies or Stop
+// is called.
+func (s *Sensor) Start() error {
+	cmd := exec.Command("arecord", "-q", "-D", s.Device, "-f", "S16_LE",
+		"-r", strconv.Itoa(s.Rate), "-c", "1", "-t", "raw")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	if s.stopped {
+		s.mutex.Unlock()
+		return nil
+	}
+	if err := cmd.Start(); err != nil {
+		s.mutex.Unlock()
+		return err
+	}
+	s.cmd = cmd
+	s.mutex.Unlock()
+
+	err = s.process(stdout)
+	cmd.Process.Kill()
+	cmd.Wait()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cmd = nil
+	if s.stopped {
+		return nil
+	}
+	return err
+}
+
+// Stop kills arecord, for Start to return.
+func (s *Sensor) Stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stopped = true
+	if s.cmd != nil {
+		s.cmd.Process.Kill()
+	}
+}
+
+func (s *Sensor) Received() time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.received
+}
+
+func (s *Sensor) process(r io.Reader) error {
+	filter := aWeighting(float64(s.Rate))
+	perWindow := int(float64(s.Rate) * s.Window.Seconds())
+	br := bufio.NewReader(r)
+	var sample int16
+	var sum float64
+	for n := 1; ; n++ {
+		if err := binary.Read(br, binary.LittleEndian, &sample); err != nil {
+			return err
+		}
+		x := float64(sample) / 32768
+		for _, q := range filter {
+			x = q.process(x)
+		}
+		sum += x * x
+		if n == perWindow {
+			ms := sum / float64(n)
+			level := 10*math.Log10(math.Max(ms, 1e-20)) + s.Offset
+			s.mutex.Lock()
+			if s.windows == 0 || level < s.min {
+				s.min = level
+			}
+			if s.windows == 0 || level > s.max {
+				s.max = level
+			}
+			s.energy += ms
+			s.windows++
+			s.received = time.Now()
+			s.mutex.Unlock()
+			n, sum = 0, 0
+		}
+	}
+}
+
+func (s *Sensor) Scrape() (out []sensor.Sample, e error) {
+	s.mutex.Lock()
+	windows, min, max, energy := s.windows, s.min, s.max, s.energy
+	s.windows, s.energy = 0, 0
+	s.mutex.Unlock()
+
+	if windows == 0 {
+		sensor.Incident()
+		slog.Error("Soundlevel recorded no audio since last scrape", "device", s.Device)
+		return nil, nil
+	}
+	avg := 10*math.Log10(math.Max(energy/float64(windows), 1e-20)) + s.Offset
+	out = append(out, sensor.Sample{Name: "sound_level_dba", Labels: s.labels.With("stat", "min"), Value: min})
+	out = append(out, sensor.Sample{Name: "sound_level_dba", Labels: s.labels.With("stat", "avg"), Value: avg})
+	out = append(out, sensor.Sample{Name: "sound_level_dba", Labels: s.labels.With("stat", "max"), Value: max})
+	return out, nil
+}
+
+// Collector is the soundlevel sensor, for the main package to register.
+var Collector = sensor.CollectorEntry{
+	Name:            "soundlevel",
+	New:             NewSensor,
+	DefaultInterval: suggestedScrapeInterval,
+	Type:            []string{"# TYPE sound_level_dba gauge"},
+	Help:            []string{"# HELP sound_level_dba A-weighted sound level of the quietest (min) and loudest (max) window and the energy average (avg) since the last scrape."},
+	Unit:            []string{"# UNIT sound_level_dba dba"},
+	Description:     description,
+}
@@ -0,0 +1,451 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package sensor_teleinfo reads the Téléinformation client (TIC) output of
+French electricity meters by Enedis, Linky and the older electronic meters,
+through a TIC to USB or UART adapter.
+
+Both modes of the TIC are supported: historique, 1200 baud, which every meter
+speaks by default, and standard, 9600 baud, which Linky meters switch to on
+request of the customer. Every group of a frame is checked against its
+checksum and frames with a bad group are dropped. Exported are the energy
+indexes of all tariff periods, the apparent power, currents and voltages per
+phase, the subscribed power and the current tariff period:
+
+	sensor_exporter teleinfo,,device=/dev/ttyUSB0
+	sensor_exporter teleinfo,,device=/dev/ttyAMA0,mode=standard
+
+The reading head may also sit on a serial to network bridge like ser2net or
+esp-link, set to 7E1 at the baud rate of the mode:
+
+	sensor_exporter teleinfo,,device=tcp://esp-link.local:23
+
+In standard mode the meter sends its time in every frame, DATE, and the
+skew of its clock is exported. With max_age=DURATION, frames whose time is
+older, e.g. those a bridge buffered while nobody read, are left out:
+
+	sensor_exporter teleinfo,,device=/dev/ttyAMA0,mode=standard,max_age=1m
+
+See Enedis-NOI-CPT_02E (historique) and Enedis-NOI-CPT_54E (standard).
+*/
+package sensor_teleinfo
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+	"github.com/fmoessbauer/sensor_exporter/serial"
+)
+
+var suggestedScrapeInterval = time.Duration(10 * time.Second)
+var description = `Teleinfo reads the Téléinformation (TIC) serial output of French Enedis
+electricity meters (Linky and older). Options: device=/dev/ttyUSB0 (or
+tcp://host:port of a ser2net bridge) and mode=historique (1200 baud, default) or mode=standard (9600 baud).
+In standard mode the clock skew of the meter is exported; max_age=1m leaves out
+frames whose time is older:
+
+  sensor_exporter teleinfo,,device=/dev/ttyUSB0
+  sensor_exporter teleinfo,,device=/dev/ttyAMA0,mode=standard`
+
+var defaultDevice = "/dev/ttyUSB0"
+
+// Modes of the TIC and their baud rates.
+var bauds = map[string]int{"historique": 1200, "standard": 9600}
+
+// Frame and group delimiters.
+const (
+	stx = 0x02
+	etx = 0x03
+	lf  = 0x0A
+	cr  = 0x0D
+)
+
+// maxFrameSize is the longest frame read; those of standard mode stay below
+// 1500 bytes, so a longer one is noise or a stream that lost its ETX.
+const maxFrameSize = 4096
+
+var errFrameTooLong = errors.New("frame too long")
+
+// A metric derived from a TIC label.
+type metric struct {
+	name   string
+	labels []string // label name and value pairs
+	factor float64
+}
+
+// metrics maps the labels of both modes to metrics.
+var metrics = map[string]metric{}
+
+func init() {
+	for _, index := range []string{"BASE", "HCHC", "HCHP", "EJPHN", "EJPHPM",
+		"BBRHCJB", "BBRHPJB", "BBRHCJW", "BBRHPJW", "BBRHCJR", "BBRHPJR",
+		"EAST", "EASD01", "EASD02", "EASD03", "EASD04"} {
+		metrics[index] = metric{"teleinfo_energy_watthours_total", []string{"index", index}, 1}
+	}
+	for i := 1; i <= 10; i++ {
+		index := "EASF" + twoDigits(i)
+		metrics[index] = metric{"teleinfo_energy_watthours_total", []string{"index", index}, 1}
+	}
+	metrics["EAIT"] = metric{"teleinfo_injected_energy_watthours_total", nil, 1}
+	metrics["PAPP"] = metric{"teleinfo_apparent_power_va", nil, 1}
+	metrics["SINSTS"] = metric{"teleinfo_apparent_power_va", nil, 1}
+	metrics["IINST"] = metric{"teleinfo_current_amperes", nil, 1}
+	metrics["ISOUSC"] = metric{"teleinfo_subscribed_power_va", nil, 200} // amperes, at 200 VA each
+	metrics["PREF"] = metric{"teleinfo_subscribed_power_va", nil, 1000}  // kVA
+	for _, phase := range []string{"1", "2", "3"} {
+		metrics["SINSTS"+phase] = metric{"teleinfo_apparent_power_va", []string{"phase", phase}, 1}
+		metrics["IINST"+phase] = metric{"teleinfo_current_amperes", []string{"phase", phase}, 1}
+		metrics["IRMS"+phase] = metric{"teleinfo_current_amperes", []string{"phase", phase}, 1}
+		metrics["URMS"+phase] = metric{"teleinfo_voltage_volts", []string{"phase", phase}, 1}
+	}
+}
+
+func twoDigits(i int) string {
+	if i < 10 {
+		return "0" + strconv.Itoa(i)
+	}
+	return strconv.Itoa(i)
+}
+
+type Sensor struct {
+	Device string
+	Mode   string
+
+	// MaxAge, if set, is the age beyond which frames with a time are left
+	// out.
+	MaxAge time.Duration
+
+	mutex          *sync.Mutex
+	frame          map[string]string // the last valid frame
+	fresh          bool              // whether it came after the last scrape
+	frames, errors float64
+	readerError    error
+
+	// The time of the last frame, by the meter and by the exporter, and
+	// the frames left out as older than MaxAge.
+	reported, received time.Time
+	stale              float64
+
+	port    io.ReadWriteCloser // open, nil while closed
+	stopped bool
+}
+
+func NewSensor(opts string) (sensor.Collector, error) {
+	s := &Sensor{Device: defaultDevice, Mode: "historique", mutex: &sync.Mutex{}}
+	for _, opt := range strings.Split(opts, ",") {
+		if opt == "" {
+			continue
+		}
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("Teleinfo, could not understand option: " + opt)
+		}
+		switch kv[0] {
+		case "device":
+			s.Device = kv[1]
+		case "mode":
+			if _, exists := bauds[kv[1]]; !exists {
+				return nil, errors.New("Teleinfo, mode must be historique or standard: " + kv[1])
+			}
+			s.Mode = kv[1]
+		case "max_age":
+			d, err := time.ParseDuration(kv[1])
+			if err != nil || d <= 0 {
+				return nil, errors.New("Teleinfo, bad max_age: " + kv[1])
+			}
+			s.MaxAge = d
+		default:
+			return nil, errors.New("Teleinfo, unknown option: " + kv[0])
+		}
+	}
+
+	port, err := s.open()
+	if err != nil {
+		return nil, errors.New("Teleinfo could not open serial port: " + err.Error())
+	}
+	s.port = port
+	return s, nil
+}
+
+// open opens the port with the 7E1 line settings of the TIC.
+func (s *Sensor) open() (io.ReadWriteCloser, error) {
+	return serial.Connect(s.Device, serial.Config{Baud: bauds[s.Mode], DataBits: 7, Parity: serial.ParityEven})
+}
+
+// Start parses frames from the port, reopened if it was closed, until it
+// fails or Stop is called.
+func (s *Sensor) Start() error {
+	s.mutex.Lock()
+	port := s.port
+	s.mutex.Unlock()
+	if port == nil {
+		var err error
+		if port, err = s.open(); err != nil {
+			return err
+		}
+	}
+	s.mutex.Lock()
+	if s.stopped {
+		s.mutex.Unlock()
+		return port.Close()
+	}
+	s.port = port
+	s.mutex.Unlock()
+
+	err := s.readFrames(bufio.NewReader(port))
+	port.Close()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.port = nil
+	if s.stopped {
+		return nil
+	}
+	s.readerError = err
+	return err
+}
+
+// Stop closes the port, for Start to return.
+func (s *Sensor) Stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stopped = true
+	if s.port != nil {
+		s.port.Close()
+	}
+}
+
+func (s *Sensor) Received() time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.received
+}
+
+func (s *Sensor) readFrames(r *bufio.Reader) error {
+	for {
+		raw, err := readFrame(r)
+		if err != nil && err != errFrameTooLong {
+			return err
+		}
+		received := time.Now()
+		frame, ok := parseFrame(raw, s.Mode == "standard")
+		reported, dated := horodate(frame["DATE"])
+		s.mutex.Lock()
+		switch {
+		case !ok:
+			s.errors++
+		case dated && sensor.Stale(reported, received, s.MaxAge):
+			s.stale++
+		default:
+			s.frame, s.fresh = frame, true
+			s.frames++
+			s.readerError = nil
+			s.reported, s.received = reported, received
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// readFrame skips to the start of a frame and reads it up to and including
+// its end, at most maxFrameSize bytes. Of a longer one it returns
+// errFrameTooLong, leaving the rest to be skipped for the next one.
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b == stx {
+			break
+		}
+	}
+	var raw []byte
+	for len(raw) < maxFrameSize {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		raw = append(raw, b)
+		if b == etx {
+			return raw, nil
+		}
+	}
+	return nil, errFrameTooLong
+}
+
+// parseFrame splits a frame, without its STX, into its groups and checks
+// them. Any bad group makes the whole frame bad.
+func parseFrame(raw []byte, standard bool) (map[string]string, bool) {
+	frame := make(map[string]string)
+	for _, group := range strings.Split(string(raw), string(rune(lf)))[1:] {
+		end := strings.IndexByte(group, cr)
+		if end < 0 {
+			return nil, false
+		}
+		label, date, value, ok := parseGroup([]byte(group[:end]), standard)
+		if !ok {
+			return nil, false
+		}
+		if label == "DATE" {
+			value = date
+		}
+		frame[label] = value
+	}
+	return frame, len(frame) > 0
+}
+
+// parseGroup checks the checksum of a group, between its LF and CR, and
+// returns its label, date and value. Groups are "LABEL SP VALUE SP CHECKSUM"
+// in historique mode, where the checksum leaves out the last separator, and
+// "LABEL HT [DATE HT] VALUE HT CHECKSUM" in standard mode, where it covers it.
+func parseGroup(group []byte, standard bool) (label, date, value string, ok bool) {
+	if len(group) < 4 {
+		return "", "", "", false
+	}
+	checksum := group[len(group)-1]
+	data := group[:len(group)-1]
+	sep := data[len(data)-1]
+	summed := data[:len(data)-1]
+	if standard {
+		summed = data
+	}
+	var sum byte
+	for _, b := range summed {
+		sum += b
+	}
+	if (sum&0x3F)+0x20 != checksum {
+		return "", "", "", false
+	}
+	fields := strings.Split(string(data[:len(data)-1]), string(rune(sep)))
+	if len(fields) < 2 {
+		return "", "", "", false
+	}
+	if len(fields) == 3 {
+		date = fields[1]
+	}
+	return fields[0], date, strings.TrimSpace(fields[len(fields)-1]), true
+}
+
+// horodate parses the date of standard mode, SYYMMDDhhmmss, where S is the
+// season, E for summer time, UTC+2, and H for winter time, UTC+1, lower
+// case if the clock of the meter is degraded.
+func horodate(date string) (time.Time, bool) {
+	if len(date) != 13 {
+		return time.Time{}, false
+	}
+	var zone *time.Location
+	switch date[0] {
+	case 'E', 'e':
+		zone = time.FixedZone("CEST", 2*60*60)
+	case 'H', 'h':
+		zone = time.FixedZone("CET", 60*60)
+	default:
+		return time.Time{}, false
+	}
+	t, err := time.ParseInLocation("060102150405", date[1:], zone)
+	return t, err == nil
+}
+
+func (s *Sensor) Scrape() (out []sensor.Sample, e error) {
+	s.mutex.Lock()
+	frame, fresh := s.frame, s.fresh
+	s.fresh = false
+	frames, errs, readerError := s.frames, s.errors, s.readerError
+	reported, received, stale := s.reported, s.received, s.stale
+	s.mutex.Unlock()
+
+	// The counters are there before the first frame, so they go without the
+	// meter address.
+	labels := sensor.Labels{"device": s.Device}
+	out = append(out, sensor.Sample{Name: "teleinfo_frames_total", Labels: labels, Value: frames})
+	out = append(out, sensor.Sample{Name: "teleinfo_checksum_errors_total", Labels: labels, Value: errs})
+	if s.MaxAge > 0 {
+		out = append(out, sensor.Sample{Name: "device_stale_readings_total", Labels: labels, Value: stale})
+	}
+	if !fresh {
+		sensor.Incident()
+		if readerError != nil {
+			slog.Error("Teleinfo sent no data", "device", s.Device, "err", readerError)
+		} else {
+			slog.Error("Teleinfo sent no valid frame since last scrape", "device", s.Device)
+		}
+		return out, nil
+	}
+
+	if meter := frame["ADCO"] + frame["ADSC"]; meter != "" {
+		labels = labels.With("meter", meter)
+	}
+	for label, value := range frame {
+		m, exists := metrics[label]
+		if !exists {
+			continue
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			slog.Warn("Teleinfo could not parse value", "device", s.Device, "label", label, "value", value)
+			continue
+		}
+		out = append(out, sensor.Sample{Name: m.name, Labels: labels.With(m.labels...), Value: v * m.factor})
+	}
+	if period := frame["PTEC"] + frame["LTARF"]; period != "" {
+		out = append(out, sensor.Sample{Name: "teleinfo_tariff_period", Labels: labels.With("period", period), Value: 1})
+	}
+	if !reported.IsZero() {
+		out = append(out, sensor.ClockSkew(labels, reported, received))
+	}
+	return out, nil
+}
+
+// Collector is the teleinfo sensor, for the main package to register.
+var Collector = sensor.CollectorEntry{
+	Name:            "teleinfo",
+	New:             NewSensor,
+	DefaultInterval: suggestedScrapeInterval,
+	Type: append([]string{"# TYPE teleinfo_energy_watthours_total counter",
+		"# TYPE teleinfo_injected_energy_watthours_total counter",
+		"# TYPE teleinfo_apparent_power_va gauge",
+		"# TYPE teleinfo_current_amperes gauge",
+		"# TYPE teleinfo_voltage_volts gauge",
+		"# TYPE teleinfo_subscribed_power_va gauge",
+		"# TYPE teleinfo_tariff_period gauge",
+		"# TYPE teleinfo_frames_total counter",
+		"# TYPE teleinfo_checksum_errors_total counter"}, sensor.ClockTypes...),
+	Help: append([]string{"# HELP teleinfo_energy_watthours_total Energy index of a tariff period, as the meter names it (BASE, HCHP, EASF01, ...).",
+		"# HELP teleinfo_injected_energy_watthours_total Energy injected into the grid, standard mode only.",
+		"# HELP teleinfo_apparent_power_va Instantaneous apparent power, in total or per phase.",
+		"# HELP teleinfo_current_amperes Instantaneous current, in total or per phase.",
+		"# HELP teleinfo_voltage_volts RMS voltage per phase, standard mode only.",
+		"# HELP teleinfo_subscribed_power_va Subscribed power of the contract.",
+		"# HELP teleinfo_tariff_period Current tariff period, always 1.",
+		"# HELP teleinfo_frames_total Valid frames received.",
+		"# HELP teleinfo_checksum_errors_total Frames dropped for a bad checksum or a malformed group."}, sensor.ClockHelp...),
+	Unit: append([]string{"# UNIT teleinfo_energy_watthours_total watthours",
+		"# UNIT teleinfo_injected_energy_watthours_total watthours",
+		"# UNIT teleinfo_apparent_power_va va",
+		"# UNIT teleinfo_current_amperes amperes",
+		"# UNIT teleinfo_voltage_volts volts",
+		"# UNIT teleinfo_subscribed_power_va va"}, sensor.ClockUnits...),
+	Description: description,
+	States:      map[string]string{"teleinfo_tariff_period": "period"},
+}
@@ -0,0 +1,57 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package sensor_teleinfo
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+func FuzzParseFrame(f *testing.F) {
+	// A historique frame and a standard one, with their checksums.
+	f.Add([]byte("\nADCO 021728123456 @\r\nBASE 012345678 /\r\nPAPP 00750 -\r\x03"), false)
+	f.Add([]byte("\nADSC\t021728123456\t6\r\nDATE\tE230615120000\t\t2\r\nSINSTS\t00750\tR\r\x03"), true)
+	f.Add([]byte("\n\r\x03"), true)
+	f.Fuzz(func(t *testing.T, raw []byte, standard bool) {
+		frame, ok := parseFrame(raw, standard)
+		if ok && len(frame) == 0 {
+			t.Errorf("empty frame of %q is valid", raw)
+		}
+	})
+}
+
+func FuzzReadFrame(f *testing.F) {
+	f.Add([]byte("noise\x02\nPAPP 00750 +\r\x03\x02\nBASE"))
+	f.Add(bytes.Repeat([]byte{stx, 'A'}, 3000))
+	f.Fuzz(func(t *testing.T, stream []byte) {
+		r := bufio.NewReader(bytes.NewReader(stream))
+		for {
+			raw, err := readFrame(r)
+			if err == errFrameTooLong {
+				continue
+			}
+			if err != nil {
+				return
+			}
+			if len(raw) > maxFrameSize || raw[len(raw)-1] != etx {
+				t.Errorf("frame of %d bytes ending in %#x", len(raw), raw[len(raw)-1])
+			}
+		}
+	})
+}
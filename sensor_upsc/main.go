@@ -21,11 +21,66 @@ a UPS. It is pretty basic. To add a UPS start sensor_exporter like:
 
     sensor_exporter uspc,,UPS@HOST
 
-For localhost, HOST may be ommited.
+For localhost, HOST may be ommited. If upsd wants a login before it lists
+variables, give the user and password first, or set UPSC_USERNAME and
+UPSC_PASSWORD in the environment:
 
-Currently only a few values are reported since I care only about my UPS.
-If you are interested to support more values, sumbit a pull request. It is
-an easy job, just add entries to upscVarFloat, sensorsType, sensorsHelp. ;)
+    sensor_exporter upsc,,monuser:secret@UPS@HOST
+
+Many UPSes may be given, separated by
+commas, to scrape them all with the same settings:
+
+    sensor_exporter upsc,30s,ups1@host,ups2@host,ups3@otherhost
+
+They are scraped one after the other, a UPS that does not answer does not
+keep the others from being reported.
+
+A UPS that several upsd servers read is given with them separated by |; it
+is read from the first one that answers, with the labels of the first, and
+upsc_upsd_source tells which one:
+
+    sensor_exporter 'upsc,,ups@nut1|ups@nut2'
+
+The connection to upsd is kept open between scrapes and checked with GET
+UPSDESC before LIST VAR. A lost connection is opened again at the next
+scrape; if that fails, the attempts are spaced out, doubling up to five
+minutes, and only the first failure is logged.
+
+To talk TLS with upsd, through STARTTLS, add the TLS options of the
+tlsconfig package, which apply to all UPSes of the sensor:
+
+    sensor_exporter upsc,,ups@nas.local,tls.ca_file=/etc/ssl/nut-ca.pem
+
+Every numeric variable of LIST VAR is exported, named upsc_ and its key
+with dots replaced by underscores, e.g. battery.runtime becomes
+upsc_battery_runtime. Those listed in upscVarFloat may be named otherwise and
+have a TYPE and HELP; others are untyped. Identifiers like serial numbers and
+firmware versions, and the driver.* and device.* variables are left out,
+see defaultNoVars; the model, manufacturer, serial number, firmware and battery
+type are the labels of upsc_ups_info instead, which is always 1, for joins:
+
+    upsc_ups_load * on(ups, host) group_left(model) upsc_ups_info
+
+To pick the variables, give glob patterns of their keys, which apply to all
+UPSes of the sensor: with var=PATTERN only the matching ones are exported,
+and none of those of novar=PATTERN, both may be repeated:
+
+    sensor_exporter upsc,,ups@nas,var=battery.*,var=ups.load
+    sensor_exporter upsc,,ups@nas,novar=ambient.*
+
+With the chain option, upsc_shutdown_chain_ok tells whether the UPS would
+shut its hosts down on low battery: upsd answers, reports ups.status and
+battery.charge.low, and at least one upsmon is logged in to it (GET
+NUMLOGINS). The first failed check is logged when the chain breaks:
+
+    sensor_exporter upsc,,ups@nas,chain
+
+For upsd servers that throttle LIST VAR, getvar reads the variables with GET
+VAR instead, batch=N (20) of them per write, pipelined, and batch.delay
+apart. Their keys are discovered with LIST VAR after connecting and every
+hour; those upsd no longer supports are forgotten:
+
+    sensor_exporter upsc,,ups@nas,getvar,batch=40,batch.delay=50ms
 
 You can consult the UPSC manual for available readings and their description:
 http://networkupstools.org/docs/user-manual.chunked/apcs01.html
@@ -39,14 +94,18 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
+	"os"
+	"path"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fmoessbauer/sensor_exporter/sensor"
+	"github.com/fmoessbauer/sensor_exporter/tlsconfig"
 )
 
 var suggestedScrapeInterval = time.Duration(10 * time.Second)
@@ -54,25 +113,118 @@ var description = `Upsc is a sensor that uses the upsc program to get informatio
 To use it with the suggested scrape interval (HOST may be ommitted for
 localhost):
 
-  sensor_exporter upsc,,UPS@HOST`
+  sensor_exporter upsc,,UPS@HOST
+
+If upsd needs a login, use USER:PASSWORD@UPS@HOST or set UPSC_USERNAME and
+UPSC_PASSWORD. Many UPSes may be listed, separated by commas:
+
+  sensor_exporter upsc,,ups1@host,ups2@host,ups3@otherhost
+
+For a UPS on several upsd servers, separate them by |, ups@nut1|ups@nut2;
+the first that answers is read.
+
+Every numeric variable is exported; to pick them give var=PATTERN or
+novar=PATTERN, glob patterns of their keys like battery.*, repeatable.
+For STARTTLS add tls, or tls.ca_file=FILE and the other tls.* options.
+With chain, upsc_shutdown_chain_ok checks that upsmon would shut down.
+With getvar, variables are read with pipelined GET VAR, batch=N at a time,
+batch.delay=DURATION apart, for upsd servers that throttle LIST VAR.`
 var timeOut = 10 * time.Second
+var maxBackoff = 5 * time.Minute
+var rediscover = time.Hour
+
+// maxVars is the most lines a LIST VAR answer may have; upsd stays far below,
+// so more is a broken or hostile server streaming without end.
+const maxVars = 10000
 
 type Sensor struct {
-	Labels     string
+	UPSes []*UPS
+}
+
+// A UPS is one of the UPSes of a sensor.
+type UPS struct {
+	Labels     sensor.Labels
 	Host       string
 	Ups        string
 	Re         *regexp.Regexp
 	BeginToken string
 	EndToken   string
+	Username   string
+	Password   string
+	TLS        *tlsconfig.Config // nil for plain text
+	Vars       *VarFilter
+	stage      string // prefix of trace stages, if the sensor has many UPSes
+	// Backups are other upsd servers of the same UPS, tried in order when
+	// this one cannot be read. The readings keep the labels of this one.
+	Backups []*UPS
+	source  int // of the last scrape, 0 for this one, i for Backups[i-1]
+	// Chain checks the shutdown chain of the UPS at every scrape, see
+	// checkChain; chainFailure is the check that failed the last time.
+	Chain        bool
+	chainFailure string
+	// GetVar reads the variables with GET VAR, Batch at a time pipelined,
+	// BatchDelay apart, for upsd servers that throttle LIST VAR. The keys
+	// are discovered with LIST VAR after connecting and every rediscover.
+	GetVar     bool
+	Batch      int
+	BatchDelay time.Duration
+	keys       []string
+	discovered time.Time
+
+	// Transfers to battery counted from ups.status, for drivers that do
+	// not report input.transfer.count.
+	statusKnown bool
+	onBattery   bool
+	transfers   float64
+
+	badDate map[string]bool // battery dates that could not be parsed
+
+	// The connection to upsd, kept between scrapes, and the failed attempts
+	// to connect since it last worked.
+	mutex    sync.Mutex
+	conn     net.Conn
+	reader   *bufio.Reader
+	failures int
+	retry    time.Time // no connection attempt before
+}
+
+// A VarFilter picks the variables of a UPS to export by glob patterns of
+// their keys, see path.Match: those matching Only, or all if it is empty,
+// but none matching Except.
+type VarFilter struct {
+	Only   []string
+	Except []string
 }
 
-// Strings that are used to detect readings from upsd responses. If you add an
-// entry to upscVarFloat and your UPS returns this value, the sensor will
-// expose it. Please also add a TYPE and HELP entry.
+// exports tells whether the variable key is exported.
+func (f *VarFilter) exports(key string) bool {
+	for _, pattern := range f.Except {
+		if ok, _ := path.Match(pattern, key); ok {
+			return false
+		}
+	}
+	if len(f.Only) == 0 {
+		return true
+	}
+	for _, pattern := range f.Only {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Strings that are used to detect readings from upsd responses. Variables
+// listed in upscVarFloat are exported under the name given, with their
+// strings mapped by sensorsMapping, and with a TYPE and HELP entry;
+// the other numeric ones under a name derived from their key, see
+// metricName.
 var (
 	upscVarFloat = map[string]string{
 		"battery.charge"         : "upsc_battery_charge",
 		"battery.charge.low"     : "upsc_battery_charge_low",
+		"battery.runtime"        : "upsc_battery_runtime",
+		"battery.runtime.low"    : "upsc_battery_runtime_low",
 		"battery.voltage"        : "upsc_battery_voltage",
 		"battery.voltage.high"   : "upsc_battery_voltage_high",
 		"battery.voltage.low"    : "upsc_battery_voltage_low",
@@ -84,16 +236,42 @@ var (
 		"input.voltage.nominal"  : "upsc_input_voltage_nominal",
 		"input.current"          : "upsc_input_current",
 		"output.voltage"         : "upsc_output_voltage",
+		"output.current"         : "upsc_output_current",
+		"output.frequency"       : "upsc_output_frequency",
 		"ups.beeper.status"      : "upsc_ups_beeper_enabled",
 		"ups.delay.shutdown"     : "upsc_ups_delay_shutdown",
 		"ups.delay.start"        : "upsc_ups_delay_start",
 		"ups.load"               : "upsc_ups_load",
+		"ups.realpower"          : "upsc_ups_realpower",
+		"ups.realpower.nominal"  : "upsc_ups_realpower_nominal",
 		"ups.status"             : "upsc_ups_online",
 		"ups.temperature"        : "upsc_ups_temperature",
 	}
+	// Variables that are not measurements, left out unless picked with var.
+	defaultNoVars = []string{"driver.*", "device.*", "*.serial", "*.firmware*",
+		"*.id", "*.productid", "*.vendorid", "*.date", "*.mfr*", "*.model"}
+	// Variables about transfers to battery, handled by observeTransfers.
+	transferCount  = "input.transfer.count"
+	transferReason = "input.transfer.reason"
+	// Variables that are the labels of upsc_ups_info, by label, the first one
+	// the driver reports.
+	infoVars = []struct {
+		label string
+		keys  []string
+	}{
+		{"model", []string{"ups.model", "device.model"}},
+		{"manufacturer", []string{"ups.mfr", "device.mfr"}},
+		{"serial", []string{"ups.serial", "device.serial"}},
+		{"firmware", []string{"ups.firmware"}},
+		{"battery_type", []string{"battery.type"}},
+	}
+	// Layouts of battery.date and battery.mfr.date seen from NUT drivers.
+	batteryDateLayouts = []string{"2006/01/02", "2006-01-02", "01/02/06", "01/02/2006"}
 	sensorsType = []string{
 		"# TYPE upsc_battery_charge gauge",
 		"# TYPE upsc_battery_charge_low gauge",
+		"# TYPE upsc_battery_runtime gauge",
+		"# TYPE upsc_battery_runtime_low gauge",
 		"# TYPE upsc_battery_voltage gauge",
 		"# TYPE upsc_battery_voltage_high gauge",
 		"# TYPE upsc_battery_voltage_low gauge",
@@ -105,16 +283,29 @@ var (
 		"# TYPE upsc_input_voltage_nominal gauge",
 		"# TYPE upsc_input_current gauge",
 		"# TYPE upsc_output_voltage gauge",
+		"# TYPE upsc_output_current gauge",
+		"# TYPE upsc_output_frequency gauge",
 		"# TYPE upsc_ups_beeper_enabled gauge",
 		"# TYPE upsc_ups_delay_shutdown gauge",
 		"# TYPE upsc_ups_delay_start gauge",
 		"# TYPE upsc_ups_load gauge",
+		"# TYPE upsc_ups_realpower gauge",
+		"# TYPE upsc_ups_realpower_nominal gauge",
 		"# TYPE upsc_ups_online gauge",
 		"# TYPE upsc_ups_temperature gauge",
+		"# TYPE upsc_input_transfers_total counter",
+		"# TYPE upsc_input_transfer_reason gauge",
+		"# TYPE upsc_battery_replace_needed gauge",
+		"# TYPE upsc_battery_age_seconds gauge",
+		"# TYPE upsc_ups_info gauge",
+		"# TYPE upsc_upsd_source gauge",
+		"# TYPE upsc_shutdown_chain_ok gauge",
 	}
 	sensorsHelp = []string{
 		"# HELP upsc_battery_charge gauge Battery charge (percent)",
 		"# HELP upsc_battery_charge_low gauge Low battery charge threshold (percent)",
+		"# HELP upsc_battery_runtime Battery runtime (s)",
+		"# HELP upsc_battery_runtime_low Remaining battery runtime when UPS switches to LB (s)",
 		"# HELP upsc_battery_voltage Battery voltage (V)",
 		"# HELP upsc_battery_voltage_high Battery voltage high (V)",
 		"# HELP upsc_battery_voltage_low Battery voltage low (V)",
@@ -126,27 +317,156 @@ var (
 		"# HELP upsc_input_voltage_nominal Input voltage nominal / expected (V)",
 		"# HELP upsc_input_current Input current (A)",
 		"# HELP upsc_output_voltage Output voltage (V)",
+		"# HELP upsc_output_current Output current (A)",
+		"# HELP upsc_output_frequency Output frequency (Hz)",
 		"# HELP upsc_ups_beeper_enabled Beeper is enabled (bool)",
 		"# HELP upsc_ups_delay_shutdown Wait number of seconds before shutdown (s)",
 		"# HELP upsc_ups_delay_start Start delay after number of seconds (s)",
 		"# HELP upsc_ups_load Load on UPS (percent)",
+		"# HELP upsc_ups_realpower Current value of real power (W)",
+		"# HELP upsc_ups_realpower_nominal Nominal value of real power (W)",
 		"# HELP upsc_ups_online UPS is online (bool)",
 		"# HELP upsc_ups_temperature UPS temperature (degrees C)",
+		"# HELP upsc_input_transfers_total Transfers to battery, as reported by the driver or else counted from status changes since start",
+		"# HELP upsc_input_transfer_reason Reason of the last transfer to battery, as reported by the driver (1 for the current reason)",
+		"# HELP upsc_battery_replace_needed UPS asks for its battery to be replaced, RB in ups.status (bool)",
+		"# HELP upsc_battery_age_seconds Time since battery.date, or else battery.mfr.date (s)",
+		"# HELP upsc_ups_info UPS model, manufacturer, serial number, firmware and battery type as labels, always 1",
+		"# HELP upsc_upsd_source Whether the UPS was read from the upsd server of the source label, of those given for it with | (bool)",
+		"# HELP upsc_shutdown_chain_ok Whether upsd answers, with ups.status and battery.charge.low, and upsmon is logged in, so the hosts would shut down on low battery (bool)",
+	}
+	sensorsRange = map[string]sensor.Range{
+		"upsc_battery_charge"    : {Min: 0, Max: 100},
+		"upsc_battery_charge_low": {Min: 0, Max: 100},
+		"upsc_ups_load"          : {Min: 0, Max: 1000},
 	}
-	sensorStringMapping = map[string]float64{
-		"enabled"  : 1,
-		"disabled" : 0,
-		"OL"       : 2,   // online, charged
-		"FSD OL"   : 1.5, // online, forced shutdown 
-		"OB"       : 1,   // on battery
-		"FSD OB"   : 0.5, // offline, forced shutdown 
-		"LB"       : 0,   // low battery
+	// The value of upsc_ups_online is the state, see sensorsMapping.
+	sensorsState = map[string]string{
+		"upsc_ups_online"            : "",
+		"upsc_input_transfer_reason" : "reason",
+	}
+	// The values of the strings of variables, unless the mappings of the
+	// sensor's configuration map them.
+	sensorsMapping = []sensor.Mapping{
+		{Text: "enabled" , Value: 1},
+		{Text: "disabled", Value: 0},
+		{Text: "OL"      , Value: 2},   // online, charged
+		{Text: "FSD OL"  , Value: 1.5}, // online, forced shutdown
+		{Text: "OB"      , Value: 1},   // on battery
+		{Text: "FSD OB"  , Value: 0.5}, // offline, forced shutdown
+		{Text: "LB"      , Value: 0},   // low battery
 	}
 )
 
 func NewSensor(opts string) (sensor.Collector, error) {
+	var s Sensor
+	var tlsConf tlsconfig.Config
+	vars := &VarFilter{}
+	seen := make(map[string]bool)
+	chain, getVar, batch, batchDelay := false, false, 20, time.Duration(0)
+	for _, uri := range strings.Split(opts, ",") {
+		if ok, err := tlsConf.Option(uri); ok {
+			if err != nil {
+				return nil, errors.New("Upsc, bad option " + uri + ": " + err.Error())
+			}
+			continue
+		}
+		if uri == "chain" {
+			chain = true
+			continue
+		}
+		if uri == "getvar" {
+			getVar = true
+			continue
+		}
+		if v, ok := strings.CutPrefix(uri, "batch="); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return nil, errors.New("Upsc, bad option " + uri + ": expected a positive number")
+			}
+			batch = n
+			continue
+		}
+		if v, ok := strings.CutPrefix(uri, "batch.delay="); ok {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				return nil, errors.New("Upsc, bad option " + uri + ": expected a duration")
+			}
+			batchDelay = d
+			continue
+		}
+		if kv := strings.SplitN(uri, "=", 2); len(kv) == 2 && (kv[0] == "var" || kv[0] == "novar") {
+			if _, err := path.Match(kv[1], ""); err != nil {
+				return nil, errors.New("Upsc, bad option " + uri + ": " + err.Error())
+			}
+			if kv[0] == "var" {
+				vars.Only = append(vars.Only, kv[1])
+			} else {
+				vars.Except = append(vars.Except, kv[1])
+			}
+			continue
+		}
+		// UPS@HOST1|UPS@HOST2 are upsd servers of the same UPS.
+		var sources []*UPS
+		for _, alt := range strings.Split(uri, "|") {
+			u, err := newUPS(alt)
+			if err != nil {
+				return nil, err
+			}
+			if seen[u.Ups+"@"+u.Host] {
+				return nil, errors.New("Upsc, UPS given twice: " + alt)
+			}
+			seen[u.Ups+"@"+u.Host] = true
+			sources = append(sources, u)
+		}
+		sources[0].Backups = sources[1:]
+		s.UPSes = append(s.UPSes, sources[0])
+	}
+	if len(s.UPSes) == 0 {
+		return nil, errors.New("Upsc, no UPS given.")
+	}
+	if len(vars.Only) == 0 {
+		vars.Except = append(vars.Except, defaultNoVars...)
+	}
+	for _, u := range s.UPSes {
+		u.Vars, u.Chain = vars, chain
+		for _, src := range u.sources() {
+			src.GetVar, src.Batch, src.BatchDelay = getVar, batch, batchDelay
+		}
+	}
+	if tlsConf.Enabled {
+		if err := tlsConf.Check(); err != nil {
+			return nil, errors.New("Upsc, bad TLS options: " + err.Error())
+		}
+		for _, u := range s.UPSes {
+			for _, src := range u.sources() {
+				src.TLS = &tlsConf
+			}
+		}
+	}
+	for _, u := range s.UPSes {
+		if len(s.UPSes) > 1 || len(u.Backups) > 0 {
+			for _, src := range u.sources() {
+				src.stage = src.Ups + "@" + src.Host + " "
+			}
+		}
+	}
+	return s, nil
+}
+
+func newUPS(opts string) (*UPS, error) {
 	conf := strings.Split(opts, `@`)
-	var labels, host, ups string
+	var labels sensor.Labels
+	var host, ups string
+	username, password := os.Getenv("UPSC_USERNAME"), os.Getenv("UPSC_PASSWORD")
+	if len(conf) == 3 { // USER:PASSWORD@UPS@HOST
+		creds := strings.SplitN(conf[0], `:`, 2)
+		if len(creds) != 2 {
+			return nil, errors.New("Upsc, could not understand credentials, expected USER:PASSWORD@UPS@HOST.")
+		}
+		username, password = creds[0], creds[1]
+		conf = conf[1:]
+	}
 	switch len(conf) {
 	case 2:
 		ups = conf[0]
@@ -155,94 +475,620 @@ func NewSensor(opts string) (sensor.Collector, error) {
 		if len(hostParts) == 1 {              // set default port if needed
 			host += ":3493"
 		}
-		labels = fmt.Sprintf("{ups=\"%s\",host=\"%s\"}", ups, hostParts[0])
+		labels = sensor.Labels{"ups": ups, "host": hostParts[0]}
 	case 1:
-		labels = fmt.Sprintf("{ups=\"%s\"}", conf[0])
+		labels = sensor.Labels{"ups": conf[0]}
 		ups = conf[0]
 		host = "localhost:3493"
 	default:
 		return nil, errors.New("Upsc, could not understand UPS URI. Empty or too many '@'?. Opts: " + opts)
 	}
 	// Output is like: VAR UPS ups.load "14"
-	reString := "VAR " + ups + " ([a-zA-Z.]*) \"(.*)\""
+	reString := "VAR " + ups + " (\\S+) \"(.*)\""
 	re, err := regexp.Compile(reString)
 	if err != nil {
 		return nil, errors.New("Upsc, could not compile regural expression: " + reString + ". Err: " + err.Error())
 	}
-	conn, err := net.DialTimeout("tcp", host, timeOut)
+	conn, err := sensor.DialTimeout("tcp", host, timeOut)
 	if err != nil {
-		log.Printf("Adding upsc sensor at %s but could not connect to remote.\n", host)
+		slog.Warn("Adding upsc sensor but could not connect to remote", "host", host)
 	} else {
 		defer conn.Close()
 	}
-	s := Sensor{Labels: labels, Host: host, Ups: ups, Re: re,
-		BeginToken: "BEGIN LIST VAR " + ups + "\n", EndToken: "END LIST VAR " + ups + "\n"}
-	return s, nil
+	u := &UPS{Labels: labels, Host: host, Ups: ups, Re: re,
+		BeginToken: "BEGIN LIST VAR " + ups + "\n", EndToken: "END LIST VAR " + ups + "\n",
+		Username: username, Password: password, badDate: make(map[string]bool)}
+	return u, nil
+}
+
+func (s Sensor) Scrape() (out []sensor.Sample, e error) {
+	return s.ScrapeTrace(nil)
+}
+
+// ScrapeTrace scrapes, marking the ping, dial, starttls, login, request, read and parse
+// stages of every UPS.
+func (s Sensor) ScrapeTrace(t *sensor.Trace) (out []sensor.Sample, e error) {
+	for _, u := range s.UPSes {
+		out = append(out, u.scrape(t)...)
+	}
+	return out, nil
 }
 
-func (s Sensor) Scrape() (out string, e error) {
-	conn, err := net.DialTimeout("tcp", s.Host, timeOut)
+// sources returns s and its Backups, in the order they are tried.
+func (s *UPS) sources() []*UPS {
+	return append([]*UPS{s}, s.Backups...)
+}
+
+func (s *UPS) scrape(t *sensor.Trace) (out []sensor.Sample) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var vars [][2]string
+	var used int
+	for i, src := range s.sources() {
+		if vars = src.read(t); vars != nil {
+			used = i
+			break
+		}
+	}
+	if vars == nil {
+		if s.Chain {
+			return []sensor.Sample{s.chain(s.checkChain(nil, nil))}
+		}
+		return nil
+	}
+	if used != s.source && len(s.Backups) > 0 {
+		src := s.sources()[used]
+		slog.Warn("Upsc switched to another upsd", "ups", s.Ups+"@"+s.Host, "source", src.Ups+"@"+src.Host)
+	}
+	s.source = used
+
+	byKey := make(map[string]string)
+	for _, v := range vars {
+		byKey[v[0]] = v[1]
+	}
+
+	for _, v := range vars {
+		if v[0] == transferCount || !s.Vars.exports(v[0]) {
+			continue
+		}
+		if sample := Reading(v[0], v[1]); sample.Name != "" {
+			sample.Labels = s.Labels
+			out = append(out, sample)
+		}
+	}
+	out = append(out, s.observeTransfers(byKey)...)
+	out = append(out, s.battery(byKey)...)
+	out = append(out, s.info(byKey)...)
+	if s.Chain {
+		out = append(out, s.chain(s.checkChain(s.sources()[used], byKey)))
+	}
+	if len(s.Backups) > 0 {
+		for i, src := range s.sources() {
+			value := 0.0
+			if i == used {
+				value = 1
+			}
+			out = append(out, sensor.Sample{Name: "upsc_upsd_source",
+				Labels: s.Labels.With("source", src.Ups+"@"+src.Host), Value: value})
+		}
+	}
+	t.Mark(s.stage + "parse")
+
+	return out
+}
+
+// read returns the keys and values of the variables from the upsd of s, by
+// LIST VAR, or by GET VAR of the keys LIST VAR discovered if GetVar is set;
+// nil if they could not be read. The caller holds the mutex of the UPS s is a
+// source of.
+func (s *UPS) read(t *sensor.Trace) [][2]string {
+	if s.GetVar && s.keys != nil && time.Since(s.discovered) < rediscover {
+		return s.getVars(t)
+	}
+	vars := s.list(t)
+	if s.GetVar && vars != nil {
+		s.keys = make([]string, len(vars))
+		for i, v := range vars {
+			s.keys[i] = v[0]
+		}
+		s.discovered = time.Now()
+	}
+	return vars
+}
+
+// getVars returns the values of the keys of s by GET VAR, pipelined Batch at
+// a time, nil if they could not be read. Keys upsd no longer supports are
+// forgotten. The caller holds the mutex of the UPS s is a source of.
+func (s *UPS) getVars(t *sensor.Trace) [][2]string {
+	keys := s.keys
+	conn, reader, err := s.connection(t)
 	if err != nil {
+		return nil
+	}
+	vars := make([][2]string, 0, len(keys))
+	unsupported := make(map[string]bool)
+	var failure string
+	for start := 0; start < len(keys); start += s.Batch {
+		if start > 0 {
+			time.Sleep(s.BatchDelay)
+		}
+		batch := keys[start:min(start+s.Batch, len(keys))]
+		var request, received strings.Builder
+		for _, key := range batch {
+			request.WriteString("GET VAR " + s.Ups + " " + key + "\n")
+		}
+		conn.SetDeadline(time.Now().Add(timeOut))
+		_, err := fmt.Fprint(conn, request.String())
+		for _, key := range batch {
+			if err != nil {
+				break
+			}
+			var res string
+			res, err = readLine(reader)
+			received.WriteString(res)
+			switch v := s.Re.FindStringSubmatch(res); {
+			case err != nil:
+			case len(v) == 3:
+				vars = append(vars, [2]string{v[1], v[2]})
+			case res == "ERR VAR-NOT-SUPPORTED\n":
+				unsupported[key] = true
+			case failure == "":
+				failure = strings.TrimSpace(res)
+			}
+		}
+		sensor.RecordExchange(sensor.Exchange{Collector: "upsc", Device: s.Ups + "@" + s.Host,
+			Sent: []byte(request.String()), Received: []byte(received.String())})
+		if err != nil {
+			sensor.Incident()
+			slog.Error("Upsc connection error while reading", "ups", s.Ups+"@"+s.Host, "err", err)
+			s.disconnect()
+			return nil
+		}
+	}
+	t.Mark(s.stage + "read")
+	if failure != "" {
 		sensor.Incident()
-		log.Printf("Upsc %s@%s, failed to connect: %s\n", s.Ups, s.Host, err.Error())
-		return "", nil
+		slog.Error("Upsc, upsd daemon returned unknown response", "ups", s.Ups+"@"+s.Host, "response", failure)
+		return nil
 	}
-	defer conn.Close()
-	fmt.Fprintf(conn, "LIST VAR "+s.Ups+"\n")
-	reader := bufio.NewReader(conn)
+	if len(unsupported) > 0 && s.keys != nil {
+		slog.Debug("Upsc variables no longer supported", "ups", s.Ups+"@"+s.Host, "count", len(unsupported))
+		kept := make([]string, 0, len(keys))
+		for _, key := range keys {
+			if !unsupported[key] {
+				kept = append(kept, key)
+			}
+		}
+		s.keys = kept
+	}
+	return vars
+}
 
-	res, err := reader.ReadString('\n')
+// list returns the keys and values of LIST VAR from the upsd of s, nil if it
+// could not be read. The caller holds the mutex of the UPS s is a source of.
+func (s *UPS) list(t *sensor.Trace) [][2]string {
+	conn, reader, err := s.connection(t)
 	if err != nil {
-		sensor.Incident()
-		log.Printf("Upsc %s@%s, reading returned error: %s\n", s.Ups, s.Host, err.Error())
-		return "", nil
+		return nil
 	}
-	if res == "ERR UNKNOWN-UPS" {
+	conn.SetDeadline(time.Now().Add(timeOut))
+	request := "LIST VAR " + s.Ups + "\n"
+	fmt.Fprint(conn, request)
+	var received strings.Builder
+	defer func() {
+		sensor.RecordExchange(sensor.Exchange{Collector: "upsc", Device: s.Ups + "@" + s.Host,
+			Sent: []byte(request), Received: []byte(received.String())})
+	}()
+
+	vars, err := s.readList(reader, &received, t)
+	if err == errUnknownUPS {
 		sensor.Incident()
-		log.Printf("Upsc %s@%s, upsd daemon said \"unknown ups\".\n", s.Ups, s.Host)
-		return "", nil
+		slog.Error("Upsc, upsd daemon said \"unknown ups\"", "ups", s.Ups+"@"+s.Host)
+		return nil
+	} else if err != nil {
+		sensor.Incident()
+		slog.Error("Upsc could not read the variables", "ups", s.Ups+"@"+s.Host, "err", err)
+		s.disconnect()
+		return nil
+	}
+	return vars
+}
+
+var errUnknownUPS = errors.New("unknown ups")
+
+// readList reads the answer to LIST VAR from reader, copying it to received,
+// and returns its keys and values.
+func (s *UPS) readList(reader *bufio.Reader, received *strings.Builder, t *sensor.Trace) ([][2]string, error) {
+	// upsd answers once it has the values, so this is the time of the request.
+	res, err := readLine(reader)
+	received.WriteString(res)
+	t.Mark(s.stage + "request")
+	if err != nil {
+		return nil, err
+	}
+	if res == "ERR UNKNOWN-UPS\n" {
+		return nil, errUnknownUPS
 	} else if res != s.BeginToken {
+		return nil, fmt.Errorf("unknown response %q", res)
+	}
+
+	var lines []string
+	for res != s.EndToken {
+		res, err = readLine(reader)
+		received.WriteString(res)
+		if err != nil {
+			return nil, err
+		}
+		if len(lines) == maxVars {
+			return nil, errors.New("too many variables")
+		}
+		lines = append(lines, res)
+	}
+	t.Mark(s.stage + "read")
+
+	// Output is like: VAR UPS ups.load "14"
+	vars := [][2]string{}
+	for _, line := range lines {
+		if v := s.Re.FindStringSubmatch(line); len(v) == 3 {
+			vars = append(vars, [2]string{v[1], v[2]})
+		}
+	}
+	return vars, nil
+}
+
+// Reading returns the sample of the variable key with value. Its name is
+// empty for strings, like ups.mfr or outlet.1.status, which are left out,
+// unless key is in upscVarFloat; then the string is the Text of the sample,
+// for the mappings of the sensor and sensorsMapping.
+func Reading(key, value string) sensor.Sample {
+	reading, err := strconv.ParseFloat(value, 64)
+	if name, exists := upscVarFloat[key]; exists {
+		if err != nil {
+			return sensor.Sample{Name: name, Text: value}
+		}
+		return sensor.Sample{Name: name, Value: reading}
+	}
+	if err == nil {
+		return sensor.Sample{Name: metricName(key), Value: reading}
+	}
+	return sensor.Sample{}
+}
+
+// metricName derives the metric name of a variable without an entry in
+// upscVarFloat from its key: input.L1-N.voltage becomes
+// upsc_input_l1_n_voltage.
+func metricName(key string) string {
+	return "upsc_" + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z' || r >= '0' && r <= '9':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '_'
+	}, key)
+}
+
+// connection returns the connection to upsd, after checking with GET
+// UPSDESC that it still works, or a new one. After a failed connection
+// attempt the next ones are delayed, doubling up to maxBackoff, and logged
+// only until the connection works again.
+func (s *UPS) connection(t *sensor.Trace) (net.Conn, *bufio.Reader, error) {
+	if s.conn != nil {
+		err := s.ping()
+		t.Mark(s.stage + "ping")
+		if err == nil {
+			return s.conn, s.reader, nil
+		}
+		slog.Warn("Upsc connection lost, reconnecting", "ups", s.Ups+"@"+s.Host, "err", err)
+		s.disconnect()
+	}
+	if time.Now().Before(s.retry) {
+		return nil, nil, errors.New("waiting to reconnect")
+	}
+	conn, reader, err := s.connect(t)
+	if err != nil {
 		sensor.Incident()
-		log.Printf("Upsc %s@%s, upsd daemon returned unknown response: %s.\n", s.Ups, s.Host, res)
-		return "", nil
+		if s.failures == 0 {
+			slog.Error("Upsc could not connect, retrying with backoff", "ups", s.Ups+"@"+s.Host, "err", err)
+		}
+		backoff := time.Second << uint(s.failures)
+		if backoff > maxBackoff || backoff <= 0 {
+			backoff = maxBackoff
+		}
+		s.retry = time.Now().Add(backoff)
+		s.failures++
+		return nil, nil, err
 	}
+	if s.failures > 0 {
+		slog.Info("Upsc connected again", "ups", s.Ups+"@"+s.Host, "failed_attempts", s.failures)
+	}
+	s.conn, s.reader, s.failures = conn, reader, 0
+	return conn, reader, nil
+}
 
-	var v []string
-	for {
-		res, err = reader.ReadString('\n')
-		//		fmt.Println(res)
+// connect dials upsd and, if set, starts TLS and logs in.
+func (s *UPS) connect(t *sensor.Trace) (net.Conn, *bufio.Reader, error) {
+	conn, err := sensor.DialTimeout("tcp", s.Host, timeOut)
+	t.Mark(s.stage + "dial")
+	if err != nil {
+		return nil, nil, errors.New("failed to connect: " + err.Error())
+	}
+	conn.SetDeadline(time.Now().Add(timeOut))
+	reader := bufio.NewReader(conn)
+	if s.TLS != nil {
+		tc, err := s.starttls(conn, reader)
+		t.Mark(s.stage + "starttls")
+		if err != nil {
+			conn.Close()
+			return nil, nil, errors.New("STARTTLS failed: " + err.Error())
+		}
+		conn, reader = tc, bufio.NewReader(tc)
+	}
+	if s.Username != "" || s.Password != "" {
+		err = s.login(conn, reader)
+		t.Mark(s.stage + "login")
 		if err != nil {
+			conn.Close()
+			return nil, nil, errors.New("login failed: " + err.Error())
+		}
+	}
+	return conn, reader, nil
+}
+
+// ping checks the connection with GET UPSDESC, which any upsd answers in a
+// line, with the description or an error.
+func (s *UPS) ping() error {
+	s.conn.SetDeadline(time.Now().Add(timeOut))
+	if _, err := fmt.Fprint(s.conn, "GET UPSDESC "+s.Ups+"\n"); err != nil {
+		return err
+	}
+	res, err := readLine(s.reader)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(res, "UPSDESC ") && !strings.HasPrefix(res, "ERR ") {
+		return errors.New("unexpected answer: " + strings.TrimSpace(res))
+	}
+	return nil
+}
+
+// disconnect closes the connection, to reconnect at the next scrape.
+func (s *UPS) disconnect() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn, s.reader = nil, nil
+	}
+	// The upsd connected to next may have other variables.
+	s.keys = nil
+}
+
+// Close closes the connections to upsd.
+func (s Sensor) Close() error {
+	for _, u := range s.UPSes {
+		u.mutex.Lock()
+		for _, src := range u.sources() {
+			if src.conn != nil {
+				fmt.Fprint(src.conn, "LOGOUT\n")
+			}
+			src.disconnect()
+		}
+		u.mutex.Unlock()
+	}
+	return nil
+}
+
+// starttls switches conn to TLS.
+func (s *UPS) starttls(conn net.Conn, reader *bufio.Reader) (net.Conn, error) {
+	fmt.Fprint(conn, "STARTTLS\n")
+	res, err := readLine(reader)
+	if err != nil {
+		return nil, err
+	}
+	if res = strings.TrimSpace(res); res != "OK STARTTLS" {
+		return nil, errors.New("upsd answered " + res)
+	}
+	return s.TLS.Client(conn, s.Host)
+}
+
+// login sends USERNAME and PASSWORD, as far as they are set.
+func (s *UPS) login(conn net.Conn, reader *bufio.Reader) error {
+	for _, cmd := range [][2]string{{"USERNAME", s.Username}, {"PASSWORD", s.Password}} {
+		if cmd[1] == "" {
+			continue
+		}
+		fmt.Fprintf(conn, "%s %s\n", cmd[0], quote(cmd[1]))
+		res, err := readLine(reader)
+		if err != nil {
+			return err
+		}
+		if res = strings.TrimSpace(res); res != "OK" {
+			return errors.New(cmd[0] + " returned " + res)
+		}
+	}
+	return nil
+}
+
+// checkChain checks what it takes for the hosts of the UPS to shut down on
+// low battery, with vars read from src: that upsd answers, that the driver
+// reports ups.status and battery.charge.low, and that upsmon is logged in to
+// upsd, by NUMLOGINS. It returns the failed check, or "".
+func (s *UPS) checkChain(src *UPS, vars map[string]string) string {
+	switch {
+	case vars == nil:
+		return "upsd does not answer"
+	case vars["ups.status"] == "":
+		return "no ups.status"
+	case vars["battery.charge.low"] == "":
+		return "no battery.charge.low"
+	}
+	logins, err := src.numLogins()
+	if err != nil {
+		return "no NUMLOGINS: " + err.Error()
+	}
+	if logins == 0 {
+		return "no upsmon logged in"
+	}
+	return ""
+}
+
+// chain returns upsc_shutdown_chain_ok of the failed check of checkChain,
+// logging when it changes.
+func (s *UPS) chain(failure string) sensor.Sample {
+	if failure != s.chainFailure {
+		if failure != "" {
 			sensor.Incident()
-			log.Printf("Upsc %s@%s, connection error while reading: %s\n", s.Ups, s.Host, err.Error())
-			return "", nil
-		}
-		v = s.Re.FindStringSubmatch(res)
-		if len(v) == 3 {
-			if value, exists := upscVarFloat[v[1]]; exists {
-				var reading float64
-				if mapping, mexists := sensorStringMapping[v[2]]; mexists {
-					reading = mapping
-				} else {
-					reading, err = strconv.ParseFloat(v[2], 64)
-					if err != nil {
-						sensor.Incident()
-						log.Printf("Upsc %s@%s, could not parse %s. Error: %s\n", s.Ups, s.Host, v[1], err.Error())
-						break
-					}
-				}
-				out += fmt.Sprintf("%s%s %.2f\n", value, s.Labels, reading)
-			}
-		}
-
-		if res == s.EndToken {
-			break
+			slog.Warn("Upsc shutdown chain broken", "ups", s.Ups+"@"+s.Host, "check", failure)
+		} else {
+			slog.Info("Upsc shutdown chain complete again", "ups", s.Ups+"@"+s.Host)
 		}
+		s.chainFailure = failure
 	}
+	value := 0.0
+	if failure == "" {
+		value = 1
+	}
+	return sensor.Sample{Name: "upsc_shutdown_chain_ok", Labels: s.Labels, Value: value}
+}
 
-	return out, nil
+// numLogins returns the number of clients logged in to the UPS, upsmon
+// instances, with GET NUMLOGINS on the connection of the last scrape.
+func (s *UPS) numLogins() (int, error) {
+	if s.conn == nil {
+		return 0, errors.New("not connected")
+	}
+	s.conn.SetDeadline(time.Now().Add(timeOut))
+	if _, err := fmt.Fprint(s.conn, "GET NUMLOGINS "+s.Ups+"\n"); err != nil {
+		s.disconnect()
+		return 0, err
+	}
+	res, err := readLine(s.reader)
+	if err != nil {
+		s.disconnect()
+		return 0, err
+	}
+	// NUMLOGINS UPS 2
+	fields := strings.Fields(res)
+	if len(fields) != 3 || fields[0] != "NUMLOGINS" {
+		return 0, errors.New("upsd answered " + strings.TrimSpace(res))
+	}
+	return strconv.Atoi(fields[2])
+}
+
+// readLine reads a line of the upsd protocol. Lines longer than the buffer of
+// reader are an error rather than grown without bound.
+func readLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		err = errors.New("line too long")
+	}
+	return string(line), err
+}
+
+// quote quotes an argument of the upsd protocol.
+func quote(arg string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+}
+
+// info returns upsc_ups_info, labeled with the identifiers of the UPS, if the
+// driver reports any.
+func (s *UPS) info(vars map[string]string) []sensor.Sample {
+	var pairs []string
+	for _, v := range infoVars {
+		for _, key := range v.keys {
+			if value := strings.TrimSpace(unquote(vars[key])); value != "" {
+				pairs = append(pairs, v.label, value)
+				break
+			}
+		}
+	}
+	if pairs == nil {
+		return nil
+	}
+	return []sensor.Sample{{Name: "upsc_ups_info", Labels: s.Labels.With(pairs...), Value: 1}}
+}
+
+// unquote undoes quote on a value of LIST VAR.
+func unquote(value string) string {
+	return strings.NewReplacer(`\\`, `\`, `\"`, `"`).Replace(value)
+}
+
+// battery returns whether the battery needs to be replaced and its age.
+func (s *UPS) battery(vars map[string]string) (out []sensor.Sample) {
+	if status, exists := vars["ups.status"]; exists {
+		replace := 0.0
+		for _, flag := range strings.Fields(status) {
+			if flag == "RB" {
+				replace = 1
+			}
+		}
+		out = append(out, sensor.Sample{Name: "upsc_battery_replace_needed", Labels: s.Labels, Value: replace})
+	}
+
+	for _, name := range []string{"battery.date", "battery.mfr.date"} {
+		date, exists := vars[name]
+		if !exists {
+			continue
+		}
+		for _, layout := range batteryDateLayouts {
+			if t, err := time.Parse(layout, strings.TrimSpace(date)); err == nil {
+				return append(out, sensor.Sample{Name: "upsc_battery_age_seconds", Labels: s.Labels,
+					Value: time.Since(t).Seconds()})
+			}
+		}
+		if !s.badDate[name] { // Some drivers report "not set", say so once.
+			slog.Warn("Upsc could not parse date", "ups", s.Ups+"@"+s.Host, "var", name, "value", date)
+			s.badDate[name] = true
+		}
+	}
+	return out
+}
+
+// observeTransfers returns the transfer count and reason. If the driver
+// does not report the count, transfers are counted from ups.status going
+// from online to on battery, since the start of the exporter.
+func (s *UPS) observeTransfers(vars map[string]string) (out []sensor.Sample) {
+	if status, exists := vars["ups.status"]; exists {
+		onBattery := false
+		for _, flag := range strings.Fields(status) {
+			if flag == "OB" {
+				onBattery = true
+			}
+		}
+		if s.statusKnown && onBattery && !s.onBattery {
+			s.transfers++
+		}
+		s.statusKnown, s.onBattery = true, onBattery
+	}
+
+	if count, exists := vars[transferCount]; exists {
+		value, err := strconv.ParseFloat(count, 64)
+		if err != nil {
+			sensor.Incident()
+			slog.Warn("Upsc could not parse variable", "ups", s.Ups+"@"+s.Host, "var", transferCount, "err", err)
+		} else {
+			out = append(out, sensor.Sample{Name: "upsc_input_transfers_total", Labels: s.Labels, Value: value})
+		}
+	} else if s.statusKnown {
+		out = append(out, sensor.Sample{Name: "upsc_input_transfers_total", Labels: s.Labels, Value: s.transfers})
+	}
+
+	if reason := vars[transferReason]; reason != "" {
+		out = append(out, sensor.Sample{Name: "upsc_input_transfer_reason",
+			Labels: s.Labels.With("reason", reason), Value: 1})
+	}
+	return out
 }
 
-func init() {
-	sensor.RegisterCollector("upsc", NewSensor, suggestedScrapeInterval,
-		sensorsType, sensorsHelp, description)
+// Collector is the upsc sensor, for the main package to register.
+var Collector = sensor.CollectorEntry{
+	Name:            "upsc",
+	New:             NewSensor,
+	DefaultInterval: suggestedScrapeInterval,
+	Type:            sensorsType,
+	Help:            sensorsHelp,
+	Description:     description,
+	Ranges:          sensorsRange,
+	States:          sensorsState,
+	Mappings:        sensorsMapping,
 }
@@ -0,0 +1,58 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package sensor_upsc
+
+import (
+	"bufio"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func FuzzReadList(f *testing.F) {
+	f.Add("BEGIN LIST VAR ups\nVAR ups battery.charge \"97\"\nVAR ups ups.model \"Back-UPS \\\"XS\\\" 700\"\nEND LIST VAR ups\n")
+	f.Add("ERR UNKNOWN-UPS\n")
+	f.Add("BEGIN LIST VAR ups\nVAR ups ups.status \"OL\"")
+	f.Fuzz(func(t *testing.T, answer string) {
+		s := &UPS{Ups: "ups", Re: regexp.MustCompile(`VAR ups (\S+) "(.*)"`),
+			BeginToken: "BEGIN LIST VAR ups\n", EndToken: "END LIST VAR ups\n"}
+		var received strings.Builder
+		vars, err := s.readList(bufio.NewReader(strings.NewReader(answer)), &received, nil)
+		if err != nil {
+			return
+		}
+		if len(vars) > maxVars {
+			t.Errorf("%d variables, more than %d", len(vars), maxVars)
+		}
+		if !strings.HasPrefix(answer, received.String()) {
+			t.Errorf("received %q is not the start of the answer", received.String())
+		}
+	})
+}
+
+func FuzzReading(f *testing.F) {
+	f.Add("battery.charge", "97")
+	f.Add("ups.status", "OL CHRG")
+	f.Add("input.L1-N.voltage", "231.5")
+	f.Fuzz(func(t *testing.T, key, value string) {
+		s := Reading(key, value)
+		if s.Name != "" && !strings.HasPrefix(s.Name, "upsc_") {
+			t.Errorf("metric name %q of %q", s.Name, key)
+		}
+	})
+}
@@ -0,0 +1,237 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package sensor_upsc
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+// DefaultUpslogFormat is the format of the lines upslog writes without -f.
+const DefaultUpslogFormat = "%TIME @Y@m@d @H@M@S% %VAR battery.charge% %VAR input.voltage% " +
+	"%VAR ups.load% [%VAR ups.status%] %VAR ups.temperature% %VAR input.frequency%"
+
+// strftimeLayouts are the Go layouts of the conversions of strftime that
+// upslog takes in %TIME%, with @ for %.
+var strftimeLayouts = map[byte]string{
+	'Y': "2006", 'y': "06", 'm': "01", 'd': "02", 'e': "_2",
+	'H': "15", 'I': "03", 'M': "04", 'S': "05", 'p': "PM",
+	'b': "Jan", 'h': "Jan", 'B': "January", 'a': "Mon", 'A': "Monday",
+	'T': "15:04:05", 'D': "01/02/06", 'F': "2006-01-02", 'z': "-0700", 'Z': "MST",
+	'@': "@",
+}
+
+// An upslogField is what a group of the expression of a format matches.
+type upslogField struct {
+	kind string // TIME, ETIME, UPSHOST or VAR
+	arg  string // the layout of TIME, the key of VAR
+}
+
+// ReadUpslog reads the log of upslog, written in format, see upslog -f, and
+// calls f with the time and readings of every line, named as the sensor
+// names them, with labels, or those of %UPSHOST% if the format has it. Times
+// without a zone are local, those without a year are taken to be within the
+// year up to now. Lines that do not match the format are skipped
+// and counted; values NA, of variables upsd did not have, and strings are
+// left out.
+func ReadUpslog(r io.Reader, format string, labels sensor.Labels, now time.Time, f func(time.Time, []sensor.Sample)) (skipped int, err error) {
+	re, fields, err := upslogExpr(format)
+	if err != nil {
+		return 0, err
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		m := re.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			skipped++
+			continue
+		}
+		var t time.Time
+		lineLabels := labels
+		var out []sensor.Sample
+		for i, field := range fields {
+			value := m[i+1]
+			switch field.kind {
+			case "TIME":
+				t, err = time.ParseInLocation(field.arg, value, time.Local)
+				if err == nil && t.Year() == 0 {
+					if t = t.AddDate(now.Year(), 0, 0); t.After(now) {
+						t = t.AddDate(-1, 0, 0)
+					}
+				}
+			case "ETIME":
+				var seconds int64
+				seconds, err = strconv.ParseInt(value, 10, 64)
+				t = time.Unix(seconds, 0)
+			case "UPSHOST":
+				ups, host, found := strings.Cut(value, "@")
+				lineLabels = sensor.Labels{"ups": ups}
+				if found {
+					lineLabels["host"] = strings.Split(host, ":")[0]
+				}
+			case "VAR":
+				if field.arg == "ups.status" {
+					value = status(value)
+				}
+				// Imported samples bypass the exporter, which maps them
+				// otherwise.
+				if sample := Reading(field.arg, value); sample.Name != "" && sensor.MapText(sensorsMapping, &sample) {
+					out = append(out, sample)
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		if err != nil || t.IsZero() {
+			err = nil
+			skipped++
+			continue
+		}
+		for i := range out {
+			out[i].Labels = lineLabels
+		}
+		f(t, out)
+	}
+	return skipped, scanner.Err()
+}
+
+// upslogExpr returns the regular expression of the lines of format and the
+// fields of its groups.
+func upslogExpr(format string) (*regexp.Regexp, []upslogField, error) {
+	var expr strings.Builder
+	var fields []upslogField
+	expr.WriteString(`^\s*`)
+	// Text between the fields, with any run of spaces matching any other.
+	literal := func(s string) {
+		space := false
+		for _, r := range s {
+			if r == ' ' || r == '\t' {
+				space = true
+				continue
+			}
+			if space {
+				expr.WriteString(`\s+`)
+				space = false
+			}
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+		if space {
+			expr.WriteString(`\s+`)
+		}
+	}
+	for format != "" {
+		start := strings.IndexByte(format, '%')
+		if start < 0 {
+			literal(format)
+			break
+		}
+		end := strings.IndexByte(format[start+1:], '%')
+		if end < 0 {
+			return nil, nil, errors.New("unterminated % in upslog format")
+		}
+		if start > 0 {
+			literal(format[:start])
+		}
+		kind, arg, _ := strings.Cut(format[start+1:start+1+end], " ")
+		format = format[start+end+2:]
+		switch kind = strings.ToUpper(kind); kind {
+		case "TIME":
+			if arg == "" {
+				arg = "@Y@m@d @H@M@S"
+			}
+			layout, err := goLayout(arg)
+			if err != nil {
+				return nil, nil, err
+			}
+			fields = append(fields, upslogField{kind, layout})
+			// As many words as the layout has.
+			words := strings.Repeat(`\S+`, len(strings.Fields(layout)))
+			expr.WriteString(`(` + strings.ReplaceAll(words, `+\S`, `+\s+\S`) + `)`)
+		case "ETIME":
+			fields = append(fields, upslogField{kind, ""})
+			expr.WriteString(`(\d+)`)
+		case "UPSHOST":
+			fields = append(fields, upslogField{kind, ""})
+			expr.WriteString(`(\S+)`)
+		case "VAR":
+			if arg == "" {
+				return nil, nil, errors.New("%VAR% without a variable in upslog format")
+			}
+			fields = append(fields, upslogField{kind, arg})
+			expr.WriteString(`(.*?)`)
+		case "HOST", "PID":
+			expr.WriteString(`\S*`)
+		default:
+			return nil, nil, errors.New("unknown %" + kind + "% in upslog format")
+		}
+	}
+	expr.WriteString(`\s*$`)
+	re, err := regexp.Compile(expr.String())
+	return re, fields, err
+}
+
+// goLayout converts the strftime format of %TIME%, with @ for %, to a Go
+// time layout.
+func goLayout(format string) (string, error) {
+	var layout strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '@' {
+			layout.WriteByte(format[i])
+			continue
+		}
+		if i++; i == len(format) {
+			return "", errors.New("upslog time format ends in @")
+		}
+		l, exists := strftimeLayouts[format[i]]
+		if !exists {
+			return "", errors.New("unknown @" + string(format[i]) + " in upslog time format")
+		}
+		layout.WriteString(l)
+	}
+	return layout.String(), nil
+}
+
+// status reduces ups.status to the flags of sensorsMapping: upslog logs
+// it as upsd has it, with others like CHRG.
+func status(value string) string {
+	flags := make(map[string]bool)
+	for _, flag := range strings.Fields(value) {
+		flags[flag] = true
+	}
+	fsd := ""
+	if flags["FSD"] {
+		fsd = "FSD "
+	}
+	switch {
+	case flags["LB"]:
+		return "LB"
+	case flags["OB"]:
+		return fsd + "OB"
+	case flags["OL"]:
+		return fsd + "OL"
+	}
+	return value
+}
@@ -0,0 +1,272 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package sensor_upsd monitors upsd, the NUT server, rather than the UPSes it
+serves: whether it answers, how fast, its version and protocol version and
+how many UPSes it knows of. Give the address of upsd as option, HOST or
+HOST:PORT, default localhost:3493:
+
+	sensor_exporter upsd,,nas.local
+
+The commands used, VER, NETVER and LIST UPS, need no login. See
+http://networkupstools.org/docs/developer-guide.chunked/ar01s09.html
+
+The TLS options of the tlsconfig package, after the address, switch to TLS
+with STARTTLS first:
+
+	sensor_exporter upsd,,nas.local,tls.ca_file=/etc/ssl/nut-ca.pem
+*/
+package sensor_upsd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+	"github.com/fmoessbauer/sensor_exporter/tlsconfig"
+)
+
+var suggestedScrapeInterval = time.Duration(30 * time.Second)
+var description = `Upsd monitors a NUT upsd server itself: whether it answers, its response time,
+version, protocol version and the number of UPSes it serves. Its option is the
+address of upsd, default localhost:3493, optionally followed by tls or the
+tls.* options to use STARTTLS:
+
+  sensor_exporter upsd,,HOST`
+var timeOut = 10 * time.Second
+
+// maxUPSes is the most lines a LIST UPS answer may have; a server serves a
+// few, so more is a broken or hostile one streaming without end.
+const maxUPSes = 10000
+
+// VER answers like: Network UPS Tools upsd 2.8.0 - http://www.networkupstools.org/
+var versionRe = regexp.MustCompile(`upsd (\S+)`)
+
+type Sensor struct {
+	Host   string
+	Labels sensor.Labels
+	TLS    *tlsconfig.Config // nil for plain text
+}
+
+func NewSensor(opts string) (sensor.Collector, error) {
+	args := strings.Split(opts, ",")
+	host := args[0]
+	if host == "tls" || strings.HasPrefix(host, "tls.") { // no address, localhost
+		host, args = "", append([]string{""}, args...)
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	if strings.Contains(host, "@") || strings.Contains(host, "=") {
+		return nil, errors.New("Upsd, expected HOST or HOST:PORT, got: " + opts)
+	}
+	s := Sensor{}
+	var tlsConf tlsconfig.Config
+	for _, opt := range args[1:] {
+		ok, err := tlsConf.Option(opt)
+		if !ok {
+			err = errors.New("unknown option")
+		}
+		if err != nil {
+			return nil, errors.New("Upsd, bad option " + opt + ": " + err.Error())
+		}
+	}
+	if tlsConf.Enabled {
+		if err := tlsConf.Check(); err != nil {
+			return nil, errors.New("Upsd, bad TLS options: " + err.Error())
+		}
+		s.TLS = &tlsConf
+	}
+	label := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		label = h
+	} else {
+		host = net.JoinHostPort(host, "3493")
+	}
+	s.Host, s.Labels = host, sensor.Labels{"host": label}
+	return s, nil
+}
+
+func (s Sensor) Scrape() (out []sensor.Sample, e error) {
+	return s.ScrapeContext(context.Background(), nil)
+}
+
+// ScrapeTrace scrapes, marking the dial, starttls, ver, netver and list
+// stages.
+func (s Sensor) ScrapeTrace(t *sensor.Trace) (out []sensor.Sample, e error) {
+	return s.ScrapeContext(context.Background(), t)
+}
+
+// ScrapeContext scrapes like ScrapeTrace, giving up when ctx is done.
+func (s Sensor) ScrapeContext(ctx context.Context, t *sensor.Trace) (out []sensor.Sample, e error) {
+	ctx, cancel := context.WithTimeout(ctx, timeOut)
+	defer cancel()
+	start := time.Now()
+	conn, err := sensor.Dial(ctx, "tcp", s.Host)
+	t.Mark("dial")
+	if err != nil {
+		sensor.Incident()
+		slog.Error("Upsd failed to connect", "host", s.Host, "err", err)
+		return s.down(), nil
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	// Cancelling ctx before its deadline interrupts the commands too.
+	defer context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })()
+	reader := bufio.NewReader(conn)
+	if s.TLS != nil {
+		conn, err = starttls(conn, reader, s.TLS, s.Host)
+		t.Mark("starttls")
+		if err != nil {
+			sensor.Incident()
+			slog.Error("Upsd STARTTLS failed", "host", s.Host, "err", err)
+			return s.down(), nil
+		}
+		reader = bufio.NewReader(conn)
+	}
+	connected := time.Now()
+
+	version, err := command(conn, reader, "VER")
+	t.Mark("ver")
+	responded := time.Now()
+	if err != nil {
+		sensor.Incident()
+		slog.Error("Upsd VER failed", "host", s.Host, "err", err)
+		return s.down(), nil
+	}
+	// Very old servers do not know NETVER, they are still up.
+	protocol, err := command(conn, reader, "NETVER")
+	t.Mark("netver")
+	if err != nil {
+		slog.Warn("Upsd NETVER failed", "host", s.Host, "err", err)
+		protocol = ""
+	}
+	count, err := countUPSes(conn, reader)
+	t.Mark("list")
+	if err != nil {
+		sensor.Incident()
+		slog.Error("Upsd LIST UPS failed", "host", s.Host, "err", err)
+		return s.down(), nil
+	}
+	fmt.Fprint(conn, "LOGOUT\n")
+	if v := versionRe.FindStringSubmatch(version); v != nil {
+		version = v[1]
+	}
+
+	out = append(out, sensor.Sample{Name: "upsd_up", Labels: s.Labels, Value: 1})
+	out = append(out, sensor.Sample{Name: "upsd_connect_seconds", Labels: s.Labels, Value: connected.Sub(start).Seconds()})
+	out = append(out, sensor.Sample{Name: "upsd_response_seconds", Labels: s.Labels, Value: responded.Sub(connected).Seconds()})
+	out = append(out, sensor.Sample{Name: "upsd_info",
+		Labels: s.Labels.With("version", version, "protocol", protocol), Value: 1})
+	out = append(out, sensor.Sample{Name: "upsd_ups_count", Labels: s.Labels, Value: float64(count)})
+	return out, nil
+}
+
+// down are the samples of a server that does not answer.
+func (s Sensor) down() []sensor.Sample {
+	return []sensor.Sample{{Name: "upsd_up", Labels: s.Labels, Value: 0}}
+}
+
+// starttls switches conn to TLS.
+func starttls(conn net.Conn, reader *bufio.Reader, c *tlsconfig.Config, host string) (net.Conn, error) {
+	if _, err := command(conn, reader, "STARTTLS"); err != nil {
+		return nil, err
+	}
+	return c.Client(conn, host)
+}
+
+// command sends cmd and returns the one line answer.
+func command(conn io.Writer, reader *bufio.Reader, cmd string) (string, error) {
+	fmt.Fprint(conn, cmd+"\n")
+	res, err := readLine(reader)
+	if err != nil {
+		return "", err
+	}
+	res = strings.TrimSpace(res)
+	if strings.HasPrefix(res, "ERR ") {
+		return "", errors.New(res)
+	}
+	return res, nil
+}
+
+// countUPSes sends LIST UPS and counts the UPS lines of the answer.
+func countUPSes(conn io.Writer, reader *bufio.Reader) (int, error) {
+	res, err := command(conn, reader, "LIST UPS")
+	if err != nil {
+		return 0, err
+	}
+	if res != "BEGIN LIST UPS" {
+		return 0, errors.New("unexpected response: " + res)
+	}
+	count := 0
+	for lines := 0; ; lines++ {
+		if lines == maxUPSes {
+			return 0, errors.New("too many UPSes")
+		}
+		res, err = readLine(reader)
+		if err != nil {
+			return 0, err
+		}
+		res = strings.TrimSpace(res)
+		if res == "END LIST UPS" {
+			return count, nil
+		}
+		if strings.HasPrefix(res, "UPS ") {
+			count++
+		}
+	}
+}
+
+// readLine reads a line of the upsd protocol. Lines longer than the buffer of
+// reader are an error rather than grown without bound.
+func readLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		err = errors.New("line too long")
+	}
+	return string(line), err
+}
+
+// Collector is the upsd sensor, for the main package to register.
+var Collector = sensor.CollectorEntry{
+	Name:            "upsd",
+	New:             NewSensor,
+	DefaultInterval: suggestedScrapeInterval,
+	Type: []string{"# TYPE upsd_up gauge",
+		"# TYPE upsd_connect_seconds gauge",
+		"# TYPE upsd_response_seconds gauge",
+		"# TYPE upsd_info gauge",
+		"# TYPE upsd_ups_count gauge"},
+	Help: []string{"# HELP upsd_up Whether upsd answered the last scrape.",
+		"# HELP upsd_connect_seconds Time to connect to upsd.",
+		"# HELP upsd_response_seconds Time upsd took to answer VER.",
+		"# HELP upsd_info Version and network protocol version of upsd, always 1.",
+		"# HELP upsd_ups_count Number of UPSes upsd serves."},
+	Unit: []string{"# UNIT upsd_connect_seconds seconds",
+		"# UNIT upsd_response_seconds seconds"},
+	Description: description,
+}
@@ -0,0 +1,43 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package sensor_upsd
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+)
+
+func FuzzCountUPSes(f *testing.F) {
+	f.Add("BEGIN LIST UPS\nUPS ups \"Back-UPS\"\nUPS pdu \"PDU\"\nEND LIST UPS\n")
+	f.Add("ERR ACCESS-DENIED\n")
+	f.Add("BEGIN LIST UPS\nUPS ups")
+	f.Fuzz(func(t *testing.T, answer string) {
+		count, err := countUPSes(io.Discard, bufio.NewReader(strings.NewReader(answer)))
+		if err != nil {
+			return
+		}
+		if count > maxUPSes {
+			t.Errorf("%d UPSes, more than %d", count, maxUPSes)
+		}
+		if !strings.HasPrefix(answer, "BEGIN LIST UPS") {
+			t.Errorf("counted %d UPSes of %q", count, answer)
+		}
+	})
+}
@@ -0,0 +1,308 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package sensor_w1 reads 1-Wire temperature probes, the DS18B20 and its
+relatives DS18S20, DS1822, DS1825 and DS28EA00, from the w1-therm kernel
+driver under /sys/bus/w1/devices, e.g. on a Raspberry Pi with the w1-gpio
+overlay, or from an owserver of owfs over the network.
+
+Probes are found anew on every scrape, so probes plugged in later show up.
+Each reading is labeled with the sensor_id of the probe, like
+28-000005e2fdc3, and its alias, which the alias option maps, repeatable, or
+else is the sensor_id too:
+
+	sensor_exporter w1
+	sensor_exporter w1,,alias=28-000005e2fdc3:rack1_top,alias=28-0316a2794bff:rack1_bottom
+	sensor_exporter w1,,owserver=pi.local:4304
+
+The owserver protocol is described at
+https://owfs.org/index_php_page_owserver-protocol.html
+*/
+package sensor_w1
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+var suggestedScrapeInterval = time.Duration(30 * time.Second)
+var description = `W1 reads 1-Wire temperature probes (DS18B20, DS18S20, DS1822, DS1825,
+DS28EA00) from /sys/bus/w1/devices or, with owserver=HOST[:PORT], from an
+owfs owserver. Readings are labeled with the sensor_id and an alias, mapped
+with alias=SENSOR_ID:NAME, repeatable:
+
+  sensor_exporter w1,,alias=28-000005e2fdc3:rack1_top`
+
+// Root is the directory of the 1-Wire devices of the kernel.
+var Root = "/sys/bus/w1/devices"
+
+var timeOut = 10 * time.Second
+
+// families are the 1-Wire family codes of the temperature probes.
+var families = []string{"28", "10", "22", "3b", "42"}
+
+// powerOnReset is the reading of a DS18B20 that has not converted yet, e.g.
+// after a brown-out; it is no temperature.
+const powerOnReset = 85.0
+
+type Sensor struct {
+	Owserver string
+	Aliases  map[string]string
+}
+
+func NewSensor(opts string) (sensor.Collector, error) {
+	s := &Sensor{Aliases: make(map[string]string)}
+	for _, opt := range strings.Split(opts, ",") {
+		if opt == "" {
+			continue
+		}
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("W1, could not understand option: " + opt)
+		}
+		switch kv[0] {
+		case "alias":
+			a := strings.SplitN(kv[1], ":", 2)
+			if len(a) != 2 || a[1] == "" {
+				return nil, errors.New("W1, expected alias=SENSOR_ID:NAME, got: " + kv[1])
+			}
+			s.Aliases[sensorID(a[0])] = a[1]
+		case "owserver":
+			s.Owserver = kv[1]
+			if _, _, err := net.SplitHostPort(s.Owserver); err != nil {
+				s.Owserver = net.JoinHostPort(s.Owserver, "4304")
+			}
+		default:
+			return nil, errors.New("W1, unknown option: " + kv[0])
+		}
+	}
+	if s.Owserver == "" {
+		if _, err := os.Stat(Root); err != nil {
+			return nil, errors.New("W1 needs the w1 kernel drivers, e.g. dtoverlay=w1-gpio on a Raspberry Pi: " + err.Error())
+		}
+	}
+	return s, nil
+}
+
+// sensorID returns the ID of a probe as the kernel names it, 28-000005e2fdc3,
+// also if given as owfs does, 28.000005E2FDC3.
+func sensorID(id string) string {
+	return strings.ToLower(strings.Replace(id, ".", "-", 1))
+}
+
+func (s *Sensor) Scrape() (out []sensor.Sample, e error) {
+	var temps map[string]float64
+	var err error
+	if s.Owserver != "" {
+		temps, err = s.readOwserver()
+	} else {
+		temps, err = readSysfs()
+	}
+	if err != nil {
+		sensor.Incident()
+		slog.Error("W1 could not read the probes", "err", err)
+		return nil, nil
+	}
+	for id, temp := range temps {
+		alias, ok := s.Aliases[id]
+		if !ok {
+			alias = id
+		}
+		out = append(out, sensor.Sample{Name: "w1_temperature_celsius",
+			Labels: sensor.Labels{"sensor_id": id, "alias": alias}, Value: temp})
+	}
+	return out, nil
+}
+
+// readSysfs reads the probes of the w1-therm driver. A probe that fails is
+// logged and left out.
+func readSysfs() (map[string]float64, error) {
+	temps := make(map[string]float64)
+	for _, family := range families {
+		dirs, err := filepath.Glob(filepath.Join(Root, family+"-*"))
+		if err != nil {
+			return nil, err
+		}
+		for _, dir := range dirs {
+			id := filepath.Base(dir)
+			temp, err := readSlave(filepath.Join(dir, "w1_slave"))
+			if err != nil {
+				sensor.Incident()
+				slog.Error("W1 could not read probe", "probe", id, "err", err)
+				continue
+			}
+			temps[id] = temp
+		}
+	}
+	return temps, nil
+}
+
+// readSlave reads a w1_slave file, like:
+//
+//	72 01 4b 46 7f ff 0e 10 57 : crc=57 YES
+//	72 01 4b 46 7f ff 0e 10 57 t=23125
+//
+// The driver reads the probe on every read of the file, so a failed CRC
+// check is retried once.
+func readSlave(file string) (float64, error) {
+	var err error
+	for try := 0; try < 2; try++ {
+		var data []byte
+		if data, err = os.ReadFile(file); err != nil {
+			return 0, err
+		}
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		if len(lines) != 2 || !strings.HasSuffix(lines[0], "YES") {
+			err = errors.New("CRC check failed")
+			continue
+		}
+		i := strings.LastIndex(lines[1], "t=")
+		if i < 0 {
+			return 0, errors.New("no temperature in: " + lines[1])
+		}
+		milli, err := strconv.Atoi(lines[1][i+2:])
+		if err != nil {
+			return 0, err
+		}
+		return checkTemp(float64(milli) / 1000)
+	}
+	return 0, err
+}
+
+func checkTemp(temp float64) (float64, error) {
+	if temp == powerOnReset {
+		return 0, errors.New("power-on reset value 85°C, the probe did not convert")
+	}
+	return temp, nil
+}
+
+// owserver message types.
+const (
+	msgRead   = 2
+	msgDirall = 7
+)
+
+// readOwserver lists the probes of the owserver and reads their
+// temperatures. A probe that fails is logged and left out.
+func (s *Sensor) readOwserver() (map[string]float64, error) {
+	dir, err := s.owRequest(msgDirall, "/")
+	if err != nil {
+		return nil, errors.New("dirall: " + err.Error())
+	}
+	temps := make(map[string]float64)
+	for _, path := range strings.Split(dir, ",") {
+		name := strings.TrimPrefix(path, "/")
+		if len(name) < 3 || !isProbe(strings.ToLower(name[:2])) {
+			continue
+		}
+		id := sensorID(name)
+		value, err := s.owRequest(msgRead, "/"+name+"/temperature")
+		var temp float64
+		if err == nil {
+			temp, err = strconv.ParseFloat(strings.TrimSpace(value), 64)
+		}
+		if err == nil {
+			temp, err = checkTemp(temp)
+		}
+		if err != nil {
+			sensor.Incident()
+			slog.Error("W1 could not read probe", "probe", id, "err", err)
+			continue
+		}
+		temps[id] = temp
+	}
+	return temps, nil
+}
+
+func isProbe(family string) bool {
+	for _, f := range families {
+		if f == family {
+			return true
+		}
+	}
+	return false
+}
+
+// owRequest sends a request to the owserver and returns the payload of its
+// answer. owserver closes the connection after every answer, unless asked
+// to keep it, so every request dials anew. Requests and answers have a
+// header of six big-endian int32: version, payload length, type (of the
+// request) or return value (of the answer), flags, size and offset.
+func (s *Sensor) owRequest(typ int32, path string) (string, error) {
+	conn, err := sensor.DialTimeout("tcp", s.Owserver, timeOut)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeOut))
+	r := bufio.NewReader(conn)
+
+	payload := append([]byte(path), 0)
+	header := []int32{0, int32(len(payload)), typ, 0, 8192, 0}
+	if err := binary.Write(conn, binary.BigEndian, header); err != nil {
+		return "", err
+	}
+	if _, err := conn.Write(payload); err != nil {
+		return "", err
+	}
+	for {
+		answer := make([]int32, 6)
+		if err := binary.Read(r, binary.BigEndian, answer); err != nil {
+			return "", err
+		}
+		// A payload length of -1 is a keep-alive of a slow request.
+		if answer[1] < 0 {
+			continue
+		}
+		if answer[2] < 0 {
+			return "", errors.New("owserver error " + strconv.Itoa(int(-answer[2])))
+		}
+		data := make([]byte, answer[1])
+		if _, err := io.ReadFull(r, data); err != nil {
+			return "", err
+		}
+		if size := int(answer[4]); size < len(data) {
+			data = data[:size]
+		}
+		return strings.TrimRight(string(data), "\x00"), nil
+	}
+}
+
+// Collector is the w1 sensor, for the main package to register.
+var Collector = sensor.CollectorEntry{
+	Name:            "w1",
+	New:             NewSensor,
+	DefaultInterval: suggestedScrapeInterval,
+	Type:            []string{"# TYPE w1_temperature_celsius gauge"},
+	Help:            []string{"# HELP w1_temperature_celsius Temperature of a 1-Wire probe."},
+	Unit:            []string{"# UNIT w1_temperature_celsius celsius"},
+	Description:     description,
+	// The range of the DS18B20 and DS18S20.
+	Ranges: map[string]sensor.Range{"w1_temperature_celsius": {Min: -55, Max: 125}},
+}
@@ -0,0 +1,417 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package sensor_weather reads the wind and rain sensors of DIY weather
+stations: a cup anemometer and a tipping bucket rain gauge with reed
+switches on GPIO lines, and a wind vane read through an IIO ADC.
+
+Pulses are counted in the background, see Start. Every scrape exposes the average wind
+speed since the last scrape, the gust (the highest 3 second average, as the
+WMO defines it), the wind direction and a rain counter.
+
+The wind vane of the Misol/SparkFun style stations is a resistor network
+that gives one of 16 resistances per direction. Wired as the lower half of a
+voltage divider with a pull-up resistor to the ADC reference voltage, its
+direction is decoded from the measured voltage.
+
+Options, comma separated:
+
+	chip=gpiochip0          GPIO chip of the reed switches
+	wind=17                 GPIO line of the anemometer
+	rain=27                 GPIO line of the rain gauge
+	vane=iio:device0/in_voltage0   IIO channel of the wind vane
+	vref=3300               ADC reference voltage in mV
+	pullup=10000            vane pull-up resistor in ohms
+	model=misol|davis       calibration preset (default misol)
+	windfactor=0.667        m/s per pulse per second, overrides the model
+	rainfactor=0.2794       mm per bucket tip, overrides the model
+	station=garden          station label
+
+Any of wind, rain and vane may be left out if the station lacks it.
+*/
+package sensor_weather
+
+import (
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/gpio"
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+var suggestedScrapeInterval = time.Duration(15 * time.Second)
+var description = `Weather counts anemometer and rain gauge pulses on GPIO lines and decodes a
+wind vane on an IIO ADC, exposing wind speed, gust, direction and rainfall.
+Main options: chip, wind and rain (GPIO lines), vane (IIO channel), model
+(misol or davis) and station (label):
+
+  sensor_exporter weather,,wind=17,rain=27,vane=iio:device0/in_voltage0,station=garden`
+
+var iioRoot = "/sys/bus/iio/devices"
+
+// Calibration presets: m/s per Hz of the anemometer, mm per rain tip.
+var models = map[string][2]float64{
+	"misol": {0.6667, 0.2794}, // 2.4 km/h per Hz
+	"davis": {1.00584, 0.2},   // 2.25 mph per Hz, metric bucket
+}
+
+// Vane resistances (ohms) of the Misol/SparkFun wind vane for each 22.5°.
+var vaneResistances = []float64{33000, 6570, 8200, 891, 1000, 688, 2200, 1410,
+	3900, 3140, 16000, 14120, 120000, 42120, 64900, 21880}
+
+var gustWindow = 3 // seconds
+
+type Sensor struct {
+	station    string
+	windFactor float64
+	rainFactor float64
+	vane       string
+	vref       float64
+	pullup     float64
+	hasRain    bool
+	labels     sensor.Labels
+	chip       string
+	windLine   int // GPIO line offsets, -1 if none
+	rainLine   int
+	stop       chan struct{} // closed by Stop
+
+	mutex      sync.Mutex
+	lines      []*gpio.Line // requested, nil while released
+	received   time.Time
+	windPulses uint64
+	rainTips   uint64
+	buckets    []uint64 // wind pulses of the last seconds, for gusts
+	gust       float64
+	lastScrape time.Time
+	lastPulses uint64
+	lineError  error
+}
+
+func NewSensor(opts string) (sensor.Collector, error) {
+	s := &Sensor{station: "default", vref: 3300, pullup: 10000,
+		windFactor: models["misol"][0], rainFactor: models["misol"][1],
+		chip: "gpiochip0", windLine: -1, rainLine: -1, stop: make(chan struct{})}
+	var windFactor, rainFactor float64
+	for _, opt := range strings.Split(opts, ",") {
+		if opt == "" {
+			continue
+		}
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("Weather, could not understand option: " + opt)
+		}
+		var err error
+		switch kv[0] {
+		case "chip":
+			s.chip = kv[1]
+		case "wind":
+			s.windLine, err = strconv.Atoi(kv[1])
+		case "rain":
+			s.rainLine, err = strconv.Atoi(kv[1])
+		case "vane":
+			s.vane = kv[1]
+		case "vref":
+			s.vref, err = strconv.ParseFloat(kv[1], 64)
+		case "pullup":
+			s.pullup, err = strconv.ParseFloat(kv[1], 64)
+		case "model":
+			m, exists := models[kv[1]]
+			if !exists {
+				err = errors.New("unknown model")
+			}
+			s.windFactor, s.rainFactor = m[0], m[1]
+		case "windfactor":
+			windFactor, err = strconv.ParseFloat(kv[1], 64)
+		case "rainfactor":
+			rainFactor, err = strconv.ParseFloat(kv[1], 64)
+		case "station":
+			s.station = kv[1]
+		default:
+			err = errors.New("unknown option")
+		}
+		if err != nil {
+			return nil, errors.New("Weather, bad option " + opt + ": " + err.Error())
+		}
+	}
+	if windFactor > 0 {
+		s.windFactor = windFactor
+	}
+	if rainFactor > 0 {
+		s.rainFactor = rainFactor
+	}
+	if s.windLine < 0 && s.rainLine < 0 && s.vane == "" {
+		return nil, errors.New("Weather needs at least one of wind, rain or vane.")
+	}
+	s.labels = sensor.Labels{"station": s.station}
+
+	if s.vane != "" {
+		if _, err := s.direction(); err != nil {
+			return nil, errors.New("Weather could not read wind vane: " + err.Error())
+		}
+	}
+	if s.windLine >= 0 {
+		s.buckets = make([]uint64, gustWindow)
+	}
+	s.hasRain = s.rainLine >= 0
+	lines, err := s.request()
+	if err != nil {
+		return nil, err
+	}
+	s.lines = lines
+	s.lastScrape = time.Now()
+	return s, nil
+}
+
+// request requests the lines of the anemometer and the rain gauge.
+func (s *Sensor) request() ([]*gpio.Line, error) {
+	// Reed switches close to ground, so pull up and count falling edges.
+	flags := gpio.Input | gpio.PullUp | gpio.EdgeFalling
+	var lines []*gpio.Line
+	if s.windLine >= 0 {
+		l, err := gpio.Request(s.chip, s.windLine, flags, time.Millisecond)
+		if err != nil {
+			return nil, errors.New("Weather could not request anemometer line: " + err.Error())
+		}
+		lines = append(lines, l)
+	}
+	if s.rainLine >= 0 {
+		l, err := gpio.Request(s.chip, s.rainLine, flags, 10*time.Millisecond)
+		if err != nil {
+			closeLines(lines)
+			return nil, errors.New("Weather could not request rain gauge line: " + err.Error())
+		}
+		lines = append(lines, l)
+	}
+	return lines, nil
+}
+
+func closeLines(lines []*gpio.Line) {
+	for _, l := range lines {
+		l.Close()
+	}
+}
+
+// Start counts the pulses on the lines, requested again if they were
+// released, and keeps the gusts, until a line fails or Stop is called.
+func (s *Sensor) Start() error {
+	s.mutex.Lock()
+	lines := s.lines
+	s.mutex.Unlock()
+	if lines == nil && (s.windLine >= 0 || s.rainLine >= 0) {
+		var err error
+		if lines, err = s.request(); err != nil {
+			return err
+		}
+	}
+	s.mutex.Lock()
+	s.lines, s.lineError = lines, nil
+	s.mutex.Unlock()
+
+	errs := make(chan error, len(lines))
+	for _, l := range lines {
+		counter := &s.rainTips
+		if l.Offset == s.windLine {
+			counter = &s.windPulses
+		}
+		go func() { errs <- s.count(l, counter) }()
+	}
+	var tick <-chan time.Time
+	if s.buckets != nil {
+		t := time.NewTicker(time.Second)
+		defer t.Stop()
+		tick = t.C
+	}
+	// Closing the lines ends the counting, on Stop or when one failed.
+	var err error
+	stop := s.stop
+	s.mutex.Lock()
+	last := s.windPulses
+	s.mutex.Unlock()
+	for i, running := 0, len(lines); running > 0 || stop != nil; {
+		select {
+		case e := <-errs:
+			running--
+			if err == nil {
+				err = e
+			}
+			closeLines(lines)
+			if stop != nil && running == 0 {
+				stop = nil
+			}
+		case <-stop:
+			stop = nil
+			closeLines(lines)
+		case <-tick:
+			last = s.gusts(i, last)
+			i++
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lines = nil
+	select {
+	case <-s.stop:
+		return nil
+	default:
+	}
+	s.lineError = err
+	return err
+}
+
+// Stop releases the lines, for Start to return.
+func (s *Sensor) Stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	select {
+	case <-s.stop:
+	default:
+		close(s.stop)
+	}
+}
+
+// Received is when the last pulse was counted.
+func (s *Sensor) Received() time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.received
+}
+
+func (s *Sensor) count(l *gpio.Line, counter *uint64) error {
+	for {
+		if _, err := l.WaitEdge(); err != nil {
+			return err
+		}
+		s.mutex.Lock()
+		*counter++
+		s.received = time.Now()
+		s.mutex.Unlock()
+	}
+}
+
+// gusts keeps the pulses of second i, last being the count of the one before,
+// and records the highest speed over the gust window. It returns the count.
+func (s *Sensor) gusts(i int, last uint64) uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.buckets[i%gustWindow] = s.windPulses - last
+	var sum uint64
+	for _, b := range s.buckets {
+		sum += b
+	}
+	if speed := float64(sum) / float64(gustWindow) * s.windFactor; speed > s.gust {
+		s.gust = speed
+	}
+	return s.windPulses
+}
+
+// direction reads the vane and returns the nearest of the 16 directions.
+func (s *Sensor) direction() (float64, error) {
+	parts := strings.SplitN(s.vane, "/", 2)
+	if len(parts) != 2 {
+		return 0, errors.New("vane must be device/channel, e.g. iio:device0/in_voltage0")
+	}
+	dir := filepath.Join(iioRoot, parts[0])
+	raw, err := readFloat(filepath.Join(dir, parts[1]+"_raw"))
+	if err != nil {
+		return 0, err
+	}
+	// The scale is per channel or shared by all voltage channels.
+	scale, err := readFloat(filepath.Join(dir, parts[1]+"_scale"))
+	if err != nil {
+		if scale, err = readFloat(filepath.Join(dir, "in_voltage_scale")); err != nil {
+			return 0, err
+		}
+	}
+	ratio := raw * scale / s.vref
+	best, bestDiff := 0, math.Inf(1)
+	for i, r := range vaneResistances {
+		if d := math.Abs(r/(r+s.pullup) - ratio); d < bestDiff {
+			best, bestDiff = i, d
+		}
+	}
+	return float64(best) * 22.5, nil
+}
+
+func readFloat(file string) (float64, error) {
+	dat, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(strings.TrimSpace(string(dat)), 64)
+}
+
+func (s *Sensor) Scrape() (out []sensor.Sample, e error) {
+	s.mutex.Lock()
+	if s.lineError != nil {
+		s.mutex.Unlock()
+		return nil, errors.New("Weather lost its gpio line: " + s.lineError.Error())
+	}
+	now := time.Now()
+	elapsed := now.Sub(s.lastScrape).Seconds()
+	pulses := s.windPulses - s.lastPulses
+	gust := s.gust
+	rain := s.rainTips
+	s.lastScrape, s.lastPulses, s.gust = now, s.windPulses, 0
+	s.mutex.Unlock()
+
+	if s.buckets != nil {
+		out = append(out, sensor.Sample{Name: "wind_speed_meters_per_second", Labels: s.labels, Value: float64(pulses) / elapsed * s.windFactor})
+		out = append(out, sensor.Sample{Name: "wind_gust_meters_per_second", Labels: s.labels, Value: gust})
+	}
+	if s.hasRain {
+		out = append(out, sensor.Sample{Name: "rain_millimeters_total", Labels: s.labels, Value: float64(rain) * s.rainFactor})
+	}
+	if s.vane != "" {
+		dir, err := s.direction()
+		if err != nil {
+			sensor.Incident()
+			slog.Error("Weather could not read wind vane", "station", s.station, "err", err)
+		} else {
+			out = append(out, sensor.Sample{Name: "wind_direction_degrees", Labels: s.labels, Value: dir})
+		}
+	}
+	return out, nil
+}
+
+// Collector is the weather sensor, for the main package to register.
+var Collector = sensor.CollectorEntry{
+	Name:            "weather",
+	New:             NewSensor,
+	DefaultInterval: suggestedScrapeInterval,
+	Type: []string{"# TYPE wind_speed_meters_per_second gauge",
+		"# TYPE wind_gust_meters_per_second gauge",
+		"# TYPE wind_direction_degrees gauge",
+		"# TYPE rain_millimeters_total counter"},
+	Help: []string{"# HELP wind_speed_meters_per_second Average wind speed since the last scrape.",
+		"# HELP wind_gust_meters_per_second Highest 3 second average wind speed since the last scrape.",
+		"# HELP wind_direction_degrees Direction the wind blows from, 0 is north.",
+		"# HELP rain_millimeters_total Rainfall since sensor_exporter started."},
+	Unit: []string{"# UNIT wind_speed_meters_per_second meters_per_second",
+		"# UNIT wind_gust_meters_per_second meters_per_second",
+		"# UNIT wind_direction_degrees degrees",
+		"# UNIT rain_millimeters_total millimeters"},
+	Description: description,
+}
@@ -0,0 +1,78 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package serial
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+)
+
+// DialTimeout is how long Connect waits for a network serial bridge.
+var DialTimeout = 10 * time.Second
+
+// An Opener opens the port of a device given as scheme://address, with the
+// line settings c if it has them.
+type Opener func(address string, c Config) (io.ReadWriteCloser, error)
+
+// backends open the devices given as scheme://address, by scheme.
+var backends = map[string]Opener{"tcp": dialTCP}
+
+// RegisterBackend makes Connect open the devices given as scheme://address
+// with open, from the init function of a file built in with a tag, e.g. for
+// RFC 2217 servers or USB adapters without a kernel driver. Backends are
+// pure Go, so that the exporter still cross-compiles without cgo.
+func RegisterBackend(scheme string, open Opener) {
+	backends[scheme] = open
+}
+
+// Connect opens device with the given line settings, like OpenConfig. A
+// device of the form scheme://address is opened by the backend of scheme
+// instead: tcp://host:port is a serial to network bridge, such as ser2net or
+// esp-link, which has the line settings in its own configuration; c is
+// ignored then.
+func Connect(device string, c Config) (io.ReadWriteCloser, error) {
+	if scheme, address, ok := strings.Cut(device, "://"); ok {
+		open, exists := backends[scheme]
+		if !exists {
+			return nil, errors.New("no serial backend for " + scheme + "://")
+		}
+		return open(address, c)
+	}
+	port, err := OpenConfig(device, c)
+	if err != nil {
+		return nil, err
+	}
+	if sensor.Faults == nil {
+		return port, nil
+	}
+	faulty, err := sensor.Faults.Port(device, port)
+	if err != nil {
+		port.Close()
+		return nil, err
+	}
+	return faulty, nil
+}
+
+// dialTCP connects to a serial to network bridge.
+func dialTCP(address string, c Config) (io.ReadWriteCloser, error) {
+	return sensor.DialTimeout("tcp", address, DialTimeout)
+}
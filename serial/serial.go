@@ -0,0 +1,49 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package serial opens serial ports in raw mode for sensors that talk to their
+devices over a UART or USB-serial adapter. It uses termios directly, so no
+cgo is needed and the exporter cross-compiles for any Linux architecture, like
+the MIPS of OpenWrt routers or the ARMv5 of old NAS boxes. Connect also
+reaches devices through other backends, like serial to network bridges.
+
+Local ports are only supported on Linux.
+*/
+package serial
+
+import "os"
+
+// Parity settings for Config.
+const (
+	ParityNone = iota
+	ParityEven
+	ParityOdd
+)
+
+// Config describes the line settings. The zero value of DataBits means 8.
+type Config struct {
+	Baud     int
+	DataBits int
+	Parity   int
+	StopBits int
+}
+
+// Open opens device at the given baud rate with 8N1 line settings.
+func Open(device string, baud int) (*os.File, error) {
+	return OpenConfig(device, Config{Baud: baud})
+}
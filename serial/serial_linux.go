@@ -0,0 +1,93 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package serial
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+var bauds = map[int]uint32{
+	1200:   syscall.B1200,
+	2400:   syscall.B2400,
+	4800:   syscall.B4800,
+	9600:   syscall.B9600,
+	19200:  syscall.B19200,
+	38400:  syscall.B38400,
+	57600:  syscall.B57600,
+	115200: syscall.B115200,
+}
+
+// OpenConfig opens device with the given line settings. The returned file
+// supports read deadlines.
+func OpenConfig(device string, c Config) (*os.File, error) {
+	speed, exists := bauds[c.Baud]
+	if !exists {
+		return nil, errors.New("unsupported baud rate " + strconv.Itoa(c.Baud))
+	}
+	f, err := os.OpenFile(device, os.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// The speed is that of Cflag, TCSETS ignores the others, which MIPS
+	// does not even have.
+	t := syscall.Termios{Cflag: speed | syscall.CREAD | syscall.CLOCAL}
+	switch c.DataBits {
+	case 0, 8:
+		t.Cflag |= syscall.CS8
+	case 7:
+		t.Cflag |= syscall.CS7
+	default:
+		f.Close()
+		return nil, errors.New("unsupported data bits " + strconv.Itoa(c.DataBits))
+	}
+	switch c.Parity {
+	case ParityEven:
+		t.Cflag |= syscall.PARENB
+	case ParityOdd:
+		t.Cflag |= syscall.PARENB | syscall.PARODD
+	}
+	if c.StopBits == 2 {
+		t.Cflag |= syscall.CSTOPB
+	}
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+
+	sc, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	var errno syscall.Errno
+	err = sc.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd,
+			uintptr(syscall.TCSETS), uintptr(unsafe.Pointer(&t)))
+	})
+	if err == nil && errno != 0 {
+		err = errno
+	}
+	if err != nil {
+		f.Close()
+		return nil, errors.New("could not configure " + device + ": " + err.Error())
+	}
+	return f, nil
+}
@@ -0,0 +1,31 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+//go:build !linux
+
+package serial
+
+import (
+	"errors"
+	"os"
+)
+
+// OpenConfig fails, local ports are only supported on Linux. Devices behind a
+// serial to network bridge can be reached with Connect.
+func OpenConfig(device string, c Config) (*os.File, error) {
+	return nil, errors.New("serial ports are only supported on Linux, could not open " + device)
+}
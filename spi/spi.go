@@ -0,0 +1,120 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package spi talks to devices on an SPI bus through the Linux spidev
+interface (/dev/spidevB.C). It is a helper for sensors, not a sensor itself.
+*/
+package spi
+
+import (
+	"os"
+	"runtime"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// spidev ioctls, from linux/spi/spidev.h.
+const (
+	spiIocWrMode        = 0x40016b01
+	spiIocWrMaxSpeedHz  = 0x40046b04
+	spiIocMessage1      = 0x40206b00
+	spiIocWrBitsPerWord = 0x40016b03
+)
+
+// spiIocTransfer mirrors struct spi_ioc_transfer.
+type spiIocTransfer struct {
+	txBuf       uint64
+	rxBuf       uint64
+	len         uint32
+	speedHz     uint32
+	delayUsecs  uint16
+	bitsPerWord uint8
+	csChange    uint8
+	txNbits     uint8
+	rxNbits     uint8
+	wordDelay   uint8
+	_           uint8
+}
+
+// A Device is an opened spidev node. Its methods may be called concurrently.
+type Device struct {
+	Path  string
+	Speed uint32
+
+	f     *os.File
+	mutex sync.Mutex
+}
+
+// Open opens path (e.g. /dev/spidev0.0) with the given SPI mode (0-3) and
+// clock speed in Hz.
+func Open(path string, mode uint8, speed uint32) (*Device, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	bits := uint8(8)
+	for _, c := range []struct {
+		req uintptr
+		arg unsafe.Pointer
+	}{
+		{spiIocWrMode, unsafe.Pointer(&mode)},
+		{spiIocWrBitsPerWord, unsafe.Pointer(&bits)},
+		{spiIocWrMaxSpeedHz, unsafe.Pointer(&speed)},
+	} {
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), c.req, uintptr(c.arg)); errno != 0 {
+			f.Close()
+			return nil, errno
+		}
+	}
+	return &Device{Path: path, Speed: speed, f: f}, nil
+}
+
+// Transfer clocks out tx and returns what was clocked in at the same time.
+func (d *Device) Transfer(tx []byte) ([]byte, error) {
+	rx := make([]byte, len(tx))
+	if len(tx) == 0 {
+		return rx, nil
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	t := spiIocTransfer{
+		txBuf:       uint64(uintptr(unsafe.Pointer(&tx[0]))),
+		rxBuf:       uint64(uintptr(unsafe.Pointer(&rx[0]))),
+		len:         uint32(len(tx)),
+		speedHz:     d.Speed,
+		bitsPerWord: 8,
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, d.f.Fd(), spiIocMessage1, uintptr(unsafe.Pointer(&t)))
+	runtime.KeepAlive(tx)
+	runtime.KeepAlive(rx)
+	if errno != 0 {
+		return nil, errno
+	}
+	return rx, nil
+}
+
+// Close closes the device.
+func (d *Device) Close() error {
+	return d.f.Close()
+}
+
+// String returns the device path, for logs and labels.
+func (d *Device) String() string {
+	return d.Path
+}
@@ -0,0 +1,291 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package supervisor runs the helper processes some sensors need, like
+rtl_433, ebusd or gpsd, next to the exporter: it starts them, restarts them
+with backoff when they exit, and stops them with the exporter, so that one
+unit file runs the whole stack:
+
+	helpers:
+	  - name: ebusd
+	    command: [ebusd, --foreground, --device=/dev/ttyUSB0]
+	  - name: rtl_433
+	    command: [rtl_433, -F, "mqtt://localhost:1883"]
+	    env: {TZ: UTC}
+
+Helpers must stay in the foreground. Their standard error is logged, their
+standard output only at debug level.
+*/
+package supervisor
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fmoessbauer/sensor_exporter/sensor"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A Helper is a process run for as long as the exporter.
+type Helper struct {
+	Name    string            `yaml:"name" toml:"name"`
+	Command []string          `yaml:"command" toml:"command"`
+	Env     map[string]string `yaml:"env" toml:"env"` // added to the environment of the exporter
+	Dir     string            `yaml:"dir" toml:"dir"`
+	// Backoff is the wait before a restart, 1s by default, doubled after
+	// each exit within MaxBackoff of the start, up to MaxBackoff, 5m by
+	// default.
+	Backoff    time.Duration `yaml:"backoff" toml:"backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff" toml:"max_backoff"`
+}
+
+// stopTimeout is how long a helper has to exit on SIGTERM before it is
+// killed.
+var stopTimeout = 10 * time.Second
+
+var (
+	upDesc = prometheus.NewDesc("sensor_exporter_helper_up",
+		"1 if the helper process is running, else 0.", []string{"helper"}, nil)
+	restartsDesc = prometheus.NewDesc("sensor_exporter_helper_restarts_total",
+		"Times the helper process exited or could not be started and was restarted.", []string{"helper"}, nil)
+	startDesc = prometheus.NewDesc("sensor_exporter_helper_start_time_seconds",
+		"Time the helper process was last started, in seconds since the epoch.", []string{"helper"}, nil)
+)
+
+// Check checks the helpers of a configuration file.
+func Check(helpers []Helper) error {
+	names := make(map[string]bool, len(helpers))
+	for i, h := range helpers {
+		if h.Name == "" || len(h.Command) == 0 {
+			return fmt.Errorf("helper %d needs a name and command", i+1)
+		}
+		if names[h.Name] {
+			return errors.New("helper " + h.Name + " is given twice")
+		}
+		names[h.Name] = true
+		if h.Backoff < 0 || h.MaxBackoff < 0 {
+			return errors.New("helper " + h.Name + ", backoff cannot be negative")
+		}
+	}
+	return nil
+}
+
+// A Supervisor runs helpers, and is a prometheus.Collector of their state.
+type Supervisor struct {
+	mutex     sync.Mutex
+	processes map[string]*process // by name
+}
+
+// process is a helper and its state, run until stop is closed.
+type process struct {
+	Helper
+	stop chan struct{}
+	done chan struct{}
+
+	mutex    sync.Mutex
+	up       bool
+	restarts uint64
+	started  time.Time
+}
+
+// New returns a Supervisor running no helpers.
+func New() *Supervisor {
+	return &Supervisor{processes: make(map[string]*process)}
+}
+
+// SetHelpers makes helpers, which should have been checked, the running
+// helpers: the ones no longer listed or changed are stopped, new and
+// changed ones started, while unchanged ones keep running.
+func (s *Supervisor) SetHelpers(helpers []Helper) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	wanted := make(map[string]Helper, len(helpers))
+	for _, h := range helpers {
+		wanted[h.Name] = h
+	}
+	for name, p := range s.processes {
+		if h, ok := wanted[name]; !ok || fmt.Sprint(h) != fmt.Sprint(p.Helper) {
+			p.terminate()
+			delete(s.processes, name)
+		}
+	}
+	for _, h := range helpers {
+		if _, running := s.processes[h.Name]; running {
+			continue
+		}
+		p := &process{Helper: h, stop: make(chan struct{}), done: make(chan struct{})}
+		s.processes[h.Name] = p
+		go p.run()
+	}
+}
+
+// Stop stops all helpers and waits for them to exit.
+func (s *Supervisor) Stop() {
+	s.SetHelpers(nil)
+}
+
+// terminate stops the helper and waits for it to exit.
+func (p *process) terminate() {
+	close(p.stop)
+	<-p.done
+}
+
+// run starts the helper and restarts it when it exits, until stop is
+// closed.
+func (p *process) run() {
+	defer close(p.done)
+	least, most := p.Backoff, p.MaxBackoff
+	if least == 0 {
+		least = time.Second
+	}
+	if most == 0 {
+		most = 5 * time.Minute
+	}
+	backoff := least
+	for {
+		started := time.Now()
+		err := p.once()
+		if err == nil {
+			return
+		}
+		p.mutex.Lock()
+		p.up = false
+		p.restarts++
+		p.mutex.Unlock()
+		// A helper that ran for a while restarts quickly again, one that
+		// keeps failing ever slower.
+		if time.Since(started) > most {
+			backoff = least
+		}
+		sensor.Incident()
+		slog.Error("Helper exited, restarting", "helper", p.Name, "err", err, "backoff", backoff)
+		select {
+		case <-p.stop:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > most {
+			backoff = most
+		}
+	}
+}
+
+// once runs the helper until it exits, with the error it exited with, or
+// until stop is closed, when it stops it and returns nil.
+func (p *process) once() error {
+	cmd := exec.Command(p.Command[0], p.Command[1:]...)
+	cmd.Dir = p.Dir
+	cmd.Env = os.Environ()
+	keys := make([]string, 0, len(p.Env))
+	for k := range p.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		cmd.Env = append(cmd.Env, k+"="+p.Env[k])
+	}
+	cmd.SysProcAttr = sysProcAttr()
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	slog.Info("Started helper", "helper", p.Name, "pid", cmd.Process.Pid)
+	p.mutex.Lock()
+	p.up, p.started = true, time.Now()
+	p.mutex.Unlock()
+	var output sync.WaitGroup
+	output.Add(2)
+	go p.log(stdout, slog.LevelDebug, &output)
+	go p.log(stderr, slog.LevelInfo, &output)
+	exited := make(chan error, 1)
+	go func() {
+		// Wait closes the pipes, so their output is read first.
+		output.Wait()
+		exited <- cmd.Wait()
+	}()
+	select {
+	case err := <-exited:
+		if err == nil {
+			err = errors.New("exited with status 0")
+		}
+		return err
+	case <-p.stop:
+	}
+	cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-exited:
+	case <-time.After(stopTimeout):
+		slog.Warn("Helper did not exit on SIGTERM, killing it", "helper", p.Name)
+		cmd.Process.Kill()
+		<-exited
+	}
+	p.mutex.Lock()
+	p.up = false
+	p.mutex.Unlock()
+	slog.Info("Stopped helper", "helper", p.Name)
+	return nil
+}
+
+// log logs the lines of r, output of the helper, at level.
+func (p *process) log(r io.Reader, level slog.Level, done *sync.WaitGroup) {
+	defer done.Done()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		slog.Log(context.Background(), level, "Helper output", "helper", p.Name, "line", scanner.Text())
+	}
+}
+
+// Describe describes nothing, the metrics depend on the helpers; the
+// Supervisor is an unchecked collector.
+func (s *Supervisor) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect sends the state of the helpers.
+func (s *Supervisor) Collect(ch chan<- prometheus.Metric) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for name, p := range s.processes {
+		p.mutex.Lock()
+		up := 0.0
+		if p.up {
+			up = 1
+		}
+		ch <- prometheus.MustNewConstMetric(upDesc, prometheus.GaugeValue, up, name)
+		ch <- prometheus.MustNewConstMetric(restartsDesc, prometheus.CounterValue, float64(p.restarts), name)
+		if !p.started.IsZero() {
+			ch <- prometheus.MustNewConstMetric(startDesc, prometheus.GaugeValue, float64(p.started.UnixNano())/1e9, name)
+		}
+		p.mutex.Unlock()
+	}
+}
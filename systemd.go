@@ -0,0 +1,47 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/daemon"
+)
+
+// notifyReady tells systemd that the exporter is ready, if it runs as a
+// Type=notify service, and pings the watchdog of WatchdogSec= if set.
+func notifyReady() {
+	if _, err := daemon.SdNotify(false, daemon.SdNotifyReady); err != nil {
+		slog.Warn("Could not notify systemd", "err", err)
+	}
+	interval, err := daemon.SdWatchdogEnabled(false)
+	if err != nil || interval == 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(interval / 2) {
+			daemon.SdNotify(false, daemon.SdNotifyWatchdog)
+		}
+	}()
+}
+
+// notifyStopping tells systemd that the exporter is shutting down.
+func notifyStopping() {
+	daemon.SdNotify(false, daemon.SdNotifyStopping)
+}
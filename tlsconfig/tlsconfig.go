@@ -0,0 +1,178 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+/*
+Package tlsconfig is the TLS client configuration shared by the sensors that
+talk TLS, so that all take the same options:
+
+	tls                          use TLS, verifying the server with the system CAs
+	tls.ca_file=FILE             verify the server with the CAs of FILE instead
+	tls.cert_file=FILE           client certificate, for servers that ask for one
+	tls.key_file=FILE            key of the client certificate
+	tls.server_name=NAME         name to verify the server certificate against,
+	                             by default the host the sensor connects to
+	tls.insecure_skip_verify     do not verify the server at all
+
+Any of the tls.* options turns TLS on. In a configuration file they are a
+tls block of the sensor:
+
+	sensors:
+	  - type: upsc
+	    options: ups@nas.local
+	    tls:
+	      ca_file: /etc/ssl/nut-ca.pem
+
+Sensors check their options with Option and connect with Client.
+*/
+package tlsconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config configures the TLS client of a sensor.
+type Config struct {
+	CAFile             string `yaml:"ca_file" toml:"ca_file"`
+	CertFile           string `yaml:"cert_file" toml:"cert_file"`
+	KeyFile            string `yaml:"key_file" toml:"key_file"`
+	ServerName         string `yaml:"server_name" toml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify" toml:"insecure_skip_verify"`
+
+	// Enabled is set by any option.
+	Enabled bool `yaml:"-" toml:"-"`
+}
+
+// HandshakeTimeout limits the TLS handshake of Client.
+var HandshakeTimeout = 10 * time.Second
+
+// Option takes a sensor option if it is one of the TLS ones, tls or
+// tls.NAME=VALUE, and reports whether it was.
+func (c *Config) Option(opt string) (bool, error) {
+	kv := strings.SplitN(opt, "=", 2)
+	if kv[0] != "tls" && !strings.HasPrefix(kv[0], "tls.") {
+		return false, nil
+	}
+	value := ""
+	if len(kv) == 2 {
+		value = kv[1]
+	}
+	var err error
+	switch kv[0] {
+	case "tls":
+		if value != "" {
+			c.Enabled, err = strconv.ParseBool(value)
+			return true, err
+		}
+	case "tls.ca_file":
+		c.CAFile = value
+	case "tls.cert_file":
+		c.CertFile = value
+	case "tls.key_file":
+		c.KeyFile = value
+	case "tls.server_name":
+		c.ServerName = value
+	case "tls.insecure_skip_verify":
+		c.InsecureSkipVerify = true
+		if value != "" {
+			c.InsecureSkipVerify, err = strconv.ParseBool(value)
+		}
+	default:
+		return true, errors.New("unknown TLS option " + kv[0])
+	}
+	c.Enabled = true
+	return true, err
+}
+
+// Options returns c as sensor options, for the tls block of a sensor in a
+// configuration file.
+func (c *Config) Options() string {
+	opts := []string{"tls"}
+	for _, o := range [][2]string{{"ca_file", c.CAFile}, {"cert_file", c.CertFile},
+		{"key_file", c.KeyFile}, {"server_name", c.ServerName}} {
+		if o[1] != "" {
+			opts = append(opts, "tls."+o[0]+"="+o[1])
+		}
+	}
+	if c.InsecureSkipVerify {
+		opts = append(opts, "tls.insecure_skip_verify")
+	}
+	return strings.Join(opts, ",")
+}
+
+// TLS returns the crypto/tls configuration to connect to addr, HOST:PORT.
+func (c *Config) TLS(addr string) (*tls.Config, error) {
+	conf := &tls.Config{ServerName: c.ServerName, InsecureSkipVerify: c.InsecureSkipVerify}
+	if conf.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		conf.ServerName = host
+	}
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates in " + c.CAFile)
+		}
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+// Check loads the files of c, to report errors when the sensor is created
+// rather than on its first connection.
+func (c *Config) Check() error {
+	if !c.Enabled {
+		return nil
+	}
+	_, err := c.TLS("")
+	return err
+}
+
+// Client starts TLS on conn, connected to addr, and returns the TLS
+// connection once the handshake is done.
+func (c *Config) Client(conn net.Conn, addr string) (net.Conn, error) {
+	conf, err := c.TLS(addr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), HandshakeTimeout)
+	defer cancel()
+	tc := tls.Client(conn, conf)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	return tc, nil
+}
@@ -0,0 +1,101 @@
+//
+// Copyright 2016 Marios Andreopoulos
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+//go:build !minimal || web
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"flag"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+
+	"github.com/prometheus/exporter-toolkit/web"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	webConfig        = flag.String("web.config.file", "", "file with the TLS and basic auth settings of the HTTP server, in the format of the Prometheus exporter-toolkit")
+	webSystemdSocket = flag.Bool("web.systemd-socket", false, "serve on the socket of systemd socket activation instead of listening on -p")
+)
+
+func init() {
+	serve = serveWeb
+	grpcTLS = webTLS
+	webAuth = webAuthenticates
+}
+
+// serveWeb serves the default mux with server on addr, or the socket passed
+// by systemd, over TLS and with basic auth if the web config file asks for
+// them.
+func serveWeb(server *http.Server, addr string) error {
+	listen := []string{addr}
+	flags := &web.FlagConfig{WebListenAddresses: &listen, WebSystemdSocket: webSystemdSocket, WebConfigFile: webConfig}
+	return web.ListenAndServe(server, flags, slog.Default())
+}
+
+// webTLS returns the TLS settings of the web config file, client
+// certificates included, for the gRPC API; nil if it has none.
+func webTLS() (*tls.Config, error) {
+	if *webConfig == "" {
+		return nil, nil
+	}
+	c, err := readWebConfig()
+	if err != nil {
+		return nil, err
+	}
+	if c.TLSConfig.TLSCertPath == "" && c.TLSConfig.TLSCert == "" {
+		return nil, nil
+	}
+	c.TLSConfig.SetDirectory(filepath.Dir(*webConfig))
+	return web.ConfigToTLSConfig(&c.TLSConfig)
+}
+
+// webAuthenticates tells whether the web config file asks for basic auth or
+// verified client certificates.
+func webAuthenticates() bool {
+	if *webConfig == "" {
+		return false
+	}
+	c, err := readWebConfig()
+	if err != nil {
+		// The server does not start either.
+		return false
+	}
+	return len(c.Users) > 0 || c.TLSConfig.ClientAuth == "RequireAndVerifyClientCert"
+}
+
+// readWebConfig reads the web config file.
+func readWebConfig() (*web.Config, error) {
+	data, err := ioutil.ReadFile(*webConfig)
+	if err != nil {
+		return nil, err
+	}
+	// The defaults of the exporter toolkit.
+	c := &web.Config{TLSConfig: web.TLSConfig{MinVersion: tls.VersionTLS12,
+		MaxVersion: tls.VersionTLS13, PreferServerCipherSuites: true}}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}